@@ -0,0 +1,217 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+)
+
+// copy the latest version into a new file at `path`, like Compact the
+// copy has no unused pages. it reads a snapshot, the updates can go on.
+// the progress is in keys, `p` can be nil.
+func (db *KV) Backup(path string, p *Progress) error {
+  tx := KVTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  out := &KV{Path: path}
+  if err := backupTo(db, &tx.snapshot, out, p); err != nil {
+    return fmt.Errorf("backup: %w", err)
+  }
+  return nil
+}
+
+// bulk load the tree into a new file, removed on error
+func backupTo(db *KV, src *BTree, out *KV, p *Progress) error {
+  out.Options.Create = OPEN_EXCL
+  out.Options.PageSize = db.tree.pageSize()
+  out.Options.EntryChecksums = db.Options.EntryChecksums
+  out.Options.ColdTier, out.Options.ColdMinSize = db.Options.ColdTier, db.Options.ColdMinSize
+  out.Options.Clock = db.Options.Clock
+  if err := out.Open(); err != nil {
+    return err
+  }
+  err := out.LoadSorted(src.Seek(nil, CMP_GT), 1, p)
+  out.Close()
+  if err != nil {
+    os.Remove(out.Path)
+    os.Remove(sumPath(out))
+    os.Remove(freePath(out))
+    if out.Options.ColdPath == "" {
+      os.Remove(coldPath(out)) // not the shared one of Compact
+    }
+  }
+  return err
+}
+
+// write the tree and empty the log, nothing to do without a WAL
+func (db *KV) Checkpoint() error {
+  if !db.Options.WAL {
+    return nil
+  }
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  return walCheckpoint(db)
+}
+
+// the size of a table, see DB.Analyze
+type TableStats struct {
+  Name         string
+  Rows         uint64
+  IndexEntries uint64 // of all the secondary indexes
+  KeyBytes     uint64 // of the rows
+  ValBytes     uint64 // as stored, see policy.go
+}
+
+// count the rows of each table in a snapshot
+func (db *DB) Analyze() ([]TableStats, error) {
+  tx := DBTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  tables := &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+  if err := tx.Scan(TDEF_TABLE.Name, tables); err != nil {
+    return nil, err
+  }
+  var out []TableStats
+  for ; tables.Valid(); tables.Next() {
+    rec := Record{}
+    if err := tables.Deref(&rec); err != nil {
+      return nil, err
+    }
+    tdef := getTableDef(&tx, string(rec.Get("name").Str))
+    if tdef == nil {
+      return nil, fmt.Errorf("analyze: bad table %q", rec.Get("name").Str)
+    }
+    stats := TableStats{Name: tdef.Name}
+    analyzePrefix(&tx, tdef.Prefix, func(key []byte, val []byte) {
+      stats.Rows++
+      stats.KeyBytes += uint64(len(key))
+      stats.ValBytes += uint64(len(val))
+    })
+    for _, prefix := range tdef.IndexPrefixes {
+      analyzePrefix(&tx, prefix, func([]byte, []byte) { stats.IndexEntries++ })
+    }
+    out = append(out, stats)
+  }
+  return out, nil
+}
+
+func analyzePrefix(tx *DBTX, prefix uint32, fn func(key []byte, val []byte)) {
+  var start [4]byte
+  binary.BigEndian.PutUint32(start[:], prefix)
+  for iter := tx.kv.Seek(start[:], CMP_GE); iter.Valid(); iter.Next() {
+    key := iter.Key()
+    if len(key) < 4 || binary.BigEndian.Uint32(key) != prefix {
+      break
+    }
+    fn(key, iter.Val())
+  }
+}
+
+// a maintenance statement:
+//   VACUUM | COMPACT; ANALYZE; CHECKPOINT; INTEGRITY_CHECK; BACKUP TO 'name';
+// BACKUP writes a file, the path is a name in Options.BackupDir.
+type QLAdmin struct {
+  Cmd  string // the upper case keyword, COMPACT is VACUUM
+  Path string // BACKUP
+}
+
+func (p *qlParser) parseAdmin() (interface{}, bool, error) {
+  for _, cmd := range []string{"VACUUM", "COMPACT", "ANALYZE", "CHECKPOINT", "INTEGRITY_CHECK"} {
+    if p.tryKeyword(cmd) {
+      if cmd == "COMPACT" {
+        cmd = "VACUUM"
+      }
+      return &QLAdmin{Cmd: cmd}, true, nil
+    }
+  }
+  if !p.tryKeyword("BACKUP") {
+    return nil, false, nil
+  }
+  if err := p.expectKeywords("TO"); err != nil {
+    return nil, true, err
+  }
+  tok := p.peek()
+  if tok.kind != TOK_STR || tok.text == "" {
+    return nil, true, p.errorf("expect a file name")
+  }
+  p.idx++
+  return &QLAdmin{Cmd: "BACKUP", Path: tok.text}, true, nil
+}
+
+// outside of transactions: VACUUM holds the writer lock, the commits of
+// all the sessions of the DB wait for it, e.g. the connections of the
+// SQL driver. their transactions go on reading the old file.
+// the others don't change the data.
+func qlAdmin(db *DB, stmt *QLAdmin) (*QLResult, error) {
+  switch stmt.Cmd {
+  case "VACUUM":
+    return &QLResult{}, db.Compact(nil)
+  case "CHECKPOINT":
+    return &QLResult{}, db.kv.Checkpoint()
+  case "BACKUP":
+    path, err := qlBackupPath(db, stmt.Path)
+    if err != nil {
+      return nil, err
+    }
+    return &QLResult{}, db.kv.Backup(path, nil)
+  case "ANALYZE":
+    tables, err := db.Analyze()
+    if err != nil {
+      return nil, err
+    }
+    res := &QLResult{Cols: []string{"table", "rows", "index_entries", "key_bytes", "val_bytes"}}
+    for _, t := range tables {
+      res.Rows = append(res.Rows, []Value{
+        {Type: TYPE_BYTES, Str: []byte(t.Name)},
+        {Type: TYPE_INT64, I64: int64(t.Rows)},
+        {Type: TYPE_INT64, I64: int64(t.IndexEntries)},
+        {Type: TYPE_INT64, I64: int64(t.KeyBytes)},
+        {Type: TYPE_INT64, I64: int64(t.ValBytes)},
+      })
+    }
+    return res, nil
+  case "INTEGRITY_CHECK":
+    // one row per problem, or "ok"
+    res := &QLResult{Cols: []string{"result"}}
+    bad, err := integrityCheck(&db.kv)
+    var problems []string
+    for _, e := range bad {
+      problems = append(problems, e.Error())
+    }
+    if err != nil {
+      problems = append(problems, err.Error())
+    }
+    if len(problems) == 0 {
+      problems = []string{"ok"}
+    }
+    for _, msg := range problems {
+      res.Rows = append(res.Rows, []Value{{Type: TYPE_BYTES, Str: []byte(msg)}})
+    }
+    return res, nil
+  }
+  panic("unreachable")
+}
+
+// a statement names a new file in Options.BackupDir, not any path the
+// process can write
+func qlBackupPath(db *DB, name string) (string, error) {
+  if db.Options.BackupDir == "" {
+    return "", errors.New("BACKUP: disabled, no Options.BackupDir")
+  }
+  if !filepath.IsLocal(name) {
+    return "", fmt.Errorf("BACKUP: %q is not a file name in the backup directory", name)
+  }
+  return filepath.Join(db.Options.BackupDir, name), nil
+}
+
+// the checks of KV.VerifySkip, an in-memory store has no file to check
+func integrityCheck(db *KV) ([]*ErrChecksum, error) {
+  if db.Options.InMemory {
+    tree, release := db.snapshot()
+    defer release()
+    return nil, tree.Verify()
+  }
+  return db.VerifySkip()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// VACUUM from a connection of the SQL driver while another one of the
+// same DB is in a transaction
+func TestQLVacuumShared(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "db")
+  pool, err := sql.Open(SQL_DRIVER, path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer pool.Close()
+  ctx := context.Background()
+  if _, err := pool.Exec("CREATE TABLE t (a int64, b bytes, PRIMARY KEY (a))"); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; i < 100; i++ {
+    if _, err := pool.Exec("UPDATE t SET b = 'x' WHERE a = 0"); err != nil {
+      t.Fatal(err)
+    }
+  }
+  tx, err := pool.BeginTx(ctx, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := tx.Exec("INSERT INTO t (a, b) VALUES (1, 'one'), (2, 'two')"); err != nil {
+    t.Fatal(err)
+  }
+  other, err := pool.Conn(ctx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, err := other.ExecContext(ctx, "VACUUM"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := other.ExecContext(ctx, "INSERT INTO t (a, b) VALUES (3, 'three')"); err != nil {
+    t.Fatal(err)
+  }
+  other.Close()
+  // the snapshot of the transaction is in the old file
+  rows, err := tx.Query("SELECT a FROM t WHERE a >= 0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  rows.Close()
+  if err := tx.Commit(); err != nil {
+    t.Fatal(err)
+  }
+  var n int
+  rows, err = pool.Query("SELECT a FROM t WHERE a >= 0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  for rows.Next() {
+    n++
+  }
+  rows.Close()
+  if n != 3 {
+    t.Fatalf("%d rows", n)
+  }
+}
+
+func TestQLBackupDir(t *testing.T) {
+  dir := t.TempDir()
+  db := &DB{Path: filepath.Join(dir, "db")}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  s := &QLSession{DB: db}
+  if _, err := s.Exec("BACKUP TO 'copy'"); err == nil {
+    t.Fatal("BACKUP without a backup directory")
+  }
+  db.Options.BackupDir = filepath.Join(dir, "backups")
+  if err := os.Mkdir(db.Options.BackupDir, 0755); err != nil {
+    t.Fatal(err)
+  }
+  for _, name := range []string{"../escaped", "/tmp/escaped", "a/../../escaped"} {
+    if _, err := s.Exec("BACKUP TO '" + name + "'"); err == nil {
+      t.Fatalf("BACKUP TO %q", name)
+    }
+  }
+  if _, err := s.Exec("BACKUP TO 'copy'"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := os.Stat(filepath.Join(db.Options.BackupDir, "copy")); err != nil {
+    t.Fatal(err)
+  }
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "slices"
+)
+
+// the other changes of the catalog, in the transaction like TableNew.
+// see schema.go
+
+// drop a table with its rows and index entries
+func (tx *DBTX) TableDrop(name string) error {
+  tdef, err := alterTable(tx, name)
+  if err != nil {
+    return err
+  }
+  for _, prefix := range append([]uint32{tdef.Prefix}, tdef.IndexPrefixes...) {
+    prefixDrop(tx, prefix)
+  }
+  table := (&Record{}).AddStr("name", []byte(name))
+  if _, err := dbRemove(tx, TDEF_TABLE, *table); err != nil {
+    return err
+  }
+  if tdef.AutoInc != "" {
+    if _, err := dbRemove(tx, TDEF_META, *autoIncKey(tdef)); err != nil {
+      return err
+    }
+  }
+  delete(tx.tables, name)
+  return schemaBump(tx)
+}
+
+// rename a table, the rows keep their prefix
+func (tx *DBTX) TableRename(name string, to string) error {
+  tdef, err := alterTable(tx, name)
+  if err != nil {
+    return err
+  }
+  if to == "" || to[0] == '@' {
+    return fmt.Errorf("bad table name: %q", to)
+  }
+  if getTableDef(tx, to) != nil {
+    return fmt.Errorf("table exists: %s", to)
+  }
+  table := (&Record{}).AddStr("name", []byte(name))
+  if _, err := dbRemove(tx, TDEF_TABLE, *table); err != nil {
+    return err
+  }
+  renamed := *tdef
+  renamed.Name = to
+  if err := tableDefSave(tx, &renamed); err != nil {
+    return err
+  }
+  delete(tx.tables, name)
+  tx.tables[to] = &renamed
+  return schemaBump(tx)
+}
+
+// add a secondary index and fill it with the existing rows
+func (tx *DBTX) IndexAdd(table string, index []string, unique bool) error {
+  tdef, err := alterTable(tx, table)
+  if err != nil {
+    return err
+  }
+  if err := indexCheck(tdef, index); err != nil {
+    return err
+  }
+  if indexFind(tdef, index) >= 0 {
+    return fmt.Errorf("index exists: %v", index)
+  }
+  prefix, err := prefixAlloc(tx, 1)
+  if err != nil {
+    return err
+  }
+  // a copy, the old definition may be cached elsewhere
+  altered := tableDefCopy(tdef)
+  if unique && altered.Unique == nil {
+    altered.Unique = make([]bool, len(altered.Indexes))
+  }
+  if altered.Unique != nil {
+    altered.Unique = append(altered.Unique, unique)
+  }
+  altered.Indexes = append(altered.Indexes, indexWithPKey(tdef, append([]string(nil), index...)))
+  altered.IndexCols = append(altered.IndexCols, len(index))
+  altered.IndexPrefixes = append(altered.IndexPrefixes, prefix)
+  i := len(altered.Indexes) - 1
+  cols := uniqueCols(altered, i)
+  // the rows first, the tree can't change under the iterator
+  var keys, uniq [][]byte
+  var rowErr error
+  analyzePrefix(tx, tdef.Prefix, func(key []byte, val []byte) {
+    values, err := rowValues(tx, altered, key, val)
+    if err != nil {
+      rowErr = err
+      return
+    }
+    keys = append(keys, encodeKey(nil, prefix, indexValues(altered, values, altered.Indexes[i])))
+    if cols != nil {
+      uniq = append(uniq, encodeKey(nil, prefix, indexValues(altered, values, cols)))
+    }
+  })
+  if rowErr != nil {
+    return rowErr
+  }
+  for j, key := range keys {
+    if cols != nil {
+      // the entries of the same values share the prefix, see checkUnique
+      iter := tx.kv.Seek(uniq[j], CMP_GE)
+      if iter.Valid() && bytes.HasPrefix(iter.Key(), uniq[j]) {
+        return &ErrDuplicateKey{Table: table, Cols: cols}
+      }
+    }
+    if err := applyWrites(tx, []kvWrite{{key: key}}); err != nil {
+      return err
+    }
+  }
+  return alterSave(tx, altered)
+}
+
+// drop a secondary index by its columns
+func (tx *DBTX) IndexDrop(table string, index []string) error {
+  tdef, err := alterTable(tx, table)
+  if err != nil {
+    return err
+  }
+  i := indexFind(tdef, index)
+  if i < 0 {
+    return fmt.Errorf("no index %v in table %s", index, table)
+  }
+  prefixDrop(tx, tdef.IndexPrefixes[i])
+  altered := tableDefCopy(tdef)
+  altered.Indexes = append(altered.Indexes[:i], altered.Indexes[i+1:]...)
+  altered.IndexCols = append(altered.IndexCols[:i], altered.IndexCols[i+1:]...)
+  altered.IndexPrefixes = append(altered.IndexPrefixes[:i], altered.IndexPrefixes[i+1:]...)
+  if altered.Unique != nil {
+    altered.Unique = append(altered.Unique[:i], altered.Unique[i+1:]...)
+  }
+  return alterSave(tx, altered)
+}
+
+// a user table to change
+func alterTable(tx *DBTX, name string) (*TableDef, error) {
+  if INTERNAL_TABLES[name] != nil {
+    return nil, fmt.Errorf("reserved table name: %s", name)
+  }
+  schemaUse(tx)
+  tdef := getTableDef(tx, name)
+  if tdef == nil {
+    return nil, errNoTable(name)
+  }
+  return tdef, nil
+}
+
+func alterSave(tx *DBTX, tdef *TableDef) error {
+  if err := tableDefSave(tx, tdef); err != nil {
+    return err
+  }
+  tx.tables[tdef.Name] = tdef
+  return schemaBump(tx)
+}
+
+// the index with these columns before the primary key
+func indexFind(tdef *TableDef, index []string) int {
+  for i, cols := range tdef.Indexes {
+    if len(index) == tdef.IndexCols[i] && slices.Equal(cols[:len(index)], index) {
+      return i
+    }
+  }
+  return -1
+}
+
+// the slices are not shared
+func tableDefCopy(tdef *TableDef) *TableDef {
+  out := *tdef
+  out.Cols = append([]string(nil), tdef.Cols...)
+  out.Types = append([]uint32(nil), tdef.Types...)
+  out.Indexes = nil
+  for _, index := range tdef.Indexes {
+    out.Indexes = append(out.Indexes, append([]string(nil), index...))
+  }
+  out.IndexCols = append([]int(nil), tdef.IndexCols...)
+  out.IndexPrefixes = append([]uint32(nil), tdef.IndexPrefixes...)
+  if tdef.Unique != nil {
+    out.Unique = append([]bool(nil), tdef.Unique...)
+  }
+  return &out
+}
+
+// delete the keys of a prefix
+func prefixDrop(tx *DBTX, prefix uint32) {
+  var keys [][]byte
+  analyzePrefix(tx, prefix, func(key []byte, val []byte) {
+    keys = append(keys, append([]byte(nil), key...))
+  })
+  for _, key := range keys {
+    _, err := tx.kv.Del(key)
+    assert(err == nil)
+  }
+}
+
+// all the columns of a stored row
+func rowValues(tx *DBTX, tdef *TableDef, key []byte, val []byte) ([]Value, error) {
+  values := make([]Value, len(tdef.Cols))
+  for i := range values {
+    values[i].Type = tdef.Types[i]
+  }
+  if _, err := decodeKey(key, values[:tdef.PKeys]); err != nil {
+    return nil, err
+  }
+  val, err := rowDecode(tx, tdef, key, val)
+  if err != nil {
+    return nil, err
+  }
+  if err := decodeValues(val, values[tdef.PKeys:]); err != nil {
+    return nil, err
+  }
+  return values, nil
+}
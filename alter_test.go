@@ -0,0 +1,87 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+)
+
+// the rows of a result as text, or the error
+func qlRender(res *QLResult, err error) string {
+  if err != nil {
+    return "error: " + err.Error()
+  }
+  rows := []string{}
+  for _, row := range res.Rows {
+    vals := []string{}
+    for _, v := range row {
+      if v.Type == TYPE_INT64 {
+        vals = append(vals, fmt.Sprint(v.I64))
+      } else {
+        vals = append(vals, string(v.Str))
+      }
+    }
+    rows = append(rows, strings.Join(vals, " "))
+  }
+  return "[" + strings.Join(rows, ", ") + "]"
+}
+
+// the changes of the catalog are seen by the other sessions at the
+// commit, and not at all after an abort
+func TestAlterTx(t *testing.T) {
+  db := &DB{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  sessions := []*QLSession{{DB: db}, {DB: db}}
+  steps := []struct {
+    s     int
+    query string
+    want  string // a prefix of the result
+  }{
+    {0, "CREATE TABLE t (id int64, v bytes, PRIMARY KEY (id));", "[]"},
+    {0, "INSERT INTO t (id, v) VALUES (1, 'a'), (2, 'b');", "[]"},
+    // a rename rolled back
+    {0, "BEGIN;", "[]"},
+    {0, "ALTER TABLE t RENAME TO u;", "[]"},
+    {0, "SELECT id, v FROM u WHERE id >= 0;", "[1 a, 2 b]"},
+    {1, "SELECT id FROM u WHERE id >= 0;", "error: table not found: u"},
+    {1, "SELECT id, v FROM t WHERE id >= 0;", "[1 a, 2 b]"},
+    {0, "ABORT;", "[]"},
+    {0, "SELECT id FROM u WHERE id >= 0;", "error: table not found: u"},
+    // an index committed
+    {0, "BEGIN;", "[]"},
+    {0, "ALTER TABLE t ADD UNIQUE (v);", "[]"},
+    {1, "INSERT INTO t (id, v) VALUES (3, 'a');", "[]"},
+    {0, "COMMIT;", "error: serialization conflict"},
+    {1, "DELETE FROM t WHERE id = 3;", "[]"},
+    {0, "ALTER TABLE t ADD UNIQUE (v);", "[]"},
+    {1, "INSERT INTO t (id, v) VALUES (3, 'a');", "error: duplicate key in table t: (v)"},
+    {1, "ALTER TABLE t ADD UNIQUE (v);", "error: index exists"},
+    {1, "ALTER TABLE t DROP INDEX (v);", "[]"},
+    {0, "INSERT INTO t (id, v) VALUES (3, 'a');", "[]"},
+    {1, "ALTER TABLE t ADD UNIQUE (v);", "error: duplicate key in table t: (v)"},
+    {1, "ALTER TABLE t ADD INDEX (v);", "[]"},
+    {0, "SELECT id FROM t WHERE v = 'a';", "[1, 3]"},
+    // a drop seen at the commit
+    {0, "BEGIN;", "[]"},
+    {0, "DROP TABLE t;", "[]"},
+    {1, "SELECT id FROM t WHERE id >= 0;", "[1, 2, 3]"},
+    {0, "COMMIT;", "[]"},
+    {1, "SELECT id FROM t WHERE id >= 0;", "error: table not found: t"},
+    // and its rows are gone
+    {1, "CREATE TABLE t (id int64, v bytes, PRIMARY KEY (id));", "[]"},
+    {1, "SELECT id FROM t WHERE id >= 0;", "[]"},
+    {1, "DROP TABLE @meta;", "error: reserved table name"},
+  }
+  for i, step := range steps {
+    got := qlRender(sessions[step.s].Exec(step.query))
+    if !strings.HasPrefix(got, step.want) {
+      t.Fatalf("step %d: %s: %s, want %s", i, step.query, got, step.want)
+    }
+  }
+  if err := db.kv.Verify(); err != nil {
+    t.Fatal(err)
+  }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "math/rand"
+)
+
+// assertion levels
+const (
+  ASSERT_OFF   = 0 // no checks at all
+  ASSERT_CHEAP = 1 // O(1) checks such as index bounds
+  ASSERT_FULL  = 2 // also validate every node touched
+)
+
+var (
+  AssertLevel = ASSERT_CHEAP
+  // at ASSERT_CHEAP, still validate 1 in N nodes touched (0: never).
+  AssertSample = 0
+)
+
+func assert(cond bool) {
+  if AssertLevel >= ASSERT_CHEAP && !cond {
+    panic("assertion failure")
+  }
+}
+
+// validate a node read from a page, depending on the assertion level.
+func assertNode(node BNode) {
+  switch {
+  case AssertLevel >= ASSERT_FULL:
+  case AssertLevel == ASSERT_CHEAP && AssertSample > 0 && rand.Intn(AssertSample) == 0:
+  default:
+    return
+  }
+  if err := nodeCheck(node); err != nil {
+    panic(err)
+  }
+}
+
+// check the node layout without trusting any of its fields.
+func nodeCheck(node BNode) error {
+  if len(node) < HEADER {
+    return fmt.Errorf("bad node: %d bytes", len(node))
+  }
+  btype, nkeys := node.btype(), int(node.nkeys())
+  if btype != BNODE_LEAF && btype != BNODE_NODE {
+    return fmt.Errorf("bad node: type %d", btype)
+  }
+  if nkeys == 0 {
+    return fmt.Errorf("bad node: no keys")
+  }
+  start := HEADER + 8 * nkeys + 2 * nkeys
+  if start > len(node) {
+    return fmt.Errorf("bad node: %d keys in %d bytes", nkeys, len(node))
+  }
+  var prev []byte
+  for i := 0; i < nkeys; i++ {
+    pos := start + int(node.getOffset(uint16(i)))
+    end := start + int(node.getOffset(uint16(i + 1)))
+    if pos + 4 > end || end > len(node) {
+      return fmt.Errorf("bad node: offset of key %d out of range", i)
+    }
+    klen := binary.LittleEndian.Uint16(node[pos+0:])
+    vlen := binary.LittleEndian.Uint16(node[pos+2:])
+    flags := vlen & VAL_FLAGS
+    vlen &^= flags
+    if flags != 0 && btype != BNODE_LEAF {
+      return fmt.Errorf("bad node: value flags of key %d", i)
+    }
+    header := uint16(0) // the expiry time and the checksum
+    if flags & VAL_EXPIRES != 0 {
+      header += EXPIRES_SIZE
+    }
+    if flags & VAL_CHECKSUM != 0 {
+      header += ENTRY_SUM_SIZE
+    }
+    if vlen < header {
+      return fmt.Errorf("bad node: value header of key %d", i)
+    }
+    if flags & VAL_OVERFLOW != 0 && vlen - header != OVERFLOW_REF_SIZE {
+      return fmt.Errorf("bad node: overflow reference of key %d", i)
+    }
+    if pos + 4 + int(klen) + int(vlen) != end {
+      return fmt.Errorf("bad node: size of key %d mismatch", i)
+    }
+    key := node.getKey(uint16(i))
+    if i > 0 && bytes.Compare(prev, key) >= 0 {
+      return fmt.Errorf("bad node: key %d out of order", i)
+    }
+    prev = key
+  }
+  return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+  "fmt"
+)
+
+// updates applied together by KV.Apply, in the order they are added.
+// unlike a transaction it reads nothing, so there is no snapshot to keep;
+// a merge reads the latest value when the batch is applied.
+type Batch struct {
+  ops []batchOp
+  err error // the first bad update
+}
+
+type batchOp struct {
+  op    byte // WAL_SET or WAL_DEL, or BATCH_MERGE
+  key   []byte
+  val   []byte
+  merge MergeFunc
+}
+
+const BATCH_MERGE = byte(0xff)
+
+// the new value from the current one, `ok` is false if the key doesn't
+// exist. it's called with the writer lock held.
+type MergeFunc func(old []byte, ok bool, operand []byte) []byte
+
+// a MergeFunc that appends the operand to the value
+func MergeAppend(old []byte, ok bool, operand []byte) []byte {
+  return append(append([]byte(nil), old...), operand...)
+}
+
+// the key and value are copied
+func (b *Batch) Set(key []byte, val []byte) {
+  b.add(batchOp{op: WAL_SET, key: key, val: val})
+}
+
+func (b *Batch) Del(key []byte) {
+  b.add(batchOp{op: WAL_DEL, key: key})
+}
+
+// set the key to `fn(old, ok, operand)` with the value at the time of Apply
+func (b *Batch) Merge(key []byte, operand []byte, fn MergeFunc) {
+  b.add(batchOp{op: BATCH_MERGE, key: key, val: operand, merge: fn})
+}
+
+func (b *Batch) add(op batchOp) {
+  if b.err != nil {
+    return
+  }
+  val := op.val
+  if op.op == BATCH_MERGE {
+    val = nil // the result is checked instead
+  }
+  if err := checkLimit(op.key, val); err != nil {
+    b.err = fmt.Errorf("batch op %d: %w", len(b.ops), err)
+    return
+  }
+  op.key = append([]byte(nil), op.key...)
+  op.val = append([]byte(nil), op.val...)
+  b.ops = append(b.ops, op)
+}
+
+// the number of updates
+func (b *Batch) Len() int {
+  return len(b.ops)
+}
+
+// to be reused
+func (b *Batch) Reset() {
+  b.ops, b.err = b.ops[:0], nil
+}
+
+// apply the updates of the batch in a single commit, all or nothing.
+// a bad update added to the batch fails it here.
+func (db *KV) Apply(b *Batch) error {
+  if b.err != nil {
+    return b.err
+  }
+  if len(b.ops) == 0 {
+    return nil
+  }
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  meta := saveMeta(db)
+  for i, op := range b.ops {
+    switch op.op {
+    case WAL_SET:
+      db.tree.update(op.key, op.val)
+      walLog(db, op.key, op.val, false)
+      keyEvent(db, op.key, KEY_SET)
+    case WAL_DEL:
+      deleted, err := db.tree.Delete(op.key)
+      if err != nil {
+        revertMeta(db, meta)
+        return fmt.Errorf("batch op %d: %w", i, err)
+      }
+      if deleted {
+        walLog(db, op.key, nil, true)
+        keyEvent(db, op.key, KEY_DEL)
+      }
+    case BATCH_MERGE:
+      // the earlier updates of the batch are visible
+      old, ok := db.tree.Get(op.key)
+      val := op.merge(old, ok, op.val)
+      if err := checkLimit(op.key, val); err != nil {
+        revertMeta(db, meta)
+        return fmt.Errorf("batch op %d: merge: %w", i, err)
+      }
+      db.tree.update(op.key, val)
+      walLog(db, op.key, val, false)
+      keyEvent(db, op.key, KEY_SET)
+    default:
+      panic("bad batch op")
+    }
+  }
+  return updateOrRevert(db, meta)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "path/filepath"
+  "testing"
+)
+
+func batchOpen(t *testing.T, path string) (*KV, *[]KeyEvent) {
+  t.Helper()
+  db := checksumOpen(t, path, Options{WAL: true})
+  events := &[]KeyEvent{}
+  db.SubscribeKeys(nil, func(ev KeyEvent) {
+    *events = append(*events, KeyEvent{Key: append([]byte(nil), ev.Key...), Event: ev.Event})
+  })
+  return db, events
+}
+
+func batchCheck(t *testing.T, db *KV, want map[string]string) {
+  t.Helper()
+  got := map[string]string{}
+  for key, val := range db.Range(nil, nil, false) {
+    got[string(key)] = string(val)
+  }
+  if fmt.Sprint(got) != fmt.Sprint(want) {
+    t.Fatalf("%v, want %v", got, want)
+  }
+}
+
+// the updates are applied in order, the merges see the earlier ones, and
+// a missing key is deleted without a log record or an event
+func TestBatchApply(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "db")
+  db, events := batchOpen(t, path)
+  db.Set([]byte("a"), []byte("1"))
+  b := &Batch{}
+  b.Set([]byte("b"), []byte("2"))
+  b.Merge([]byte("a"), []byte("x"), MergeAppend)
+  b.Merge([]byte("b"), []byte("y"), MergeAppend)
+  b.Merge([]byte("c"), []byte("z"), MergeAppend)
+  b.Del([]byte("missing"))
+  b.Set([]byte("d"), []byte("4"))
+  b.Del([]byte("d"))
+  if err := db.Apply(b); err != nil {
+    t.Fatal(err)
+  }
+  want := map[string]string{"a": "1x", "b": "2y", "c": "z"}
+  batchCheck(t, db, want)
+  got := []string{}
+  for _, ev := range *events {
+    got = append(got, string(ev.Key) + " " + ev.Event)
+  }
+  if fmt.Sprint(got) != "[a set b set a set b set c set d set d del]" {
+    t.Fatal(got)
+  }
+  // replayed from the log
+  crash := filepath.Join(t.TempDir(), "crash")
+  walCrashCopy(t, db, crash)
+  db.Close()
+  db, _ = batchOpen(t, crash)
+  defer db.Close()
+  if r := db.Startup(); r.Replayed != 2 {
+    t.Fatalf("%+v", r)
+  }
+  batchCheck(t, db, want)
+}
+
+// a failed update discards the whole batch
+func TestBatchAtomic(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "db")
+  db, events := batchOpen(t, path)
+  defer db.Close()
+  db.Set([]byte("a"), []byte("1"))
+  *events = nil
+  tooLarge := func(old []byte, ok bool, operand []byte) []byte {
+    return make([]byte, BTREE_MAX_BLOB_SIZE + 1)
+  }
+  b := &Batch{}
+  b.Set([]byte("b"), []byte("2"))
+  b.Del([]byte("a"))
+  b.Merge([]byte("c"), nil, tooLarge)
+  if err := db.Apply(b); !errors.Is(err, ErrTooLarge) {
+    t.Fatal(err)
+  }
+  batchCheck(t, db, map[string]string{"a": "1"})
+  if len(*events) != 0 {
+    t.Fatal(*events)
+  }
+  // and a bad update when it's added
+  b.Reset()
+  b.Set([]byte("b"), []byte("2"))
+  b.Set(make([]byte, BTREE_MAX_KEY_SIZE + 1), nil)
+  b.Del([]byte("a"))
+  if err := db.Apply(b); !errors.Is(err, ErrTooLarge) || b.Len() != 1 {
+    t.Fatal(err, b.Len())
+  }
+  batchCheck(t, db, map[string]string{"a": "1"})
+  // the store is still usable
+  b.Reset()
+  b.Del([]byte("a"))
+  if err := db.Apply(b); err != nil {
+    t.Fatal(err)
+  }
+  batchCheck(t, db, map[string]string{})
+}
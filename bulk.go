@@ -0,0 +1,179 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+)
+
+// a stream of KV pairs, e.g. BIter or TxIter
+type KVIter interface {
+  Valid() bool
+  Key() []byte
+  Val() []byte
+  Next()
+}
+
+// build the tree bottom-up from a stream of keys in increasing order.
+// each node is filled up to `fill` of a page, the rest is left for
+// later updates. the tree must be empty.
+func (tree *BTree) BulkLoad(iter KVIter, fill float64) error {
+  if tree.root != 0 {
+    if root := BNode(tree.get(tree.root)); root.btype() != BNODE_LEAF || root.nkeys() > 1 {
+      return errors.New("bulk load into a non-empty tree")
+    }
+  }
+  if !(0 < fill && fill <= 1) {
+    return fmt.Errorf("bad fill factor: %v", fill)
+  }
+  bl := &bulkLoader{tree: tree, limit: int(fill * float64(tree.pageSize()))}
+  bl.add(0, bulkEntry{}) // the sentinel
+  var prev []byte
+  for ; iter.Valid(); iter.Next() {
+    key, val := iter.Key(), iter.Val()
+    if err := checkLimit(key, val); err != nil {
+      return err
+    }
+    if prev != nil && bytes.Compare(prev, key) >= 0 {
+      return fmt.Errorf("bulk load: keys out of order: %q", key)
+    }
+    // the iterator may reuse its buffers
+    e := bulkEntry{key: append([]byte(nil), key...)}
+    if len(val) > BTREE_MAX_VAL_SIZE {
+      e.val, e.vflag = overflowWrite(tree, val), VAL_OVERFLOW
+    } else {
+      e.val = append([]byte(nil), val...)
+    }
+    if tree.entrySums {
+      e.val, e.vflag = withEntrySum(e.key, val, e.val, e.vflag)
+    }
+    // keep the expiry time of a stream such as BIter
+    if expiring, ok := iter.(interface{ Expires() int64 }); ok {
+      e.val, e.vflag = withExpires(e.val, e.vflag, expiring.Expires())
+    }
+    bl.add(0, e)
+    prev = e.key
+  }
+  // a stream that can fail reports it once it stops
+  if failing, ok := iter.(interface{ Err() error }); ok && failing.Err() != nil {
+    return failing.Err()
+  }
+  // close the last node of each level, the top level has a single node
+  for level := 0; ; level++ {
+    top := bl.levels[level]
+    if level > 0 && level == len(bl.levels) - 1 && len(top.entries) == 1 {
+      if tree.root != 0 {
+        tree.del(tree.root) // the empty tree
+      }
+      tree.root = top.entries[0].ptr
+      return nil
+    }
+    bl.flush(level)
+  }
+}
+
+// load sorted KV pairs into an empty store, see BTree.BulkLoad.
+// this is faster than inserting the keys one by one, and it's atomic.
+// the progress is in keys, `p` can be nil.
+func (db *KV) LoadSorted(iter KVIter, fill float64, p *Progress) error {
+  defer p.finish()
+  p.begin("keys", 0)
+  return db.loadSorted(progressIter{KVIter: iter, p: p}, fill)
+}
+
+func (db *KV) loadSorted(iter KVIter, fill float64) error {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  db.serial.all = true // conflicts with any read
+  if db.Options.WAL {
+    // the loaded tree is written as is, there must be nothing in the
+    // log to replay on top of it.
+    if err := walCheckpoint(db); err != nil {
+      return err
+    }
+    meta := saveMeta(db)
+    if err := db.tree.BulkLoad(iter, fill); err != nil {
+      revertMeta(db, meta)
+      return err
+    }
+    if err := walCheckpoint(db); err != nil {
+      // the master page may point to the new tree
+      revertMeta(db, meta)
+      return errors.Join(err, updateRoot(db), db.store.Sync())
+    }
+    publish(db)
+    return nil
+  }
+  meta := saveMeta(db)
+  if err := db.tree.BulkLoad(iter, fill); err != nil {
+    revertMeta(db, meta)
+    return err
+  }
+  return updateOrRevert(db, meta)
+}
+
+type bulkEntry struct {
+  ptr   uint64
+  key   []byte
+  val   []byte
+  vflag uint16
+}
+
+// the nodes being filled, one per level from the leaves up
+type bulkLoader struct {
+  tree   *BTree
+  limit  int // node size in bytes
+  levels []bulkNode
+}
+
+type bulkNode struct {
+  entries []bulkEntry
+  size    int    // the node size in bytes
+  last    []byte // the last key of the previous leaf
+}
+
+func (bl *bulkLoader) add(level int, e bulkEntry) {
+  if level == len(bl.levels) {
+    bl.levels = append(bl.levels, bulkNode{size: HEADER})
+  }
+  size := 8 + 2 + int(kvBytes(e.key, e.val))
+  // an internal node needs 2 kids for the levels to shrink
+  least := 1
+  if level > 0 {
+    least = 2
+  }
+  if n := &bl.levels[level]; len(n.entries) >= least && n.size + size > bl.limit {
+    bl.flush(level)
+  }
+  n := &bl.levels[level]
+  n.entries = append(n.entries, e)
+  n.size += size
+}
+
+// write the node and link it in the parent
+func (bl *bulkLoader) flush(level int) {
+  n := &bl.levels[level]
+  btype := uint16(BNODE_NODE)
+  if level == 0 {
+    btype = BNODE_LEAF
+  }
+  kvbytes := uint16(0)
+  for _, e := range n.entries {
+    kvbytes += kvBytes(e.key, e.val)
+  }
+  node := BNode(make([]byte, bl.tree.pageSize()))
+  b := newNodeBuilder(node, btype, uint16(len(n.entries)), kvbytes)
+  for _, e := range n.entries {
+    b.addFlagged(e.ptr, e.key, e.val, e.vflag)
+  }
+  // linked by the first key, leaves by a shorter one, see kidKeys()
+  first := n.entries[0].key
+  if level == 0 && n.last != nil {
+    first = truncateKey(n.last, first)
+  }
+  if level == 0 {
+    n.last = n.entries[len(n.entries)-1].key
+  }
+  n.entries, n.size = nil, HEADER
+  bl.add(level + 1, bulkEntry{ptr: bl.tree.new(node), key: first})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "os"
+)
+
+// a CRC32-C of each page is kept in a file next to the database,
+// 4 bytes per page at the offset of the page number * 4.
+// a page is only overwritten once no reader can reach it, see freelist.go,
+// so the checksum of a reachable page never changes.
+// its entry for the master page is unused, the master page is small
+// enough to be written atomically.
+// a zero checksum means unknown, e.g. pages written before the checksum
+// file existed.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func sumPath(db *KV) string {
+  return db.Path + "-sum"
+}
+
+func pageSum(page []byte, size int) uint32 {
+  sum := crc32.Checksum(page, crcTable)
+  if len(page) < size {
+    // the file is zero padded to the page size
+    sum = crc32.Update(sum, crcTable, make([]byte, size - len(page)))
+  }
+  return sum
+}
+
+// the page has been modified since it was written
+type ErrChecksum struct {
+  Ptr uint64
+}
+
+func (e *ErrChecksum) Error() string {
+  return fmt.Sprintf("page %d: checksum mismatch", e.Ptr)
+}
+
+// check a page read from the file. a bad page can't be returned to the
+// B-tree, so this panics with an *ErrChecksum.
+func checkPage(sums []uint32, ptr uint64, page []byte) []byte {
+  if err := pageSumCheck(sums, ptr, page); err != nil {
+    panic(err)
+  }
+  return page
+}
+
+func pageSumCheck(sums []uint32, ptr uint64, page []byte) error {
+  if ptr < uint64(len(sums)) && sums[ptr] != 0 && sums[ptr] != pageSum(page, len(page)) {
+    return &ErrChecksum{Ptr: ptr}
+  }
+  return nil
+}
+
+// load the checksums of the pages in the file
+func sumOpen(db *KV) error {
+  var fd *os.File
+  var err error
+  if db.Options.ReadOnly {
+    fd, err = os.OpenFile(sumPath(db), os.O_RDONLY, 0)
+  } else {
+    fd, err = fileOpen(db, sumPath(db), true)
+  }
+  if db.Options.ReadOnly && errors.Is(err, os.ErrNotExist) {
+    db.sums.crcs = make([]uint32, db.page.flushed) // unknown
+    return nil
+  }
+  if err != nil {
+    return fmt.Errorf("open checksums: %w", err)
+  }
+  db.sums.fd = fd
+  data, err := io.ReadAll(fd)
+  if err != nil {
+    return fmt.Errorf("read checksums: %w", err)
+  }
+  // the entries past the file size are from a failed update
+  sums := make([]uint32, db.page.flushed)
+  for i := range sums {
+    if 4 * i + 4 <= len(data) {
+      sums[i] = binary.LittleEndian.Uint32(data[4*i:])
+    }
+  }
+  db.sums.crcs = sums
+  return nil
+}
+
+// write the checksums of the pages after the flushed ones
+func sumWrite(db *KV, sums []uint32) error {
+  buf := make([]byte, 4 * len(sums))
+  for i, sum := range sums {
+    binary.LittleEndian.PutUint32(buf[4*i:], sum)
+  }
+  if _, err := db.sums.fd.WriteAt(buf, int64(4 * db.page.flushed)); err != nil {
+    return fmt.Errorf("write checksums: %w", err)
+  }
+  return nil
+}
+
+// write the checksum of a reused page
+func sumUpdate(db *KV, ptr uint64) error {
+  var buf [4]byte
+  binary.LittleEndian.PutUint32(buf[:], db.sums.crcs[ptr])
+  if _, err := db.sums.fd.WriteAt(buf[:], int64(4 * ptr)); err != nil {
+    return fmt.Errorf("write checksums: %w", err)
+  }
+  return nil
+}
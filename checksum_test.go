@@ -0,0 +1,155 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// the panic of a read of a bad page or KV
+func checksumGet(db *KV, key string) (err error) {
+  defer func() {
+    if r := recover(); r != nil {
+      err = r.(error)
+    }
+  }()
+  db.Get([]byte(key))
+  return nil
+}
+
+// flip a byte of `needle` in the page that has it, returns the page
+func checksumCorrupt(t *testing.T, path string, needle []byte) uint64 {
+  t.Helper()
+  data, err := os.ReadFile(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // the latest copy, past the master page
+  off := bytes.LastIndex(data[BTREE_PAGE_SIZE:], needle)
+  if off < 0 {
+    t.Fatalf("%q not in the file", needle)
+  }
+  off += BTREE_PAGE_SIZE
+  data[off] ^= 1
+  if err := os.WriteFile(path, data, 0644); err != nil {
+    t.Fatal(err)
+  }
+  return uint64(off / BTREE_PAGE_SIZE)
+}
+
+// a store with a value in the leaf and one in overflow pages
+func checksumCreate(t *testing.T, opts Options) string {
+  t.Helper()
+  path := filepath.Join(t.TempDir(), "db")
+  db := &KV{Path: path, Options: opts}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  db.Set([]byte("small"), []byte("small value"))
+  big := bytes.Repeat([]byte("big value "), BTREE_MAX_VAL_SIZE)
+  if err := db.Set([]byte("big"), big); err != nil {
+    t.Fatal(err)
+  }
+  return path
+}
+
+func checksumOpen(t *testing.T, path string, opts Options) *KV {
+  t.Helper()
+  db := &KV{Path: path, Options: opts}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  return db
+}
+
+// a page modified after it was written
+func TestChecksumPage(t *testing.T) {
+  for _, needle := range []string{"small value", "big value "} {
+    path := checksumCreate(t, Options{})
+    ptr := checksumCorrupt(t, path, []byte(needle))
+    db := checksumOpen(t, path, Options{})
+    key := "small"
+    if needle == "big value " {
+      key = "big"
+    }
+    err := checksumGet(db, key)
+    var bad *ErrChecksum
+    if !errors.As(err, &bad) || bad.Ptr != ptr {
+      t.Fatalf("%s: %v, want page %d", key, err, ptr)
+    }
+    var corrupt *ErrCorrupt
+    if !errors.As(err, &corrupt) || corrupt.Page != ptr {
+      t.Fatalf("%s: %v", key, err)
+    }
+    if err := db.Verify(); !errors.As(err, &bad) || bad.Ptr != ptr {
+      t.Fatalf("%s: %v", key, err)
+    }
+    found, err := db.VerifySkip()
+    if err != nil || len(found) != 1 || found[0].Ptr != ptr {
+      t.Fatalf("%s: %v %v", key, found, err)
+    }
+    db.Close()
+  }
+}
+
+// a KV that doesn't match its own checksum, also without the page checksums
+func TestChecksumEntry(t *testing.T) {
+  opts := Options{EntryChecksums: true}
+  for _, needle := range []string{"small value", "big value "} {
+    path := checksumCreate(t, opts)
+    checksumCorrupt(t, path, []byte(needle))
+    if err := os.Remove(path + "-sum"); err != nil {
+      t.Fatal(err)
+    }
+    db := checksumOpen(t, path, opts)
+    key := "small"
+    if needle == "big value " {
+      key = "big"
+    }
+    err := checksumGet(db, key)
+    var bad *ErrEntryChecksum
+    if !errors.As(err, &bad) || string(bad.Key) != key {
+      t.Fatalf("%s: %v", key, err)
+    }
+    var corrupt *ErrCorrupt
+    if !errors.As(err, &corrupt) {
+      t.Fatalf("%s: %v", key, err)
+    }
+    if err := db.Verify(); !errors.As(err, &bad) || string(bad.Key) != key {
+      t.Fatalf("%s: %v", key, err)
+    }
+    db.Close()
+  }
+}
+
+// the pages written before the checksum file existed are not checked
+func TestChecksumMissing(t *testing.T) {
+  for _, readOnly := range []bool{false, true} {
+    path := checksumCreate(t, Options{})
+    if err := os.Remove(path + "-sum"); err != nil {
+      t.Fatal(err)
+    }
+    db := checksumOpen(t, path, Options{ReadOnly: readOnly})
+    if err := db.Verify(); err != nil {
+      t.Fatal(err)
+    }
+    if val, ok := db.Get([]byte("small")); !ok || string(val) != "small value" {
+      t.Fatal(string(val))
+    }
+    if !readOnly {
+      // the new pages are
+      db.Set([]byte("new"), []byte("new value"))
+      db.Close()
+      ptr := checksumCorrupt(t, path, []byte("new value"))
+      db = checksumOpen(t, path, Options{})
+      var bad *ErrChecksum
+      if err := checksumGet(db, "new"); !errors.As(err, &bad) || bad.Ptr != ptr {
+        t.Fatal(err)
+      }
+    }
+    db.Close()
+  }
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+  "sort"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// the source of the wall time for the TTLs, the retention of the
+// soft-deleted rows, the commit times and the waits between maintenance
+// steps, see Options.Clock. a ManualClock makes them deterministic.
+type Clock interface {
+  Now() time.Time
+  // receives the time once `d` has passed, see time.After
+  After(d time.Duration) <-chan time.Time
+}
+
+// the default
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+  return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+  return time.After(d)
+}
+
+// a clock for the tests that only moves when it's told to. it can also go
+// back, like a wall clock after a correction.
+type ManualClock struct {
+  mu    sync.Mutex
+  now   time.Time
+  waits []manualWait // the pending After calls
+}
+
+type manualWait struct {
+  at time.Time
+  ch chan time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+  return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  ch := make(chan time.Time, 1)
+  if d <= 0 {
+    ch <- c.now
+    return ch
+  }
+  c.waits = append(c.waits, manualWait{at: c.now.Add(d), ch: ch})
+  return ch
+}
+
+// move the time forward and fire the After calls that are due, in order
+func (c *ManualClock) Advance(d time.Duration) {
+  c.Set(c.Now().Add(d))
+}
+
+// set the time, earlier or later
+func (c *ManualClock) Set(now time.Time) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.now = now
+  sort.SliceStable(c.waits, func(i, j int) bool { return c.waits[i].at.Before(c.waits[j].at) })
+  i := 0
+  for ; i < len(c.waits) && !c.waits[i].at.After(now); i++ {
+    c.waits[i].ch <- now
+  }
+  c.waits = c.waits[i:]
+}
+
+// the number of pending After calls, to wait for a goroutine to block
+func (c *ManualClock) Waiters() int {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return len(c.waits)
+}
+
+// a hybrid logical clock for the expiry times and the commit times. it's
+// the wall clock, unless the wall clock is behind the latest time read,
+// then it's that time, and the times that must be unique count up from
+// it like a logical counter in the low nanoseconds. the clock never goes
+// back: a backward jump of the wall clock stalls it until the wall clock
+// catches up, instead of making the expired keys live again or setting
+// the TTLs from an earlier time. the latest time is kept in the master
+// page and in the log, so a reopened store doesn't start behind it.
+type hlcClock struct {
+  last atomic.Int64 // unix nanoseconds
+  wall Clock
+}
+
+// the clock of the stores without Options.Clock
+var hlc = hlcClock{wall: systemClock{}}
+
+// see Options.Clock
+func clockOpen(db *KV) {
+  db.clock = &hlc
+  if db.Options.Clock != nil {
+    db.clock = &hlcClock{wall: db.Options.Clock}
+  }
+  db.tree.clock = db.clock
+}
+
+// the current time, for the comparisons
+func (c *hlcClock) now() int64 {
+  for {
+    last, wall := c.last.Load(), c.wall.Now().UnixNano()
+    if wall <= last {
+      return last
+    }
+    if c.last.CompareAndSwap(last, wall) {
+      return wall
+    }
+  }
+}
+
+// a time after all the times read before, for the timestamps
+func (c *hlcClock) tick() int64 {
+  for {
+    last := c.last.Load()
+    t := max(c.wall.Now().UnixNano(), last + 1)
+    if c.last.CompareAndSwap(last, t) {
+      return t
+    }
+  }
+}
+
+// the most a time from elsewhere can be ahead of the wall clock. a time
+// further ahead, e.g. written with a wrong wall clock or corrupted, would
+// stall the clock until the wall clock reaches it.
+const HLC_MAX_AHEAD = time.Hour
+
+// don't go behind a time from elsewhere, e.g. the one persisted. returns
+// false for a time over HLC_MAX_AHEAD, which is ignored.
+func (c *hlcClock) observe(t int64) bool {
+  if t > c.wall.Now().Add(HLC_MAX_AHEAD).UnixNano() {
+    return false
+  }
+  for {
+    last := c.last.Load()
+    if t <= last || c.last.CompareAndSwap(last, t) {
+      return true
+    }
+  }
+}
+
+// a persisted time ignored by observe, reported by KV.Warnings
+func clockAhead(db *KV, t int64) {
+  db.clockAhead = max(db.clockAhead, t)
+}
+
+// wait for the wall clock
+func (c *hlcClock) sleep(d time.Duration) {
+  <-c.wall.After(d)
+}
+
+// the latest time read, to be persisted
+func (c *hlcClock) latest() int64 {
+  return c.last.Load()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+var clockStart = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestClockTTL(t *testing.T) {
+  clock := NewManualClock(clockStart)
+  db := &KV{Options: Options{InMemory: true, Clock: clock}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  for i, ttl := range []time.Duration{time.Minute, time.Hour} {
+    if err := db.SetWithTTL([]byte{'a' + byte(i)}, []byte("v"), ttl); err != nil {
+      t.Fatal(err)
+    }
+  }
+  db.Set([]byte("c"), []byte("v"))
+  clock.Advance(time.Minute - time.Nanosecond)
+  if _, ok := db.Get([]byte("a")); !ok {
+    t.Fatal("expired early")
+  }
+  if n, err := db.Sweep(); n != 0 || err != nil {
+    t.Fatal(n, err)
+  }
+  clock.Advance(time.Nanosecond)
+  if _, ok := db.Get([]byte("a")); ok {
+    t.Fatal("not expired")
+  }
+  if it := db.Seek(nil, CMP_GT); !it.Valid() || string(it.Key()) != "b" {
+    t.Fatal("the scan doesn't skip it")
+  }
+  // a transaction reads by the same clock
+  tx := KVTX{}
+  db.Begin(&tx)
+  tx.SetWithTTL([]byte("d"), []byte("v"), time.Second)
+  clock.Advance(time.Second)
+  if _, ok := tx.Get([]byte("d")); ok {
+    t.Fatal("pending update not expired")
+  }
+  db.Abort(&tx)
+  // the expired key is still in the tree until the sweep
+  if n, err := db.Sweep(); n != 1 || err != nil {
+    t.Fatal(n, err)
+  }
+  clock.Advance(time.Hour)
+  if n, err := db.Sweep(); n != 1 || err != nil {
+    t.Fatal(n, err)
+  }
+  st, err := db.Stats()
+  if err != nil || st.Keys != 1 {
+    t.Fatal(st.Keys, err)
+  }
+  // the keys don't come back when the wall clock goes back
+  clock.Set(clockStart)
+  if _, ok := db.Get([]byte("a")); ok {
+    t.Fatal("expired key live again")
+  }
+}
+
+func TestClockPurge(t *testing.T) {
+  clock := NewManualClock(clockStart)
+  db := &DB{Options: Options{InMemory: true, Clock: clock}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  tx := DBTX{}
+  db.Begin(&tx)
+  tdef := &TableDef{
+    Name: "t", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "v"},
+    PKeys: 1, SoftDelete: true,
+  }
+  if err := tx.TableNew(tdef); err != nil {
+    t.Fatal(err)
+  }
+  for i := int64(0); i < 3; i++ {
+    if _, err := tx.Insert("t", *(&Record{}).AddInt64("id", i).AddStr("v", []byte("x"))); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := db.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+  remove := func(id int64) {
+    db.Begin(&tx)
+    if ok, err := tx.Delete("t", *(&Record{}).AddInt64("id", id)); !ok || err != nil {
+      t.Fatal(ok, err)
+    }
+    if err := db.Commit(&tx); err != nil {
+      t.Fatal(err)
+    }
+  }
+  remove(0)
+  clock.Advance(time.Hour)
+  remove(1)
+  // the row deleted an hour ago, not the one just deleted
+  if n, err := db.Purge("t", time.Hour); n != 1 || err != nil {
+    t.Fatal(n, err)
+  }
+  if n, err := db.Purge("t", time.Hour); n != 0 || err != nil {
+    t.Fatal(n, err)
+  }
+  clock.Advance(time.Hour)
+  if n, err := db.Purge("t", time.Hour); n != 1 || err != nil {
+    t.Fatal(n, err)
+  }
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  rec := (&Record{}).AddInt64("id", 2)
+  if ok, err := tx.Get("t", rec); !ok || err != nil {
+    t.Fatal("the live row is gone", err)
+  }
+}
+
+// a store opened with the wall clock behind the times it has written
+// starts from the latest of them, up to HLC_MAX_AHEAD
+func TestClockPersisted(t *testing.T) {
+  for _, wal := range []bool{false, true} {
+    for _, behind := range []time.Duration{HLC_MAX_AHEAD / 2, 2 * HLC_MAX_AHEAD} {
+      path := filepath.Join(t.TempDir(), "db")
+      clock := NewManualClock(clockStart.Add(behind))
+      db := &KV{Path: path, Options: Options{WAL: wal, Clock: clock}}
+      if err := db.Open(); err != nil {
+        t.Fatal(err)
+      }
+      if err := db.SetWithTTL([]byte("k"), []byte("v"), time.Minute); err != nil {
+        t.Fatal(err)
+      }
+      clock.Advance(time.Minute)
+      // the latest time read is written by the next commit
+      if _, ok := db.Get([]byte("k")); ok {
+        t.Fatal("not expired")
+      }
+      db.Set([]byte("other"), nil)
+      latest := db.clock.latest()
+      db.Close()
+
+      db = &KV{Path: path, Options: Options{WAL: wal, Clock: NewManualClock(clockStart)}}
+      if err := db.Open(); err != nil {
+        t.Fatal(err)
+      }
+      now := db.clock.now()
+      if behind > HLC_MAX_AHEAD {
+        // too far ahead, the clock is not stalled for it
+        if now != clockStart.UnixNano() || len(db.Warnings()) != 1 {
+          t.Fatalf("WAL %v: %v ahead, warnings %q", wal, time.Duration(now - clockStart.UnixNano()), db.Warnings())
+        }
+      } else {
+        if now < latest {
+          t.Fatalf("WAL %v: the clock went back by %v", wal, time.Duration(latest - now))
+        }
+        if _, ok := db.Get([]byte("k")); ok {
+          t.Fatalf("WAL %v: expired key live again", wal)
+        }
+        if len(db.Warnings()) != 0 {
+          t.Fatal(db.Warnings())
+        }
+      }
+      db.Close()
+    }
+  }
+}
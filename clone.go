@@ -0,0 +1,93 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "os"
+)
+
+// copy the store into a new file at `path`. where the file system can
+// share the blocks of files, the copy is a clone of the file at the latest
+// commit, which is instant and takes no space until either file changes.
+// the commits wait for the clone. elsewhere, and for an in-memory store,
+// it's a Backup, also for an Options.Store. unlike a Backup, a clone
+// keeps the unused pages, with the free list.
+func (db *KV) CloneTo(path string) error {
+  if db.Options.InMemory || db.Options.Store != nil {
+    return db.Backup(path, nil)
+  }
+  err := cloneLocked(db, path)
+  if errors.Is(err, errors.ErrUnsupported) {
+    return db.Backup(path, nil)
+  }
+  if err != nil {
+    return fmt.Errorf("clone: %w", err)
+  }
+  return nil
+}
+
+func cloneLocked(db *KV, path string) error {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  if db.Options.WAL && !db.Options.ReadOnly {
+    // the clone has no log, the tree must be complete
+    if err := walCheckpoint(db); err != nil {
+      return err
+    }
+  }
+  out := &KV{Path: path}
+  if err := cloneFile(db.Path, out.Path); err != nil {
+    return err
+  }
+  // no checksums file is unknown checksums, see sumOpen
+  err := cloneFile(sumPath(db), sumPath(out))
+  if errors.Is(err, os.ErrNotExist) {
+    err = nil
+  }
+  if data := freeEncode(db); err == nil && data != nil {
+    // or it's rebuilt when the clone is opened
+    err = os.WriteFile(freePath(out), data, 0644)
+  }
+  if err == nil && db.cold.fd != nil {
+    // at the default path of the clone
+    err = cloneFile(coldPath(db), coldPath(out))
+  }
+  if err == nil {
+    // like the file of a Backup, the clone is synced when it's returned
+    err = syncDir(out.Path)
+  }
+  if err != nil {
+    os.Remove(out.Path)
+    os.Remove(sumPath(out))
+    os.Remove(freePath(out))
+    os.Remove(coldPath(out))
+  }
+  return err
+}
+
+// clone `src` into the new file `dst`, removed on error
+func cloneFile(src string, dst string) error {
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+  if err != nil {
+    return err
+  }
+  err = fileClone(out, in)
+  if err == nil {
+    err = out.Sync()
+  }
+  out.Close()
+  if err != nil {
+    os.Remove(dst)
+  }
+  return err
+}
+
+// see KV.CloneTo
+func (db *DB) CloneTo(path string) error {
+  return db.kv.CloneTo(path)
+}
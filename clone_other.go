@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+  "errors"
+  "os"
+)
+
+// only FICLONE for now, clonefile() of APFS isn't in package syscall
+func fileClone(out *os.File, in *os.File) error {
+  return errors.ErrUnsupported
+}
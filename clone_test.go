@@ -0,0 +1,61 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// a clone, or a backup where the file system can't clone, has the
+// latest commit and is apart from the store
+func TestCloneTo(t *testing.T) {
+  cases := []Options{
+    {},
+    {WAL: true}, // the commits still in the log
+    {ColdTier: true, ColdMinSize: 1},
+    {InMemory: true},
+  }
+  for i, opts := range cases {
+    dir := t.TempDir()
+    db := &KV{Options: opts}
+    if !opts.InMemory {
+      db.Path = filepath.Join(dir, "db")
+    }
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    for k := 0; k < 500; k++ {
+      db.Set([]byte(fmt.Sprintf("k%03d", k)), make([]byte, 10 + k * 10))
+    }
+    db.Del([]byte("k000"))
+    out := filepath.Join(dir, "clone")
+    if err := db.CloneTo(out); err != nil {
+      t.Fatalf("case %d: %v", i, err)
+    }
+    // it exists now
+    if err := db.CloneTo(out); err == nil {
+      t.Fatalf("case %d: cloned over the file", i)
+    }
+    db.Set([]byte("k001"), []byte("after"))
+    db.Close()
+    if _, err := os.Stat(out + "-wal"); err == nil {
+      t.Fatalf("case %d: a log", i)
+    }
+    copts := opts
+    copts.InMemory = false
+    clone := checksumOpen(t, out, copts)
+    if err := clone.Verify(); err != nil {
+      t.Fatalf("case %d: %v", i, err)
+    }
+    if _, ok := clone.Get([]byte("k000")); ok {
+      t.Fatalf("case %d: deleted key", i)
+    }
+    for k := 1; k < 500; k++ {
+      if val, ok := clone.Get([]byte(fmt.Sprintf("k%03d", k))); !ok || len(val) != 10 + k * 10 {
+        t.Fatalf("case %d: k%03d: %d %v", i, k, len(val), ok)
+      }
+    }
+    clone.Close()
+  }
+}
@@ -0,0 +1,175 @@
+// order-preserving encodings for composite keys. the encoded elements of
+// a tuple compare as bytes like the tuples compare element by element,
+// so a tuple can be a key of the KV store. they are the encodings of the
+// table layer.
+//
+// each Append function appends a value to `out`, and the decoding
+// function of the same name takes a value from `in` and returns the rest.
+package codec
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "math"
+  "time"
+)
+
+var ErrBadEncoding = errors.New("codec: bad encoding")
+
+// big-endian
+func AppendUint64(out []byte, v uint64) []byte {
+  return binary.BigEndian.AppendUint64(out, v)
+}
+
+func Uint64(in []byte) (uint64, []byte, error) {
+  if len(in) < 8 {
+    return 0, in, ErrBadEncoding
+  }
+  return binary.BigEndian.Uint64(in), in[8:], nil
+}
+
+// big-endian with the sign bit flipped
+func AppendInt64(out []byte, v int64) []byte {
+  return AppendUint64(out, uint64(v) + (1 << 63))
+}
+
+func Int64(in []byte) (int64, []byte, error) {
+  u, rest, err := Uint64(in)
+  return int64(u - (1 << 63)), rest, err
+}
+
+// the IEEE bits with the sign bit flipped for positive numbers and all
+// bits flipped for negative ones. -0 sorts before 0, NaNs sort at the ends.
+func AppendFloat64(out []byte, v float64) []byte {
+  u := math.Float64bits(v)
+  if u & (1 << 63) != 0 {
+    u = ^u
+  } else {
+    u |= 1 << 63
+  }
+  return AppendUint64(out, u)
+}
+
+func Float64(in []byte) (float64, []byte, error) {
+  u, rest, err := Uint64(in)
+  if u & (1 << 63) != 0 {
+    u &^= 1 << 63
+  } else {
+    u = ^u
+  }
+  return math.Float64frombits(u), rest, err
+}
+
+// null-terminated, the null byte is escaped:
+// 0x00 -> 0x01 0x01, 0x01 -> 0x01 0x02.
+// a shorter string still sorts first since the terminator is the smallest.
+func AppendBytes(out []byte, v []byte) []byte {
+  for _, c := range v {
+    if c <= 1 {
+      out = append(out, 0x01, c + 1)
+    } else {
+      out = append(out, c)
+    }
+  }
+  return append(out, 0)
+}
+
+func Bytes(in []byte) ([]byte, []byte, error) {
+  idx := bytes.IndexByte(in, 0)
+  if idx < 0 {
+    return nil, in, ErrBadEncoding
+  }
+  rest := in[idx+1:]
+  in = in[:idx]
+  if bytes.IndexByte(in, 0x01) < 0 {
+    return in, rest, nil // nothing to unescape
+  }
+  out := make([]byte, 0, len(in))
+  for i := 0; i < len(in); i++ {
+    if in[i] == 0x01 {
+      i++
+      if i >= len(in) || in[i] > 2 || in[i] == 0 {
+        return nil, rest, ErrBadEncoding
+      }
+      out = append(out, in[i] - 1)
+    } else {
+      out = append(out, in[i])
+    }
+  }
+  return out, rest, nil
+}
+
+func AppendString(out []byte, v string) []byte {
+  return AppendBytes(out, []byte(v))
+}
+
+func String(in []byte) (string, []byte, error) {
+  b, rest, err := Bytes(in)
+  return string(b), rest, err
+}
+
+// unix nanoseconds, for the years 1678 to 2262. the location is lost.
+func AppendTime(out []byte, v time.Time) []byte {
+  return AppendInt64(out, v.UnixNano())
+}
+
+func Time(in []byte) (time.Time, []byte, error) {
+  n, rest, err := Int64(in)
+  return time.Unix(0, n), rest, err
+}
+
+// the elements one after another. an element is one of the types above:
+// uint64, int64, float64, []byte, string or time.Time.
+func AppendTuple(out []byte, vals ...any) []byte {
+  for _, v := range vals {
+    switch v := v.(type) {
+    case uint64:
+      out = AppendUint64(out, v)
+    case int64:
+      out = AppendInt64(out, v)
+    case float64:
+      out = AppendFloat64(out, v)
+    case []byte:
+      out = AppendBytes(out, v)
+    case string:
+      out = AppendString(out, v)
+    case time.Time:
+      out = AppendTime(out, v)
+    default:
+      panic(fmt.Sprintf("codec: unsupported type %T", v))
+    }
+  }
+  return out
+}
+
+// decode a whole tuple into pointers to the element types
+func DecodeTuple(in []byte, ptrs ...any) error {
+  var err error
+  for _, p := range ptrs {
+    switch p := p.(type) {
+    case *uint64:
+      *p, in, err = Uint64(in)
+    case *int64:
+      *p, in, err = Int64(in)
+    case *float64:
+      *p, in, err = Float64(in)
+    case *[]byte:
+      *p, in, err = Bytes(in)
+    case *string:
+      *p, in, err = String(in)
+    case *time.Time:
+      *p, in, err = Time(in)
+    default:
+      panic(fmt.Sprintf("codec: unsupported type %T", p))
+    }
+    if err != nil {
+      return err
+    }
+  }
+  if len(in) != 0 {
+    return ErrBadEncoding // trailing bytes
+  }
+  return nil
+}
@@ -0,0 +1,134 @@
+package codec
+
+import (
+  "bytes"
+  "errors"
+  "math"
+  "testing"
+  "time"
+)
+
+// the values are in order, the encodings must be too
+func checkOrder[T any](t *testing.T, vals []T, enc func([]byte, T) []byte) {
+  t.Helper()
+  for i := 1; i < len(vals); i++ {
+    a, b := enc(nil, vals[i-1]), enc(nil, vals[i])
+    if bytes.Compare(a, b) >= 0 {
+      t.Fatalf("%v >= %v: %x %x", vals[i-1], vals[i], a, b)
+    }
+  }
+}
+
+// decode the encoding of each value followed by a marker, which is the rest
+func checkRoundTrip[T any](t *testing.T, vals []T, enc func([]byte, T) []byte, dec func([]byte) (T, []byte, error), eq func(T, T) bool) {
+  t.Helper()
+  for _, v := range vals {
+    got, rest, err := dec(append(enc(nil, v), 0xfe))
+    if err != nil || !eq(got, v) || !bytes.Equal(rest, []byte{0xfe}) {
+      t.Fatalf("%v: %v %x %v", v, got, rest, err)
+    }
+  }
+}
+
+func same[T comparable](a T, b T) bool {
+  return a == b
+}
+
+func TestUint64(t *testing.T) {
+  vals := []uint64{0, 1, 255, 256, 1 << 32, math.MaxInt64, 1 << 63, math.MaxUint64}
+  checkOrder(t, vals, AppendUint64)
+  checkRoundTrip(t, vals, AppendUint64, Uint64, same)
+}
+
+func TestInt64(t *testing.T) {
+  vals := []int64{math.MinInt64, math.MinInt64 + 1, -1 << 32, -256, -1, 0, 1, 255, 1 << 32, math.MaxInt64}
+  checkOrder(t, vals, AppendInt64)
+  checkRoundTrip(t, vals, AppendInt64, Int64, same)
+}
+
+func TestFloat64(t *testing.T) {
+  negNaN := math.Float64frombits(math.Float64bits(math.NaN()) | 1 << 63)
+  // NaNs at the ends, -0 before 0
+  vals := []float64{
+    negNaN, math.Inf(-1), -math.MaxFloat64, -1.5, -1, -math.SmallestNonzeroFloat64,
+    math.Copysign(0, -1), 0, math.SmallestNonzeroFloat64, 1, 1.5, math.MaxFloat64, math.Inf(1), math.NaN(),
+  }
+  checkOrder(t, vals, AppendFloat64)
+  // the bits are kept, -0 and the sign of a NaN too
+  sameBits := func(a float64, b float64) bool {
+    return math.Float64bits(a) == math.Float64bits(b)
+  }
+  checkRoundTrip(t, vals, AppendFloat64, Float64, sameBits)
+}
+
+func TestBytes(t *testing.T) {
+  vals := []string{
+    "", "\x00", "\x00\x00", "\x00\x01", "\x01", "\x01\x00", "\x02", "a", "a\x00", "a\x00b", "a\x01", "ab", "b", "\xff",
+  }
+  checkOrder(t, vals, AppendString)
+  checkRoundTrip(t, vals, AppendString, String, same)
+  bvals := [][]byte{nil, {0}, {0, 0xff}, {1, 0, 1}, {0xff, 0}}
+  checkRoundTrip(t, bvals, AppendBytes, Bytes, bytes.Equal)
+  for _, bad := range []string{"", "abc", "\x01", "\x01\x00", "\x01\x03\x00"} {
+    if _, _, err := Bytes([]byte(bad)); !errors.Is(err, ErrBadEncoding) {
+      t.Fatalf("%q: %v", bad, err)
+    }
+  }
+}
+
+func TestTime(t *testing.T) {
+  vals := []time.Time{
+    time.Unix(0, math.MinInt64), time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC), time.Unix(-1, 0),
+    time.Unix(0, -1), time.Unix(0, 0), time.Unix(0, 1), time.Date(2024, 2, 29, 12, 0, 0, 5, time.FixedZone("x", 3600)),
+    time.Date(2024, 2, 29, 12, 0, 0, 6, time.UTC), time.Unix(0, math.MaxInt64),
+  }
+  checkOrder(t, vals, AppendTime)
+  // the same instant, in the local time
+  checkRoundTrip(t, vals, AppendTime, Time, time.Time.Equal)
+}
+
+func TestTuple(t *testing.T) {
+  type row struct {
+    a int64
+    b string
+    c float64
+  }
+  vals := []row{
+    {-1, "z", 0}, {0, "", 0}, {0, "\x00", -1}, {0, "\x00", 0}, {0, "a", math.Inf(-1)},
+    {0, "a", 2}, {0, "a\x00", -5}, {0, "ab", -5}, {1, "", -1},
+  }
+  enc := func(out []byte, r row) []byte {
+    return AppendTuple(out, r.a, r.b, r.c)
+  }
+  checkOrder(t, vals, enc)
+  for _, r := range vals {
+    var got row
+    if err := DecodeTuple(enc(nil, r), &got.a, &got.b, &got.c); err != nil || got != r {
+      t.Fatalf("%v: %v %v", r, got, err)
+    }
+  }
+  // all the element types
+  now := time.Unix(1700000000, 123)
+  in := AppendTuple(nil, uint64(7), int64(-7), 0.5, []byte("x\x00"), "y", now)
+  var (
+    u  uint64
+    i  int64
+    f  float64
+    bs []byte
+    s  string
+    tm time.Time
+  )
+  if err := DecodeTuple(in, &u, &i, &f, &bs, &s, &tm); err != nil {
+    t.Fatal(err)
+  }
+  if u != 7 || i != -7 || f != 0.5 || string(bs) != "x\x00" || s != "y" || !tm.Equal(now) {
+    t.Fatal(u, i, f, bs, s, tm)
+  }
+  // trailing and missing bytes
+  if err := DecodeTuple(append(in, 0), &u, &i, &f, &bs, &s, &tm); !errors.Is(err, ErrBadEncoding) {
+    t.Fatal(err)
+  }
+  if err := DecodeTuple(in[:len(in)-1], &u, &i, &f, &bs, &s, &tm); !errors.Is(err, ErrBadEncoding) {
+    t.Fatal(err)
+  }
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "os"
+  "sync/atomic"
+)
+
+// large values can be stored in a second file, the cold tier, which can
+// be on cheaper storage. the B-tree file keeps the leaves, so it stays
+// small. the overflow pages of the cold file are like the ones of the
+// B-tree file, and the pointers to them have the file id COLD_FILE in
+// the top byte, in the references and in the chains.
+// the cold file is appended to, its pages are written and synced before
+// the commit that references them. it has no page checksums, the values
+// are checked with Options.EntryChecksums.
+const (
+  COLD_FILE       = uint64(1)
+  PAGE_FILE_SHIFT = 56
+  PAGE_FILE_MASK  = uint64(0xff) << PAGE_FILE_SHIFT
+  MIGRATE_BATCH   = 256 // keys per commit in MigrateTier
+)
+
+// the cold file of a store
+type coldFile struct {
+  fd      *os.File
+  flushed atomic.Uint64 // the pages in the file, read by the snapshots
+  temp    [][]byte      // the pages of the commit in progress
+}
+
+func coldPath(db *KV) string {
+  if db.Options.ColdPath != "" {
+    return db.Options.ColdPath
+  }
+  return db.Path + "-cold"
+}
+
+// open the cold file if the values go there or it exists
+func coldOpen(db *KV) error {
+  var fd *os.File
+  var err error
+  if db.Options.ReadOnly {
+    fd, err = os.OpenFile(coldPath(db), os.O_RDONLY, 0)
+  } else {
+    fd, err = fileOpen(db, coldPath(db), db.Options.ColdTier)
+  }
+  if errors.Is(err, os.ErrNotExist) {
+    return nil // no cold values
+  }
+  if err != nil {
+    return fmt.Errorf("open cold file: %w", err)
+  }
+  fi, err := fd.Stat()
+  if err != nil {
+    fd.Close()
+    return fmt.Errorf("stat cold file: %w", err)
+  }
+  psize := int64(db.tree.pageSize())
+  // a partial page from a crash is not referenced, it's overwritten
+  db.cold.fd = fd
+  db.cold.flushed.Store(uint64((fi.Size() + psize - 1) / psize))
+  db.tree.cold = coldPages{db}
+  if db.Options.ColdTier {
+    db.tree.coldMin = max(db.Options.ColdMinSize, BTREE_MAX_VAL_SIZE + 1)
+  }
+  return nil
+}
+
+func coldClose(db *KV) {
+  if db.cold.fd != nil {
+    _ = db.cold.fd.Close()
+    db.cold.fd = nil
+  }
+}
+
+// write and sync the new pages of the cold file before the commit
+func coldFlush(db *KV) error {
+  if len(db.cold.temp) == 0 {
+    return nil
+  }
+  psize := int64(db.tree.pageSize())
+  flushed := db.cold.flushed.Load()
+  for i, page := range db.cold.temp {
+    if _, err := db.cold.fd.WriteAt(page, int64(flushed + uint64(i)) * psize); err != nil {
+      return fmt.Errorf("write cold page: %w", err)
+    }
+  }
+  if err := db.cold.fd.Sync(); err != nil {
+    return fmt.Errorf("fsync cold file: %w", err)
+  }
+  db.cold.flushed.Add(uint64(len(db.cold.temp)))
+  db.cold.temp = nil
+  return nil
+}
+
+// the pages of the cold file. the snapshots only reach the flushed ones,
+// the pages not written yet are only read by the writer.
+type coldPages struct {
+  db *KV
+}
+
+func (cp coldPages) Get(ptr uint64) []byte {
+  db := cp.db
+  if flushed := db.cold.flushed.Load(); ptr >= flushed {
+    return db.cold.temp[ptr - flushed]
+  }
+  page := make([]byte, db.tree.pageSize())
+  if _, err := db.cold.fd.ReadAt(page, int64(ptr) * int64(len(page))); err != nil {
+    panic(corruptf(ptr | COLD_FILE << PAGE_FILE_SHIFT, "cold file: %w", err))
+  }
+  db.stats.reads.Add(1)
+  return page
+}
+
+func (cp coldPages) New(page []byte) uint64 {
+  db := cp.db
+  db.cold.temp = append(db.cold.temp, page)
+  return db.cold.flushed.Load() + uint64(len(db.cold.temp)) - 1
+}
+
+// unlike the pages of the B-tree file, the pages are never reused
+func (cp coldPages) Del(ptr uint64) {}
+
+// the page of an overflow chain, in either file
+func overflowPage(tree *BTree, ptr uint64) []byte {
+  switch ptr >> PAGE_FILE_SHIFT {
+  case 0:
+    return tree.get(ptr)
+  case COLD_FILE:
+    if tree.cold == nil {
+      panic(corruptf(ptr, "a value in the cold tier, but no cold file"))
+    }
+    return tree.cold.Get(ptr &^ PAGE_FILE_MASK)
+  }
+  panic(corruptf(ptr, "bad file id in overflow pointer"))
+}
+
+// the allocator of the overflow pages of a value of `size` bytes
+func overflowAlloc(tree *BTree, size int) func([]byte) uint64 {
+  if tree.cold == nil || tree.coldMin <= 0 || size < tree.coldMin {
+    return tree.new
+  }
+  return func(page []byte) uint64 {
+    return tree.cold.New(page) | COLD_FILE << PAGE_FILE_SHIFT
+  }
+}
+
+// is the value of the leaf KV in the cold file?
+func (node BNode) isCold(idx uint16) bool {
+  if !node.isOverflow(idx) {
+    return false
+  }
+  ref := node.getVal(idx)
+  return binary.LittleEndian.Uint64(ref[4:]) >> PAGE_FILE_SHIFT == COLD_FILE
+}
+
+// move the existing overflow values to the cold file, or back to the
+// B-tree file if `cold` is false. the new values go to the tier of
+// Options.ColdTier either way. the keys are moved in batches of
+// MIGRATE_BATCH, one commit each, the updates can go on in between.
+// the space of the moved values is reclaimed by Compact.
+// the progress is in keys moved, `p` can be nil.
+func (db *KV) MigrateTier(cold bool, p *Progress) (int, error) {
+  if cold && db.cold.fd == nil {
+    return 0, errors.New("migrate: no cold file, see Options.ColdTier")
+  }
+  p.begin("keys", 0)
+  defer p.finish()
+  moved := 0
+  var start []byte
+  for {
+    n, next, err := migrateBatch(db, cold, start)
+    moved += n
+    p.add(int64(n))
+    if err != nil {
+      return moved, fmt.Errorf("migrate: %w", err)
+    }
+    if next == nil {
+      return moved, nil
+    }
+    start = next
+  }
+}
+
+// move the values of a batch of keys from `start`, returns the start of
+// the next batch or nil at the end
+func migrateBatch(db *KV, cold bool, start []byte) (int, []byte, error) {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  type entry struct {
+    key     []byte
+    val     []byte
+    expires int64
+  }
+  var batch []entry
+  var next []byte
+  iter := db.tree.Seek(start, CMP_GE)
+  for ; iter.Valid(); iter.Next() {
+    if len(batch) == MIGRATE_BATCH {
+      next = append([]byte(nil), iter.Key()...)
+      break
+    }
+    last := len(iter.path) - 1
+    node, idx := iter.path[last], iter.pos[last]
+    if node.isOverflow(idx) && node.isCold(idx) != cold {
+      key := append([]byte(nil), iter.Key()...)
+      batch = append(batch, entry{key: key, val: iter.Val(), expires: iter.Expires()})
+    }
+  }
+  if len(batch) == 0 {
+    return 0, next, nil
+  }
+  // the values go to the target tier during the batch
+  coldMin := db.tree.coldMin
+  db.tree.coldMin = -1
+  if cold {
+    db.tree.coldMin = 1
+  }
+  meta := saveMeta(db)
+  for _, e := range batch {
+    db.tree.updateExpiring(e.key, e.val, e.expires)
+    if e.expires != 0 {
+      walLogExpiring(db, e.key, e.val, e.expires)
+    } else {
+      walLog(db, e.key, e.val, false)
+    }
+  }
+  db.tree.coldMin = coldMin
+  if err := updateOrRevert(db, meta); err != nil {
+    return 0, nil, err
+  }
+  return len(batch), next, nil
+}
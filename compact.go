@@ -0,0 +1,122 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "os"
+)
+
+// rewrite the live KV pairs into a new file and replace the file with it.
+// the free pages are reused and only those at the end are cut off, see
+// freelist.go; the new file has no unused pages and no expired keys. it
+// takes as much free disk space as the live data.
+// the updates wait for it. the transactions and the iterators in use
+// keep reading the old file, which stays mapped until Close.
+// the progress is in keys, `p` can be nil. on error after the copy, the
+// store must be closed and opened again.
+func (db *KV) Compact(p *Progress) error {
+  if db.Options.InMemory {
+    return errors.New("compact: in-memory store")
+  }
+  if db.Options.ReadOnly {
+    return fmt.Errorf("compact: %w", ErrReadOnly)
+  }
+  if db.Options.Store != nil {
+    return fmt.Errorf("compact: %w", errCustomStore)
+  }
+  // no commits between the copy and the swap
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  if db.Options.WAL {
+    // the new file is a copy of the tree, the log must be empty
+    if err := walCheckpoint(db); err != nil {
+      return fmt.Errorf("compact: %w", err)
+    }
+  }
+  tmp := &KV{Path: db.Path + ".compact"}
+  // the cold values are appended to the same cold file, so both files are
+  // valid until the swap. the old cold values are not reclaimed.
+  if db.cold.fd != nil {
+    tmp.Options.ColdPath = coldPath(db)
+  }
+  // left by a failed compaction
+  os.Remove(tmp.Path)
+  os.Remove(sumPath(tmp))
+  os.Remove(freePath(tmp))
+  src, release := db.snapshot()
+  err := backupTo(db, &src, tmp, p)
+  release()
+  if err == nil {
+    err = compactSwap(db, tmp)
+  }
+  if err != nil {
+    os.Remove(tmp.Path)
+    os.Remove(sumPath(tmp))
+    os.Remove(freePath(tmp))
+    return fmt.Errorf("compact: %w", err)
+  }
+  return nil
+}
+
+// replace the file with the compacted one and reopen it in place, with
+// the writer lock held. the readers of the old store are not affected.
+func compactSwap(db *KV, tmp *KV) error {
+  walClose(db)
+  if db.sums.fd != nil {
+    _ = db.sums.fd.Close()
+    db.sums.fd = nil
+  }
+  // the pages of the old file, it's not saved
+  if db.free.fd != nil {
+    _ = db.free.fd.Close()
+    db.free.fd = nil
+  }
+  // the old checksums don't match the new file, they are all reset to
+  // unknown first in case of a crash between the renames.
+  err := os.Truncate(sumPath(db), 0)
+  if err == nil {
+    err = fileRename(db, tmp.Path, db.Path)
+  }
+  if err == nil {
+    err = dirSyncWait(db) // the file before its checksums
+  }
+  if err == nil {
+    err = fileRename(db, sumPath(tmp), sumPath(db))
+  }
+  if err == nil {
+    err = fileRename(db, freePath(tmp), freePath(db))
+  }
+  // the reopened store starts with no syncs in the background
+  err = errors.Join(err, dirSyncWait(db))
+  // the old or the new file, whichever is in place
+  next := &KV{Path: db.Path, Warmup: db.Warmup, Options: db.Options}
+  next.Options.Create = OPEN_NOCREATE
+  if oerr := next.Open(); oerr != nil {
+    return errors.Join(err, oerr)
+  }
+  _ = dirSyncWait(next)
+  // the same cold file, the values of the copy are appended to it
+  db.cold.flushed.Store(next.cold.flushed.Load())
+  if next.cold.fd != nil {
+    _ = next.cold.fd.Close()
+  }
+  db.mu.Lock()
+  db.retired = append(db.retired, db.store)
+  db.store = next.store
+  db.tree.file++
+  db.mu.Unlock()
+  db.tree.root = next.tree.root
+  db.page = next.page
+  db.sums = next.sums
+  db.free = next.free
+  db.free.durable = db.version
+  db.wal = next.wal
+  db.failed = false
+  publish(db)
+  return err
+}
+
+// see KV.Compact
+func (db *DB) Compact(p *Progress) error {
+  return db.kv.Compact(p)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+  "fmt"
+  "path/filepath"
+  "sync"
+  "sync/atomic"
+  "testing"
+)
+
+// the commits during a Compact wait for it and are kept, and the readers
+// of the old file keep working
+func TestCompactConcurrent(t *testing.T) {
+  for _, wal := range []bool{false, true} {
+    db := &KV{Path: filepath.Join(t.TempDir(), "db"), Options: Options{WAL: wal}}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    for i := 0; i < 2000; i++ {
+      if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 50)); err != nil {
+        t.Fatal(err)
+      }
+    }
+    // an iterator of the old file, used after the swaps
+    old := db.Seek(nil, CMP_GT)
+    var stop atomic.Bool
+    var wg sync.WaitGroup
+    var written atomic.Int64
+    wg.Add(3)
+    go func() {
+      defer wg.Done()
+      for i := 0; !stop.Load(); i++ {
+        if err := db.Set([]byte(fmt.Sprintf("new%06d", i)), []byte("v")); err != nil {
+          t.Error(err)
+          return
+        }
+        written.Add(1)
+      }
+    }()
+    go func() {
+      defer wg.Done()
+      for !stop.Load() {
+        if _, ok := db.Get([]byte("k01000")); !ok {
+          t.Error("lost a key")
+          return
+        }
+        n := 0
+        for it := db.Seek([]byte("k"), CMP_GE); it.Valid() && n < 100; it.Next() {
+          n++
+        }
+      }
+    }()
+    go func() {
+      defer wg.Done()
+      for !stop.Load() {
+        tx := KVTX{}
+        db.BeginReadCommitted(&tx)
+        if _, ok := tx.Get([]byte("k00001")); !ok {
+          t.Error("lost a key")
+        }
+        db.Abort(&tx)
+      }
+    }()
+    for i := 0; i < 3; i++ {
+      if err := db.Compact(nil); err != nil {
+        t.Fatal(err)
+      }
+    }
+    stop.Store(true)
+    wg.Wait()
+    n := 0
+    for ; old.Valid(); old.Next() {
+      n++
+    }
+    if n != 2000 {
+      t.Fatalf("old iterator: %d keys", n)
+    }
+    if err := db.Verify(); err != nil {
+      t.Fatal(err)
+    }
+    want := written.Load()
+    db.Close()
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    for i := int64(0); i < want; i++ {
+      if _, ok := db.Get([]byte(fmt.Sprintf("new%06d", i))); !ok {
+        t.Fatalf("WAL %v: commit %d of %d lost", wal, i, want)
+      }
+    }
+    db.Close()
+  }
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+  "bytes"
+  "compress/flate"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "sync"
+)
+
+// a store that compresses the pages, the internal nodes and the leaves,
+// for the archival datasets that are read more than they are written.
+// all the pages are compressed, not only the cold ones: the B-tree never
+// updates a page in place, so a page is cold once it's written, and the
+// hot pages are read from the cache, decompressed.
+// see Options.Store. the pages are appended to the data file at the path,
+// compressed with flate, and the page directory in the path with "-dir"
+// appended has the offset and the compressed size of each page:
+// | sig 8B | page size 4B | unused 4B | master page | entries |
+// an entry is | offset 8B | size 4B |, the size of a page that doesn't
+// compress is the page size, it's stored as is. the master page is not
+// compressed, so its update is still a small write in place.
+// a page written again, after a failed commit, is appended again.
+// the decompressed pages are kept in a cache of COMPRESS_CACHE_PAGES.
+const (
+  COMPRESS_SIG         = "PAGEDIR1"
+  COMPRESS_HEADER      = 16
+  COMPRESS_ENTRY       = 12
+  COMPRESS_CACHE_PAGES = 1024
+)
+
+// a flate.Writer is large, they are reused
+var compressWriters = sync.Pool{New: func() any {
+  w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+  return w
+}}
+
+type CompressedStore struct {
+  data   *os.File
+  dir    *os.File
+  psize  int
+  mu     sync.Mutex
+  master bool         // the master page is written
+  end    int64        // the end of the data file
+  pages  []storedPage // the directory, by page number from 1
+  dirty  []uint64     // the entries to write at the next Sync
+  size   int64        // the compressed bytes of the pages in use
+  // the decompressed pages, evicted in the order they are read
+  cache map[uint64][]byte
+  order []uint64
+}
+
+type storedPage struct {
+  off  int64
+  size uint32 // 0 for a page not written
+}
+
+// open or create a store with pages of `pageSize` bytes, 0 for
+// BTREE_PAGE_SIZE. an existing store keeps its page size, it must match.
+func OpenCompressedStore(path string, pageSize int, readOnly bool) (*CompressedStore, error) {
+  if pageSize == 0 {
+    pageSize = BTREE_PAGE_SIZE
+  }
+  if err := checkPageSize(pageSize); err != nil {
+    return nil, err
+  }
+  flags := os.O_RDWR|os.O_CREATE
+  if readOnly {
+    flags = os.O_RDONLY
+  }
+  data, err := os.OpenFile(path, flags, 0644)
+  if err != nil {
+    return nil, fmt.Errorf("OpenFile: %w", err)
+  }
+  dir, err := os.OpenFile(path + "-dir", flags, 0644)
+  if err != nil {
+    data.Close()
+    return nil, fmt.Errorf("OpenFile: %w", err)
+  }
+  cs := &CompressedStore{data: data, dir: dir, psize: pageSize, cache: map[uint64][]byte{}}
+  if err := cs.load(readOnly); err != nil {
+    data.Close()
+    dir.Close()
+    return nil, fmt.Errorf("compressed store: %w", err)
+  }
+  return cs, nil
+}
+
+// read the directory, or write the header of a new one
+func (cs *CompressedStore) load(readOnly bool) error {
+  fi, err := cs.data.Stat()
+  if err != nil {
+    return fmt.Errorf("stat: %w", err)
+  }
+  cs.end = fi.Size()
+  dir, err := io.ReadAll(cs.dir)
+  if err != nil {
+    return fmt.Errorf("read directory: %w", err)
+  }
+  if len(dir) == 0 && !readOnly {
+    // with room for the master page
+    header := make([]byte, COMPRESS_HEADER + cs.psize)
+    copy(header, COMPRESS_SIG)
+    binary.LittleEndian.PutUint32(header[8:], uint32(cs.psize))
+    if _, err := cs.dir.WriteAt(header, 0); err != nil {
+      return fmt.Errorf("write directory: %w", err)
+    }
+    return nil
+  }
+  if len(dir) < COMPRESS_HEADER || string(dir[:8]) != COMPRESS_SIG {
+    return errors.New("bad directory")
+  }
+  if size := int(binary.LittleEndian.Uint32(dir[8:])); size != cs.psize {
+    return fmt.Errorf("the store has a page size of %d, not %d", size, cs.psize)
+  }
+  if len(dir) < COMPRESS_HEADER + cs.psize {
+    return errors.New("bad directory")
+  }
+  cs.master = !bytes.Equal(dir[COMPRESS_HEADER:COMPRESS_HEADER+16], make([]byte, 16))
+  // a partial entry from a crash is not referenced, it's overwritten.
+  // so is an entry past the data, it's read as a page not written.
+  entries := dir[COMPRESS_HEADER + cs.psize:]
+  for i := 0; i + COMPRESS_ENTRY <= len(entries); i += COMPRESS_ENTRY {
+    page := storedPage{
+      off: int64(binary.LittleEndian.Uint64(entries[i:])),
+      size: binary.LittleEndian.Uint32(entries[i+8:]),
+    }
+    if page.size > uint32(cs.psize) || page.off + int64(page.size) > cs.end {
+      page = storedPage{}
+    }
+    cs.pages = append(cs.pages, page)
+    cs.size += int64(page.size)
+  }
+  return nil
+}
+
+// the size of the pages uncompressed, like the size of a B-tree file
+func (cs *CompressedStore) Size() (int64, error) {
+  cs.mu.Lock()
+  defer cs.mu.Unlock()
+  if !cs.master {
+    return 0, nil // a new store
+  }
+  return int64(1 + len(cs.pages)) * int64(cs.psize), nil
+}
+
+// the pages in use and their size in the data file, without the master page
+func (cs *CompressedStore) Compressed() (pages int, size int64) {
+  cs.mu.Lock()
+  defer cs.mu.Unlock()
+  return len(cs.pages), cs.size
+}
+
+func (cs *CompressedStore) ReadPage(ptr uint64, size int) []byte {
+  if size > cs.psize {
+    panic(fmt.Errorf("page %d: the store has a page size of %d", ptr, cs.psize))
+  }
+  if ptr == 0 {
+    page := make([]byte, size)
+    if _, err := cs.dir.ReadAt(page, COMPRESS_HEADER); err != nil {
+      panic(fmt.Errorf("master page: read: %w", err))
+    }
+    return page
+  }
+  cs.mu.Lock()
+  if page, ok := cs.cache[ptr]; ok {
+    cs.mu.Unlock()
+    return page[:size]
+  }
+  if ptr > uint64(len(cs.pages)) || cs.pages[ptr-1].size == 0 {
+    cs.mu.Unlock()
+    panic(fmt.Errorf("page %d: not written", ptr))
+  }
+  stored := cs.pages[ptr-1]
+  cs.mu.Unlock()
+  page, err := cs.readPage(stored)
+  if err != nil {
+    panic(fmt.Errorf("page %d: %w", ptr, err))
+  }
+  cs.mu.Lock()
+  // not if it was written again meanwhile
+  if cs.pages[ptr-1] == stored {
+    cs.cachePage(ptr, page)
+  }
+  cs.mu.Unlock()
+  return page[:size]
+}
+
+func (cs *CompressedStore) readPage(stored storedPage) ([]byte, error) {
+  data := make([]byte, stored.size)
+  if _, err := cs.data.ReadAt(data, stored.off); err != nil {
+    return nil, fmt.Errorf("read: %w", err)
+  }
+  if int(stored.size) == cs.psize {
+    return data, nil
+  }
+  page := make([]byte, cs.psize)
+  r := flate.NewReader(bytes.NewReader(data))
+  if _, err := io.ReadFull(r, page); err != nil {
+    return nil, fmt.Errorf("decompress: %w", err)
+  }
+  return page, nil
+}
+
+// the caller holds cs.mu
+func (cs *CompressedStore) cachePage(ptr uint64, page []byte) {
+  if _, ok := cs.cache[ptr]; !ok {
+    if len(cs.order) >= COMPRESS_CACHE_PAGES {
+      delete(cs.cache, cs.order[0])
+      cs.order = cs.order[1:]
+    }
+    cs.order = append(cs.order, ptr)
+  }
+  cs.cache[ptr] = page
+}
+
+// the master page at 0 or whole pages
+func (cs *CompressedStore) WriteAt(data []byte, off int64) error {
+  if off < int64(cs.psize) {
+    if off + int64(len(data)) > int64(cs.psize) {
+      return errors.New("write across the master page")
+    }
+    _, err := cs.dir.WriteAt(data, COMPRESS_HEADER + off)
+    cs.mu.Lock()
+    cs.master = true
+    cs.mu.Unlock()
+    return err
+  }
+  if off % int64(cs.psize) != 0 || len(data) % cs.psize != 0 {
+    return fmt.Errorf("unaligned write of %d bytes at %d", len(data), off)
+  }
+  for ; len(data) > 0; data, off = data[cs.psize:], off + int64(cs.psize) {
+    if err := cs.writePage(uint64(off / int64(cs.psize)), data[:cs.psize]); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (cs *CompressedStore) writePage(ptr uint64, page []byte) error {
+  var buf bytes.Buffer
+  w := compressWriters.Get().(*flate.Writer)
+  w.Reset(&buf)
+  w.Write(page)
+  w.Close()
+  compressWriters.Put(w)
+  stored := buf.Bytes()
+  // not for the pages that don't compress
+  if len(stored) >= cs.psize {
+    stored = page
+  }
+  cs.mu.Lock()
+  defer cs.mu.Unlock()
+  if _, err := cs.data.WriteAt(stored, cs.end); err != nil {
+    return err
+  }
+  for uint64(len(cs.pages)) < ptr {
+    cs.pages = append(cs.pages, storedPage{})
+  }
+  cs.size += int64(len(stored)) - int64(cs.pages[ptr-1].size)
+  cs.pages[ptr-1] = storedPage{off: cs.end, size: uint32(len(stored))}
+  cs.end += int64(len(stored))
+  cs.dirty = append(cs.dirty, ptr)
+  if _, ok := cs.cache[ptr]; ok {
+    cs.cache[ptr] = append([]byte(nil), page...)
+  }
+  return nil
+}
+
+// the pages before the directory entries that point to them
+func (cs *CompressedStore) Sync() error {
+  cs.mu.Lock()
+  defer cs.mu.Unlock()
+  if err := cs.data.Sync(); err != nil {
+    return err
+  }
+  var entry [COMPRESS_ENTRY]byte
+  for _, ptr := range cs.dirty {
+    page := cs.pages[ptr-1]
+    binary.LittleEndian.PutUint64(entry[0:], uint64(page.off))
+    binary.LittleEndian.PutUint32(entry[8:], page.size)
+    off := int64(COMPRESS_HEADER + cs.psize) + int64(ptr - 1) * COMPRESS_ENTRY
+    if _, err := cs.dir.WriteAt(entry[:], off); err != nil {
+      return err
+    }
+  }
+  cs.dirty = cs.dirty[:0]
+  return cs.dir.Sync()
+}
+
+func (cs *CompressedStore) Close() error {
+  return errors.Join(cs.data.Close(), cs.dir.Close())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func compressOpen(t *testing.T, dir string) (*KV, *CompressedStore) {
+  t.Helper()
+  cs, err := OpenCompressedStore(filepath.Join(dir, "pages"), 0, false)
+  if err != nil {
+    t.Fatal(err)
+  }
+  db := &KV{Path: filepath.Join(dir, "db"), Options: Options{Store: cs}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  return db, cs
+}
+
+// more pages than the cache, read back after a reopen
+func TestCompressedStore(t *testing.T) {
+  dir := t.TempDir()
+  db, cs := compressOpen(t, dir)
+  val := func(i int) []byte {
+    return bytes.Repeat([]byte(fmt.Sprintf("value %d,", i)), 200)
+  }
+  const n = 4000
+  for i := 0; i < n; i += 100 {
+    tx := KVTX{}
+    db.Begin(&tx)
+    for j := i; j < i + 100; j++ {
+      tx.Set([]byte(fmt.Sprintf("k%05d", j)), val(j))
+    }
+    if err := db.Commit(&tx); err != nil {
+      t.Fatal(err)
+    }
+  }
+  check := func() {
+    t.Helper()
+    for i := 0; i < n; i++ {
+      if got, ok := db.Get([]byte(fmt.Sprintf("k%05d", i))); !ok || !bytes.Equal(got, val(i)) {
+        t.Fatalf("k%05d: %.20q %v", i, got, ok)
+      }
+    }
+    if err := db.Verify(); err != nil {
+      t.Fatal(err)
+    }
+  }
+  check()
+  pages, size := cs.Compressed()
+  if pages <= COMPRESS_CACHE_PAGES || size * 4 > int64(pages * BTREE_PAGE_SIZE) {
+    t.Fatalf("%d pages in %d bytes", pages, size)
+  }
+  db.Close()
+  db, cs = compressOpen(t, dir)
+  defer db.Close()
+  check()
+  if again, _ := cs.Compressed(); again != pages {
+    t.Fatalf("%d pages, want %d", again, pages)
+  }
+  // the updates after the reopen
+  db.Set([]byte("k00000"), []byte("new"))
+  if got, _ := db.Get([]byte("k00000")); string(got) != "new" {
+    t.Fatal(got)
+  }
+  // the store keeps its page size
+  _, err := OpenCompressedStore(filepath.Join(dir, "pages"), 2 * BTREE_PAGE_SIZE, true)
+  if err == nil || !strings.Contains(err.Error(), "page size of 4096") {
+    t.Fatal(err)
+  }
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+)
+
+// how Open treats a missing or an existing file, see Options.Create
+const (
+  OPEN_CREATE   = 0 // create the file if it's missing
+  OPEN_EXCL     = 1 // the file must not exist
+  OPEN_NOCREATE = 2 // the file must exist
+)
+
+// a new directory entry is lost in a crash until the directory is synced,
+// see Options.DirSync
+const (
+  DIRSYNC_ON         = 0 // sync it before the create or rename returns
+  DIRSYNC_BACKGROUND = 1 // sync it in the background, before the next commit
+  DIRSYNC_OFF        = 2 // never, e.g. for temporary files
+)
+
+func openFile(db *KV) (*os.File, error) {
+  if db.Options.ReadOnly {
+    fd, err := os.OpenFile(db.Path, os.O_RDONLY, 0)
+    if err != nil {
+      return nil, fmt.Errorf("OpenFile: %w", err)
+    }
+    return fd, nil
+  }
+  mode := db.Options.Create
+  if mode != OPEN_CREATE && mode != OPEN_EXCL && mode != OPEN_NOCREATE {
+    return nil, fmt.Errorf("bad create mode %d", mode)
+  }
+  if db.Options.DirSync < DIRSYNC_ON || db.Options.DirSync > DIRSYNC_OFF {
+    return nil, fmt.Errorf("bad dir sync mode %d", db.Options.DirSync)
+  }
+  if mode != OPEN_NOCREATE {
+    err := createFile(db, db.Path, db.tree.pageSize())
+    if err != nil && !(mode == OPEN_CREATE && errors.Is(err, os.ErrExist)) {
+      return nil, err
+    }
+  }
+  fd, err := os.OpenFile(db.Path, os.O_RDWR, 0644)
+  if err != nil {
+    return nil, fmt.Errorf("OpenFile: %w", err)
+  }
+  return fd, nil
+}
+
+// create the file with an empty DB. the file is written under a temporary
+// name and then linked to the path, which fails if the path exists. of
+// several processes creating the same file, only one of them succeeds,
+// and the others never see a file without the master page.
+func createFile(db *KV, path string, size int) error {
+  if _, err := os.Stat(path); err == nil {
+    return fmt.Errorf("create %s: %w", path, os.ErrExist)
+  }
+  tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".tmp-*")
+  if err != nil {
+    return fmt.Errorf("create: %w", err)
+  }
+  defer os.Remove(tmp.Name())
+  // the master page of an empty tree, with no time seen yet
+  empty := &KV{clock: &hlcClock{}}
+  empty.page.flushed = 1
+  empty.tree.psize = size
+  page := make([]byte, size)
+  copy(page, saveMeta(empty))
+  _, err = tmp.Write(page)
+  if err == nil {
+    err = tmp.Sync()
+  }
+  if cerr := tmp.Close(); err == nil {
+    err = cerr
+  }
+  if err != nil {
+    return fmt.Errorf("create: %w", err)
+  }
+  if err := os.Link(tmp.Name(), path); err != nil {
+    return fmt.Errorf("create %s: %w", path, err)
+  }
+  // persist the new directory entry
+  return dirSync(db, path)
+}
+
+// the files of a store are created and renamed with these, which sync
+// the directory entries per Options.DirSync
+
+// open a file for update, creating it if it's missing and `create`
+func fileOpen(db *KV, path string, create bool) (*os.File, error) {
+  fd, err := os.OpenFile(path, os.O_RDWR, 0644)
+  if !create || !errors.Is(err, os.ErrNotExist) {
+    return fd, err
+  }
+  fd, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+  if errors.Is(err, os.ErrExist) {
+    return os.OpenFile(path, os.O_RDWR, 0644) // created by another process
+  }
+  if err != nil {
+    return nil, err
+  }
+  if err := dirSync(db, path); err != nil {
+    fd.Close()
+    return nil, err
+  }
+  return fd, nil
+}
+
+func fileRename(db *KV, oldpath string, newpath string) error {
+  if err := os.Rename(oldpath, newpath); err != nil {
+    return err
+  }
+  return dirSync(db, newpath)
+}
+
+// sync the directory of a new or renamed file
+func dirSync(db *KV, path string) error {
+  switch db.Options.DirSync {
+  case DIRSYNC_OFF:
+    return nil
+  case DIRSYNC_BACKGROUND:
+    db.dirs.wg.Add(1)
+    go func() {
+      defer db.dirs.wg.Done()
+      if err := syncDir(path); err != nil {
+        db.dirs.mu.Lock()
+        db.dirs.err = errors.Join(db.dirs.err, err)
+        db.dirs.mu.Unlock()
+      }
+    }()
+    return nil
+  }
+  return syncDir(path)
+}
+
+// wait for the background syncs, the error is reported once
+func dirSyncWait(db *KV) error {
+  db.dirs.wg.Wait()
+  db.dirs.mu.Lock()
+  defer db.dirs.mu.Unlock()
+  err := db.dirs.err
+  db.dirs.err = nil
+  return err
+}
+
+// fsync the directory of the path after creating or renaming the file
+func syncDir(path string) error {
+  dir, err := os.Open(filepath.Dir(path))
+  if err != nil {
+    return fmt.Errorf("open dir: %w", err)
+  }
+  defer dir.Close()
+  if err := dir.Sync(); err != nil {
+    return fmt.Errorf("fsync dir: %w", err)
+  }
+  return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+)
+
+// rows from one or more range queries on a table, in the order of the
+// ranges. the ranges can be on different indexes, rows are fetched from
+// the table and a row in several ranges is only returned by the first
+// one. the position can be saved as a token to resume later, e.g. for
+// pagination.
+type Cursor struct {
+  tx     *DBTX
+  tdef   *TableDef
+  ranges []*Scanner
+  cur    int    // the current range
+  row    Record // the current row
+}
+
+// start the range queries, or resume after the row of a token.
+// the token must come from a cursor with the same ranges.
+func (tx *DBTX) Cursor(table string, token []byte, ranges ...*Scanner) (*Cursor, error) {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return nil, errNoTable(table)
+  }
+  if len(ranges) == 0 {
+    return nil, errors.New("no ranges")
+  }
+  for _, sc := range ranges {
+    if err := dbScan(tx, tdef, sc); err != nil {
+      return nil, err
+    }
+  }
+  c := &Cursor{tx: tx, tdef: tdef, ranges: ranges}
+  if token != nil {
+    // | range 2B | index key |
+    if len(token) < 2 || int(binary.BigEndian.Uint16(token)) >= len(ranges) {
+      return nil, errors.New("bad cursor token")
+    }
+    c.cur = int(binary.BigEndian.Uint16(token))
+    sc, key := ranges[c.cur], token[2:]
+    if !sc.contains(key) {
+      return nil, errors.New("bad cursor token")
+    }
+    if sc.Cmp1 > 0 {
+      sc.iter = tx.kv.Seek(key, CMP_GT)
+    } else {
+      sc.iter = tx.kv.Seek(key, CMP_LT)
+    }
+    sc.skipDeleted()
+  }
+  return c, c.settle()
+}
+
+func (c *Cursor) Valid() bool {
+  return c.cur < len(c.ranges)
+}
+
+func (c *Cursor) Next() error {
+  assert(c.Valid())
+  c.ranges[c.cur].Next()
+  return c.settle()
+}
+
+// the current row
+func (c *Cursor) Deref(rec *Record) {
+  assert(c.Valid())
+  rec.Cols = c.row.Cols
+  rec.Vals = append([]Value(nil), c.row.Vals...)
+}
+
+// the position of the current row, a cursor created with it resumes
+// after the row.
+func (c *Cursor) Token() []byte {
+  assert(c.Valid())
+  key := c.ranges[c.cur].iter.Key()
+  token := make([]byte, 2, 2 + len(key))
+  binary.BigEndian.PutUint16(token, uint16(c.cur))
+  return append(token, key...)
+}
+
+// move to the next row that isn't in an earlier range
+func (c *Cursor) settle() error {
+  for ; c.cur < len(c.ranges); c.cur++ {
+    sc := c.ranges[c.cur]
+    for ; sc.Valid(); sc.Next() {
+      c.row = Record{}
+      if err := sc.Deref(&c.row); err != nil {
+        return err
+      }
+      if !c.seen(c.row) {
+        return nil
+      }
+    }
+  }
+  return nil
+}
+
+// checked against the bounds of the ranges instead of remembering the
+// rows, so a resumed cursor agrees with the original one.
+func (c *Cursor) seen(row Record) bool {
+  for _, sc := range c.ranges[:c.cur] {
+    if sc.contains(sc.rowKey(row)) {
+      return true
+    }
+  }
+  return false
+}
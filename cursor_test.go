@@ -0,0 +1,91 @@
+package main
+
+import (
+  "fmt"
+  "testing"
+)
+
+// the rows of the ranges in order, without the repeated ones, and the
+// same rows after a resume from each token
+func TestCursor(t *testing.T) {
+  db := &DB{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  tx := DBTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  tdef := &TableDef{
+    Name: "t", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "v"},
+    PKeys: 1, Indexes: [][]string{{"v"}},
+  }
+  if err := tx.TableNew(tdef); err != nil {
+    t.Fatal(err)
+  }
+  for i, v := range []string{"a", "b", "c", "d", "e", "f"} {
+    if _, err := tx.Insert("t", *(&Record{}).AddInt64("id", int64(i + 1)).AddStr("v", []byte(v))); err != nil {
+      t.Fatal(err)
+    }
+  }
+  ids := func(lo, hi int64) *Scanner {
+    return &Scanner{
+      Cmp1: CMP_GE, Cmp2: CMP_LE,
+      Key1: *(&Record{}).AddInt64("id", lo), Key2: *(&Record{}).AddInt64("id", hi),
+    }
+  }
+  vals := func(cmp1 int, lo string, cmp2 int, hi string) *Scanner {
+    return &Scanner{
+      Cmp1: cmp1, Cmp2: cmp2,
+      Key1: *(&Record{}).AddStr("v", []byte(lo)), Key2: *(&Record{}).AddStr("v", []byte(hi)),
+    }
+  }
+  cases := []struct {
+    ranges func() []*Scanner
+    want   []int64
+  }{
+    {func() []*Scanner { return []*Scanner{ids(2, 4)} }, []int64{2, 3, 4}},
+    {func() []*Scanner { return []*Scanner{ids(2, 4), vals(CMP_GE, "c", CMP_LE, "f")} }, []int64{2, 3, 4, 5, 6}},
+    {func() []*Scanner { return []*Scanner{vals(CMP_LE, "e", CMP_GE, "b"), ids(1, 6)} }, []int64{5, 4, 3, 2, 1, 6}},
+    {func() []*Scanner { return []*Scanner{ids(1, 6), vals(CMP_GT, "a", CMP_LT, "f")} }, []int64{1, 2, 3, 4, 5, 6}},
+    {func() []*Scanner { return []*Scanner{ids(7, 9), vals(CMP_GT, "x", CMP_LT, "z")} }, nil},
+  }
+  // the ids from the cursor, and the tokens of the rows
+  rows := func(token []byte, ranges []*Scanner) ([]int64, [][]byte) {
+    t.Helper()
+    c, err := tx.Cursor("t", token, ranges...)
+    if err != nil {
+      t.Fatal(err)
+    }
+    var got []int64
+    var tokens [][]byte
+    for c.Valid() {
+      rec := Record{}
+      c.Deref(&rec)
+      got = append(got, rec.Get("id").I64)
+      tokens = append(tokens, c.Token())
+      if err := c.Next(); err != nil {
+        t.Fatal(err)
+      }
+    }
+    return got, tokens
+  }
+  for i, tc := range cases {
+    got, tokens := rows(nil, tc.ranges())
+    if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+      t.Fatalf("case %d: %v, want %v", i, got, tc.want)
+    }
+    for j, token := range tokens {
+      if rest, _ := rows(token, tc.ranges()); fmt.Sprint(rest) != fmt.Sprint(tc.want[j+1:]) {
+        t.Fatalf("case %d: resumed after %d: %v", i, tc.want[j], rest)
+      }
+    }
+  }
+  // a token of other ranges
+  if _, err := tx.Cursor("t", []byte{0, 5}, ids(1, 6)); err == nil {
+    t.Fatal("bad token")
+  }
+  if _, err := tx.Cursor("t", []byte{0, 0, 1}, ids(1, 6)); err == nil {
+    t.Fatal("bad token")
+  }
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// `database demo`: a new database in a temporary directory with a small
+// library of sample tables, then the REPL with some statements to try.
+// the directory is removed on exit.
+
+var DEMO_SCHEMA = []string{
+  "CREATE TABLE authors (id int64 AUTO_INCREMENT, name bytes, country bytes, PRIMARY KEY (id), UNIQUE (name))",
+  "CREATE TABLE books (id int64, author int64, title bytes, year int64, pages int64, PRIMARY KEY (id), INDEX (author), INDEX (year))",
+  `INSERT INTO authors (name, country) VALUES
+    ('Ursula K. Le Guin', 'US'), ('Stanislaw Lem', 'PL'), ('Italo Calvino', 'IT'),
+    ('Octavia E. Butler', 'US'), ('Jorge Luis Borges', 'AR'), ('Ted Chiang', 'US')`,
+  `INSERT INTO books (id, author, title, year, pages) VALUES
+    (1, 1, 'A Wizard of Earthsea', 1968, 183), (2, 1, 'The Left Hand of Darkness', 1969, 286),
+    (3, 1, 'The Dispossessed', 1974, 387), (4, 2, 'Solaris', 1961, 204),
+    (5, 2, 'The Cyberiad', 1965, 295), (6, 2, 'His Master''s Voice', 1968, 199),
+    (7, 3, 'Invisible Cities', 1972, 165), (8, 3, 'If on a winter''s night a traveler', 1979, 260),
+    (9, 4, 'Kindred', 1979, 264), (10, 4, 'Parable of the Sower', 1993, 345),
+    (11, 5, 'Ficciones', 1944, 174), (12, 5, 'The Aleph', 1949, 146),
+    (13, 6, 'Stories of Your Life and Others', 2002, 281), (14, 6, 'Exhalation', 2019, 350)`,
+}
+
+var DEMO_QUERIES = []string{
+  "SELECT id, name FROM authors WHERE country = 'US';",
+  "SELECT title, year FROM books WHERE author = 2;",
+  "SELECT title, year FROM books WHERE year >= 1970 AND year < 1980;",
+  "EXPLAIN SELECT title FROM books WHERE year = 1968;",
+  "UPDATE books SET pages = pages + 1 WHERE id = 4;",
+  "BEGIN; DELETE FROM books WHERE author = 6; ABORT;",
+  "INSERT INTO authors (name, country) VALUES ('Kurt Vonnegut', 'US');",
+  "ALTER TABLE books ADD INDEX (title);",
+  "set greeting hello, world",
+  "get greeting",
+}
+
+func demo(in io.Reader, out io.Writer, interactive bool) error {
+  dir, err := os.MkdirTemp("", "database-demo-")
+  if err != nil {
+    return err
+  }
+  defer os.RemoveAll(dir)
+  db := DB{Path: filepath.Join(dir, "demo.db")}
+  if err := db.Open(); err != nil {
+    return err
+  }
+  defer db.Close()
+  s := &QLSession{DB: &db}
+  for _, stmt := range DEMO_SCHEMA {
+    if _, err := s.Exec(stmt); err != nil {
+      return fmt.Errorf("demo: %w", err)
+    }
+  }
+  fmt.Fprintf(out, "a demo database in %s, removed on exit.\n", db.Path)
+  fmt.Fprintln(out, "the tables are authors and books. some statements to try:")
+  for _, query := range DEMO_QUERIES {
+    fmt.Fprintln(out, "  " + query)
+  }
+  fmt.Fprintln(out, strings.TrimSpace(`
+the statements end with a semicolon, see ql.go for the syntax.
+get, set, del and scan work on the raw keys. exit to quit.`))
+  repl(s, in, out, interactive)
+  return nil
+}
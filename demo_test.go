@@ -0,0 +1,49 @@
+package main
+
+import (
+  "os"
+  "strings"
+  "testing"
+)
+
+// the sample data answers the suggested statements
+func TestDemo(t *testing.T) {
+  cases := []struct {
+    in   string
+    want []string // in the output, in order
+  }{
+    {"", []string{"the tables are authors and books", "  " + DEMO_QUERIES[0]}},
+    {DEMO_QUERIES[0], []string{"1  | Ursula K. Le Guin", "4  | Octavia E. Butler", "6  | Ted Chiang", "(3 row(s))"}},
+    {DEMO_QUERIES[1], []string{"Solaris", "The Cyberiad", "His Master's Voice", "(3 row(s))"}},
+    {DEMO_QUERIES[2], []string{"Invisible Cities", "The Dispossessed", "If on a winter's night a traveler", "Kindred", "(4 row(s))"}},
+    {DEMO_QUERIES[3], []string{"scan: index (year, id), range year = 1968"}},
+    {DEMO_QUERIES[4] + "\nSELECT pages FROM books WHERE id = 4;", []string{"1 row(s) affected", "205"}},
+    {DEMO_QUERIES[5] + "\nSELECT id FROM books WHERE author = 6;", []string{"2 row(s) affected", "ok", "13", "14"}},
+    {DEMO_QUERIES[6], []string{"1 row(s) affected, last insert id 7"}},
+    {DEMO_QUERIES[7] + "\nSELECT author FROM books WHERE title = 'Kindred';", []string{"ok", "4"}},
+    {DEMO_QUERIES[8] + "\n" + DEMO_QUERIES[9], []string{"greeting | hello, world"}},
+  }
+  for i, c := range cases {
+    var out strings.Builder
+    if err := demo(strings.NewReader(c.in), &out, false); err != nil {
+      t.Fatal(err)
+    }
+    text := out.String()
+    if strings.Contains(text, "error:") {
+      t.Fatalf("case %d: %s", i, text)
+    }
+    rest := text
+    for _, want := range c.want {
+      j := strings.Index(rest, want)
+      if j < 0 {
+        t.Fatalf("case %d: no %q in\n%s", i, want, text)
+      }
+      rest = rest[j+len(want):]
+    }
+    // the directory is removed on exit
+    path, _, _ := strings.Cut(strings.TrimPrefix(text, "a demo database in "), ", removed on exit")
+    if _, err := os.Stat(path); !os.IsNotExist(err) {
+      t.Fatalf("case %d: %s: %v", i, path, err)
+    }
+  }
+}
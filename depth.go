@@ -0,0 +1,45 @@
+package main
+
+import (
+  "fmt"
+  "math/bits"
+)
+
+// a path from the root deeper than the tree can be, e.g. a pointer cycle
+// in a corrupted file. like ErrChecksum, the tree can't continue with it,
+// so this is a panic.
+type ErrCorruptTree struct {
+  Path []uint64 // the pages from the root
+}
+
+func (e *ErrCorruptTree) Error() string {
+  return fmt.Sprintf("corrupt tree: path of %d pages is too deep: %v", len(e.Path), e.Path)
+}
+
+// the depth limit of a tree of `npages` pages, see Options.MaxDepth.
+// a node has 2 kids or more except when a deletion leaves it with 1 and
+// it can't be merged, so the height is about log2(npages) at most.
+func maxDepth(opts *Options, npages uint64) int {
+  if opts.MaxDepth > 0 {
+    return opts.MaxDepth
+  }
+  return 2 * bits.Len64(npages) + 2
+}
+
+// the path is one page deeper, 0 for no limit
+func checkDepth(path []uint64, limit int) {
+  if limit > 0 && len(path) > limit {
+    panic(&ErrCorruptTree{Path: append([]uint64(nil), path...)})
+  }
+}
+
+// walking down during an update. the updates of a tree are serialized,
+// so the path is kept in the tree.
+func (tree *BTree) enter(ptr uint64) {
+  tree.walk = append(tree.walk, ptr)
+  checkDepth(tree.walk, tree.maxDepth)
+}
+
+func (tree *BTree) leave() {
+  tree.walk = tree.walk[:len(tree.walk)-1]
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+  "bytes"
+)
+
+// an unvisited part of a tree version during a diff.
+type diffItem struct {
+  ptr   uint64 // a page to be expanded, 0 for a KV pair
+  level int    // height of the page, leaves are 0, KV pairs are -1
+  key   []byte
+  val   []byte
+}
+
+// enumerate the differences between 2 versions of the tree given by
+// their root pointers. fn gets oldVal == nil for added keys and
+// newVal == nil for deleted keys. since the tree is copy-on-write,
+// subtrees shared by both versions have the same page number and are
+// skipped without being read. the expired keys are left out of both.
+func (tree *BTree) Diff(a uint64, b uint64, fn func(key []byte, oldVal []byte, newVal []byte)) {
+  ta, tb := *tree, *tree
+  ta.root, tb.root = a, b
+  diffTrees(&ta, &tb, fn)
+}
+
+// the differences between the snapshot of `old` and the snapshot of tx,
+// see BTree.Diff. the pending updates of tx are not included. the keys
+// and the values are only valid in fn.
+func (tx *KVTX) Diff(old *KVTX, fn func(key []byte, oldVal []byte, newVal []byte)) {
+  assert(old.db == tx.db && !old.done && !tx.done)
+  diffTrees(old.view(), tx.view(), fn)
+}
+
+// the differences between the snapshot of `old` and the latest version
+func (db *KV) Diff(old *KVTX, fn func(key []byte, oldVal []byte, newVal []byte)) {
+  assert(old.db == db && !old.done)
+  tree, release := db.snapshot()
+  defer release()
+  diffTrees(old.view(), &tree, fn)
+}
+
+// the trees of the same file share the pages with the same number, the
+// ones from either side of a Compact share none and are compared in full
+func diffTrees(ta *BTree, tb *BTree, fn func(key []byte, oldVal []byte, newVal []byte)) {
+  shared := ta.file == tb.file
+  now := ta.now()
+  sa := diffStack(ta, ta.root)
+  sb := diffStack(tb, tb.root)
+  for len(sa) > 0 || len(sb) > 0 {
+    var x, y *diffItem
+    if len(sa) > 0 {
+      x = &sa[len(sa)-1]
+    }
+    if len(sb) > 0 {
+      y = &sb[len(sb)-1]
+    }
+    // a shared subtree
+    if shared && x != nil && y != nil && x.ptr != 0 && x.ptr == y.ptr {
+      sa, sb = sa[:len(sa)-1], sb[:len(sb)-1]
+      continue
+    }
+    // expand the taller page first so that shared pages line up
+    if x != nil && x.ptr != 0 && (y == nil || x.level >= y.level) {
+      sa = diffExpand(ta, sa, now)
+      continue
+    }
+    if y != nil && y.ptr != 0 {
+      sb = diffExpand(tb, sb, now)
+      continue
+    }
+    // KV pairs, merged in key order
+    cmp := 0
+    switch {
+    case x == nil:
+      cmp = +1
+    case y == nil:
+      cmp = -1
+    default:
+      cmp = bytes.Compare(x.key, y.key)
+    }
+    switch {
+    case cmp < 0:
+      fn(x.key, x.val, nil)
+      sa = sa[:len(sa)-1]
+    case cmp > 0:
+      fn(y.key, nil, y.val)
+      sb = sb[:len(sb)-1]
+    default:
+      if !bytes.Equal(x.val, y.val) {
+        fn(x.key, x.val, y.val)
+      }
+      sa, sb = sa[:len(sa)-1], sb[:len(sb)-1]
+    }
+  }
+}
+
+// the initial stack for a root pointer.
+func diffStack(tree *BTree, root uint64) []diffItem {
+  if root == 0 {
+    return nil
+  }
+  level := 0
+  for node := BNode(tree.get(root)); node.btype() == BNODE_NODE; level++ {
+    node = tree.get(node.getPtr(0))
+  }
+  return []diffItem{{ptr: root, level: level}}
+}
+
+// replace the page on top of the stack with its content, without the
+// keys expired at `now`.
+// the stack top is the smallest key, so kids are pushed in reverse.
+func diffExpand(tree *BTree, stack []diffItem, now int64) []diffItem {
+  item := stack[len(stack)-1]
+  stack = stack[:len(stack)-1]
+  node := BNode(tree.get(item.ptr))
+  assertNode(node)
+  for i := node.nkeys(); i > 0; i-- {
+    switch node.btype() {
+    case BNODE_LEAF:
+      key := node.getKey(i - 1)
+      if len(key) == 0 || node.expired(i - 1, now) {
+        continue // the sentinel or an expired key
+      }
+      stack = append(stack, diffItem{level: -1, key: key, val: treeVal(tree, node, i - 1)})
+    case BNODE_NODE:
+      stack = append(stack, diffItem{ptr: node.getPtr(i - 1), level: item.level - 1})
+    default:
+      panic("bad node!")
+    }
+  }
+  return stack
+}
+
+// page usage of an older tree version relative to the live tree.
+type PageSharing struct {
+  Root   uint64
+  Shared int // pages also reachable from the live root
+  Unique int // pages that only this version keeps alive
+}
+
+// report the actual disk cost of keeping older tree versions around.
+// pages unique to a version may still be shared with other old versions.
+// overflow pages of large values are not counted.
+func (tree *BTree) Sharing(roots ...uint64) []PageSharing {
+  versions := []BTree{}
+  for _, root := range roots {
+    version := *tree
+    version.root = root
+    versions = append(versions, version)
+  }
+  return treeSharing(tree, versions)
+}
+
+// the pages of the snapshots of the transactions relative to the latest
+// version, see BTree.Sharing
+func (db *KV) Sharing(txs ...*KVTX) []PageSharing {
+  versions := []BTree{}
+  for _, tx := range txs {
+    assert(tx.db == db && !tx.done)
+    versions = append(versions, *tx.view())
+  }
+  live, release := db.snapshot()
+  defer release()
+  return treeSharing(&live, versions)
+}
+
+func treeSharing(live *BTree, versions []BTree) []PageSharing {
+  sizes := map[uint64]int{} // page -> number of pages in its subtree
+  if live.root != 0 {
+    countPages(live, live.root, sizes)
+  }
+  out := []PageSharing{}
+  for i := range versions {
+    version := &versions[i]
+    s := PageSharing{Root: version.root}
+    switch {
+    case version.root == 0:
+    case version.file != live.file:
+      // a version before a Compact is in the old file
+      s.Unique = countPages(version, version.root, map[uint64]int{})
+    default:
+      sharingWalk(version, version.root, sizes, &s)
+    }
+    out = append(out, s)
+  }
+  return out
+}
+
+func countPages(tree *BTree, ptr uint64, sizes map[uint64]int) int {
+  node := BNode(tree.get(ptr))
+  n := 1
+  if node.btype() == BNODE_NODE {
+    for i := uint16(0); i < node.nkeys(); i++ {
+      n += countPages(tree, node.getPtr(i), sizes)
+    }
+  }
+  sizes[ptr] = n
+  return n
+}
+
+// a shared page means the whole subtree is shared.
+func sharingWalk(tree *BTree, ptr uint64, live map[uint64]int, s *PageSharing) {
+  if n, ok := live[ptr]; ok {
+    s.Shared += n
+    return
+  }
+  s.Unique++
+  node := BNode(tree.get(ptr))
+  if node.btype() == BNODE_NODE {
+    for i := uint16(0); i < node.nkeys(); i++ {
+      sharingWalk(tree, node.getPtr(i), live, s)
+    }
+  }
+}
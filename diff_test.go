@@ -0,0 +1,176 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "math/rand"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+type diffChange struct {
+  key, old, new string
+}
+
+// the differences by reading both snapshots in full
+func diffScan(old *KVTX, new *KVTX) []diffChange {
+  read := func(tx *KVTX) map[string]string {
+    kvs := map[string]string{}
+    for it := tx.Seek(nil, CMP_GT); it.Valid(); it.Next() {
+      kvs[string(it.Key())] = string(it.Val())
+    }
+    return kvs
+  }
+  a, b := read(old), read(new)
+  var out []diffChange
+  for k, v := range a {
+    if w, ok := b[k]; !ok {
+      out = append(out, diffChange{k, v, ""})
+    } else if v != w {
+      out = append(out, diffChange{k, v, w})
+    }
+  }
+  for k, w := range b {
+    if _, ok := a[k]; !ok {
+      out = append(out, diffChange{k, "", w})
+    }
+  }
+  return out
+}
+
+func diffCheck(t *testing.T, old *KVTX, new *KVTX) {
+  t.Helper()
+  want := map[string]diffChange{}
+  for _, c := range diffScan(old, new) {
+    want[c.key] = c
+  }
+  var last []byte
+  n := 0
+  new.Diff(old, func(key []byte, oldVal []byte, newVal []byte) {
+    if last != nil && bytes.Compare(last, key) >= 0 {
+      t.Fatalf("%q after %q", key, last)
+    }
+    last = append(last[:0], key...)
+    got := diffChange{string(key), string(oldVal), string(newVal)}
+    if got != want[got.key] {
+      t.Fatalf("%q: %d/%d bytes, want %d/%d", key, len(oldVal), len(newVal), len(want[got.key].old), len(want[got.key].new))
+    }
+    n++
+  })
+  if n != len(want) {
+    t.Fatalf("%d differences, want %d", n, len(want))
+  }
+}
+
+func TestDiff(t *testing.T) {
+  rng := rand.New(rand.NewSource(1))
+  clock := NewManualClock(time.Unix(1000, 0))
+  db := &KV{Path: filepath.Join(t.TempDir(), "db"), Options: Options{Clock: clock}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  val := func() []byte {
+    size := rng.Intn(100)
+    if rng.Intn(10) == 0 {
+      size = BTREE_MAX_VAL_SIZE + rng.Intn(3 * BTREE_PAGE_SIZE) // overflow pages
+    }
+    v := make([]byte, size)
+    rng.Read(v)
+    return v
+  }
+  update := func(n int) {
+    tx := KVTX{}
+    db.Begin(&tx)
+    for i := 0; i < n; i++ {
+      key := []byte(fmt.Sprintf("k%04d", rng.Intn(2000)))
+      switch rng.Intn(10) {
+      case 0, 1:
+        tx.Del(key)
+      case 2:
+        tx.SetWithTTL(key, val(), time.Duration(1 + rng.Intn(100)) * time.Second)
+      default:
+        tx.Set(key, val())
+      }
+    }
+    if err := db.Commit(&tx); err != nil {
+      t.Fatal(err)
+    }
+  }
+  update(3000)
+  for round := 0; round < 20; round++ {
+    old := KVTX{}
+    db.Begin(&old)
+    for i := rng.Intn(4); i > 0; i-- {
+      update(1 + rng.Intn(50))
+    }
+    clock.Advance(time.Duration(rng.Intn(20)) * time.Second)
+    if round % 5 == 4 {
+      // the versions don't share pages across it
+      if err := db.Compact(nil); err != nil {
+        t.Fatal(err)
+      }
+    }
+    new := KVTX{}
+    db.Begin(&new)
+    diffCheck(t, &old, &new)
+    diffCheck(t, &new, &old)
+    // the same as the latest version
+    n := 0
+    db.Diff(&new, func(key []byte, oldVal []byte, newVal []byte) { n++ })
+    if n != 0 {
+      t.Fatalf("%d differences with the latest version", n)
+    }
+    db.Abort(&old)
+    db.Abort(&new)
+  }
+}
+
+func TestSharing(t *testing.T) {
+  db := &KV{Path: filepath.Join(t.TempDir(), "db")}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  tx := KVTX{}
+  db.Begin(&tx)
+  for i := 0; i < 5000; i++ {
+    tx.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 20))
+  }
+  if err := db.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+  old := KVTX{}
+  db.Begin(&old)
+  defer db.Abort(&old)
+  tree := db.latest()
+  total := countPages(&tree, tree.root, map[uint64]int{})
+  if s := db.Sharing(&old)[0]; s.Shared != total || s.Unique != 0 || s.Root != tree.root {
+    t.Fatalf("%+v of %d pages", s, total)
+  }
+  // the path to the updated leaf is copied, the size of the KV is the same
+  db.Set([]byte("k02500"), make([]byte, 20))
+  height := treeHeight(&tree)
+  if s := db.Sharing(&old)[0]; s.Shared != total - height || s.Unique != height {
+    t.Fatalf("%+v, height %d of %d pages", s, height, total)
+  }
+  // and the path to another leaf, with the root in common
+  db.Set([]byte("k00000"), make([]byte, 20))
+  if s := db.Sharing(&old)[0]; s.Shared != total - (2 * height - 1) || s.Unique != 2 * height - 1 {
+    t.Fatalf("%+v, height %d of %d pages", s, height, total)
+  }
+  latest := KVTX{}
+  db.Begin(&latest)
+  defer db.Abort(&latest)
+  if s := db.Sharing(&latest)[0]; s.Unique != 0 {
+    t.Fatalf("%+v", s)
+  }
+  // nothing is shared with the compacted file
+  if err := db.Compact(nil); err != nil {
+    t.Fatal(err)
+  }
+  if s := db.Sharing(&old)[0]; s.Shared != 0 || s.Unique != total {
+    t.Fatalf("%+v of %d pages", s, total)
+  }
+}
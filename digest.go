@@ -0,0 +1,61 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/binary"
+)
+
+// a SHA-256 digest of all KV pairs in the range lo <= key < hi
+// (a nil hi means no upper bound), plus the number of pairs.
+// two trees with the same content in the range have the same digest
+// regardless of their node layout.
+func (tree *BTree) DigestRange(lo []byte, hi []byte) ([32]byte, int) {
+  return digestRange(tree.Seek(lo, CMP_GE), hi)
+}
+
+// the digest of the range in the latest version, e.g. to compare a range
+// of 2 replicas
+func (db *KV) DigestRange(lo []byte, hi []byte) ([32]byte, int) {
+  tree, release := db.snapshot()
+  defer release()
+  return tree.DigestRange(lo, hi)
+}
+
+// the digest of the range as read by the transaction, with its updates
+func (tx *KVTX) DigestRange(lo []byte, hi []byte) ([32]byte, int) {
+  return digestRange(tx.Seek(lo, CMP_GE), hi)
+}
+
+// the digest of the rows of a table as stored, and the number of rows.
+// the rows of an encrypted table differ by the nonces, so do their digests.
+func (tx *DBTX) DigestTable(table string) ([32]byte, int, error) {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return [32]byte{}, 0, errNoTable(table)
+  }
+  sum, count := tx.kv.DigestRange(encodeKey(nil, tdef.Prefix, nil), encodeKey(nil, tdef.Prefix + 1, nil))
+  return sum, count, nil
+}
+
+func digestRange(iter KVIter, hi []byte) ([32]byte, int) {
+  h := sha256.New()
+  count := 0
+  for ; iter.Valid(); iter.Next() {
+    key, val := iter.Key(), iter.Val()
+    if hi != nil && bytes.Compare(key, hi) >= 0 {
+      break
+    }
+    // length-prefixed so that different splits of the same bytes differ
+    var sizes [8]byte
+    binary.LittleEndian.PutUint32(sizes[0:4], uint32(len(key)))
+    binary.LittleEndian.PutUint32(sizes[4:8], uint32(len(val)))
+    h.Write(sizes[:])
+    h.Write(key)
+    h.Write(val)
+    count++
+  }
+  var sum [32]byte
+  copy(sum[:], h.Sum(nil))
+  return sum, count
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+  "fmt"
+  "math/rand"
+  "testing"
+)
+
+func TestDigestRange(t *testing.T) {
+  kvs := map[string][]byte{}
+  for i := 0; i < 3000; i++ {
+    kvs[fmt.Sprintf("k%05d", i)] = []byte(fmt.Sprint(i * i))
+  }
+  // in order in one commit, or at random with other keys that are deleted
+  a := &KV{Options: Options{InMemory: true}}
+  b := &KV{Options: Options{InMemory: true, PageSize: 8192}}
+  for _, db := range []*KV{a, b} {
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    defer db.Close()
+  }
+  tx := KVTX{}
+  a.Begin(&tx)
+  for i := 0; i < 3000; i++ {
+    key := fmt.Sprintf("k%05d", i)
+    tx.Set([]byte(key), kvs[key])
+  }
+  if err := a.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+  rng := rand.New(rand.NewSource(1))
+  for _, i := range rng.Perm(3000) {
+    key := fmt.Sprintf("k%05d", i)
+    b.Set([]byte(key), kvs[key])
+    b.Set([]byte(key + "x"), make([]byte, 100))
+  }
+  for i := 0; i < 3000; i++ {
+    b.Del([]byte(fmt.Sprintf("k%05dx", i)))
+  }
+  ta, tb := a.latest(), b.latest()
+  na := countPages(&ta, ta.root, map[uint64]int{})
+  nb := countPages(&tb, tb.root, map[uint64]int{})
+  if na == nb {
+    t.Fatal("the same shape", na)
+  }
+  for _, r := range [][2]string{{"", ""}, {"k01000", "k02000"}, {"k00500", ""}, {"j", "k"}} {
+    lo, hi := []byte(r[0]), []byte(r[1])
+    if r[1] == "" {
+      hi = nil
+    }
+    sa, ca := a.DigestRange(lo, hi)
+    sb, cb := b.DigestRange(lo, hi)
+    if sa != sb || ca != cb {
+      t.Fatalf("%q: %d and %d keys, the digests differ", r, ca, cb)
+    }
+  }
+  if _, n := a.DigestRange(nil, nil); n != 3000 {
+    t.Fatal(n)
+  }
+  if _, n := a.DigestRange([]byte("k01000"), []byte("k02000")); n != 1000 {
+    t.Fatal(n)
+  }
+  all, _ := a.DigestRange(nil, nil)
+  // a byte of a value
+  b.Set([]byte("k01234"), []byte(fmt.Sprint(1235 * 1234)))
+  if sum, _ := b.DigestRange(nil, nil); sum == all {
+    t.Fatal("a value changed, the same digest")
+  }
+  b.Set([]byte("k01234"), kvs["k01234"])
+  if sum, _ := b.DigestRange(nil, nil); sum != all {
+    t.Fatal("changed back, a different digest")
+  }
+  // the boundary between a key and its value
+  a.Set([]byte("m1"), []byte("23"))
+  b.Set([]byte("m12"), []byte("3"))
+  sa, _ := a.DigestRange([]byte("m"), nil)
+  sb, _ := b.DigestRange([]byte("m"), nil)
+  if sa == sb {
+    t.Fatal("the same digest for a different key boundary")
+  }
+  // a transaction with its updates, like the version after its commit
+  a.Begin(&tx)
+  tx.Del([]byte("m1"))
+  tx.Set([]byte("m12"), []byte("3"))
+  st, ct := tx.DigestRange([]byte("m"), nil)
+  if err := a.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+  sa, ca := a.DigestRange([]byte("m"), nil)
+  if st != sa || ct != ca || sa != sb {
+    t.Fatal("the digest of the transaction differs")
+  }
+}
+
+func TestDigestTable(t *testing.T) {
+  var sums [2][32]byte
+  for i := range sums {
+    db := &DB{Options: Options{InMemory: true}}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    defer db.Close()
+    tx := DBTX{}
+    db.Begin(&tx)
+    for _, name := range []string{"t", "u"} {
+      tdef := &TableDef{Name: name, Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "v"}, PKeys: 1, Indexes: [][]string{{"v"}}}
+      if err := tx.TableNew(tdef); err != nil {
+        t.Fatal(err)
+      }
+    }
+    for j := int64(0); j < 100; j++ {
+      tx.Insert("t", *(&Record{}).AddInt64("id", j).AddStr("v", []byte("x")))
+      // only in the other table
+      tx.Insert("u", *(&Record{}).AddInt64("id", j + int64(i)).AddStr("v", []byte("x")))
+    }
+    sum, n, err := tx.DigestTable("t")
+    if err != nil || n != 100 {
+      t.Fatal(n, err)
+    }
+    sums[i] = sum
+    if _, _, err := tx.DigestTable("none"); err == nil {
+      t.Fatal("no table")
+    }
+    db.Abort(&tx)
+  }
+  if sums[0] != sums[1] {
+    t.Fatal("the same rows, different digests")
+  }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "fmt"
+  "io"
+)
+
+// render the tree as a Graphviz graph, e.g. `dot -Tsvg`. a node shows its
+// page number, its keys and how full it is, darker is fuller.
+// at most `maxNodes` nodes are drawn, 0 for no limit, in breadth-first
+// order; the subtrees left out are drawn as "...".
+func (tree *BTree) DumpDOT(w io.Writer, maxNodes int) error {
+  return tree.DumpDOTRange(w, maxNodes, nil, nil)
+}
+
+// like DumpDOT, only the nodes that may contain keys in [lo, hi).
+// a nil hi means no upper bound.
+func (tree *BTree) DumpDOTRange(w io.Writer, maxNodes int, lo []byte, hi []byte) error {
+  out := bufio.NewWriter(w)
+  fmt.Fprintln(out, "digraph btree {")
+  fmt.Fprintln(out, "  node [shape=box, style=filled, colorscheme=blues9, fontname=monospace];")
+  type item struct {
+    ptr    uint64
+    parent uint64 // 0 for the root
+  }
+  queue := []item{}
+  if tree.root != 0 {
+    queue = append(queue, item{ptr: tree.root})
+  }
+  drawn := 0
+  var parents []uint64     // of the nodes left out, in order
+  left := map[uint64]int{} // the nodes left out by parent
+  for ; len(queue) > 0; queue = queue[1:] {
+    it := queue[0]
+    if maxNodes > 0 && drawn >= maxNodes {
+      if left[it.parent] == 0 {
+        parents = append(parents, it.parent)
+      }
+      left[it.parent]++
+      continue
+    }
+    drawn++
+    node := BNode(tree.get(it.ptr))
+    fill := float64(node.nbytes()) / float64(tree.pageSize())
+    kind := "leaf"
+    if node.btype() == BNODE_NODE {
+      kind = "internal"
+    }
+    fmt.Fprintf(out, "  p%d [label=\"page %d, %s, %.0f%% full\\n%s\", fillcolor=%d, fontcolor=%s];\n",
+      it.ptr, it.ptr, kind, fill * 100, dotKeys(node), 1 + int(min(fill, 1) * 8), dotFontColor(fill))
+    if it.parent != 0 {
+      fmt.Fprintf(out, "  p%d -> p%d;\n", it.parent, it.ptr)
+    }
+    if node.btype() != BNODE_NODE {
+      continue
+    }
+    for i := uint16(0); i < node.nkeys(); i++ {
+      // the kid covers [key i, key i+1)
+      if hi != nil && bytes.Compare(node.getKey(i), hi) >= 0 {
+        break
+      }
+      if i + 1 < node.nkeys() && bytes.Compare(node.getKey(i + 1), lo) <= 0 {
+        continue
+      }
+      queue = append(queue, item{ptr: node.getPtr(i), parent: it.ptr})
+    }
+  }
+  // a placeholder for the kids left out of each node
+  for _, parent := range parents {
+    fmt.Fprintf(out, "  more%d [label=\"... %d nodes\", style=dashed];\n", parent, left[parent])
+    fmt.Fprintf(out, "  p%d -> more%d;\n", parent, parent)
+  }
+  fmt.Fprintln(out, "}")
+  return out.Flush()
+}
+
+// the graph of the latest version
+func (db *KV) DumpDOT(w io.Writer, maxNodes int) error {
+  tree, release := db.snapshot()
+  defer release()
+  return tree.DumpDOT(w, maxNodes)
+}
+
+// the keys of a node, the middle ones are left out if there are many
+func dotKeys(node BNode) string {
+  const show = 6
+  nkeys := node.nkeys()
+  var buf bytes.Buffer
+  for i := uint16(0); i < nkeys; i++ {
+    if nkeys > show && i == show / 2 {
+      fmt.Fprintf(&buf, "... %d more ...\\l", nkeys - show)
+      i = nkeys - show / 2
+    }
+    buf.WriteString(dotKey(node.getKey(i)))
+    buf.WriteString("\\l") // left aligned
+  }
+  return buf.String()
+}
+
+// a key as printable text, escaped for a DOT string
+func dotKey(key []byte) string {
+  const maxLen = 24
+  if len(key) == 0 {
+    return "(sentinel)"
+  }
+  var buf bytes.Buffer
+  for i, c := range key {
+    if i == maxLen {
+      buf.WriteString("...")
+      break
+    }
+    switch {
+    case c == '"' || c == '\\':
+      buf.WriteString("\\" + string(c))
+    case 0x20 <= c && c < 0x7f:
+      buf.WriteByte(c)
+    default:
+      fmt.Fprintf(&buf, "\\\\x%02x", c)
+    }
+  }
+  return buf.String()
+}
+
+// readable on the darker fills
+func dotFontColor(fill float64) string {
+  if fill > 0.6 {
+    return "white"
+  }
+  return "black"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "strings"
+  "testing"
+)
+
+// the nodes drawn by the limit and the key range
+func TestDumpDOT(t *testing.T) {
+  db := &KV{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  tx := KVTX{}
+  db.Begin(&tx)
+  for k := 0; k < 2000; k++ {
+    tx.Set([]byte(fmt.Sprintf("k%04d", k)), make([]byte, 100))
+  }
+  if err := db.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+  db.SampleOccupancy()
+  levels := db.Occupancy()[0].Levels
+  if len(levels) != 2 {
+    t.Fatalf("%+v", levels)
+  }
+  leaves := int(levels[0].Nodes)
+  // the leaves from the one of k1000
+  root := BNode(db.tree.get(db.tree.root))
+  rest := leaves - int(nodeLookupLE(root, []byte("k1000")))
+  cases := []struct {
+    max    int
+    lo, hi string
+    nodes  int
+    more   int // the nodes left out
+  }{
+    {0, "", "", 1 + leaves, 0},
+    {5, "", "", 5, leaves - 4},
+    {1, "", "", 1, leaves},
+    {0, "k1000", "k1001", 2, 0},
+    {0, "k1000", "", 1 + rest, 0},
+    {0, "", "k0001", 2, 0},
+    {2, "k1000", "", 2, rest - 1},
+  }
+  for i, c := range cases {
+    var hi []byte
+    if c.hi != "" {
+      hi = []byte(c.hi)
+    }
+    tree, release := db.snapshot()
+    var out bytes.Buffer
+    err := tree.DumpDOTRange(&out, c.max, []byte(c.lo), hi)
+    release()
+    if err != nil {
+      t.Fatal(err)
+    }
+    dot := out.String()
+    nodes, edges := strings.Count(dot, `[label="page `), strings.Count(dot, " -> p")
+    more := 0
+    if _, s, ok := strings.Cut(dot, `[label="... `); ok {
+      fmt.Sscan(s, &more)
+    }
+    if nodes != c.nodes || edges != nodes - 1 {
+      t.Fatalf("case %d: %d nodes, %d edges\n%s", i, nodes, edges, dot)
+    }
+    if more != c.more {
+      t.Fatalf("case %d: %d more\n%s", i, more, dot)
+    }
+    if !strings.HasPrefix(dot, "digraph btree {\n") || !strings.HasSuffix(dot, "}\n") {
+      t.Fatalf("case %d: %s", i, dot)
+    }
+  }
+  for key, want := range map[string]string{
+    "": "(sentinel)", `a"b\`: `a\"b\\`, "\x00\xff": `\\x00\\xff`,
+    strings.Repeat("x", 30): strings.Repeat("x", 24) + "...",
+  } {
+    if got := dotKey([]byte(key)); got != want {
+      t.Fatalf("%q: %s", key, got)
+    }
+  }
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+  "database/sql"
+  "database/sql/driver"
+  "errors"
+  "io"
+  "sync"
+)
+
+// a database/sql driver over QLSession, registered as SQL_DRIVER. the
+// data source name is the path of the DB file, the connections to the
+// same path share the DB, which is closed with the last of them.
+// a connection is a session, each statement outside of a transaction is
+// committed on its own. there are no placeholders, the statements take
+// no arguments.
+const SQL_DRIVER = "database"
+
+func init() {
+  sql.Register(SQL_DRIVER, &sqlDriver{open: map[string]*sqlShared{}})
+}
+
+type sqlDriver struct {
+  mu   sync.Mutex
+  open map[string]*sqlShared
+}
+
+type sqlShared struct {
+  db   *DB
+  refs int
+}
+
+func (d *sqlDriver) Open(path string) (driver.Conn, error) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  shared := d.open[path]
+  if shared == nil {
+    db := &DB{Path: path}
+    if err := db.Open(); err != nil {
+      return nil, err
+    }
+    shared = &sqlShared{db: db}
+    d.open[path] = shared
+  }
+  shared.refs++
+  return &sqlConn{d: d, path: path, s: QLSession{DB: shared.db}}, nil
+}
+
+type sqlConn struct {
+  d    *sqlDriver
+  path string
+  s    QLSession
+}
+
+// the statement is parsed once, like a cached plan, see QLSession.prepare
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+  if _, err := c.s.prepare(query); err != nil {
+    return nil, err
+  }
+  return &sqlStmt{c: c, query: query}, nil
+}
+
+// an open transaction is aborted
+func (c *sqlConn) Close() error {
+  if c.s.InTx() {
+    c.s.DB.Abort(c.s.tx)
+    c.s.tx = nil
+  }
+  c.d.mu.Lock()
+  defer c.d.mu.Unlock()
+  shared := c.d.open[c.path]
+  if shared.refs--; shared.refs == 0 {
+    delete(c.d.open, c.path)
+    shared.db.Close()
+  }
+  return nil
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+  if _, err := c.s.Exec("BEGIN"); err != nil {
+    return nil, err
+  }
+  return &sqlTx{c: c}, nil
+}
+
+type sqlTx struct {
+  c *sqlConn
+}
+
+func (tx *sqlTx) Commit() error {
+  _, err := tx.c.s.Exec("COMMIT")
+  return err
+}
+
+// the transaction may be aborted already by a failed statement
+func (tx *sqlTx) Rollback() error {
+  if !tx.c.s.InTx() {
+    return nil
+  }
+  _, err := tx.c.s.Exec("ROLLBACK")
+  return err
+}
+
+type sqlStmt struct {
+  c     *sqlConn
+  query string
+}
+
+func (st *sqlStmt) Close() error {
+  return nil
+}
+
+// database/sql rejects the arguments
+func (st *sqlStmt) NumInput() int {
+  return 0
+}
+
+func (st *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+  res, err := st.c.s.Exec(st.query)
+  if err != nil {
+    return nil, err
+  }
+  return sqlResult{affected: int64(res.Affected), lastID: res.LastInsertID}, nil
+}
+
+func (st *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+  res, err := st.c.s.Exec(st.query)
+  if err != nil {
+    return nil, err
+  }
+  if res.Cols == nil {
+    return nil, errors.New("not a query")
+  }
+  return &sqlRows{res: res}, nil
+}
+
+type sqlResult struct {
+  affected int64
+  lastID   int64
+}
+
+func (r sqlResult) LastInsertId() (int64, error) {
+  return r.lastID, nil
+}
+
+func (r sqlResult) RowsAffected() (int64, error) {
+  return r.affected, nil
+}
+
+// the rows are read by the statement, the result is in memory
+type sqlRows struct {
+  res  *QLResult
+  next int
+}
+
+func (r *sqlRows) Columns() []string {
+  return r.res.Cols
+}
+
+func (r *sqlRows) Close() error {
+  return nil
+}
+
+// INT64 is an int64, BYTES is a []byte
+func (r *sqlRows) Next(dest []driver.Value) error {
+  if r.next >= len(r.res.Rows) {
+    return io.EOF
+  }
+  for i, v := range r.res.Rows[r.next] {
+    if v.Type == TYPE_INT64 {
+      dest[i] = v.I64
+    } else {
+      dest[i] = append([]byte(nil), v.Str...)
+    }
+  }
+  r.next++
+  return nil
+}
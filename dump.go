@@ -0,0 +1,167 @@
+package main
+
+import (
+  "bufio"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+)
+
+// the dump format is the sorted KV pairs, table schemas included since
+// they are stored as KV pairs too. it doesn't depend on the page format.
+// | sig 16B | klen 4B | vlen 4B | key | val | ... | 0 4B | count 8B |
+// the trailer tells a complete dump from a truncated one.
+// the high bit of klen marks an expiring key, the expiry time follows
+// vlen as 8 more bytes. the expired keys are not dumped.
+const DUMP_SIG = "BuildYourOwnDump"
+
+const DUMP_EXPIRES = uint32(1 << 31)
+
+// write a consistent snapshot of the store.
+// the progress is in leaf pages, `p` can be nil.
+func (db *KV) Dump(out io.Writer, p *Progress) error {
+  tx := KVTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  defer p.finish()
+  p.begin("pages", leafCount(&tx.snapshot))
+  w := bufio.NewWriter(out)
+  w.WriteString(DUMP_SIG)
+  count := uint64(0)
+  var head [16]byte
+  // no updates in the transaction, read the snapshot directly
+  for iter := tx.snapshot.Seek(nil, CMP_GT); iter.Valid(); iter.Next() {
+    key, val := iter.Key(), iter.Val()
+    binary.LittleEndian.PutUint32(head[0:], uint32(len(key)))
+    binary.LittleEndian.PutUint32(head[4:], uint32(len(val)))
+    if expires := iter.Expires(); expires != 0 {
+      binary.LittleEndian.PutUint32(head[0:], uint32(len(key)) | DUMP_EXPIRES)
+      binary.LittleEndian.PutUint64(head[8:], uint64(expires))
+      w.Write(head[:])
+    } else {
+      w.Write(head[:8])
+    }
+    w.Write(key)
+    if _, err := w.Write(val); err != nil {
+      return fmt.Errorf("dump: %w", err)
+    }
+    count++
+    if iter.leafEnd() {
+      p.add(1)
+    }
+  }
+  binary.LittleEndian.PutUint32(head[0:], 0)
+  w.Write(head[:4])
+  binary.LittleEndian.PutUint64(head[0:], count)
+  w.Write(head[:8])
+  if err := w.Flush(); err != nil {
+    return fmt.Errorf("dump: %w", err)
+  }
+  return nil
+}
+
+// load a dump into an empty store, all or nothing. see KV.LoadSorted.
+// the progress is in bytes read, with a total if `in` is a file.
+func (db *KV) Restore(in io.Reader, p *Progress) error {
+  total := int64(0)
+  if f, ok := in.(*os.File); ok {
+    if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+      total = fi.Size()
+    }
+  }
+  defer p.finish()
+  p.begin("bytes", total)
+  r := &dumpReader{in: bufio.NewReader(progressReader{in: in, p: p})}
+  sig := make([]byte, len(DUMP_SIG))
+  if _, err := io.ReadFull(r.in, sig); err != nil || string(sig) != DUMP_SIG {
+    return errors.New("restore: not a dump")
+  }
+  r.Next()
+  return db.loadSorted(r, 1)
+}
+
+// the KV pairs of a dump as a KVIter
+type dumpReader struct {
+  in      *bufio.Reader
+  key     []byte
+  val     []byte
+  expires int64 // 0 if the key doesn't expire
+  count   uint64
+  done    bool
+  err     error
+}
+
+func (r *dumpReader) Valid() bool {
+  return !r.done && r.err == nil
+}
+
+func (r *dumpReader) Key() []byte {
+  return r.key
+}
+
+func (r *dumpReader) Val() []byte {
+  return r.val
+}
+
+// the expiry time of the current key, see BulkLoad
+func (r *dumpReader) Expires() int64 {
+  return r.expires
+}
+
+func (r *dumpReader) Next() {
+  var head [8]byte
+  if _, err := io.ReadFull(r.in, head[:4]); err != nil {
+    r.fail(err)
+    return
+  }
+  klen := binary.LittleEndian.Uint32(head[0:])
+  if klen == 0 {
+    // the trailer
+    if _, err := io.ReadFull(r.in, head[:]); err != nil {
+      r.fail(err)
+    } else if binary.LittleEndian.Uint64(head[:]) != r.count {
+      r.fail(errors.New("bad count"))
+    }
+    r.done = true
+    return
+  }
+  if _, err := io.ReadFull(r.in, head[4:]); err != nil {
+    r.fail(err)
+    return
+  }
+  vlen := binary.LittleEndian.Uint32(head[4:])
+  r.expires = 0
+  if klen & DUMP_EXPIRES != 0 {
+    klen &^= DUMP_EXPIRES
+    if _, err := io.ReadFull(r.in, head[:]); err != nil {
+      r.fail(err)
+      return
+    }
+    r.expires = int64(binary.LittleEndian.Uint64(head[:]))
+  }
+  if klen > BTREE_MAX_KEY_SIZE || vlen > BTREE_MAX_BLOB_SIZE {
+    r.fail(errors.New("bad record"))
+    return
+  }
+  data := make([]byte, klen + vlen)
+  if _, err := io.ReadFull(r.in, data); err != nil {
+    r.fail(err)
+    return
+  }
+  r.key, r.val = data[:klen], data[klen:]
+  r.count++
+}
+
+func (r *dumpReader) fail(err error) {
+  if errors.Is(err, io.EOF) {
+    err = io.ErrUnexpectedEOF // no trailer
+  }
+  r.err = fmt.Errorf("restore: %w", err)
+}
+
+// checked by BulkLoad once the stream ends
+func (r *dumpReader) Err() error {
+  return r.err
+}
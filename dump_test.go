@@ -0,0 +1,118 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "io"
+  "strings"
+  "testing"
+  "time"
+)
+
+// a dump restored whole, the tables and the TTLs included, and the bad
+// dumps that restore nothing
+func TestDumpRestore(t *testing.T) {
+  clock := NewManualClock(time.Unix(1000, 0))
+  open := func() *DB {
+    t.Helper()
+    db := &DB{Options: Options{InMemory: true, Clock: clock}}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    return db
+  }
+  src := open()
+  defer src.Close()
+  tx := DBTX{}
+  src.Begin(&tx)
+  tdef := &TableDef{
+    Name: "t", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "v"},
+    PKeys: 1, Indexes: [][]string{{"v"}},
+  }
+  if err := tx.TableNew(tdef); err != nil {
+    t.Fatal(err)
+  }
+  tx.Insert("t", *(&Record{}).AddInt64("id", 1).AddStr("v", []byte("one")))
+  if err := src.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+  src.kv.Set([]byte("k"), []byte("v"))
+  src.kv.Set([]byte("big"), make([]byte, 3 * BTREE_PAGE_SIZE))
+  src.kv.SetWithTTL([]byte("ttl"), []byte("v"), time.Minute)
+  src.kv.SetWithTTL([]byte("expired"), []byte("v"), time.Second)
+  clock.Advance(2 * time.Second)
+  var out bytes.Buffer
+  if err := src.kv.Dump(&out, nil); err != nil {
+    t.Fatal(err)
+  }
+  dump := out.Bytes()
+  edit := func(i int, b byte) []byte {
+    data := bytes.Clone(dump)
+    data[i] = b
+    return data
+  }
+  cases := []struct {
+    data []byte
+    err  string // "" for a restore
+  }{
+    {dump, ""},
+    {dump[:len(dump)-1], io.ErrUnexpectedEOF.Error()},
+    {dump[:len(dump)-12], io.ErrUnexpectedEOF.Error()}, // no trailer
+    {edit(len(dump)-8, 9), "bad count"},
+    {edit(0, 'x'), "not a dump"},
+    {dump[:5], "not a dump"},
+  }
+  for i, c := range cases {
+    db := open()
+    err := db.kv.Restore(bytes.NewReader(c.data), nil)
+    if c.err != "" {
+      if err == nil || !strings.Contains(err.Error(), c.err) {
+        t.Fatalf("case %d: %v", i, err)
+      }
+      if db.kv.Seek(nil, CMP_GT).Valid() {
+        t.Fatalf("case %d: restored", i)
+      }
+      db.Close()
+      continue
+    }
+    if err != nil {
+      t.Fatalf("case %d: %v", i, err)
+    }
+    if err := db.kv.Verify(); err != nil {
+      t.Fatal(err)
+    }
+    tx := DBTX{}
+    db.Begin(&tx)
+    rec := (&Record{}).AddInt64("id", 1)
+    if ok, err := tx.Get("t", rec); !ok || err != nil || string(rec.Get("v").Str) != "one" {
+      t.Fatal(ok, err, rec)
+    }
+    db.Abort(&tx)
+    for key, want := range map[string]int{"k": 1, "big": 3 * BTREE_PAGE_SIZE, "ttl": 1, "expired": -1} {
+      if val, ok := db.kv.Get([]byte(key)); ok != (want >= 0) || ok && len(val) != want {
+        t.Fatalf("%s: %d %v", key, len(val), ok)
+      }
+    }
+    // the expiry time is kept
+    clock.Advance(time.Minute)
+    if _, ok := db.kv.Get([]byte("ttl")); ok {
+      t.Fatal("not expired")
+    }
+    // only into an empty store
+    if err := db.kv.Restore(bytes.NewReader(dump), nil); err == nil {
+      t.Fatal("restored over the data")
+    }
+    db.Close()
+  }
+  if err := src.kv.Dump(failWriter{}, nil); !errors.Is(err, errFailWrite) {
+    t.Fatal(err)
+  }
+}
+
+var errFailWrite = errors.New("write failed")
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) {
+  return 0, errFailWrite
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+  "encoding/binary"
+  "fmt"
+  "hash/crc32"
+)
+
+// a KV can carry its own CRC32-C over the key and the value, marked by the
+// 3rd highest bit of the value size. unlike the page checksums, it's kept
+// with the KV when the KV is copied between nodes, so it catches a KV
+// corrupted in memory before the page is written, e.g. by code writing
+// to the raw pages. see Options.EntryChecksums.
+// the checksum is of the actual value, not of the overflow reference.
+// value: | expires 8B, see ttl.go | crc 4B | value or overflow reference |
+const (
+  VAL_CHECKSUM   = uint16(1 << 13)
+  ENTRY_SUM_SIZE = 4
+  VAL_FLAGS      = VAL_OVERFLOW | VAL_EXPIRES | VAL_CHECKSUM
+)
+
+// a KV doesn't match its checksum. like ErrChecksum, this is a panic.
+type ErrEntryChecksum struct {
+  Key []byte
+}
+
+func (e *ErrEntryChecksum) Error() string {
+  return fmt.Sprintf("key %q: entry checksum mismatch", e.Key)
+}
+
+func entrySum(key []byte, val []byte) uint32 {
+  return crc32.Update(crc32.Checksum(key, crcTable), crcTable, val)
+}
+
+// the value in the leaf format, `full` is the actual value of `val`
+func withEntrySum(key []byte, full []byte, val []byte, vflag uint16) ([]byte, uint16) {
+  out := make([]byte, ENTRY_SUM_SIZE + len(val))
+  binary.LittleEndian.PutUint32(out, entrySum(key, full))
+  copy(out[ENTRY_SUM_SIZE:], val)
+  return out, vflag | VAL_CHECKSUM
+}
+
+// the checksum of a KV, false if it has none
+func (node BNode) entrySum(idx uint16) (uint32, bool) {
+  assert(idx < node.nkeys())
+  pos := node.kvPos(idx)
+  vlen := binary.LittleEndian.Uint16(node[pos+2:])
+  if vlen & VAL_CHECKSUM == 0 {
+    return 0, false
+  }
+  klen := binary.LittleEndian.Uint16(node[pos+0:])
+  start := pos + 4 + klen
+  if vlen & VAL_EXPIRES != 0 {
+    start += EXPIRES_SIZE
+  }
+  return binary.LittleEndian.Uint32(node[start:]), true
+}
+
+// `val` is the actual value of the KV
+func entryCheck(node BNode, idx uint16, val []byte) error {
+  sum, ok := node.entrySum(idx)
+  if ok && sum != entrySum(node.getKey(idx), val) {
+    return &ErrEntryChecksum{Key: append([]byte(nil), node.getKey(idx)...)}
+  }
+  return nil
+}
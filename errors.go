@@ -0,0 +1,86 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+)
+
+// the failure modes callers can test with errors.Is and errors.As.
+// the specific errors map to them: *ErrChecksum, *ErrCorruptTree and
+// *ErrEntryChecksum are also an *ErrCorrupt, *ErrDuplicateKey is also an
+// *ErrConstraint, and ErrDeadlock and ErrLockTimeout are retryable like
+// ErrConflict, see IsRetryable.
+var (
+  // a table, or a key where one is required
+  ErrNotFound = errors.New("not found")
+  // the transaction read something changed by a later commit, retry it
+  ErrConflict = errors.New("serialization conflict")
+  // an update of a store opened with Options.ReadOnly
+  ErrReadOnly = errors.New("read-only store")
+  // a key or a value over the limits of the format
+  ErrTooLarge = errors.New("too large")
+)
+
+// the file or a page of it is not what was written. Page is 0 when the
+// page is unknown or the master page.
+type ErrCorrupt struct {
+  Page uint64
+  Err  error
+}
+
+func (e *ErrCorrupt) Error() string {
+  return fmt.Sprintf("page %d: %v", e.Page, e.Err)
+}
+
+func (e *ErrCorrupt) Unwrap() error {
+  return e.Err
+}
+
+func corruptf(ptr uint64, format string, args ...any) error {
+  return &ErrCorrupt{Page: ptr, Err: fmt.Errorf(format, args...)}
+}
+
+// asCorrupt and asConstraint implement the As methods of the specific errors
+func asCorrupt(target any, ptr uint64, err error) bool {
+  if out, ok := target.(**ErrCorrupt); ok {
+    *out = &ErrCorrupt{Page: ptr, Err: err}
+    return true
+  }
+  return false
+}
+
+func (e *ErrChecksum) As(target any) bool {
+  return asCorrupt(target, e.Ptr, errors.New("checksum mismatch"))
+}
+
+func (e *ErrCorruptTree) As(target any) bool {
+  return asCorrupt(target, e.Path[len(e.Path)-1], errors.New("the path is too deep"))
+}
+
+func (e *ErrEntryChecksum) As(target any) bool {
+  return asCorrupt(target, 0, fmt.Errorf("key %q: entry checksum mismatch", e.Key))
+}
+
+// a row violates a constraint of the table: the primary key or a unique
+// index, identified by its columns
+type ErrConstraint struct {
+  Table string
+  Index []string
+}
+
+func (e *ErrConstraint) Error() string {
+  return fmt.Sprintf("constraint violation in table %s: (%v)", e.Table, e.Index)
+}
+
+func (e *ErrDuplicateKey) As(target any) bool {
+  if out, ok := target.(**ErrConstraint); ok {
+    *out = &ErrConstraint{Table: e.Table, Index: e.Cols}
+    return true
+  }
+  return false
+}
+
+// "table not found: name"
+func errNoTable(name string) error {
+  return fmt.Errorf("table %w: %s", ErrNotFound, name)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+  "encoding/binary"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "math/bits"
+  "os"
+  "runtime"
+)
+
+// the pages freed by the updates are reused by the later ones. a page
+// freed by version v is still reachable from the versions before it, so
+// it's reused once no transaction or snapshot reads a version before v,
+// see KV.readers, and the master page on disk is at v or later, so that
+// a crash doesn't go back to a tree that has it.
+// the freed pages wait in version order, then they join the reusable ones,
+// which are allocated lowest first. the reusable pages at the end of the
+// file are cut off, so the file shrinks after deletions.
+// the list is saved at Close in a file next to the database, the path
+// with "-free" appended, and emptied on Open. a file that is empty or
+// doesn't match the master page, e.g. after a crash, is rebuilt from the
+// pages the tree doesn't reach. the pages of the cold file are not reused.
+type freeList struct {
+  fd      *os.File   // the saved list
+  pending []freePage // freed by the committed versions, not reusable yet
+  freed   []uint64   // by the update in progress
+  taken   []uint64   // reused by the update in progress
+  bits    []uint64   // the reusable pages
+  count   int        // the set bits
+  low     uint64     // no reusable page below it
+  durable uint64     // the version of the master page in the file
+  written bool       // the update in progress is in the file, see freeCommit
+  checked bool       // the pending pages were looked at by the update in progress
+  cut     [2]uint64  // the pages cut off by the update in progress, see freeCut
+  err     error      // the list couldn't be rebuilt, nothing is reused
+}
+
+type freePage struct {
+  ptr     uint64
+  version uint64 // the first version without it
+}
+
+func freePath(db *KV) string {
+  return db.Path + "-free"
+}
+
+func (fl *freeList) has(ptr uint64) bool {
+  return ptr / 64 < uint64(len(fl.bits)) && fl.bits[ptr / 64] & (1 << (ptr % 64)) != 0
+}
+
+// a reusable page
+func (fl *freeList) add(ptr uint64) {
+  assert(ptr != 0 && !fl.has(ptr))
+  for ptr / 64 >= uint64(len(fl.bits)) {
+    fl.bits = append(fl.bits, 0)
+  }
+  fl.bits[ptr / 64] |= 1 << (ptr % 64)
+  fl.count++
+  fl.low = min(fl.low, ptr)
+}
+
+func (fl *freeList) remove(ptr uint64) {
+  assert(fl.has(ptr))
+  fl.bits[ptr / 64] &^= 1 << (ptr % 64)
+  fl.count--
+}
+
+// the lowest reusable page
+func (fl *freeList) pop() (uint64, bool) {
+  if fl.count == 0 {
+    return 0, false
+  }
+  for i := fl.low / 64; ; i++ {
+    if word := fl.bits[i]; word != 0 {
+      ptr := i * 64 + uint64(bits.TrailingZeros64(word))
+      fl.remove(ptr)
+      fl.low = ptr + 1
+      return ptr, true
+    }
+  }
+}
+
+// the reusable pages and the pending ones, for Stats and Verify
+func (fl *freeList) all() []uint64 {
+  out := []uint64{}
+  for i, word := range fl.bits {
+    for ; word != 0; word &= word - 1 {
+      out = append(out, uint64(i) * 64 + uint64(bits.TrailingZeros64(word)))
+    }
+  }
+  for _, page := range fl.pending {
+    out = append(out, page.ptr)
+  }
+  return out
+}
+
+// a page to reuse for the update in progress
+func freeAlloc(db *KV) (uint64, bool) {
+  fl := &db.free
+  if fl.count == 0 && len(fl.pending) > 0 && !fl.checked {
+    // the readers may have ended since the last commit
+    fl.checked = true
+    db.mu.Lock()
+    freeRelease(db)
+    db.mu.Unlock()
+  }
+  ptr, ok := fl.pop()
+  if ok {
+    fl.taken = append(fl.taken, ptr)
+  }
+  return ptr, ok
+}
+
+// the pending pages that no reader can reach become reusable.
+// the caller holds the writer lock and db.mu.
+func freeRelease(db *KV) {
+  fl := &db.free
+  limit := fl.durable
+  for version := range db.readers {
+    limit = min(limit, version)
+  }
+  n := 0
+  for ; n < len(fl.pending) && fl.pending[n].version <= limit; n++ {
+    fl.add(fl.pending[n].ptr)
+  }
+  fl.pending = fl.pending[n:]
+}
+
+// the update is published as db.version, with the caller holding db.mu
+func freeCommit(db *KV) {
+  fl := &db.free
+  for _, ptr := range fl.freed {
+    fl.pending = append(fl.pending, freePage{ptr: ptr, version: db.version})
+  }
+  if fl.written {
+    fl.durable = db.version
+  }
+  freeUncut(db) // a failed checkpoint
+  fl.freed, fl.taken, fl.checked, fl.written = fl.freed[:0], fl.taken[:0], false, false
+  freeRelease(db)
+}
+
+// the update is discarded, so are its changes to the list
+func freeRevert(db *KV) {
+  fl := &db.free
+  for _, ptr := range fl.taken {
+    delete(db.page.updates, ptr)
+    fl.add(ptr)
+  }
+  freeUncut(db)
+  fl.freed, fl.taken, fl.checked, fl.written = fl.freed[:0], fl.taken[:0], false, false
+}
+
+// drop the reusable pages at the end of the file before the master page is
+// written, the file is truncated once it is, see freeShrink
+func freeCut(db *KV) {
+  fl := &db.free
+  if len(fl.pending) > 0 {
+    // e.g. those of the last transaction, which ended after its commit
+    db.mu.Lock()
+    freeRelease(db)
+    db.mu.Unlock()
+  }
+  end := db.page.flushed
+  for end > 1 && fl.has(end - 1) {
+    fl.remove(end - 1)
+    end--
+  }
+  if end == db.page.flushed {
+    return
+  }
+  // only free pages are at the end, the new ones are written already
+  assert(len(db.page.temp) == 0)
+  fl.cut = [2]uint64{end, db.page.flushed}
+  db.page.flushed = end
+  db.sums.crcs = db.sums.crcs[:end]
+}
+
+// the master page wasn't written after freeCut, the pages are back
+func freeUncut(db *KV) {
+  fl := &db.free
+  if fl.cut[1] == 0 {
+    return
+  }
+  db.page.flushed = fl.cut[1]
+  db.sums.crcs = db.sums.crcs[:fl.cut[1]] // the array still has them
+  for ptr := fl.cut[0]; ptr < fl.cut[1]; ptr++ {
+    fl.add(ptr)
+  }
+  fl.cut = [2]uint64{}
+}
+
+// the file and the checksums after freeCut. the pages past the master
+// page are not read, so a failure only leaves the file larger.
+func freeShrink(db *KV) {
+  if db.free.cut[1] == 0 {
+    return
+  }
+  if store, ok := db.store.(interface{ Truncate(int64) error }); ok {
+    _ = store.Truncate(int64(db.page.flushed) * int64(db.tree.pageSize()))
+  }
+  _ = db.sums.fd.Truncate(int64(4 * db.page.flushed))
+  db.free.cut = [2]uint64{}
+}
+
+// load the list saved by the last Close, or rebuild it
+func freeOpen(db *KV) error {
+  db.free = freeList{}
+  if db.Options.ReadOnly {
+    return nil // nothing is allocated
+  }
+  fd, err := fileOpen(db, freePath(db), true)
+  if err != nil {
+    return fmt.Errorf("open free list: %w", err)
+  }
+  db.free.fd = fd
+  data, err := io.ReadAll(fd)
+  if err != nil {
+    return fmt.Errorf("read free list: %w", err)
+  }
+  if !freeLoad(db, data) {
+    freeRebuild(db)
+  }
+  if len(data) == 0 {
+    return nil
+  }
+  // it's out of date after the next commit
+  if err := fd.Truncate(0); err != nil {
+    return fmt.Errorf("truncate free list: %w", err)
+  }
+  if err := fd.Sync(); err != nil {
+    return fmt.Errorf("fsync free list: %w", err)
+  }
+  return nil
+}
+
+// | root 8B | pages 8B | count 8B | page 8B ... | crc32 4B |
+// the root and the number of pages are those of the master page
+func freeLoad(db *KV, data []byte) bool {
+  if len(data) < 28 || (len(data) - 28) % 8 != 0 {
+    return false
+  }
+  body := data[:len(data)-4]
+  if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+    return false
+  }
+  root, flushed := binary.LittleEndian.Uint64(body[0:]), binary.LittleEndian.Uint64(body[8:])
+  count := binary.LittleEndian.Uint64(body[16:])
+  if root != db.tree.root || flushed != db.page.flushed || count != uint64(len(body) - 24) / 8 {
+    return false
+  }
+  fl := freeList{fd: db.free.fd}
+  for off := 24; off < len(body); off += 8 {
+    ptr := binary.LittleEndian.Uint64(body[off:])
+    if ptr == 0 || ptr >= flushed || fl.has(ptr) {
+      return false
+    }
+    fl.add(ptr)
+  }
+  db.free = fl
+  return true
+}
+
+// the pages in the file that the tree doesn't reach
+func freeRebuild(db *KV) {
+  fl := freeList{fd: db.free.fd}
+  v := kvVerifier(db, false)
+  if err := v.run(); err != nil {
+    fl.err = err
+    db.free = fl
+    return
+  }
+  for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+    if !v.seen[ptr] {
+      fl.add(ptr)
+    }
+  }
+  db.free = fl
+}
+
+// save the list if the file is up to date
+func freeClose(db *KV) {
+  fl := &db.free
+  if fl.fd == nil {
+    return
+  }
+  // a torn write fails the checksum, the list is rebuilt
+  if data := freeEncode(db); data != nil {
+    if _, err := fl.fd.WriteAt(data, 0); err == nil {
+      _ = fl.fd.Sync()
+    }
+  }
+  _ = fl.fd.Close()
+  fl.fd = nil
+}
+
+// the list as saved, see freeLoad. nil if it doesn't match the file.
+func freeEncode(db *KV) []byte {
+  if db.Options.ReadOnly || db.failed || len(db.page.temp) > 0 || len(db.page.updates) > 0 || db.free.err != nil {
+    return nil
+  }
+  pages := db.free.all()
+  data := make([]byte, 24 + 8 * len(pages) + 4)
+  binary.LittleEndian.PutUint64(data[0:], db.tree.root)
+  binary.LittleEndian.PutUint64(data[8:], db.page.flushed)
+  binary.LittleEndian.PutUint64(data[16:], uint64(len(pages)))
+  for i, ptr := range pages {
+    binary.LittleEndian.PutUint64(data[24+8*i:], ptr)
+  }
+  body := data[:len(data)-4]
+  binary.LittleEndian.PutUint32(data[len(body):], crc32.ChecksumIEEE(body))
+  return data
+}
+
+// a snapshot of the latest version whose pages are not reused until
+// release is called
+func (db *KV) snapshot() (tree BTree, release func()) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  tree = db.viewTree()
+  reader := db.pin()
+  return tree, func() { db.unpin(reader) }
+}
+
+// like KV.snapshot, for a snapshot that the caller keeps, e.g. in an
+// iterator. it's released once the tree and its iterators are unreachable.
+func (db *KV) latest() BTree {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  tree := db.viewTree()
+  pin := &snapshotPin{get: tree.get}
+  tree.get = pin.read
+  runtime.AddCleanup(pin, db.unpin, db.pin())
+  return tree
+}
+
+// the pages of the snapshot are read through it, which keeps it reachable
+type snapshotPin struct {
+  get func(uint64) []byte
+}
+
+func (pin *snapshotPin) read(ptr uint64) []byte {
+  return pin.get(ptr)
+}
+
+// a reader of a version, in the readers of the Open it's from
+type snapshotReader struct {
+  readers map[uint64]int
+  version uint64
+}
+
+// the caller holds db.mu
+func (db *KV) pin() snapshotReader {
+  db.readers[db.version]++
+  return snapshotReader{readers: db.readers, version: db.version}
+}
+
+func (db *KV) unpin(reader snapshotReader) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  if reader.readers[reader.version]--; reader.readers[reader.version] == 0 {
+    delete(reader.readers, reader.version)
+  }
+}
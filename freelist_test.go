@@ -0,0 +1,193 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func freeStats(t *testing.T, db *KV) Stats {
+  t.Helper()
+  if err := db.Verify(); err != nil {
+    t.Fatal(err)
+  }
+  st, err := db.Stats()
+  if err != nil {
+    t.Fatal(err)
+  }
+  return st
+}
+
+// update the same keys `n` times, returns the growth of the file in pages
+func freeChurn(t *testing.T, db *KV, n int) int64 {
+  t.Helper()
+  before := freeStats(t, db).Pages
+  for i := 0; i < n; i++ {
+    if err := db.Set([]byte(fmt.Sprintf("k%05d", i % 100)), []byte(fmt.Sprint(i))); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return int64(freeStats(t, db).Pages) - int64(before)
+}
+
+// the freed pages are reused once the older snapshots are gone
+func TestFreeReuse(t *testing.T) {
+  for _, opts := range []Options{{}, {WAL: true, CheckpointPages: 50}, {InMemory: true}} {
+    db := &KV{Options: opts}
+    if !opts.InMemory {
+      db.Path = filepath.Join(t.TempDir(), "db")
+    }
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    for i := 0; i < 2000; i++ {
+      if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100)); err != nil {
+        t.Fatal(err)
+      }
+    }
+    freeChurn(t, db, 200)
+    if grown := freeChurn(t, db, 1000); grown > 50 {
+      t.Fatalf("%+v: %d new pages", opts, grown)
+    }
+    // a transaction keeps the pages of its version
+    tx := KVTX{}
+    db.Begin(&tx)
+    old, _ := tx.Get([]byte("k00001"))
+    if grown := freeChurn(t, db, 1000); grown < 1000 {
+      t.Fatalf("%+v: %d new pages", opts, grown)
+    }
+    if val, ok := tx.Get([]byte("k00001")); !ok || string(val) != string(old) {
+      t.Fatalf("%+v: %q", opts, val)
+    }
+    db.Abort(&tx)
+    if grown := freeChurn(t, db, 1000); grown > 0 {
+      t.Fatalf("%+v: %d new pages", opts, grown)
+    }
+    if st := freeStats(t, db); st.FreePages == 0 {
+      t.Fatalf("%+v: %+v", opts, st)
+    }
+    db.Close()
+  }
+}
+
+// the list is saved at Close, and rebuilt without it or when it's stale
+func TestFreeReopen(t *testing.T) {
+  for _, wal := range []bool{false, true} {
+    path := filepath.Join(t.TempDir(), "db")
+    opts := Options{WAL: wal}
+    db := checksumOpen(t, path, opts)
+    for i := 0; i < 2000; i++ {
+      if err := db.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100)); err != nil {
+        t.Fatal(err)
+      }
+    }
+    for i := 0; i < 2000; i += 3 {
+      if _, err := db.Del([]byte(fmt.Sprintf("k%05d", i))); err != nil {
+        t.Fatal(err)
+      }
+    }
+    db.Close()
+    db = checksumOpen(t, path, opts)
+    want := freeStats(t, db)
+    if want.FreePages == 0 || want.FreePages != want.UnusedPages {
+      t.Fatalf("%+v", want)
+    }
+    db.Close()
+    stale, err := os.ReadFile(freePath(db))
+    if err != nil || len(stale) == 0 {
+      t.Fatal(err)
+    }
+    // the file is emptied while the store is open, like after a crash
+    db = checksumOpen(t, path, opts)
+    if data, err := os.ReadFile(freePath(db)); err != nil || len(data) != 0 {
+      t.Fatal(len(data), err)
+    }
+    db.Close()
+    if err := os.Remove(freePath(db)); err != nil {
+      t.Fatal(err)
+    }
+    db = checksumOpen(t, path, opts)
+    if st := freeStats(t, db); st.FreePages != want.FreePages {
+      t.Fatalf("%d free pages, want %d", st.FreePages, want.FreePages)
+    }
+    db.Set([]byte("new"), []byte("new"))
+    db.Close()
+    if err := os.WriteFile(freePath(db), stale, 0644); err != nil {
+      t.Fatal(err)
+    }
+    db = checksumOpen(t, path, opts)
+    if st := freeStats(t, db); st.FreePages != st.UnusedPages {
+      t.Fatalf("%+v", st)
+    }
+    db.Close()
+  }
+}
+
+// a reachable page in the list
+func TestFreeVerify(t *testing.T) {
+  db := checksumOpen(t, filepath.Join(t.TempDir(), "db"), Options{})
+  defer db.Close()
+  for i := 0; i < 100; i++ {
+    db.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100))
+  }
+  db.free.add(db.tree.root)
+  var corrupt *ErrCorrupt
+  if err := db.Verify(); !errors.As(err, &corrupt) || corrupt.Page != db.tree.root {
+    t.Fatal(err)
+  }
+}
+
+// the tree loses levels and the file shrinks after a mass delete
+func TestFreeMassDelete(t *testing.T) {
+  for _, wal := range []bool{false, true} {
+    path := filepath.Join(t.TempDir(), "db")
+    db := checksumOpen(t, path, Options{WAL: wal})
+    const n = 20000
+    for i := 0; i < n; i += 500 {
+      tx := KVTX{}
+      db.Begin(&tx)
+      for j := i; j < i + 500; j++ {
+        tx.Set([]byte(fmt.Sprintf("k%06d", j)), make([]byte, 100))
+      }
+      if err := db.Commit(&tx); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if err := db.Checkpoint(); err != nil {
+      t.Fatal(err)
+    }
+    full := freeStats(t, db)
+    // all but the first keys, in batches
+    for i := n - 500; i >= 0; i -= 500 {
+      tx := KVTX{}
+      db.Begin(&tx)
+      for j := max(i, 100); j < i + 500; j++ {
+        if _, err := tx.Del([]byte(fmt.Sprintf("k%06d", j))); err != nil {
+          t.Fatal(err)
+        }
+      }
+      if err := db.Commit(&tx); err != nil {
+        t.Fatal(err)
+      }
+    }
+    // the pages freed by a commit are cut off by the next ones, or by
+    // the next checkpoints with a WAL
+    for i := 0; i < 3; i++ {
+      db.Set([]byte("new"), []byte(fmt.Sprint(i)))
+      if err := db.Checkpoint(); err != nil {
+        t.Fatal(err)
+      }
+    }
+    st := freeStats(t, db)
+    if st.Keys != 101 || st.Height >= full.Height || st.FileBytes * 10 > full.FileBytes {
+      t.Fatalf("WAL %v: %+v, before %+v", wal, st, full)
+    }
+    db.Close()
+    fi, err := os.Stat(path)
+    if err != nil || fi.Size() != st.FileBytes {
+      t.Fatal(fi.Size(), err)
+    }
+  }
+}
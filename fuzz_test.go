@@ -0,0 +1,220 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "math/rand"
+  "sort"
+  "testing"
+)
+
+// the tree against a map, with the invariants checked after each update
+type treeRef struct {
+  t    *testing.T
+  tree BTree
+  ref  map[string]string
+}
+
+func newTreeRef(t *testing.T) *treeRef {
+  return &treeRef{t: t, tree: newMemTree(), ref: map[string]string{}}
+}
+
+func (r *treeRef) set(key []byte, val []byte) {
+  if err := r.tree.Insert(key, val); err != nil {
+    r.t.Fatalf("insert %q: %v", key, err)
+  }
+  r.ref[string(key)] = string(val)
+  r.check()
+}
+
+func (r *treeRef) del(key []byte) {
+  deleted, err := r.tree.Delete(key)
+  if err != nil {
+    r.t.Fatalf("delete %q: %v", key, err)
+  }
+  if _, ok := r.ref[string(key)]; ok != deleted {
+    r.t.Fatalf("delete %q: %v, want %v", key, deleted, ok)
+  }
+  delete(r.ref, string(key))
+  r.check()
+}
+
+// the tree has the same KVs in order, in both directions
+func (r *treeRef) check() {
+  r.t.Helper()
+  if err := r.tree.Verify(); err != nil {
+    r.t.Fatal(err)
+  }
+  keys := make([]string, 0, len(r.ref))
+  for k := range r.ref {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  i := 0
+  for iter := r.tree.Seek(nil, CMP_GT); iter.Valid(); iter.Next() {
+    if i >= len(keys) || string(iter.Key()) != keys[i] || string(iter.Val()) != r.ref[keys[i]] {
+      r.t.Fatalf("key %d: got %q", i, iter.Key())
+    }
+    i++
+  }
+  if i != len(keys) {
+    r.t.Fatalf("%d keys, want %d", i, len(keys))
+  }
+  for iter := r.tree.SeekLast(); iter.Valid(); iter.Prev() {
+    i--
+    if string(iter.Key()) != keys[i] {
+      r.t.Fatalf("backward key %d: got %q", i, iter.Key())
+    }
+  }
+  for _, k := range keys {
+    if val, ok := r.tree.Get([]byte(k)); !ok || string(val) != r.ref[k] {
+      r.t.Fatalf("get %q: %q %v", k, val, ok)
+    }
+  }
+}
+
+// random keys and values of random sizes, overflow values included
+func randKV(rng *rand.Rand, nkeys int) ([]byte, []byte) {
+  key := []byte(fmt.Sprintf("%0*d", 1 + rng.Intn(40), rng.Intn(nkeys)))
+  size := rng.Intn(200)
+  switch rng.Intn(20) {
+  case 0:
+    size = BTREE_MAX_VAL_SIZE - 1 + rng.Intn(3) // around the overflow limit
+  case 1:
+    size = BTREE_MAX_VAL_SIZE + rng.Intn(3 * BTREE_PAGE_SIZE)
+  }
+  val := make([]byte, size)
+  rng.Read(val)
+  return key, val
+}
+
+func TestTreeRandomOps(t *testing.T) {
+  for seed := int64(0); seed < 4; seed++ {
+    rng := rand.New(rand.NewSource(seed))
+    r := newTreeRef(t)
+    for i := 0; i < 1500; i++ {
+      key, val := randKV(rng, 300)
+      if rng.Intn(3) == 0 {
+        r.del(key)
+      } else {
+        r.set(key, val)
+      }
+    }
+    // empty it again
+    for k := range r.ref {
+      r.del([]byte(k))
+    }
+  }
+}
+
+// long keys make the internal nodes split and merge too
+func TestTreeLongKeys(t *testing.T) {
+  rng := rand.New(rand.NewSource(1))
+  r := newTreeRef(t)
+  for i := 0; i < 600; i++ {
+    key := bytes.Repeat([]byte{byte('a' + rng.Intn(26))}, 1 + rng.Intn(BTREE_MAX_KEY_SIZE))
+    if rng.Intn(4) == 0 {
+      r.del(key)
+    } else {
+      r.set(key, []byte(fmt.Sprint(i)))
+    }
+  }
+}
+
+// a leaf built from fuzzed KVs decodes to the same KVs
+func FuzzNodeKVs(f *testing.F) {
+  f.Add([]byte("\x01a\x01b\x00\x00"))
+  f.Add([]byte("\x03key\x05value\x02k2\x00"))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    var keys, vals [][]byte
+    kvbytes := uint16(0)
+    for len(data) >= 2 {
+      klen, vlen := int(data[0]), int(data[1])
+      data = data[2:]
+      if klen + vlen > len(data) {
+        break
+      }
+      key, val := data[:klen], data[klen:klen+vlen]
+      data = data[klen+vlen:]
+      if nodeSize(uint16(len(keys) + 1), kvbytes + kvBytes(key, val)) > BTREE_PAGE_SIZE {
+        break
+      }
+      keys, vals = append(keys, key), append(vals, val)
+      kvbytes += kvBytes(key, val)
+    }
+    if len(keys) == 0 {
+      return
+    }
+    node := BNode(make([]byte, BTREE_PAGE_SIZE))
+    b := newNodeBuilder(node, BNODE_LEAF, uint16(len(keys)), kvbytes)
+    for i := range keys {
+      b.add(uint64(i), keys[i], vals[i])
+    }
+    if node.nkeys() != uint16(len(keys)) || node.kvBytes() != kvbytes {
+      t.Fatalf("%d keys %d bytes", node.nkeys(), node.kvBytes())
+    }
+    for i := range keys {
+      idx := uint16(i)
+      if !bytes.Equal(node.getKey(idx), keys[i]) || !bytes.Equal(node.getVal(idx), vals[i]) {
+        t.Fatalf("KV %d: %q %q", i, node.getKey(idx), node.getVal(idx))
+      }
+      if node.getPtr(idx) != uint64(i) || node.isOverflow(idx) || node.expires(idx) != 0 {
+        t.Fatalf("KV %d: bad ptr or flags", i)
+      }
+    }
+    // copying a range keeps the KVs
+    if len(keys) > 1 {
+      n := uint16(len(keys) / 2)
+      copied := BNode(make([]byte, BTREE_PAGE_SIZE))
+      b := newNodeBuilder(copied, BNODE_LEAF, uint16(len(keys)) - n, node.rangeBytes(n, uint16(len(keys)) - n))
+      b.addRange(node, n, uint16(len(keys)) - n)
+      for i := n; i < uint16(len(keys)); i++ {
+        if !bytes.Equal(copied.getKey(i - n), keys[i]) || !bytes.Equal(copied.getVal(i - n), vals[i]) {
+          t.Fatalf("copied KV %d", i)
+        }
+      }
+    }
+  })
+}
+
+// random bytes as a node never crash the checks
+func FuzzNodeCheck(f *testing.F) {
+  node := BNode(make([]byte, BTREE_PAGE_SIZE))
+  b := newNodeBuilder(node, BNODE_LEAF, 2, kvBytes(nil, nil) + kvBytes([]byte("k"), []byte("v")))
+  b.add(0, nil, nil)
+  b.add(0, []byte("k"), []byte("v"))
+  f.Add([]byte(node[:node.nbytes()]))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    if nodeCheck(BNode(data)) != nil {
+      return
+    }
+    // a valid layout can be read
+    node := BNode(data)
+    for i := uint16(0); i < node.nkeys(); i++ {
+      node.getKey(i)
+      node.getVal(i)
+    }
+  })
+}
+
+// a fuzzed sequence of updates, 3 bytes each: op, key, value size
+func FuzzTreeOps(f *testing.F) {
+  f.Add([]byte("\x00\x01\x10\x00\x02\x20\x01\x01\x00"))
+  f.Fuzz(func(t *testing.T, data []byte) {
+    r := newTreeRef(t)
+    for ; len(data) >= 3; data = data[3:] {
+      key := []byte(fmt.Sprintf("%03d", data[1]))
+      if data[0] % 4 == 0 {
+        r.del(key)
+        continue
+      }
+      size := int(data[2]) * 24 // up to past the overflow limit
+      val := make([]byte, size)
+      if size >= 2 {
+        binary.LittleEndian.PutUint16(val, uint16(len(data))) // a different value each time
+      }
+      r.set(key, val)
+    }
+  })
+}
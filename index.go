@@ -0,0 +1,263 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+)
+
+// a range query on the primary key or a secondary index.
+// the columns of the keys must be a prefix of one of them,
+// the query runs on the first one that matches.
+// one of the keys can have fewer columns, e.g. no columns at all
+// for the start or the end of the index.
+// Cmp1 > 0 scans forward from Key1 to Key2, Cmp1 < 0 scans backward.
+type Scanner struct {
+  Cmp1 int // CMP_GE, CMP_GT, CMP_LT, CMP_LE
+  Cmp2 int // the opposite direction of Cmp1
+  Key1 Record
+  Key2 Record
+  // internal
+  tx     *DBTX
+  tdef   *TableDef
+  index  int // -1: the primary key
+  iter     *TxIter
+  keyStart []byte // the encoded Key1
+  keyEnd   []byte // the encoded Key2
+  withDeleted bool // see WithDeleted
+}
+
+// start a range query
+func (tx *DBTX) Scan(table string, req *Scanner) error {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return errNoTable(table)
+  }
+  return dbScan(tx, tdef, req)
+}
+
+func dbScan(tx *DBTX, tdef *TableDef, req *Scanner) error {
+  // sanity checks
+  switch {
+  case req.Cmp1 > 0 && req.Cmp2 < 0:
+  case req.Cmp1 < 0 && req.Cmp2 > 0:
+  default:
+    return errors.New("bad range")
+  }
+  // select an index
+  index, cols := findIndex(tdef, req.Key1.Cols)
+  if len(req.Key2.Cols) > len(req.Key1.Cols) {
+    index, cols = findIndex(tdef, req.Key2.Cols)
+  }
+  if cols == nil {
+    return errors.New("no index found")
+  }
+  val1, err := scanValues(tdef, cols, req.Key1)
+  if err != nil {
+    return err
+  }
+  val2, err := scanValues(tdef, cols, req.Key2)
+  if err != nil {
+    return err
+  }
+  req.tx = tx
+  req.tdef = tdef
+  req.index = index
+  // seek to the start key
+  prefix := tdef.Prefix
+  if index >= 0 {
+    prefix = tdef.IndexPrefixes[index]
+  }
+  req.keyStart = encodeScanKey(prefix, val1, req.Cmp1)
+  if req.Cmp1 > 0 {
+    req.iter = tx.kv.Seek(req.keyStart, CMP_GE)
+  } else {
+    req.iter = tx.kv.Seek(req.keyStart, CMP_LT)
+  }
+  req.keyEnd = encodeScanKey(prefix, val2, req.Cmp2)
+  req.skipDeleted()
+  return nil
+}
+
+// is the encoded index key within the range?
+func (sc *Scanner) contains(key []byte) bool {
+  if sc.Cmp1 > 0 {
+    return bytes.Compare(key, sc.keyStart) >= 0 && bytes.Compare(key, sc.keyEnd) < 0
+  }
+  return bytes.Compare(key, sc.keyStart) < 0 && bytes.Compare(key, sc.keyEnd) >= 0
+}
+
+// the encoded key of a row in the index of the scan
+func (sc *Scanner) rowKey(rec Record) []byte {
+  tdef := sc.tdef
+  values := make([]Value, len(tdef.Cols))
+  for i, col := range tdef.Cols {
+    values[i] = *rec.Get(col)
+  }
+  if sc.index < 0 {
+    return encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+  }
+  index := tdef.Indexes[sc.index]
+  return encodeKey(nil, tdef.IndexPrefixes[sc.index], indexValues(tdef, values, index))
+}
+
+// the first index whose leading columns are exactly `cols`.
+// returns -1 for the primary key, and the columns of the index.
+func findIndex(tdef *TableDef, cols []string) (int, []string) {
+  if isPrefix(tdef.Cols[:tdef.PKeys], cols) {
+    return -1, tdef.Cols[:tdef.PKeys]
+  }
+  for i, index := range tdef.Indexes {
+    if isPrefix(index, cols) {
+      return i, index
+    }
+  }
+  return -2, nil
+}
+
+// are `cols` the leading columns of `index`, in any order?
+func isPrefix(index []string, cols []string) bool {
+  if len(cols) > len(index) {
+    return false
+  }
+  for i, col := range cols {
+    if !contains(index[:len(cols)], col) || contains(cols[:i], col) {
+      return false
+    }
+  }
+  return true
+}
+
+// the values of a scan key, in the order of the index
+func scanValues(tdef *TableDef, index []string, rec Record) ([]Value, error) {
+  if len(rec.Cols) != len(rec.Vals) {
+    return nil, errors.New("bad record")
+  }
+  out := make([]Value, 0, len(rec.Cols))
+  for _, col := range index[:len(rec.Cols)] {
+    v := rec.Get(col)
+    if v == nil {
+      return nil, errors.New("the scan keys use different indexes")
+    }
+    if v.Type != tdef.Types[colIndex(tdef, col)] {
+      return nil, fmt.Errorf("bad column type: %s", col)
+    }
+    out = append(out, *v)
+  }
+  return out, nil
+}
+
+// a scan key may cover only some of the index columns.
+// it then matches all keys starting with it, so CMP_GT and CMP_LE
+// must compare against the end of that prefix.
+func encodeScanKey(prefix uint32, vals []Value, cmp int) []byte {
+  key := encodeKey(nil, prefix, vals)
+  if cmp == CMP_GT || cmp == CMP_LE {
+    key = prefixEnd(key)
+  }
+  return key
+}
+
+// the smallest key larger than all keys starting with `key`
+func prefixEnd(key []byte) []byte {
+  out := append([]byte(nil), key...)
+  for i := len(out) - 1; i >= 0; i-- {
+    if out[i] < 0xff {
+      out[i]++
+      return out[:i+1]
+    }
+  }
+  panic("unreachable") // the 4-byte table prefix is small
+}
+
+// within the range?
+func (sc *Scanner) Valid() bool {
+  if !sc.iter.Valid() {
+    return false
+  }
+  r := bytes.Compare(sc.iter.Key(), sc.keyEnd)
+  if sc.Cmp1 > 0 {
+    return r < 0
+  }
+  return r >= 0
+}
+
+// move the underlying B-tree iterator
+func (sc *Scanner) Next() {
+  assert(sc.Valid())
+  sc.step()
+  sc.skipDeleted()
+}
+
+func (sc *Scanner) step() {
+  if sc.Cmp1 > 0 {
+    sc.iter.Next()
+  } else {
+    sc.iter.Prev()
+  }
+}
+
+// fetch the current row
+func (sc *Scanner) Deref(rec *Record) error {
+  assert(sc.Valid())
+  tdef := sc.tdef
+  if sc.index < 0 {
+    // the primary key
+    values := make([]Value, len(tdef.Cols))
+    for i := range values {
+      values[i].Type = tdef.Types[i]
+    }
+    if _, err := decodeKey(sc.iter.Key(), values[:tdef.PKeys]); err != nil {
+      return err
+    }
+    val, err := rowDecode(sc.tx, tdef, sc.iter.Key(), sc.iter.Val())
+    if err != nil {
+      return err
+    }
+    if err := decodeValues(val, values[tdef.PKeys:]); err != nil {
+      return err
+    }
+    rec.Cols = tdef.Cols
+    rec.Vals = values
+    return nil
+  }
+  // a secondary index, the primary key is in the index key
+  pkey, err := sc.primaryKey()
+  if err != nil {
+    return err
+  }
+  *rec = pkey
+  ok, err := dbGetAll(sc.tx, tdef, rec, true) // skipped by skipDeleted()
+  if err != nil {
+    return err
+  }
+  if !ok {
+    return errors.New("index entry without a row")
+  }
+  return nil
+}
+
+// the primary key of the current row, without fetching the row
+func (sc *Scanner) primaryKey() (Record, error) {
+  assert(sc.Valid())
+  tdef := sc.tdef
+  index := tdef.Cols[:tdef.PKeys]
+  if sc.index >= 0 {
+    index = tdef.Indexes[sc.index]
+  }
+  ivals := make([]Value, len(index))
+  for i, col := range index {
+    ivals[i].Type = tdef.Types[colIndex(tdef, col)]
+  }
+  rec := Record{}
+  if _, err := decodeKey(sc.iter.Key(), ivals); err != nil {
+    return rec, err
+  }
+  for i, col := range index {
+    if colIndex(tdef, col) < tdef.PKeys {
+      rec.Cols = append(rec.Cols, col)
+      rec.Vals = append(rec.Vals, ivals[i])
+    }
+  }
+  return rec, nil
+}
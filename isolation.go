@@ -0,0 +1,68 @@
+package main
+
+// a read-committed transaction doesn't keep a snapshot from its start.
+// each read sees the latest committed version at the time of the read,
+// so a transaction left open for long doesn't keep old versions alive,
+// at the cost of repeatable reads: the same key read twice can differ.
+// the updates are buffered and applied on commit, like the default mode.
+func (db *KV) BeginReadCommitted(tx *KVTX) {
+  tx.db = db
+  db.mu.Lock()
+  tx.version = db.version
+  db.mu.Unlock()
+  tx.snapshot = BTree{}
+  tx.pending = newMemTree()
+  tx.done = false
+  tx.readCommitted, tx.held, tx.pinned = true, 0, nil
+  tx.committed, tx.precommit = nil, nil
+  tx.serializable, tx.reads = false, nil
+  tx.id, tx.locked = db.txids.Add(1), false
+  schedBegin(tx)
+}
+
+// the version for the next read.
+// an iterator keeps the tree it was created on, so a re-pinned version is
+// a new tree and the earlier iterators are not affected.
+func (tx *KVTX) view() *BTree {
+  if !tx.readCommitted {
+    return &tx.snapshot
+  }
+  if tx.held > 0 {
+    return tx.pinned
+  }
+  tree := tx.db.latest()
+  return &tree
+}
+
+// read a single version until the returned function is called, for a
+// statement that reads more than once, e.g. an index then the rows.
+// it can be nested, and does nothing in the default mode.
+func (tx *KVTX) HoldSnapshot() (release func()) {
+  if !tx.readCommitted {
+    return func() {}
+  }
+  if tx.held == 0 {
+    tree := tx.db.latest()
+    tx.pinned = &tree
+  }
+  tx.held++
+  return func() {
+    if tx.held--; tx.held == 0 {
+      tx.pinned = nil
+    }
+  }
+}
+
+// see KV.BeginReadCommitted
+func (db *DB) BeginReadCommitted(tx *DBTX) {
+  tx.db = db
+  tx.tables = map[string]*TableDef{}
+  schemaBegin(tx)
+  db.kv.BeginReadCommitted(&tx.kv)
+}
+
+// see KVTX.HoldSnapshot. a Scanner on a secondary index reads the rows as
+// it goes, it should be used while the snapshot is held.
+func (tx *DBTX) HoldSnapshot() (release func()) {
+  return tx.kv.HoldSnapshot()
+}
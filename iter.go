@@ -0,0 +1,188 @@
+package main
+
+import (
+  "bytes"
+)
+
+// B-tree iterator, a path from the root to a leaf.
+// it reads the tree version it was created on, any update to the tree
+// invalidates it.
+type BIter struct {
+  tree *BTree
+  path []BNode  // from root to leaf
+  pos  []uint16 // indexes into nodes
+  now  int64    // for the expired keys, see ttl.go
+}
+
+// comparison operators for Seek
+const (
+  CMP_GE = +3 // >=
+  CMP_GT = +2 // >
+  CMP_LT = -2 // <
+  CMP_LE = -3 // <=
+)
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+  iter := &BIter{tree: tree, now: tree.now()}
+  if tree.root == 0 {
+    return iter
+  }
+  var ptrs []uint64
+  for ptr := tree.root; ; {
+    ptrs = append(ptrs, ptr)
+    checkDepth(ptrs, tree.maxDepth)
+    node := BNode(tree.get(ptr))
+    assertNode(node)
+    idx := nodeLookupLE(node, key)
+    iter.path = append(iter.path, node)
+    iter.pos = append(iter.pos, idx)
+    if node.btype() == BNODE_LEAF {
+      break
+    }
+    ptr = node.getPtr(idx)
+  }
+  if leaf := len(iter.path) - 1; iter.pos[leaf] >= iter.path[leaf].nkeys() {
+    // before the first key of the leaf, the key is in the previous one
+    iter.pos[leaf] = 0
+    iter.prev()
+  }
+  iter.skipExpired(-1)
+  return iter
+}
+
+// the position of the largest key
+func (tree *BTree) SeekLast() *BIter {
+  iter := &BIter{tree: tree, now: tree.now()}
+  if tree.root == 0 {
+    return iter
+  }
+  var ptrs []uint64
+  for ptr := tree.root; ; {
+    ptrs = append(ptrs, ptr)
+    checkDepth(ptrs, tree.maxDepth)
+    node := BNode(tree.get(ptr))
+    idx := node.nkeys() - 1
+    iter.path = append(iter.path, node)
+    iter.pos = append(iter.pos, idx)
+    if node.btype() == BNODE_LEAF {
+      break
+    }
+    ptr = node.getPtr(idx)
+  }
+  iter.skipExpired(-1)
+  return iter
+}
+
+// find the closest position to the key with respect to the `cmp` relation
+func (tree *BTree) Seek(key []byte, cmp int) *BIter {
+  iter := tree.SeekLE(key)
+  // the sentinel is less than any key
+  if cmp != CMP_LE && !(iter.Valid() && cmpOK(iter.Key(), cmp, key)) {
+    // off by one
+    if cmp > 0 {
+      iter.Next()
+    } else {
+      iter.Prev()
+    }
+  }
+  return iter
+}
+
+func cmpOK(key []byte, cmp int, ref []byte) bool {
+  r := bytes.Compare(key, ref)
+  switch cmp {
+  case CMP_GE:
+    return r >= 0
+  case CMP_GT:
+    return r > 0
+  case CMP_LT:
+    return r < 0
+  case CMP_LE:
+    return r <= 0
+  default:
+    panic("bad cmp")
+  }
+}
+
+// positioned at a user key? the sentinel is before the first key,
+// and the iterator can also be past the last key.
+func (iter *BIter) Valid() bool {
+  if len(iter.path) == 0 {
+    return false
+  }
+  leaf, pos := iter.path[len(iter.path)-1], iter.pos[len(iter.pos)-1]
+  return pos < leaf.nkeys() && len(leaf.getKey(pos)) > 0
+}
+
+// at the last key of the leaf?
+func (iter *BIter) leafEnd() bool {
+  leaf, pos := iter.path[len(iter.path)-1], iter.pos[len(iter.pos)-1]
+  return pos + 1 >= leaf.nkeys()
+}
+
+// the current KV pair, only valid until the tree is updated.
+func (iter *BIter) Key() []byte {
+  assert(iter.Valid())
+  return iter.path[len(iter.path)-1].getKey(iter.pos[len(iter.pos)-1])
+}
+
+func (iter *BIter) Val() []byte {
+  assert(iter.Valid())
+  return treeVal(iter.tree, iter.path[len(iter.path)-1], iter.pos[len(iter.pos)-1])
+}
+
+// move forward, O(1) amortized
+func (iter *BIter) Next() {
+  iter.next()
+  iter.skipExpired(+1)
+}
+
+// move backward, O(1) amortized
+func (iter *BIter) Prev() {
+  iter.prev()
+  iter.skipExpired(-1)
+}
+
+// the moves including the expired keys
+func (iter *BIter) next() {
+  if len(iter.path) == 0 {
+    return
+  }
+  // the lowest level that can move right
+  level := len(iter.path) - 1
+  for level >= 0 && iter.pos[level] + 1 >= iter.path[level].nkeys() {
+    level--
+  }
+  if level < 0 {
+    leaf := len(iter.path) - 1
+    iter.pos[leaf] = iter.path[leaf].nkeys() // past the last key
+    return
+  }
+  iter.pos[level]++
+  // walk down to the leftmost leaf
+  for level++; level < len(iter.path); level++ {
+    kid := BNode(iter.tree.get(iter.path[level-1].getPtr(iter.pos[level-1])))
+    iter.path[level], iter.pos[level] = kid, 0
+  }
+}
+
+func (iter *BIter) prev() {
+  if len(iter.path) == 0 {
+    return
+  }
+  // the lowest level that can move left
+  level := len(iter.path) - 1
+  for level >= 0 && iter.pos[level] == 0 {
+    level--
+  }
+  if level < 0 {
+    return // at the sentinel, nothing is before it
+  }
+  iter.pos[level]--
+  // walk down to the rightmost leaf
+  for level++; level < len(iter.path); level++ {
+    kid := BNode(iter.tree.get(iter.path[level-1].getPtr(iter.pos[level-1])))
+    iter.path[level], iter.pos[level] = kid, kid.nkeys() - 1
+  }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+  "sort"
+  "sync"
+  "sync/atomic"
+)
+
+// keyspace notifications: the keys changed by each commit, like the
+// keyspace events of Redis. they are collected by the writer as it
+// applies the updates and delivered after the commit is visible, with
+// the writer lock held, so the subscribers see the commits in order.
+// the server sends them as Redis pub/sub messages, see server.go.
+
+// the events
+const (
+  KEY_SET     = "set"
+  KEY_DEL     = "del"
+  KEY_EXPIRED = "expired" // deleted by Sweep
+)
+
+type KeyEvent struct {
+  TXID  uint64 // the version of the store after the commit
+  Key   []byte
+  Event string
+}
+
+type keySub struct {
+  pattern []byte // nil for all the keys
+  fn      func(KeyEvent)
+}
+
+type keyspaceState struct {
+  count   atomic.Int32 // the subscriptions, nothing is collected without them
+  mu      sync.Mutex   // guards subs
+  subs    map[int]*keySub
+  nsubs   int
+  pending []KeyEvent // the events of the commit in progress, under the writer lock
+}
+
+// call fn for each key changed by a commit that matches the glob pattern,
+// see respGlob. the returned function stops it. fn is called in commit
+// order by the committing goroutine while the next commits wait, so it
+// should be quick and it can't update the store. an empty pattern is all
+// the keys. the keys of the tables of a DB are encoded.
+func (db *KV) SubscribeKeys(pattern []byte, fn func(KeyEvent)) (cancel func()) {
+  ks := &db.keys
+  ks.mu.Lock()
+  defer ks.mu.Unlock()
+  if ks.subs == nil {
+    ks.subs = map[int]*keySub{}
+  }
+  id := ks.nsubs
+  ks.nsubs++
+  ks.subs[id] = &keySub{pattern: append([]byte(nil), pattern...), fn: fn}
+  ks.count.Add(1)
+  once := sync.Once{}
+  return func() {
+    once.Do(func() {
+      ks.mu.Lock()
+      defer ks.mu.Unlock()
+      delete(ks.subs, id)
+      ks.count.Add(-1)
+    })
+  }
+}
+
+// a key is updated by the commit in progress, with the writer lock held
+func keyEvent(db *KV, key []byte, event string) {
+  if db.keys.count.Load() > 0 {
+    db.keys.pending = append(db.keys.pending, KeyEvent{Key: append([]byte(nil), key...), Event: event})
+  }
+}
+
+// the commit is visible as `version`
+func keysPublish(db *KV, version uint64) {
+  events := db.keys.pending
+  db.keys.pending = nil
+  if len(events) == 0 {
+    return
+  }
+  for _, sub := range keySubscribers(db) {
+    for _, ev := range events {
+      if sub.pattern == nil || respGlob(sub.pattern, ev.Key) {
+        ev.TXID = version
+        sub.fn(ev)
+      }
+    }
+  }
+}
+
+func keysRevert(db *KV) {
+  db.keys.pending = nil
+}
+
+// in the order of subscription
+func keySubscribers(db *KV) []*keySub {
+  ks := &db.keys
+  ks.mu.Lock()
+  defer ks.mu.Unlock()
+  ids := make([]int, 0, len(ks.subs))
+  for id := range ks.subs {
+    ids = append(ids, id)
+  }
+  sort.Ints(ids)
+  subs := make([]*keySub, len(ids))
+  for i, id := range ids {
+    subs[i] = ks.subs[id]
+  }
+  return subs
+}
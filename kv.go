@@ -0,0 +1,578 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "maps"
+  "os"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// a KV store persisted in a single file.
+// pages are read through mmap and written with pwrite.
+// page 0 is the master page, the rest are B-tree nodes.
+// readers work on snapshots of committed versions and can run concurrently
+// with each other and with a single writer. Open and Close are not
+// concurrency-safe.
+type KV struct {
+  Path    string
+  Warmup  int // the number of pages to prefetch on open, from the root down
+  Options Options
+  // internals
+  store   Store // the B-tree file, see store.go
+  retired []Store // the stores replaced by Compact, still read by the old snapshots
+  tree    BTree
+  page struct {
+    flushed   uint64   // database size in number of pages
+    temp      [][]byte // newly allocated pages
+    committed int      // temp pages of commits not written to the file
+    updates   map[uint64][]byte // reused pages not written yet, see freelist.go
+  }
+  free freeList // see freelist.go
+  sums struct {
+    fd   *os.File
+    crcs []uint32 // the checksums of the flushed pages
+  }
+  cold coldFile // see Options.ColdTier
+  stats struct {
+    reads  atomic.Uint64 // pages read from the file
+    writes uint64        // pages written to the file
+  }
+  wal struct {
+    fd   *os.File
+    size int64  // the end of the last record
+    ops  []byte // the updates logged since the last commit
+  }
+  // the directory syncs in the background, see Options.DirSync
+  dirs struct {
+    wg  sync.WaitGroup
+    mu  sync.Mutex
+    err error // the first failed one
+  }
+  failed bool // did the last update fail?
+  startup StartupReport // see KV.Startup
+  // concurrency control
+  writer  sync.Mutex // serializes the updates, guards tree, store, page and failed
+  mu      sync.Mutex // guards the fields below
+  version uint64     // incremented by each commit
+  view    struct {
+    root    uint64   // the latest committed tree
+    flushed uint64   // the pages after it are in `temp`
+    temp    [][]byte // pages of commits not written to the file
+    updates map[uint64][]byte // reused pages of commits not written, a copy
+    sums    []uint32 // the checksums of the pages in the file
+  }
+  // the number of transactions and snapshots on each version. pages freed
+  // by later versions are still reachable from them, see freelist.go
+  readers map[uint64]int
+  // the writes checked against the serializable transactions, see serial.go
+  serial serialState
+  sched  ioSched // see BeginBatch
+  keys   keyspaceState // see SubscribeKeys
+  clock  *hlcClock     // see Options.Clock
+  // the latest time read on Open that was too far ahead, see hlcClock.observe
+  clockAhead int64
+  // the samples of SampleOccupancy, under the writer lock
+  occupancy occupancyState
+  locks     LockManager   // see KVTX.Lock
+  txids     atomic.Uint64 // the last KVTX.id
+}
+
+// options of KV.Open
+type Options struct {
+  // commit by appending the updates to a write-ahead log instead of
+  // writing the tree. the tree is still copy-on-write, it's written at
+  // checkpoints. a commit costs a log append and an fsync instead of
+  // a path of pages plus the master page with 2 fsyncs.
+  WAL bool
+  // checkpoint when this many tree pages are not written yet
+  CheckpointPages int // 0 for WAL_CHECKPOINT_PAGES
+  // keep everything in memory without a file, `Path` is not used.
+  // for tests and throwaway stores. like in a file, pages are reused.
+  InMemory bool
+  // OPEN_CREATE (the default), OPEN_EXCL or OPEN_NOCREATE.
+  // a new file is created atomically, concurrent Opens of the same path
+  // from different processes are safe.
+  Create int
+  // DIRSYNC_ON (the default), DIRSYNC_BACKGROUND or DIRSYNC_OFF, how the
+  // directory is synced after a file is created or renamed, see create.go
+  DirSync int
+  // the page size of a new file, 0 for BTREE_PAGE_SIZE. an existing file
+  // keeps the page size it was created with.
+  PageSize int
+  // the max height of the tree, a deeper path is a corrupted tree such as
+  // a pointer cycle. 0 to derive it from the number of pages.
+  MaxDepth int
+  // check the file on Open, CHECK_OFF, CHECK_FAST or CHECK_FULL.
+  // the result is in KV.Startup.
+  StartupCheck int
+  // open the file and its checksums read-only, the updates fail with
+  // ErrReadOnly. a WAL left to replay can't be opened this way.
+  ReadOnly bool
+  // store a checksum with each KV written from now on, verified by Get
+  // and Verify. the KVs written before are not checked.
+  EntryChecksums bool
+  // debugging: compare each page read from the mmap with a pread of the
+  // same page, and panic on a mismatch. slow.
+  ShadowReads bool
+  // the storage of the B-tree file instead of the file at Path, e.g. a
+  // MemStore. it's closed with the KV. see store.go
+  Store Store
+  // store the values larger than ColdMinSize in the cold file, at
+  // ColdPath or by default the path with "-cold" appended. the existing
+  // values are moved with MigrateTier. see cold.go
+  ColdTier    bool
+  ColdPath    string
+  ColdMinSize int // 0 for all the values in overflow pages
+  // the page reads per second of a batch transaction while interactive
+  // ones are in progress, 0 for no limit. see BeginBatch
+  BatchReadRate int
+  // the wall clock of the TTLs, the commit times, the retention of
+  // Purge and the maintenance waits, nil for the system clock. the stores
+  // without it share one hybrid logical clock, see clock.go
+  Clock Clock
+  // the average used fraction of the pages of a level below which
+  // SampleOccupancy reports the sparse subtrees, 0 for OCCUPANCY_MIN
+  OccupancyMin float64
+  // the wait of KVTX.Lock for a lock held by others, 0 to wait until it's
+  // granted or the transaction is picked to break a deadlock
+  LockTimeout time.Duration
+  // the directory of the files written by the QL statement BACKUP TO,
+  // the statement names a file in it. empty to reject the statement,
+  // KV.Backup takes any path.
+  BackupDir string
+}
+
+func (db *KV) Open() error {
+  db.startup, db.clockAhead = StartupReport{}, 0
+  if size := db.Options.PageSize; size != 0 {
+    if err := checkPageSize(size); err != nil {
+      return fmt.Errorf("KV.Open: %w", err)
+    }
+    db.tree.psize = size
+  }
+  db.tree.entrySums = db.Options.EntryChecksums
+  clockOpen(db)
+  locksOpen(db)
+  db.mu.Lock()
+  db.readers = map[uint64]int{} // not those of a previous Open, see KV.pin
+  db.mu.Unlock()
+  if db.Options.InMemory {
+    return memOpen(db)
+  }
+  if err := storeOpen(db); err != nil {
+    return fmt.Errorf("KV.Open: %w", err)
+  }
+  // B-tree callbacks
+  db.tree.usePages(kvPages{db})
+  db.tree.onWrite = func(key []byte) { serialWrote(db, key) }
+  // read the master page
+  if err := readRoot(db); err != nil {
+    db.Close()
+    return fmt.Errorf("KV.Open: %w", err)
+  }
+  if err := sumOpen(db); err != nil {
+    db.Close()
+    return fmt.Errorf("KV.Open: %w", err)
+  }
+  // before the log, which may have cold values
+  if err := coldOpen(db); err != nil {
+    db.Close()
+    return fmt.Errorf("KV.Open: %w", err)
+  }
+  // before the log, which frees pages
+  if err := freeOpen(db); err != nil {
+    db.Close()
+    return fmt.Errorf("KV.Open: %w", err)
+  }
+  // apply the commits left in the WAL
+  if err := walOpen(db); err != nil {
+    db.Close()
+    return fmt.Errorf("KV.Open: %w", err)
+  }
+  if db.Warmup > 0 {
+    warmup(db, db.Warmup)
+  }
+  publish(db)
+  startupCheck(db)
+  return nil
+}
+
+// a store without a file, see Options.InMemory
+func memOpen(db *KV) error {
+  if db.Options.WAL {
+    return errors.New("KV.Open: no WAL for an in-memory store")
+  }
+  if db.Options.ReadOnly {
+    return fmt.Errorf("KV.Open: in-memory store: %w", ErrReadOnly)
+  }
+  if db.Options.ColdTier {
+    return errors.New("KV.Open: no cold tier for an in-memory store")
+  }
+  db.tree.usePages(kvPages{db})
+  db.tree.onWrite = func(key []byte) { serialWrote(db, key) }
+  db.page.flushed = 1 // page 0 is still the master page
+  db.free = freeList{}
+  publish(db)
+  return nil
+}
+
+func (db *KV) Close() {
+  walClose(db)
+  freeClose(db)
+  _ = dirSyncWait(db)
+  if db.store != nil {
+    _ = db.store.Close()
+    db.store = nil
+  }
+  for _, store := range db.retired {
+    _ = store.Close()
+  }
+  db.retired = nil
+  if db.sums.fd != nil {
+    _ = db.sums.fd.Close()
+    db.sums.fd = nil
+  }
+  coldClose(db)
+}
+
+// read the db
+func (db *KV) Get(key []byte) ([]byte, bool) {
+  tree, release := db.snapshot()
+  defer release()
+  val, ok := tree.Get(key)
+  // the page can be reused after the release
+  return bytes.Clone(val), ok
+}
+
+// iterate the db, see BTree.Seek.
+// the iterator is on a snapshot, later updates don't affect it. its keys
+// and values are valid while it's reachable, the pages are reused after.
+func (db *KV) Seek(key []byte, cmp int) *BIter {
+  tree := db.latest()
+  return tree.Seek(key, cmp)
+}
+
+// the caller holds db.mu
+func (db *KV) viewTree() BTree {
+  store, flushed, temp, sums := db.store, db.view.flushed, db.view.temp, db.view.sums
+  updates := db.view.updates
+  reads, size := &db.stats.reads, db.tree.pageSize()
+  npages := flushed + uint64(len(temp))
+  return BTree{
+    root: db.view.root,
+    psize: size,
+    maxDepth: maxDepth(&db.Options, npages),
+    get: func(ptr uint64) []byte {
+      if page, ok := updates[ptr]; ok {
+        return page
+      }
+      if ptr >= flushed {
+        return temp[ptr - flushed]
+      }
+      reads.Add(1)
+      return checkPage(sums, ptr, store.ReadPage(ptr, size))
+    },
+    cold: db.tree.cold, // the snapshot only reaches the flushed pages
+    clock: db.clock,
+    file: db.tree.file,
+  }
+}
+
+// make the committed tree visible to new readers
+func publish(db *KV) {
+  db.mu.Lock()
+  db.version++
+  version := db.version
+  serialPublish(db, db.version)
+  db.view.root = db.tree.root
+  // extending the mmap only appends, the old slices stay valid
+  // so does `temp` until it's written, see writePages()
+  db.view.flushed = db.page.flushed
+  db.view.temp = db.page.temp[:db.page.committed]
+  db.view.updates = nil
+  if len(db.page.updates) > 0 {
+    db.view.updates = maps.Clone(db.page.updates) // until the checkpoint
+  }
+  db.view.sums = db.sums.crcs
+  freeCommit(db)
+  db.tree.maxDepth = maxDepth(&db.Options, db.page.flushed + uint64(len(db.page.temp)))
+  db.mu.Unlock()
+  keysPublish(db, version)
+}
+
+// update the db
+func (db *KV) Set(key []byte, val []byte) error {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  meta := saveMeta(db)
+  if err := db.tree.Insert(key, val); err != nil {
+    return err
+  }
+  walLog(db, key, val, false)
+  keyEvent(db, key, KEY_SET)
+  return updateOrRevert(db, meta)
+}
+
+func (db *KV) Del(key []byte) (bool, error) {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  meta := saveMeta(db)
+  deleted, err := db.tree.Delete(key)
+  if err != nil || !deleted {
+    return deleted, err
+  }
+  walLog(db, key, nil, true)
+  keyEvent(db, key, KEY_DEL)
+  return true, updateOrRevert(db, meta)
+}
+
+// callback for BTree, dereference a pointer.
+func (db *KV) pageGet(ptr uint64) []byte {
+  if page, ok := db.page.updates[ptr]; ok {
+    return page // reused, not written yet
+  }
+  if ptr >= db.page.flushed {
+    return db.page.temp[ptr - db.page.flushed] // not written yet
+  }
+  db.stats.reads.Add(1)
+  return checkPage(db.sums.crcs, ptr, db.store.ReadPage(ptr, db.tree.pageSize()))
+}
+
+// callback for BTree, allocate a new page.
+func (db *KV) pageNew(node []byte) uint64 {
+  assert(len(node) <= db.tree.pageSize())
+  if ptr, ok := freeAlloc(db); ok {
+    if ptr >= db.page.flushed {
+      db.page.temp[ptr - db.page.flushed] = node // in memory, never written
+    } else {
+      if db.page.updates == nil {
+        db.page.updates = map[uint64][]byte{}
+      }
+      db.page.updates[ptr] = node
+      db.sums.crcs[ptr] = 0 // until it's written, see writePages
+    }
+    return ptr
+  }
+  ptr := db.page.flushed + uint64(len(db.page.temp))
+  db.page.temp = append(db.page.temp, node)
+  return ptr
+}
+
+// callback for BTree, deallocate a page. it's reused once no reader
+// can reach it, see freelist.go
+func (db *KV) pageDel(ptr uint64) {
+  db.free.freed = append(db.free.freed, ptr)
+}
+
+const DB_SIG = "BuildYourOwnDB06"
+// 1: 4K pages. 2: the page size is in the master page.
+// version 1 files are upgraded on the 1st write.
+const DB_VERSION = 2
+
+// the master page contains the pointer to the root and other important bits.
+// | sig | version | root_ptr | page_used | page_size | clock |
+// | 16B |   8B    |    8B    |    8B     |    8B     |  8B   |
+// the clock is the latest time of hlcClock, 0 in older files.
+func saveMeta(db *KV) []byte {
+  var data [56]byte
+  copy(data[:16], []byte(DB_SIG))
+  binary.LittleEndian.PutUint64(data[16:], DB_VERSION)
+  binary.LittleEndian.PutUint64(data[24:], db.tree.root)
+  binary.LittleEndian.PutUint64(data[32:], db.page.flushed)
+  binary.LittleEndian.PutUint64(data[40:], uint64(db.tree.pageSize()))
+  binary.LittleEndian.PutUint64(data[48:], uint64(db.clock.latest()))
+  return data[:]
+}
+
+func loadMeta(db *KV, data []byte) {
+  db.tree.root = binary.LittleEndian.Uint64(data[24:])
+  db.page.flushed = binary.LittleEndian.Uint64(data[32:])
+}
+
+func readRoot(db *KV) error {
+  fsize, err := db.store.Size()
+  if err != nil {
+    return err
+  }
+  if fsize == 0 {
+    // an empty file from an older version, the master page will be
+    // created on the 1st write
+    db.page.flushed = 1 // reserved for the master page
+    return nil
+  }
+  if fsize < BTREE_PAGE_MIN {
+    return fmt.Errorf("the file is shorter than a page: %d bytes", fsize)
+  }
+  data := db.store.ReadPage(0, BTREE_PAGE_MIN)
+  // verify the page
+  if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+    return corruptf(0, "bad signature")
+  }
+  size := BTREE_PAGE_SIZE
+  switch version := binary.LittleEndian.Uint64(data[16:]); version {
+  case 1:
+  case DB_VERSION:
+    size = int(binary.LittleEndian.Uint64(data[40:]))
+    if err := checkPageSize(size); err != nil {
+      return err
+    }
+  default:
+    return fmt.Errorf("unsupported format version %d", version)
+  }
+  if db.Options.PageSize != 0 && db.Options.PageSize != size {
+    return fmt.Errorf("the file has a page size of %d, not %d", size, db.Options.PageSize)
+  }
+  db.tree.psize = size
+  if fsize % int64(size) != 0 {
+    return errors.New("file size is not a multiple of page size")
+  }
+  loadMeta(db, data)
+  bound := uint64(fsize / int64(size))
+  if !(0 < db.page.flushed && db.page.flushed <= bound && db.tree.root < db.page.flushed) {
+    return corruptf(0, "bad master page")
+  }
+  if t := int64(binary.LittleEndian.Uint64(data[48:])); !db.clock.observe(t) {
+    clockAhead(db, t)
+  }
+  return nil
+}
+
+// update the master page. it must be atomic.
+func updateRoot(db *KV) error {
+  // a write smaller than a disk sector is never torn
+  if err := db.store.WriteAt(saveMeta(db), 0); err != nil {
+    return fmt.Errorf("write master page: %w", err)
+  }
+  return nil
+}
+
+// persist the newly allocated pages, then switch to the new root.
+// on error, the in-memory state is reverted to what's on disk.
+func updateOrRevert(db *KV, meta []byte) error {
+  if db.Options.ReadOnly {
+    revertMeta(db, meta)
+    return ErrReadOnly
+  }
+  if db.Options.InMemory {
+    // the pages are never written, the committed ones are kept in `temp`
+    db.page.committed = len(db.page.temp)
+    db.free.written = true
+    publish(db)
+    return nil
+  }
+  // the files of the commit must survive a crash, and the cold pages
+  // are written before the pages that reference them
+  err := dirSyncWait(db)
+  if err == nil {
+    err = coldFlush(db)
+  }
+  if err != nil {
+    revertMeta(db, meta)
+    return err
+  }
+  if db.Options.WAL {
+    return walCommit(db, meta)
+  }
+  // the on-disk master page may have been updated by the failed write,
+  // make sure it matches the in-memory state first.
+  if db.failed {
+    if err := updateRoot(db); err != nil {
+      return err
+    }
+    if err := db.store.Sync(); err != nil {
+      return fmt.Errorf("fsync: %w", err)
+    }
+    db.failed = false
+  }
+  err = updateFile(db)
+  if err != nil {
+    // the new pages are discarded, the old root is still valid
+    // because pages are never overwritten while reachable.
+    db.failed = true
+    revertMeta(db, meta)
+    return err
+  }
+  db.free.written = true
+  publish(db)
+  return nil
+}
+
+// discard the in-memory updates since `meta` was saved
+func revertMeta(db *KV, meta []byte) {
+  loadMeta(db, meta)
+  freeRevert(db)
+  db.page.temp = db.page.temp[:db.page.committed]
+  if uint64(len(db.sums.crcs)) > db.page.flushed {
+    db.sums.crcs = db.sums.crcs[:db.page.flushed] // the pages are written again
+  }
+  db.wal.ops = db.wal.ops[:0]
+  db.cold.temp = nil
+  serialRevert(db)
+  keysRevert(db)
+}
+
+func updateFile(db *KV) error {
+  // 1. write the new nodes, the cold ones are written by updateOrRevert
+  if err := writePages(db); err != nil {
+    return err
+  }
+  freeCut(db)
+  // 2. fsync to enforce the order between 1 and 3
+  if err := db.store.Sync(); err != nil {
+    return fmt.Errorf("fsync: %w", err)
+  }
+  if err := db.sums.fd.Sync(); err != nil {
+    return fmt.Errorf("fsync checksums: %w", err)
+  }
+  // 3. update the root pointer atomically
+  if err := updateRoot(db); err != nil {
+    return err
+  }
+  // 4. fsync to make everything persistent
+  if err := db.store.Sync(); err != nil {
+    return fmt.Errorf("fsync: %w", err)
+  }
+  // at least, the update in progress is published as the next one
+  db.free.durable = db.version
+  freeShrink(db)
+  return nil
+}
+
+func writePages(db *KV) error {
+  // write the pages, the file is extended as needed
+  sums := make([]uint32, len(db.page.temp))
+  for i, page := range db.page.temp {
+    ptr := db.page.flushed + uint64(i)
+    if err := db.store.WriteAt(page, int64(ptr) * int64(db.tree.pageSize())); err != nil {
+      return fmt.Errorf("write page: %w", err)
+    }
+    sums[i] = pageSum(page, db.tree.pageSize())
+  }
+  if err := sumWrite(db, sums); err != nil {
+    return err
+  }
+  // the reused pages, no reader reaches them or their checksums
+  for ptr, page := range db.page.updates {
+    if err := db.store.WriteAt(page, int64(ptr) * int64(db.tree.pageSize())); err != nil {
+      return fmt.Errorf("write page: %w", err)
+    }
+    db.sums.crcs[ptr] = pageSum(page, db.tree.pageSize())
+    if err := sumUpdate(db, ptr); err != nil {
+      return err
+    }
+  }
+  db.stats.writes += uint64(len(db.page.updates))
+  clear(db.page.updates)
+  assert(uint64(len(db.sums.crcs)) == db.page.flushed)
+  db.sums.crcs = append(db.sums.crcs, sums...)
+  db.stats.writes += uint64(len(db.page.temp))
+  db.page.flushed += uint64(len(db.page.temp))
+  db.page.temp = nil // snapshots may still read the written pages from it
+  db.page.committed = 0
+  return nil
+}
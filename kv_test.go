@@ -0,0 +1,41 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// the files that are not a store
+func TestOpenBadFile(t *testing.T) {
+  dir := t.TempDir()
+  valid := filepath.Join(dir, "valid")
+  db := checksumOpen(t, valid, Options{})
+  db.Set([]byte("k"), []byte("v"))
+  db.Close()
+  file, err := os.ReadFile(valid)
+  if err != nil {
+    t.Fatal(err)
+  }
+  cases := []struct {
+    data []byte
+    err  string
+  }{
+    {make([]byte, 100), "the file is shorter than a page: 100 bytes"},
+    {file[:BTREE_PAGE_MIN-1], "the file is shorter than a page"},
+    {make([]byte, BTREE_PAGE_SIZE), "bad signature"},
+    {append(file, 1), "file size is not a multiple of page size"},
+  }
+  for i, c := range cases {
+    path := filepath.Join(dir, "db")
+    os.Remove(sumPath(&KV{Path: path}))
+    if err := os.WriteFile(path, c.data, 0644); err != nil {
+      t.Fatal(err)
+    }
+    db := &KV{Path: path}
+    if err := db.Open(); err == nil || !strings.Contains(err.Error(), c.err) {
+      t.Fatalf("case %d: %v", i, err)
+    }
+  }
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+  "fmt"
+  "time"
+)
+
+// warn at this fraction of a limit
+const LIMIT_WARN_RATIO = 0.9
+
+// the largest page number, the file offset must fit in an int64
+func maxPages(size int) uint64 {
+  return (1<<63 - 1) / uint64(size)
+}
+
+// report the limits of the format that the store is getting close to,
+// so that they can be acted on before an update fails.
+// the counters are since the store was opened.
+func (db *KV) Warnings() []string {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  var out []string
+  npages := db.page.flushed + uint64(len(db.page.temp))
+  if limit := maxPages(db.tree.pageSize()); float64(npages) >= LIMIT_WARN_RATIO * float64(limit) {
+    out = append(out, fmt.Sprintf("%d pages of at most %d", npages, limit))
+  }
+  if key := db.tree.maxKey; float64(key) >= LIMIT_WARN_RATIO * BTREE_MAX_KEY_SIZE {
+    out = append(out, fmt.Sprintf("a key of %d bytes, the maximum is %d", key, BTREE_MAX_KEY_SIZE))
+  }
+  // a node is split in 3 only if a large key lands in a full node.
+  // this is where nodes with keys close to the maximum end up.
+  splits := db.tree.splits[2] + db.tree.splits[3]
+  if splits >= 100 && db.tree.splits[3] * 10 >= splits {
+    out = append(out, fmt.Sprintf(
+      "%d of %d node splits are 3-way, keys are too large for the page size",
+      db.tree.splits[3], splits,
+    ))
+  }
+  if db.clockAhead != 0 {
+    ahead := time.Duration(db.clockAhead - db.clock.wall.Now().UnixNano())
+    out = append(out, fmt.Sprintf(
+      "the file has a time %v ahead of the wall clock, it was ignored", ahead.Round(time.Second),
+    ))
+  }
+  if db.free.err != nil {
+    out = append(out, fmt.Sprintf("the free list couldn't be rebuilt, no page is reused: %v", db.free.err))
+  }
+  return out
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+  "errors"
+  "sort"
+  "sync"
+  "time"
+)
+
+// lock modes
+const (
+  LOCK_S = 1 // shared
+  LOCK_X = 2 // exclusive
+)
+
+var (
+  // the transaction was picked to break a wait-for cycle; abort and retry.
+  ErrDeadlock = errors.New("deadlock detected")
+  // the lock was not granted within LockManager.Timeout.
+  ErrLockTimeout = errors.New("lock wait timeout")
+  // the transaction released its locks while its request was waiting.
+  ErrLockReleased = errors.New("lock request of a released transaction")
+)
+
+// key locks held by transactions (identified by txid).
+// a conflicting request waits in FIFO order until it's granted,
+// times out, or is chosen as the victim of a deadlock.
+// the KV has one for KVTX.Lock.
+type LockManager struct {
+  Timeout time.Duration // 0 means wait forever
+  Clock   Clock         // of the timeout, nil for the system clock
+  mu      sync.Mutex
+  locks   map[string]*lockState
+  waits   map[uint64]*lockWaiter // the pending request of each tx
+  held    map[uint64][]string    // keys locked by each tx
+}
+
+type lockState struct {
+  holders map[uint64]int // txid -> mode
+  queue   []*lockWaiter
+}
+
+type lockWaiter struct {
+  txid uint64
+  key  string
+  mode int
+  done chan error // nil when granted
+}
+
+func lockCompatible(held int, want int) bool {
+  return held == LOCK_S && want == LOCK_S
+}
+
+// acquire or upgrade a lock on the key.
+func (lm *LockManager) Lock(txid uint64, key []byte, mode int) error {
+  assert(mode == LOCK_S || mode == LOCK_X)
+  lm.mu.Lock()
+  if lm.locks == nil {
+    lm.locks = map[string]*lockState{}
+    lm.waits = map[uint64]*lockWaiter{}
+    lm.held = map[uint64][]string{}
+  }
+  k := string(key)
+  st := lm.locks[k]
+  if st == nil {
+    st = &lockState{holders: map[uint64]int{}}
+    lm.locks[k] = st
+  }
+  if st.holders[txid] >= mode {
+    lm.mu.Unlock()
+    return nil // already held
+  }
+  if len(st.queue) == 0 && st.grantable(txid, mode) {
+    lm.grant(st, txid, k, mode)
+    lm.mu.Unlock()
+    return nil
+  }
+  // wait for it
+  w := &lockWaiter{txid: txid, key: k, mode: mode, done: make(chan error, 1)}
+  if st.holders[txid] > 0 {
+    // upgrades go first, otherwise they always deadlock with the queue.
+    st.queue = append([]*lockWaiter{w}, st.queue...)
+  } else {
+    st.queue = append(st.queue, w)
+  }
+  lm.waits[txid] = w
+  if victim := lm.findDeadlock(txid); victim != nil {
+    lm.dequeue(victim)
+    victim.done <- ErrDeadlock
+  }
+  // an upgrade at the head may be granted already
+  lm.wakeup(k, st)
+  lm.mu.Unlock()
+
+  var timeout <-chan time.Time
+  if lm.Timeout > 0 {
+    clock := lm.Clock
+    if clock == nil {
+      clock = systemClock{}
+    }
+    timeout = clock.After(lm.Timeout)
+  }
+  select {
+  case err := <-w.done:
+    return err
+  case <-timeout:
+    lm.mu.Lock()
+    defer lm.mu.Unlock()
+    select {
+    case err := <-w.done: // resolved before we got the mutex
+      return err
+    default:
+    }
+    lm.dequeue(w)
+    return ErrLockTimeout
+  }
+}
+
+// release all locks of a transaction (on commit or abort).
+func (lm *LockManager) ReleaseAll(txid uint64) {
+  lm.mu.Lock()
+  defer lm.mu.Unlock()
+  if w := lm.waits[txid]; w != nil {
+    lm.dequeue(w)
+    w.done <- ErrLockReleased
+  }
+  for _, k := range lm.held[txid] {
+    st := lm.locks[k]
+    delete(st.holders, txid)
+    lm.wakeup(k, st)
+  }
+  delete(lm.held, txid)
+}
+
+func (st *lockState) grantable(txid uint64, mode int) bool {
+  for holder, held := range st.holders {
+    if holder != txid && !lockCompatible(held, mode) {
+      return false
+    }
+  }
+  return true
+}
+
+func (lm *LockManager) grant(st *lockState, txid uint64, k string, mode int) {
+  if st.holders[txid] == 0 {
+    lm.held[txid] = append(lm.held[txid], k)
+  }
+  st.holders[txid] = mode
+}
+
+// grant waiters from the head of the queue.
+func (lm *LockManager) wakeup(k string, st *lockState) {
+  for len(st.queue) > 0 {
+    w := st.queue[0]
+    if !st.grantable(w.txid, w.mode) {
+      break
+    }
+    st.queue = st.queue[1:]
+    delete(lm.waits, w.txid)
+    lm.grant(st, w.txid, k, w.mode)
+    w.done <- nil
+  }
+  if len(st.holders) == 0 && len(st.queue) == 0 {
+    delete(lm.locks, k)
+  }
+}
+
+// remove a pending request that will not be granted.
+func (lm *LockManager) dequeue(w *lockWaiter) {
+  st := lm.locks[w.key]
+  for i, q := range st.queue {
+    if q == w {
+      st.queue = append(st.queue[:i], st.queue[i+1:]...)
+      break
+    }
+  }
+  delete(lm.waits, w.txid)
+  lm.wakeup(w.key, st) // the waiters behind it may be unblocked
+}
+
+// the transactions a pending request is waiting for.
+func (lm *LockManager) waitsFor(w *lockWaiter) []uint64 {
+  st := lm.locks[w.key]
+  out := []uint64{}
+  for holder, held := range st.holders {
+    if holder != w.txid && !lockCompatible(held, w.mode) {
+      out = append(out, holder)
+    }
+  }
+  for _, q := range st.queue {
+    if q == w {
+      break
+    }
+    if q.txid != w.txid && !(lockCompatible(q.mode, w.mode)) {
+      out = append(out, q.txid)
+    }
+  }
+  // sorted so that the same state always picks the same victim
+  sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+  return out
+}
+
+// look for a cycle in the wait-for graph through the new request.
+// the victim is the youngest (largest txid) transaction in the cycle.
+func (lm *LockManager) findDeadlock(start uint64) *lockWaiter {
+  path := []uint64{}
+  visited := map[uint64]bool{start: true}
+  var walk func(txid uint64) bool
+  walk = func(txid uint64) bool {
+    w := lm.waits[txid]
+    if w == nil {
+      return false // not waiting
+    }
+    path = append(path, txid)
+    for _, next := range lm.waitsFor(w) {
+      if next == start {
+        return true
+      }
+      if !visited[next] {
+        visited[next] = true
+        if walk(next) {
+          return true
+        }
+      }
+    }
+    path = path[:len(path)-1]
+    return false
+  }
+  if !walk(start) {
+    return nil
+  }
+  victim := start
+  for _, txid := range path {
+    if txid > victim {
+      victim = txid
+    }
+  }
+  return lm.waits[victim]
+}
+
+func locksOpen(db *KV) {
+  db.locks.Timeout = db.Options.LockTimeout
+  db.locks.Clock = db.clock.wall
+}
+
+// lock the key, LOCK_S or LOCK_X, until the transaction ends. e.g. a
+// transaction that reads a key and then updates it takes LOCK_X first,
+// so the others wait instead of failing with ErrConflict at the commit.
+// the locks are advisory: only the other Lock calls wait for them, the
+// reads and the updates don't. it fails with ErrDeadlock or
+// ErrLockTimeout, see Options.LockTimeout, the transaction should be
+// aborted and run again, see IsRetryable.
+func (tx *KVTX) Lock(key []byte, mode int) error {
+  assert(!tx.done)
+  tx.locked = true
+  return tx.db.locks.Lock(tx.id, key, mode)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+  "errors"
+  "testing"
+  "time"
+)
+
+// a Lock in a goroutine, the result is sent once it returns
+func lockAsync(lm *LockManager, txid uint64, key string, mode int) chan error {
+  done := make(chan error, 1)
+  go func() { done <- lm.Lock(txid, []byte(key), mode) }()
+  return done
+}
+
+// wait for `n` requests in the queue of the key
+func lockQueued(t *testing.T, lm *LockManager, key string, n int) {
+  t.Helper()
+  for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+    lm.mu.Lock()
+    queued := 0
+    if st := lm.locks[key]; st != nil {
+      queued = len(st.queue)
+    }
+    lm.mu.Unlock()
+    if queued == n {
+      return
+    }
+    time.Sleep(time.Millisecond)
+  }
+  t.Fatalf("%q: not %d waiting", key, n)
+}
+
+func lockGranted(t *testing.T, done chan error) {
+  t.Helper()
+  select {
+  case err := <-done:
+    if err != nil {
+      t.Fatal(err)
+    }
+  case <-time.After(10 * time.Second):
+    t.Fatal("not granted")
+  }
+}
+
+func lockWaiting(t *testing.T, done chan error) {
+  t.Helper()
+  select {
+  case err := <-done:
+    t.Fatalf("granted: %v", err)
+  default:
+  }
+}
+
+func TestLockFIFO(t *testing.T) {
+  lm := &LockManager{}
+  if err := lm.Lock(1, []byte("k"), LOCK_X); err != nil {
+    t.Fatal(err)
+  }
+  x2 := lockAsync(lm, 2, "k", LOCK_X)
+  lockQueued(t, lm, "k", 1)
+  s3 := lockAsync(lm, 3, "k", LOCK_S)
+  lockQueued(t, lm, "k", 2)
+  s4 := lockAsync(lm, 4, "k", LOCK_S)
+  lockQueued(t, lm, "k", 3)
+  lm.ReleaseAll(1)
+  lockGranted(t, x2)
+  lockWaiting(t, s3)
+  lockWaiting(t, s4)
+  // the shared requests behind it are granted together
+  lm.ReleaseAll(2)
+  lockGranted(t, s3)
+  lockGranted(t, s4)
+
+  // a shared request doesn't pass an exclusive one in the queue
+  x5 := lockAsync(lm, 5, "k", LOCK_X)
+  lockQueued(t, lm, "k", 1)
+  s6 := lockAsync(lm, 6, "k", LOCK_S)
+  lockQueued(t, lm, "k", 2)
+  lm.ReleaseAll(3)
+  lm.ReleaseAll(4)
+  lockGranted(t, x5)
+  lockWaiting(t, s6)
+  lm.ReleaseAll(5)
+  lockGranted(t, s6)
+  lm.ReleaseAll(6)
+  if len(lm.locks) != 0 || len(lm.held) != 0 || len(lm.waits) != 0 {
+    t.Fatal("state left", lm.locks, lm.held, lm.waits)
+  }
+}
+
+func TestLockUpgrade(t *testing.T) {
+  lm := &LockManager{}
+  for _, txid := range []uint64{1, 2} {
+    if err := lm.Lock(txid, []byte("k"), LOCK_S); err != nil {
+      t.Fatal(err)
+    }
+  }
+  x3 := lockAsync(lm, 3, "k", LOCK_X)
+  lockQueued(t, lm, "k", 1)
+  // ahead of 3, which waits for both holders
+  up1 := lockAsync(lm, 1, "k", LOCK_X)
+  lockQueued(t, lm, "k", 2)
+  lm.mu.Lock()
+  head := lm.locks["k"].queue[0].txid
+  lm.mu.Unlock()
+  if head != 1 {
+    t.Fatalf("the head of the queue is %d", head)
+  }
+  lm.ReleaseAll(2)
+  lockGranted(t, up1)
+  lockWaiting(t, x3)
+  // held already
+  if err := lm.Lock(1, []byte("k"), LOCK_S); err != nil {
+    t.Fatal(err)
+  }
+  lm.ReleaseAll(1)
+  lockGranted(t, x3)
+  lm.ReleaseAll(3)
+}
+
+// the only holder upgrades ahead of a waiter, nothing else wakes it up
+func TestLockUpgradeQueued(t *testing.T) {
+  lm := &LockManager{}
+  if err := lm.Lock(1, []byte("k"), LOCK_S); err != nil {
+    t.Fatal(err)
+  }
+  x2 := lockAsync(lm, 2, "k", LOCK_X)
+  lockQueued(t, lm, "k", 1)
+  lockGranted(t, lockAsync(lm, 1, "k", LOCK_X))
+  lockWaiting(t, x2)
+  lm.ReleaseAll(1)
+  lockGranted(t, x2)
+  lm.ReleaseAll(2)
+}
+
+func TestLockDeadlock(t *testing.T) {
+  // the youngest of the cycle is the victim, here the one that closes it
+  lm := &LockManager{}
+  lm.Lock(1, []byte("a"), LOCK_X)
+  lm.Lock(2, []byte("b"), LOCK_X)
+  b1 := lockAsync(lm, 1, "b", LOCK_X)
+  lockQueued(t, lm, "b", 1)
+  if err := lm.Lock(2, []byte("a"), LOCK_X); !errors.Is(err, ErrDeadlock) {
+    t.Fatal(err)
+  }
+  lockWaiting(t, b1)
+  lm.ReleaseAll(2)
+  lockGranted(t, b1)
+  lm.ReleaseAll(1)
+
+  // or one that was waiting already
+  lm.Lock(2, []byte("a"), LOCK_X)
+  lm.Lock(1, []byte("b"), LOCK_X)
+  b2 := lockAsync(lm, 2, "b", LOCK_X)
+  lockQueued(t, lm, "b", 1)
+  a1 := lockAsync(lm, 1, "a", LOCK_X)
+  select {
+  case err := <-b2:
+    if !errors.Is(err, ErrDeadlock) {
+      t.Fatal(err)
+    }
+  case <-time.After(10 * time.Second):
+    t.Fatal("no victim")
+  }
+  lockWaiting(t, a1)
+  lm.ReleaseAll(2)
+  lockGranted(t, a1)
+  lm.ReleaseAll(1)
+
+  // a cycle of 3, 1 upgrades ahead of 2 in the queue of "a"
+  lm.Lock(1, []byte("a"), LOCK_S)
+  lm.Lock(3, []byte("a"), LOCK_S)
+  lm.Lock(2, []byte("b"), LOCK_X)
+  a1 = lockAsync(lm, 1, "a", LOCK_X) // waits for 3
+  lockQueued(t, lm, "a", 1)
+  b3 := lockAsync(lm, 3, "b", LOCK_X) // waits for 2
+  lockQueued(t, lm, "b", 1)
+  a2 := lockAsync(lm, 2, "a", LOCK_S) // waits for 1
+  // not 2, whose request closes the cycle, but 3 which is younger
+  select {
+  case err := <-b3:
+    if !errors.Is(err, ErrDeadlock) {
+      t.Fatal(err)
+    }
+  case <-time.After(10 * time.Second):
+    t.Fatal("no victim")
+  }
+  lockWaiting(t, a1)
+  lockWaiting(t, a2)
+  lm.ReleaseAll(3)
+  lockGranted(t, a1)
+  lockWaiting(t, a2)
+  lm.ReleaseAll(1)
+  lockGranted(t, a2)
+  lm.ReleaseAll(2)
+  if len(lm.locks) != 0 || len(lm.waits) != 0 {
+    t.Fatal("state left", lm.locks, lm.waits)
+  }
+}
+
+func TestLockTimeout(t *testing.T) {
+  clock := NewManualClock(time.Unix(1000, 0))
+  lm := &LockManager{Timeout: time.Second, Clock: clock}
+  lm.Lock(1, []byte("k"), LOCK_X)
+  x2 := lockAsync(lm, 2, "k", LOCK_X)
+  for clock.Waiters() == 0 {
+    time.Sleep(time.Millisecond)
+  }
+  clock.Advance(time.Second - time.Nanosecond)
+  lockWaiting(t, x2)
+  clock.Advance(time.Nanosecond)
+  select {
+  case err := <-x2:
+    if !errors.Is(err, ErrLockTimeout) || !IsRetryable(err) {
+      t.Fatal(err)
+    }
+  case <-time.After(10 * time.Second):
+    t.Fatal("no timeout")
+  }
+  lockQueued(t, lm, "k", 0)
+  lm.ReleaseAll(2) // after the error, like an abort
+  lm.ReleaseAll(1)
+  if err := lm.Lock(3, []byte("k"), LOCK_X); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// the request of a transaction that ends while it waits fails
+func TestLockReleased(t *testing.T) {
+  lm := &LockManager{}
+  lm.Lock(1, []byte("k"), LOCK_X)
+  lm.Lock(2, []byte("j"), LOCK_S)
+  x2 := lockAsync(lm, 2, "k", LOCK_X)
+  lockQueued(t, lm, "k", 1)
+  lm.ReleaseAll(2)
+  select {
+  case err := <-x2:
+    if !errors.Is(err, ErrLockReleased) {
+      t.Fatal(err)
+    }
+  case <-time.After(10 * time.Second):
+    t.Fatal("still waiting")
+  }
+  lm.ReleaseAll(1)
+  if len(lm.locks) != 0 || len(lm.held) != 0 || len(lm.waits) != 0 {
+    t.Fatal("state left", lm.locks, lm.held, lm.waits)
+  }
+}
+
+// the locks of the transactions are released by the commit or the abort
+func TestKVTXLock(t *testing.T) {
+  clock := NewManualClock(time.Unix(1000, 0))
+  db := &KV{Options: Options{InMemory: true, Clock: clock, LockTimeout: time.Minute}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  var tx1, tx2, tx3 KVTX
+  db.Begin(&tx1)
+  db.Begin(&tx2)
+  if err := tx1.Lock([]byte("k"), LOCK_X); err != nil {
+    t.Fatal(err)
+  }
+  tx1.Set([]byte("k"), []byte("1"))
+  done := make(chan error, 1)
+  go func() { done <- tx2.Lock([]byte("k"), LOCK_S) }()
+  lockQueued(t, &db.locks, "k", 1)
+  lockWaiting(t, done)
+  if err := db.Commit(&tx1); err != nil {
+    t.Fatal(err)
+  }
+  lockGranted(t, done)
+  db.BeginReadCommitted(&tx3)
+  // the timer of the granted wait is still there
+  waiters := clock.Waiters()
+  go func() { done <- tx3.Lock([]byte("k"), LOCK_X) }()
+  for clock.Waiters() == waiters {
+    time.Sleep(time.Millisecond)
+  }
+  clock.Advance(time.Minute)
+  if err := <-done; !errors.Is(err, ErrLockTimeout) {
+    t.Fatal(err)
+  }
+  db.Abort(&tx3)
+  db.Abort(&tx2)
+  if len(db.locks.held) != 0 || len(db.locks.locks) != 0 {
+    t.Fatal("locks left", db.locks.held)
+  }
+}
@@ -0,0 +1,495 @@
+//go:build longtest
+
+package main
+
+// the long-running suite, hours by default:
+//   go test -tags=longtest -run Long -timeout 0 [-long.duration 2h]
+// each test runs for a share of the duration, then checks everything.
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "flag"
+  "fmt"
+  "math/rand"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+var longDuration = flag.Duration("long.duration", 2 * time.Hour, "the time of the longtest suite")
+
+// the tests of the suite, for the share of each
+const LONG_TESTS = 4
+
+func longDeadline() time.Time {
+  return time.Now().Add(*longDuration / LONG_TESTS)
+}
+
+// the tree against a map, with random seeds until the deadline
+func TestLongTreeOps(t *testing.T) {
+  deadline := longDeadline()
+  for seed := int64(0); time.Now().Before(deadline); seed++ {
+    rng := rand.New(rand.NewSource(seed))
+    r := newTreeRef(t)
+    nkeys := 50 + rng.Intn(2000)
+    for i := 0; i < 3000; i++ {
+      key, val := randKV(rng, nkeys)
+      if rng.Intn(3) == 0 {
+        r.del(key)
+      } else {
+        r.set(key, val)
+      }
+    }
+    for k := range r.ref {
+      r.del([]byte(k))
+    }
+  }
+}
+
+// the updates of commit `seq` of the crash test, the same in both processes
+func crashOps(seq int64) (keys [][]byte, vals [][]byte) {
+  rng := rand.New(rand.NewSource(seq))
+  for i := 1 + rng.Intn(20); i > 0; i-- {
+    key := []byte(fmt.Sprintf("k%04d", rng.Intn(2000)))
+    var val []byte // nil for a delete
+    if rng.Intn(3) != 0 {
+      size := rng.Intn(200)
+      if rng.Intn(30) == 0 {
+        size = BTREE_MAX_VAL_SIZE + rng.Intn(4 * BTREE_PAGE_SIZE)
+      }
+      val = make([]byte, size + 1)
+      rng.Read(val)
+    }
+    keys, vals = append(keys, key), append(vals, val)
+  }
+  return keys, vals
+}
+
+func crashSeq(db *KV) int64 {
+  val, ok := db.Get([]byte("seq"))
+  if !ok {
+    return 0
+  }
+  return int64(binary.LittleEndian.Uint64(val))
+}
+
+// run by the child process of TestLongCrash: commit until killed, and
+// print the sequence number of each commit once it's durable
+func crashChild(path string, wal bool) {
+  db := &KV{Path: path, Options: Options{WAL: wal}}
+  if err := db.Open(); err != nil {
+    fmt.Println("error:", err)
+    os.Exit(1)
+  }
+  for seq := crashSeq(db) + 1; ; seq++ {
+    tx := KVTX{}
+    db.Begin(&tx)
+    keys, vals := crashOps(seq)
+    for i := range keys {
+      if vals[i] == nil {
+        tx.Del(keys[i])
+      } else {
+        tx.Set(keys[i], vals[i])
+      }
+    }
+    tx.Set([]byte("seq"), binary.LittleEndian.AppendUint64(nil, uint64(seq)))
+    if err := db.Commit(&tx); err != nil {
+      fmt.Println("error:", err)
+      os.Exit(1)
+    }
+    fmt.Println(seq)
+  }
+}
+
+// a process killed at random points. after each kill, the store has all
+// the commits that were acknowledged, and at most the one in progress
+// after them. SIGKILL leaves the page cache, this is not a power loss.
+func TestLongCrash(t *testing.T) {
+  if path := os.Getenv("LONGTEST_CRASH_PATH"); path != "" {
+    crashChild(path, os.Getenv("LONGTEST_CRASH_WAL") != "")
+    return
+  }
+  share := time.Until(longDeadline()) / 2
+  for _, wal := range []bool{false, true} {
+    path := filepath.Join(t.TempDir(), "db")
+    model, applied := map[string]string{}, int64(0)
+    rng := rand.New(rand.NewSource(1))
+    deadline := time.Now().Add(share)
+    round := 0
+    for ; time.Now().Before(deadline); round++ {
+      // a child killed before its first commit acknowledged none, the
+      // commits of the earlier rounds are still there
+      acked := max(crashRound(t, path, wal, time.Duration(rng.Intn(500)) * time.Millisecond), applied)
+      db := &KV{Path: path, Options: Options{WAL: wal}}
+      if err := db.Open(); err != nil {
+        t.Fatalf("round %d: %v", round, err)
+      }
+      seq := crashSeq(db)
+      if seq < acked || seq > acked + 1 {
+        t.Fatalf("round %d: seq %d, acknowledged %d", round, seq, acked)
+      }
+      for ; applied < seq; applied++ {
+        keys, vals := crashOps(applied + 1)
+        for i := range keys {
+          if vals[i] == nil {
+            delete(model, string(keys[i]))
+          } else {
+            model[string(keys[i])] = string(vals[i])
+          }
+        }
+      }
+      checkModel(t, db, model, "seq")
+      if err := db.Verify(); err != nil {
+        t.Fatalf("round %d: %v", round, err)
+      }
+      db.Close()
+    }
+    t.Logf("WAL %v: %d kills, %d commits", wal, round, applied)
+  }
+}
+
+// run the child for `d`, kill it, and return the last acknowledged commit
+func crashRound(t *testing.T, path string, wal bool, d time.Duration) int64 {
+  cmd := exec.Command(os.Args[0], "-test.run=^TestLongCrash$")
+  cmd.Env = append(os.Environ(), "LONGTEST_CRASH_PATH=" + path)
+  if wal {
+    cmd.Env = append(cmd.Env, "LONGTEST_CRASH_WAL=1")
+  }
+  out, err := cmd.StdoutPipe()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := cmd.Start(); err != nil {
+    t.Fatal(err)
+  }
+  var acked atomic.Int64
+  done := make(chan error, 1)
+  go func() {
+    scanner := bufio.NewScanner(out)
+    for scanner.Scan() {
+      seq, err := strconv.ParseInt(scanner.Text(), 10, 64)
+      if err != nil {
+        done <- fmt.Errorf("child: %s", scanner.Text())
+        return
+      }
+      acked.Store(seq)
+    }
+    done <- nil
+  }()
+  time.Sleep(d)
+  cmd.Process.Kill()
+  err = <-done
+  cmd.Wait()
+  if err != nil {
+    t.Fatal(err)
+  }
+  return acked.Load()
+}
+
+// the store has exactly the KVs of the model, besides the `skip` key
+func checkModel(t *testing.T, db *KV, model map[string]string, skip string) {
+  t.Helper()
+  n := 0
+  for iter := db.Seek(nil, CMP_GT); iter.Valid(); iter.Next() {
+    key := string(iter.Key())
+    if key == skip {
+      continue
+    }
+    if val, ok := model[key]; !ok || val != string(iter.Val()) {
+      t.Fatalf("key %q: %v", key, ok)
+    }
+    n++
+  }
+  if n != len(model) {
+    t.Fatalf("%d keys, want %d", n, len(model))
+  }
+}
+
+const (
+  LONG_ACCOUNTS = 200
+  LONG_BALANCE  = 1000
+)
+
+func account(i int) []byte {
+  return []byte(fmt.Sprintf("acct%04d", i))
+}
+
+// the total of the accounts in a snapshot
+func balanceTotal(t *testing.T, tx *KVTX) int64 {
+  total, n := int64(0), 0
+  for iter := tx.Seek([]byte("acct"), CMP_GE); iter.Valid() && bytes.HasPrefix(iter.Key(), []byte("acct")); iter.Next() {
+    total += int64(binary.LittleEndian.Uint64(iter.Val()))
+    n++
+  }
+  if n != LONG_ACCOUNTS {
+    t.Errorf("%d accounts", n)
+  }
+  return total
+}
+
+// move an amount between 2 accounts, retried on conflicts
+func transfer(db *KV, rng *rand.Rand) error {
+  a, b := rng.Intn(LONG_ACCOUNTS), rng.Intn(LONG_ACCOUNTS)
+  for {
+    tx := KVTX{}
+    db.BeginSerializable(&tx)
+    va, _ := tx.Get(account(a))
+    vb, _ := tx.Get(account(b))
+    x, y := binary.LittleEndian.Uint64(va), binary.LittleEndian.Uint64(vb)
+    amount := uint64(rng.Intn(int(x) + 1))
+    if a != b {
+      x, y = x - amount, y + amount
+    }
+    tx.Set(account(a), binary.LittleEndian.AppendUint64(nil, x))
+    tx.Set(account(b), binary.LittleEndian.AppendUint64(nil, y))
+    // unrelated KVs, overflow values included
+    key := []byte(fmt.Sprintf("junk%05d", rng.Intn(5000)))
+    if rng.Intn(4) == 0 {
+      tx.Del(key)
+    } else {
+      tx.Set(key, make([]byte, rng.Intn(2 * BTREE_MAX_VAL_SIZE)))
+    }
+    err := db.Commit(&tx)
+    if !errors.Is(err, ErrConflict) {
+      return err
+    }
+  }
+}
+
+// concurrent writers and readers of all kinds in phases, with backups
+// during the updates and compactions in between. each snapshot sees the
+// same total of the accounts.
+func TestLongConcurrent(t *testing.T) {
+  dir := t.TempDir()
+  db := &KV{Path: filepath.Join(dir, "db"), Options: Options{WAL: true, EntryChecksums: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  b := Batch{}
+  for i := 0; i < LONG_ACCOUNTS; i++ {
+    b.Set(account(i), binary.LittleEndian.AppendUint64(nil, LONG_BALANCE))
+  }
+  if err := db.Apply(&b); err != nil {
+    t.Fatal(err)
+  }
+  want := int64(LONG_ACCOUNTS * LONG_BALANCE)
+  deadline := longDeadline()
+  for phase := 0; time.Now().Before(deadline); phase++ {
+    stop := make(chan struct{})
+    var wg sync.WaitGroup
+    for w := 0; w < 4; w++ {
+      wg.Add(1)
+      go func(seed int64) {
+        defer wg.Done()
+        rng := rand.New(rand.NewSource(seed))
+        for {
+          select {
+          case <-stop:
+            return
+          default:
+          }
+          if err := transfer(db, rng); err != nil {
+            t.Error(err)
+            return
+          }
+        }
+      }(int64(phase * 10 + w))
+    }
+    for r := 0; r < 4; r++ {
+      wg.Add(1)
+      go func(kind int) {
+        defer wg.Done()
+        for {
+          select {
+          case <-stop:
+            return
+          default:
+          }
+          tx := KVTX{}
+          switch kind {
+          case 0:
+            db.Begin(&tx)
+          case 1:
+            db.BeginBatch(&tx)
+          case 2:
+            db.BeginSerializable(&tx)
+          default:
+            db.BeginReadCommitted(&tx)
+          }
+          release := tx.HoldSnapshot() // a single version in any mode
+          if total := balanceTotal(t, &tx); total != want {
+            t.Errorf("reader %d: total %d, want %d", kind, total, want)
+          }
+          release()
+          db.Abort(&tx)
+        }
+      }(r)
+    }
+    // a backup of the live store halfway
+    half := min(time.Minute, time.Until(deadline) / 2)
+    time.Sleep(half)
+    backup := filepath.Join(dir, fmt.Sprintf("backup%d", phase))
+    if err := db.Backup(backup, nil); err != nil {
+      t.Error(err)
+    }
+    time.Sleep(half)
+    close(stop)
+    wg.Wait()
+    if t.Failed() {
+      return
+    }
+    checkBackup(t, backup, want)
+    if err := db.Compact(nil); err != nil {
+      t.Fatal(err)
+    }
+    if err := db.Verify(); err != nil {
+      t.Fatal(err)
+    }
+  }
+}
+
+func checkBackup(t *testing.T, path string, want int64) {
+  t.Helper()
+  db := &KV{Path: path}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  if err := db.Verify(); err != nil {
+    t.Fatal(err)
+  }
+  tx := KVTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  if total := balanceTotal(t, &tx); total != want {
+    t.Fatalf("backup: total %d, want %d", total, want)
+  }
+  os.Remove(path)
+  os.Remove(sumPath(db))
+}
+
+// tables with indexes against a model, reopened and compacted on the
+// way, then the final full validation
+func TestLongTables(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "db")
+  db := &DB{Path: path}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  s := &QLSession{DB: db}
+  if _, err := s.Exec("CREATE TABLE t (id int64, a int64, b bytes, PRIMARY KEY (id), INDEX (a), INDEX (b));"); err != nil {
+    t.Fatal(err)
+  }
+  model := map[int64][2]int64{} // id -> a, b as a number
+  rng := rand.New(rand.NewSource(1))
+  deadline := longDeadline()
+  for i := 0; time.Now().Before(deadline); i++ {
+    id, a, bv := int64(rng.Intn(3000)), int64(rng.Intn(100)), int64(rng.Intn(100))
+    switch rng.Intn(4) {
+    case 0:
+      if _, err := s.Exec(fmt.Sprintf("DELETE FROM t WHERE id = %d;", id)); err != nil {
+        t.Fatal(err)
+      }
+      delete(model, id)
+    case 1:
+      if _, err := s.Exec(fmt.Sprintf("UPDATE t SET a = %d WHERE id = %d;", a, id)); err != nil {
+        t.Fatal(err)
+      }
+      if row, ok := model[id]; ok {
+        model[id] = [2]int64{a, row[1]}
+      }
+    default:
+      stmt := fmt.Sprintf("INSERT INTO t (id, a, b) VALUES (%d, %d, 'b%03d');", id, a, bv)
+      if _, ok := model[id]; ok {
+        stmt = fmt.Sprintf("UPDATE t SET a = %d, b = 'b%03d' WHERE id = %d;", a, bv, id)
+      }
+      if _, err := s.Exec(stmt); err != nil {
+        t.Fatal(err)
+      }
+      model[id] = [2]int64{a, bv}
+    }
+    if i % 20000 == 0 {
+      checkTable(t, s, model)
+      if rng.Intn(2) == 0 {
+        err := db.Compact(nil)
+        if err != nil {
+          t.Fatal(err)
+        }
+      } else {
+        db.Close()
+        if err := db.Open(); err != nil {
+          t.Fatal(err)
+        }
+      }
+    }
+  }
+  checkTable(t, s, model)
+  // the final full validation
+  if err := db.kv.Verify(); err != nil {
+    t.Fatal(err)
+  }
+  if bad, err := db.kv.VerifySkip(); err != nil || len(bad) > 0 {
+    t.Fatal(bad, err)
+  }
+  if report := db.kv.Startup(); report.Status != STARTUP_CLEAN {
+    t.Fatal(report)
+  }
+  db.Close()
+}
+
+// the rows by the primary key and by each index
+func checkTable(t *testing.T, s *QLSession, model map[int64][2]int64) {
+  t.Helper()
+  res, err := s.Exec("SELECT id, a, b FROM t;")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(res.Rows) != len(model) {
+    t.Fatalf("%d rows, want %d", len(res.Rows), len(model))
+  }
+  for _, row := range res.Rows {
+    want, ok := model[row[0].I64]
+    if !ok || row[1].I64 != want[0] || string(row[2].Str) != fmt.Sprintf("b%03d", want[1]) {
+      t.Fatalf("row %d: %v", row[0].I64, row)
+    }
+  }
+  for a := int64(0); a < 100; a += 7 {
+    res, err := s.Exec(fmt.Sprintf("SELECT id FROM t WHERE a = %d;", a))
+    if err != nil {
+      t.Fatal(err)
+    }
+    n := 0
+    for _, row := range model {
+      if row[0] == a {
+        n++
+      }
+    }
+    if len(res.Rows) != n {
+      t.Fatalf("a = %d: %d rows, want %d", a, len(res.Rows), n)
+    }
+  }
+  for bv := int64(0); bv < 100; bv += 11 {
+    res, err := s.Exec(fmt.Sprintf("SELECT id FROM t WHERE b = 'b%03d';", bv))
+    if err != nil {
+      t.Fatal(err)
+    }
+    n := 0
+    for _, row := range model {
+      if row[1] == bv {
+        n++
+      }
+    }
+    if len(res.Rows) != n {
+      t.Fatalf("b = %d: %d rows, want %d", bv, len(res.Rows), n)
+    }
+  }
+}
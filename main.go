@@ -1,9 +1,144 @@
 package main
 
 import (
+  "bytes"
   "encoding/binary"
+  "errors"
+  "fmt"
+  "net"
+  "os"
+  "strconv"
 )
 
+// usage: database <dbfile> [get <key> | set <key> <val> | del <key> | scan [lo [hi]]]
+// without a command, statements are read from stdin, see repl.
+// `database demo` is the REPL on sample data, see demo.go.
+func main() {
+  if len(os.Args) == 2 && os.Args[1] == "demo" {
+    if err := demo(os.Stdin, os.Stdout, isTerminal(os.Stdin)); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(1)
+    }
+    return
+  }
+  if len(os.Args) < 2 {
+    fmt.Fprintln(os.Stderr, "usage: database demo | database <dbfile> [get <key> | set <key> <val> | del <key> | scan [lo [hi]] | verify [skip] | stats | dot [max nodes] | sweep | vacuum | migrate cold|hot | serve <addr> | dump | restore]")
+    os.Exit(2)
+  }
+  db := DB{Path: os.Args[1]}
+  if len(os.Args) == 4 && os.Args[2] == "migrate" && os.Args[3] == "cold" {
+    db.Options.ColdTier = true // creates the cold file
+  }
+  if err := db.Open(); err != nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+  defer db.Close()
+
+  s := &QLSession{DB: &db}
+  if len(os.Args) == 2 {
+    repl(s, os.Stdin, os.Stdout, isTerminal(os.Stdin))
+    return
+  }
+  args := os.Args[2:]
+  var err error
+  switch {
+  case len(args) == 1 && args[0] == "verify":
+    if err = db.kv.Verify(); err == nil {
+      for _, warning := range db.Warnings() {
+        fmt.Println("warning:", warning)
+      }
+      fmt.Println("ok")
+    }
+  case len(args) == 2 && args[0] == "verify" && args[1] == "skip":
+    // list the corrupted pages instead of stopping at the first one
+    var bad []*ErrChecksum
+    if bad, err = db.kv.VerifySkip(); err == nil {
+      for _, e := range bad {
+        fmt.Println("bad:", e)
+      }
+      if len(bad) == 0 {
+        fmt.Println("ok")
+      } else {
+        err = fmt.Errorf("%d corrupted pages", len(bad))
+      }
+    }
+  case len(args) == 1 && args[0] == "stats":
+    var stats Stats
+    if stats, err = db.Stats(); err == nil {
+      fmt.Printf("height: %d\nkeys: %d\n", stats.Height, stats.Keys)
+      fmt.Printf("pages: %d internal, %d leaf, %d overflow, %d unused, %d cold\n",
+        stats.InternalPages, stats.LeafPages, stats.OverflowPages, stats.UnusedPages, stats.ColdPages)
+      fmt.Printf("file: %d bytes\nfill:", stats.FileBytes)
+      for i, n := range stats.Fill {
+        fmt.Printf(" %d%%:%d", i * 10, n)
+      }
+      fmt.Println()
+    }
+  case len(args) <= 2 && args[0] == "dot":
+    maxNodes := 0
+    if len(args) == 2 {
+      if maxNodes, err = strconv.Atoi(args[1]); err != nil {
+        break
+      }
+    }
+    err = db.kv.DumpDOT(os.Stdout, maxNodes)
+  case len(args) == 1 && args[0] == "dump":
+    err = withProgress(func(p *Progress) error {
+      return db.kv.Dump(os.Stdout, p)
+    })
+  case len(args) == 1 && args[0] == "restore":
+    err = withProgress(func(p *Progress) error {
+      return db.kv.Restore(os.Stdin, p)
+    })
+  case len(args) == 2 && args[0] == "serve":
+    var ln net.Listener
+    if ln, err = net.Listen("tcp", args[1]); err == nil {
+      fmt.Fprintln(os.Stderr, "listening on", ln.Addr())
+      err = db.kv.Serve(ln)
+    }
+  case len(args) == 1 && args[0] == "vacuum":
+    err = withProgress(func(p *Progress) error {
+      return db.Compact(p)
+    })
+  case len(args) == 2 && args[0] == "migrate" && (args[1] == "cold" || args[1] == "hot"):
+    // move the large values between the files, see cold.go
+    var n int
+    err = withProgress(func(p *Progress) error {
+      n, err = db.kv.MigrateTier(args[1] == "cold", p)
+      return err
+    })
+    if err == nil {
+      fmt.Printf("%d values moved\n", n)
+    }
+  case len(args) == 1 && args[0] == "sweep":
+    var n int
+    if n, err = db.kv.Sweep(); err == nil {
+      fmt.Printf("%d expired keys deleted\n", n)
+    }
+  case isRawCmd(args[0]):
+    // a single raw command
+    var res *QLResult
+    res, err = rawExec(s, args)
+    switch {
+    case err != nil:
+    case args[0] == "get":
+      fmt.Printf("%s\n", res.Rows[0][1].Str)
+    case args[0] == "scan":
+      printTable(os.Stdout, res)
+    }
+  default:
+    db.Close()
+    fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+    os.Exit(2)
+  }
+  if err != nil {
+    db.Close()
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+}
+
 type BNode []byte // can be dumped to disk
 
 type BTree struct {
@@ -13,68 +148,255 @@ type BTree struct {
   get func(uint64) []byte //read data from a page number
   new func([]byte) uint64 // allocate a new page number with data
   del func(uint64)        //deallocate a page number
+  psize int // the page size, 0 for BTREE_PAGE_SIZE
+  // for the warnings on the format limits and the stats
+  splits [4]uint64 // updated nodes by the number of nodes after splitting
+  merges uint64
+  maxKey int // the longest key inserted
+  // the structural events of the updates, see SetTrace
+  trace    func(TraceEvent)
+  untraced *tracedPages
+  // against pointer cycles, see depth.go
+  maxDepth int      // 0 for no limit
+  walk     []uint64 // the pages from the root during an update
+  // add a checksum to each inserted KV, see entry.go
+  entrySums bool
+  // called with each key being inserted or deleted, see serial.go
+  onWrite func(key []byte)
+  // the pages of the cold file, nil for none, and the size of the values
+  // that go there, 0 for none. see cold.go
+  cold    Pages
+  coldMin int
+  // the clock of the expiry times, nil for the default one, see Options.Clock
+  clock *hlcClock
+  // the file of the pages, counted by Compact. the versions before and
+  // after a Compact don't share pages with the same number.
+  file uint64
 }
 
+const HEADER = 4
+
 const (
-  BTREE_PAGE_SIZE     = 4096
+  BNODE_NODE = 1 // internal nodes without values
+  BNODE_LEAF = 2 // leaf nodes with values
+)
+
+const (
+  BTREE_PAGE_SIZE     = 4096 // the default page size
   BTREE_MAX_KEY_SIZE  = 1000
   BTREE_MAX_VAL_SIZE  = 3000
 )
 
+// the supported page sizes are powers of 2 in this range. the limits on
+// the key and value sizes don't change. a node can exceed 1 page up to
+// 2x before it's split, the node size must still fit in 16 bits.
+const (
+  BTREE_PAGE_MIN = 4096
+  BTREE_PAGE_MAX = 16384
+)
+
+func (tree *BTree) pageSize() int {
+  if tree.psize == 0 {
+    return BTREE_PAGE_SIZE
+  }
+  return tree.psize
+}
+
+func checkPageSize(size int) error {
+  if size < BTREE_PAGE_MIN || size > BTREE_PAGE_MAX || size & (size - 1) != 0 {
+    return fmt.Errorf("bad page size %d", size)
+  }
+  return nil
+}
+
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+  if tree.root == 0 || len(key) == 0 {
+    return nil, false
+  }
+  return treeGet(tree, tree.root, key)
+}
+
+func treeGet(tree *BTree, ptr uint64, key []byte) ([]byte, bool) {
+  var path []uint64
+  for {
+    path = append(path, ptr)
+    checkDepth(path, tree.maxDepth)
+    node := BNode(tree.get(ptr))
+    assertNode(node)
+    idx := nodeLookupLE(node, key)
+    switch node.btype() {
+    case BNODE_LEAF:
+      if idx < node.nkeys() && bytes.Equal(key, node.getKey(idx)) && !tree.expired(node, idx) {
+        val := treeVal(tree, node, idx)
+        if err := entryCheck(node, idx, val); err != nil {
+          panic(err)
+        }
+        return val, true
+      }
+      return nil, false
+    case BNODE_NODE:
+      ptr = node.getPtr(idx)
+    default:
+      panic("bad node!")
+    }
+  }
+}
+
 func (tree *BTree) Insert(key []byte, val []byte) error {
   // 1. check the length limit imposed by the node format
   if err := checkLimit(key, val); err != nil {
     return err // the only way for an update to fail
   }
+  tree.update(key, val)
+  return nil
+}
+
+// insert or update a key without checking the limits
+func (tree *BTree) update(key []byte, val []byte) {
+  tree.updateExpiring(key, val, 0)
+}
+
+// like update, `expires` is the expiry time or 0, see ttl.go
+func (tree *BTree) updateExpiring(key []byte, val []byte, expires int64) {
+  tree.emit(TraceEvent{Op: TRACE_INSERT, Key: key})
+  if tree.onWrite != nil {
+    tree.onWrite(key)
+  }
+  tree.maxKey = max(tree.maxKey, len(key))
   // 2. create the first node
   if tree.root == 0 {
-    root := BNode(make([]byte, BTREE_PAGE_SIZE))
-    root.setHeader(BNODE_LEAF, 2)
-    // a dummy key, this makes the tree cover the whole key space.
-    // thus a lookup can always find a containing node.
-    nodeAppendKV(root, 0, 0, nil, nil)
-    nodeAppendKV(root, 1, 0, key, val)
-    tree.root = tree.new(root)
-    return nil
+    tree.bootstrap()
+  }
+  // large values go to overflow pages, the leaf only keeps a reference
+  full, vflag := val, uint16(0)
+  if len(val) > BTREE_MAX_VAL_SIZE {
+    val, vflag = overflowWrite(tree, val), VAL_OVERFLOW
   }
+  if tree.entrySums {
+    val, vflag = withEntrySum(key, full, val, vflag)
+  }
+  val, vflag = withExpires(val, vflag, expires)
   // 3. insert the key
-  node := treeInsert(tree, tree.get(tree.root), key, val)
+  tree.walk = tree.walk[:0]
+  tree.enter(tree.root)
+  node := treeInsert(tree, tree.get(tree.root), key, val, vflag)
+  tree.leave()
   // 4. grow the tree if the root is split
-  nsplit, split := nodeSplit3(node)
   tree.del(tree.root)
+  tree.setRoot(node)
+}
+
+// delete a key and returns whether the key was there
+func (tree *BTree) Delete(key []byte) (bool, error) {
+  if err := checkLimit(key, nil); err != nil {
+    return false, err
+  }
+  if tree.root == 0 {
+    return false, nil
+  }
+  tree.emit(TraceEvent{Op: TRACE_DELETE, Key: key})
+  tree.walk = tree.walk[:0]
+  tree.enter(tree.root)
+  updated := treeDelete(tree, tree.get(tree.root), key)
+  tree.leave()
+  if len(updated) == 0 {
+    return false, nil // not found
+  }
+  if tree.onWrite != nil {
+    tree.onWrite(key)
+  }
+  tree.del(tree.root)
+  if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+    // the root has a single kid after merging, remove a level
+    tree.root = updated.getPtr(0)
+    tree.emit(TraceEvent{Op: TRACE_SHRINK, Ptr: tree.root})
+    return true, nil
+  }
+  tree.setRoot(updated)
+  return true, nil
+}
+
+// replace the root with an updated node that may be oversized.
+func (tree *BTree) setRoot(node BNode) {
+  nsplit, split := nodeSplit3(node, tree.pageSize())
+  tree.splits[nsplit]++
   if nsplit > 1 {     // the root was split, add a new level.
-    root := BNode(make([]byte, BTREE_PAGE_SIZE))
-    root.setHeader(BNODE_NODE, nsplit)
+    root := BNode(make([]byte, tree.pageSize()))
+    keys := kidKeys(split[0].getKey(0), split[:nsplit])
+    kvbytes := uint16(0)
+    for _, key := range keys {
+      kvbytes += kvBytes(key, nil)
+    }
+    b := newNodeBuilder(root, BNODE_NODE, nsplit, kvbytes)
+    tree.emit(TraceEvent{Op: TRACE_SPLIT, Ptr: tree.root, Nodes: int(nsplit)})
     for i, knode := range split[:nsplit] {
-      ptr, key := tree.new(knode), knode.getKey(0)
-      nodeAppendKV(root, uint16(i), ptr, key, nil)
+      b.add(tree.new(knode), keys[i], nil)
     }
     tree.root = tree.new(root)
+    tree.emit(TraceEvent{Op: TRACE_GROW, Ptr: tree.root})
   } else {
     tree.root = tree.new(split[0])
   }
+}
 
+// the length limit imposed by the node format.
+// the empty key is reserved for the sentinel.
+func checkLimit(key []byte, val []byte) error {
+  if len(key) == 0 {
+    return errors.New("empty key")
+  }
+  if len(key) > BTREE_MAX_KEY_SIZE {
+    return fmt.Errorf("key %w", ErrTooLarge)
+  }
+  if len(val) > BTREE_MAX_BLOB_SIZE {
+    return fmt.Errorf("value %w", ErrTooLarge)
+  }
   return nil
 }
 
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+// an empty tree is a single leaf with only the sentinel key.
+func (tree *BTree) bootstrap() {
+  root := BNode(make([]byte, tree.pageSize()))
+  b := newNodeBuilder(root, BNODE_LEAF, 1, kvBytes(nil, nil))
+  // the empty key is <= any key, this makes the tree cover the whole
+  // key space. thus a lookup can always find a containing node.
+  // it's not user data and never shows up in scans or diffs.
+  b.add(0, nil, nil)
+  tree.root = tree.new(root)
+}
+
+// vflag marks the value as a reference to overflow pages
+func treeInsert(tree *BTree, node BNode, key []byte, val []byte, vflag uint16) BNode {
+  assertNode(node)
   // The extra size allows it to exceed 1 page temporarily.
-  new := BNode(make([]byte, 2 * BTREE_PAGE_SIZE))
+  new := BNode(make([]byte, 2 * tree.pageSize()))
   // where to insert the key?
   idx := nodeLookupLE(node, key)  // node.getKey(idx) <= key
   switch node.btype() {
   case BNODE_LEAF:  // leaf node
-    if bytes.Equal(key, node.getKey(idx)) {
-      leafUpdate(new, node, idx, key, val)  // found, update it
-    } else {
-      leafInsert(new, node, idx + 1, key, val)  // not found, insert
+    switch {
+    case idx >= node.nkeys():
+      leafInsert(new, node, 0, key, val, vflag)  // before the first key
+    case bytes.Equal(key, node.getKey(idx)):
+      if node.isOverflow(idx) {
+        overflowFree(tree, node.getVal(idx)) // the old value
+      }
+      leafUpdate(new, node, idx, key, val, vflag)  // found, update it
+    default:
+      leafInsert(new, node, idx + 1, key, val, vflag)  // not found, insert
     }
   case BNODE_NODE:  // internal node, walk into the child node
     // recursive insertion to the kid node
     kptr := node.getPtr(idx)
-    knode := treeInsert(tree, tree.get(kptr), key, val)
+    tree.enter(kptr)
+    knode := treeInsert(tree, tree.get(kptr), key, val, vflag)
+    tree.leave()
     // after insertion, split the result
-    nsplit, split := nodeSplit3(knode)
+    nsplit, split := nodeSplit3(knode, tree.pageSize())
+    tree.splits[nsplit]++
+    if nsplit > 1 {
+      tree.emit(TraceEvent{Op: TRACE_SPLIT, Ptr: kptr, Nodes: int(nsplit)})
+    }
     // deallocate the old kid node
     tree.del(kptr)
     // update the kid links
@@ -86,22 +408,111 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
   return new
 }
 
+// delete a key from the tree
+func treeDelete(tree *BTree, node BNode, key []byte) BNode {
+  assertNode(node)
+  // where to find the key?
+  idx := nodeLookupLE(node, key)
+  switch node.btype() {
+  case BNODE_LEAF:
+    if idx >= node.nkeys() || !bytes.Equal(key, node.getKey(idx)) {
+      return BNode{} // not found
+    }
+    if node.isOverflow(idx) {
+      overflowFree(tree, node.getVal(idx))
+    }
+    new := BNode(make([]byte, tree.pageSize()))
+    leafDelete(new, node, idx)
+    return new
+  case BNODE_NODE:
+    return nodeDelete(tree, node, idx, key)
+  default:
+    panic("bad node!")
+  }
+}
+
+func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
+  // recurse into the kid
+  kptr := node.getPtr(idx)
+  tree.enter(kptr)
+  updated := treeDelete(tree, tree.get(kptr), key)
+  tree.leave()
+  if len(updated) == 0 {
+    return BNode{} // not found
+  }
+  tree.del(kptr)
+  // the kid's first key may be replaced by a longer one, so the node
+  // can exceed 1 page temporarily, like on insertion.
+  new := BNode(make([]byte, 2 * tree.pageSize()))
+  if updated.nkeys() == 0 {
+    // the kid is empty, drop the link
+    nodeReplaceKidN(tree, new, node, idx)
+    return new
+  }
+  // check for merging
+  mergeDir, sibling := shouldMerge(tree, node, idx, updated)
+  switch {
+  case mergeDir < 0: // left
+    merged := BNode(make([]byte, tree.pageSize()))
+    nodeMerge(merged, sibling, updated)
+    tree.merges++
+    tree.emit(TraceEvent{Op: TRACE_MERGE, Ptr: kptr, Sibling: node.getPtr(idx - 1)})
+    tree.del(node.getPtr(idx - 1))
+    key := kidKeys(node.getKey(idx - 1), []BNode{merged})[0]
+    nodeReplace2Kid(new, node, idx - 1, tree.new(merged), key)
+  case mergeDir > 0: // right
+    merged := BNode(make([]byte, tree.pageSize()))
+    nodeMerge(merged, updated, sibling)
+    tree.merges++
+    tree.emit(TraceEvent{Op: TRACE_MERGE, Ptr: kptr, Sibling: node.getPtr(idx + 1)})
+    tree.del(node.getPtr(idx + 1))
+    key := kidKeys(node.getKey(idx), []BNode{merged})[0]
+    nodeReplace2Kid(new, node, idx, tree.new(merged), key)
+  default: // no merge
+    nsplit, split := nodeSplit3(updated, tree.pageSize())
+    tree.splits[nsplit]++
+    if nsplit > 1 {
+      tree.emit(TraceEvent{Op: TRACE_SPLIT, Ptr: kptr, Nodes: int(nsplit)})
+    }
+    nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+  }
+  return new
+}
+
+// merge 2 nodes into 1
+func nodeMerge(new BNode, left BNode, right BNode) {
+  kvbytes := left.kvBytes() + right.kvBytes()
+  b := newNodeBuilder(new, left.btype(), left.nkeys() + right.nkeys(), kvbytes)
+  b.addRange(left, 0, left.nkeys())
+  b.addRange(right, 0, right.nkeys())
+}
+
+// replace 2 adjacent links with 1
+func nodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte) {
+  kvbytes := old.kvBytes() - old.rangeBytes(idx, 2) + kvBytes(key, nil)
+  b := newNodeBuilder(new, BNODE_NODE, old.nkeys() - 1, kvbytes)
+  b.addRange(old, 0, idx)
+  b.add(ptr, key, nil)
+  b.addRange(old, idx + 2, old.nkeys() - (idx + 2))
+}
+
 // should the updated kid be merged with a sibling?
-func shouldMerge(tree *BTree, node BNode, uint16, updated BNode) (int, BNode) {
-  if updated.nbytes() > BTREE_PAGE_SIZE / 4 {
+func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
+  size := tree.pageSize()
+  if updated.nbytes() > uint16(size / 4) {
     return 0, BNode{}
   }
   if idx > 0 {
     sibling := BNode(tree.get(node.getPtr(idx - 1)))
     merged := sibling.nbytes() + updated.nbytes() - HEADER
-    if merged <= BTREE_PAGE_SIZE {
+    if int(merged) <= size {
       return -1, sibling  // left
     }
   }
   if idx + 1 < node.nkeys() {
     sibling := BNode(tree.get(node.getPtr(idx + 1)))
     merged := sibling.nbytes() + updated.nbytes() - HEADER
-    if merged <= BTREE_PAGE_SIZE {
+    if int(merged) <= size {
       return +1, sibling //right
     }
   }
@@ -112,12 +523,52 @@ func shouldMerge(tree *BTree, node BNode, uint16, updated BNode) (int, BNode) {
 // replace a link with multiple links
 func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
   inc := uint16(len(kids))
-  new.setHeader(BNODE_NODE, old.nkeys() + inc - 1)
-  nodeAppendRange(new, old, 0, 0, idx)
+  var keys [][]byte
+  if inc > 0 {
+    keys = kidKeys(old.getKey(idx), kids)
+  }
+  kvbytes := old.kvBytes() - old.rangeBytes(idx, 1)
+  for _, key := range keys {
+    kvbytes += kvBytes(key, nil)
+  }
+  b := newNodeBuilder(new, BNODE_NODE, old.nkeys() + inc - 1, kvbytes)
+  b.addRange(old, 0, idx)
   for i, node := range kids {
-    nodeAppendKV(new, idx + uint16(i), tree.new(node), node.getKey(0), nil)
+    b.add(tree.new(node), keys[i], nil)
   }
-  nodeAppendRange(new, old, idx + inc, idx + 1, old.nkeys() - (idx + 1))
+  b.addRange(old, idx + 1, old.nkeys() - (idx + 1))
+}
+
+// the keys of the links to adjacent kids, `first` is the old key of the
+// first kid. an internal kid is linked by its first key, so a lookup
+// always finds a key <= the target in it. a leaf only needs a key
+// between the last key of the previous leaf and its first key, the
+// shortest one is used (suffix truncation), and the first leaf keeps
+// its old key. thus a lookup can land before the first key of a leaf.
+func kidKeys(first []byte, kids []BNode) [][]byte {
+  keys := make([][]byte, len(kids))
+  for i, kid := range kids {
+    switch {
+    case kid.btype() != BNODE_LEAF:
+      keys[i] = kid.getKey(0)
+    case i == 0:
+      keys[i] = first
+    default:
+      prev := kids[i-1]
+      keys[i] = truncateKey(prev.getKey(prev.nkeys() - 1), kid.getKey(0))
+    }
+  }
+  return keys
+}
+
+// the shortest prefix of `key` that is greater than `prev`
+func truncateKey(prev []byte, key []byte) []byte {
+  assert(bytes.Compare(prev, key) < 0)
+  n := 0
+  for n < len(prev) && prev[n] == key[n] {
+    n++
+  }
+  return key[:n+1]
 }
 
 // getters
@@ -173,52 +624,143 @@ func (node BNode) getKey(idx uint16) []byte {
   return node[pos+4:][:klen]
 }
 
+// the value bytes in the node, which is only a reference for an overflow value
 func (node BNode) getVal(idx uint16) []byte {
   assert(idx < node.nkeys())
   pos := node.kvPos(idx)
   klen := binary.LittleEndian.Uint16(node[pos+0:])
   vlen := binary.LittleEndian.Uint16(node[pos+2:])
-  return node[pos+4+klen:][:vlen]
+  val := node[pos+4+klen:][:vlen &^ VAL_FLAGS]
+  if vlen & VAL_EXPIRES != 0 {
+    val = val[EXPIRES_SIZE:] // the expiry time
+  }
+  if vlen & VAL_CHECKSUM != 0 {
+    val = val[ENTRY_SUM_SIZE:] // see entry.go
+  }
+  return val
 }
 
-func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+func (node BNode) isOverflow(idx uint16) bool {
+  assert(idx < node.nkeys())
+  pos := node.kvPos(idx)
+  return binary.LittleEndian.Uint16(node[pos+2:]) & VAL_OVERFLOW != 0
+}
+
+// the size of a KV including the 4-bytes KV sizes
+func kvBytes(key []byte, val []byte) uint16 {
+  return 4 + uint16(len(key) + len(val))
+}
+
+// the size of a range of KVs
+func (node BNode) rangeBytes(idx uint16, n uint16) uint16 {
+  return node.getOffset(idx + n) - node.getOffset(idx)
+}
+
+// the size of all KVs
+func (node BNode) kvBytes() uint16 {
+  return node.getOffset(node.nkeys())
+}
+
+// the node size with nkeys KVs of kvbytes in total
+func nodeSize(nkeys uint16, kvbytes uint16) uint16 {
+  return HEADER + 8 * nkeys + 2 * nkeys + kvbytes
+}
+
+// assembles a node by appending KVs in order. the write position is
+// tracked incrementally instead of being recomputed from the offsets.
+type NodeBuilder struct {
+  node  BNode
+  nkeys uint16 // the final number of keys
+  idx   uint16 // the number of keys added so far
+  start uint16 // where the KVs begin
+  pos   uint16 // where the next KV goes
+  end   uint16 // the final node size
+}
+
+// the final size is known up front, so a node that doesn't fit
+// is rejected before any bytes are written.
+func newNodeBuilder(node BNode, btype uint16, nkeys uint16, kvbytes uint16) *NodeBuilder {
+  size := nodeSize(nkeys, kvbytes)
+  assert(int(size) <= len(node))
+  node.setHeader(btype, nkeys)
+  start := size - kvbytes
+  return &NodeBuilder{node: node, nkeys: nkeys, start: start, pos: start, end: size}
+}
+
+func (b *NodeBuilder) setOffset(idx uint16, offset uint16) {
+  pos := HEADER + 8 * b.nkeys + 2 * (idx - 1)
+  binary.LittleEndian.PutUint16(b.node[pos:], offset)
+}
+
+// append a KV
+func (b *NodeBuilder) add(ptr uint64, key []byte, val []byte) {
+  b.addFlagged(ptr, key, val, 0)
+}
+
+// the flags are stored in the high bits of the value size
+func (b *NodeBuilder) addFlagged(ptr uint64, key []byte, val []byte, vflag uint16) {
+  assert(b.idx < b.nkeys && b.pos + kvBytes(key, val) <= b.end)
   // ptrs
-  new.setPtr(idx, ptr)
-  // KVs
-  pos := new.kvPos(idx)   // uses the offset value of the previous key
+  b.node.setPtr(b.idx, ptr)
   // 4-bytes KV sizes
-  binary.LittleEndian.PutUint16(new[pos+0:], uint16(len(key)))
-  binary.LittleEndian.PutUint16(new[pos+2:], uint16(len(val)))
+  binary.LittleEndian.PutUint16(b.node[b.pos+0:], uint16(len(key)))
+  binary.LittleEndian.PutUint16(b.node[b.pos+2:], uint16(len(val)) | vflag)
   // KV data
-  copy(new[pos+4:], key)
-  copy(new[pos+4+uint16(len(key)):], val)
-  // update the offset value for the next key
-  new.setOffset(idx+1, new.getOffset(idx)+4+uint16((len(key)+len(val))))
+  copy(b.node[b.pos+4:], key)
+  copy(b.node[b.pos+4+uint16(len(key)):], val)
+  // the offset value for the next key
+  b.pos += kvBytes(key, val)
+  b.idx++
+  b.setOffset(b.idx, b.pos - b.start)
+}
+
+// copy multiple keys, values, and pointers from another node
+func (b *NodeBuilder) addRange(old BNode, src uint16, n uint16) {
+  if n == 0 {
+    return
+  }
+  assert(b.idx + n <= b.nkeys && b.pos + old.rangeBytes(src, n) <= b.end)
+  // ptrs
+  copy(b.node[HEADER+8*b.idx:], old[HEADER+8*src:HEADER+8*(src+n)])
+  // KVs are contiguous, copy them at once
+  begin, end := old.kvPos(src), old.kvPos(src + n)
+  copy(b.node[b.pos:], old[begin:end])
+  // rebase the offsets
+  base := b.pos - b.start
+  for i := uint16(1); i <= n; i++ {
+    b.setOffset(b.idx + i, base + old.rangeBytes(src, i))
+  }
+  b.idx += n
+  b.pos += end - begin
 }
 
-func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
-  new.setHeader(BNODE_LEAF, old.nkeys()+1)
-  nodeAppendRange(new, old, 0, 0, idx)    // copy the keys before 'idx'
-  nodeAppend(new, idx, 0, key, val)       // the new key
-  nodeAppendRange(new, old, idx + 1, idx, old.nkeys() - idx)  // keys from 'idx'
+func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte, vflag uint16) {
+  kvbytes := old.kvBytes() + kvBytes(key, val)
+  b := newNodeBuilder(new, BNODE_LEAF, old.nkeys()+1, kvbytes)
+  b.addRange(old, 0, idx)                 // copy the keys before 'idx'
+  b.addFlagged(0, key, val, vflag)        // the new key
+  b.addRange(old, idx, old.nkeys() - idx) // keys from 'idx'
 }
 
-// copy multiple keys, values, and pointers into the position
-func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint16) {
-  for i := uint16(0); i < n; i++ {
-    dst, src := dstNew + i, srcOld + i
-    nodeAppendKV(new, dst, old.getPtr(src), old.getKey(src), old.getVal(src))
-  }
+// remove a key from a leaf node
+func leafDelete(new BNode, old BNode, idx uint16) {
+  kvbytes := old.kvBytes() - old.rangeBytes(idx, 1)
+  b := newNodeBuilder(new, BNODE_LEAF, old.nkeys() - 1, kvbytes)
+  b.addRange(old, 0, idx)
+  b.addRange(old, idx + 1, old.nkeys() - (idx + 1))
 }
 
-func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
-  new.setHeader(BNODE_LEAF, old.nkeys())
-  nodeAppendRange(new, old, 0, 0, idx)
-  nodeAppendKV(new, idx, 0, key, val)
-  nodeAppendRange(new, old, idx + 1, idx + 1, old.nkeys() - (idx + 1))
+func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte, vflag uint16) {
+  kvbytes := old.kvBytes() - old.rangeBytes(idx, 1) + kvBytes(key, val)
+  b := newNodeBuilder(new, BNODE_LEAF, old.nkeys(), kvbytes)
+  b.addRange(old, 0, idx)
+  b.addFlagged(0, key, val, vflag)
+  b.addRange(old, idx + 1, old.nkeys() - (idx + 1))
 }
 
-// find the last position that is less than or equal to the key
+// find the last position that is less than or equal to the key.
+// the result is uint16(-1), past the last key, if the key is before the
+// first key. this is only possible in a leaf.
 func nodeLookupLE(node BNode, key []byte) uint16 {
   nkeys := node.nkeys()
   var i uint16
@@ -235,54 +777,70 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
   return i - 1
 }
 
-// Split an oversized node into 2 nodes. The 2nd node always fits.
-func nodeSplit2(left BNode, right BNode, old BNode) {
-  assert(old.nkeys() >= 2)
-  // the initial guess
-  nleft := old.nkeys() / 2
-  // try to fit the left half
-  left_bytes := func() uint16 {
-    return 4 + 8 * nleft + 2 * nleft + old.getOffset(nleft)
+// choose the number of keys for the left half by the byte sizes.
+// among the cuts where both halves fit, pick the one closest to an even
+// split; if there is none, keep the right half fitting and the left half
+// is split again.
+func nodeSplitPoint(old BNode, size int) uint16 {
+  nkeys := old.nkeys()
+  assert(nkeys >= 2)
+  left_bytes := func(nleft uint16) uint16 {
+    return nodeSize(nleft, old.getOffset(nleft))
   }
-  for left_bytes() > BTREE_PAGE_SIZE {
-    nleft--
+  right_bytes := func(nleft uint16) uint16 {
+    return nodeSize(nkeys - nleft, old.kvBytes() - old.getOffset(nleft))
   }
-
-  assert(nleft >= 1)
-  // try to fit the right half
-  right_bytes := func() uint16 {
-    return old.nbytes() - left_bytes() + 4
+  imbalance := func(nleft uint16) int {
+    d := int(left_bytes(nleft)) - int(right_bytes(nleft))
+    if d < 0 {
+      return -d
+    }
+    return d
   }
-  for right_bytes() > BTREE_PAGE_SIZE {
+  // the right half shrinks as the cut moves right
+  nleft := uint16(1)
+  for nleft < nkeys - 1 && int(right_bytes(nleft)) > size {
     nleft++
   }
-  assert(nleft < old.nkeys())
+  best := nleft
+  for ; nleft < nkeys && int(left_bytes(nleft)) <= size; nleft++ {
+    if imbalance(nleft) < imbalance(best) {
+      best = nleft
+    }
+  }
+  return best
+}
+
+// Split an oversized node into 2 nodes. The 2nd node always fits.
+func nodeSplit2(left BNode, right BNode, old BNode, size int) {
+  nleft := nodeSplitPoint(old, size)
+  assert(1 <= nleft && nleft < old.nkeys())
   nright := old.nkeys() - nleft
   // new nodes
-  left.setHeader(old.btype(), nleft)
-  right.setHeader(old.btype(), nright)
-  nodeAppendRange(left, old, 0, 0, nleft)
-  nodeAppendRange(right, old, 0, nleft, nright)
+  lb := newNodeBuilder(left, old.btype(), nleft, old.rangeBytes(0, nleft))
+  lb.addRange(old, 0, nleft)
+  rb := newNodeBuilder(right, old.btype(), nright, old.rangeBytes(nleft, nright))
+  rb.addRange(old, nleft, nright)
   // NOTE: the left half may be still too big
-  assert(right.nbytes() <= BTREE_PAGE_SIZE)
+  assert(int(right.nbytes()) <= size)
 }
 
 // split a node if it's too big. the results are 1-3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-  if old.nbytes() <= BTREE_PAGE_SIZE {
-    old = old[:BTREE_PAGE_SIZE]
+func nodeSplit3(old BNode, size int) (uint16, [3]BNode) {
+  if int(old.nbytes()) <= size {
+    old = old[:size]
     return 1, [3]BNode{old} // not split
   }
-  left := BNode(make([]byte, 2*BTREE_PAGE_SIZE))  // might be split later
-  right := BNode(make([]byte, BTREE_PAGE_SIZE))
-  nodeSplit2(left, right, old)
-  if left.nbytes() <= BTREE_PAGE_SIZE {
-    left = left[:BTREE_PAGE_SIZE]
+  left := BNode(make([]byte, 2*size))  // might be split later
+  right := BNode(make([]byte, size))
+  nodeSplit2(left, right, old, size)
+  if int(left.nbytes()) <= size {
+    left = left[:size]
     return 2, [3]BNode{left, right} // 2 nodes
   }
-  leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-  middle := BNode(make([]byte, BTREE_PAGE_SIZE))
-  nodeSplit2(leftleft, middle, left)
-  assert(leftleft.nbytes() <= BTREE_PAGE_SIZE)
-  return 3, [3]BNode{leftleft, middle, right)   // 3 nodes
+  leftleft := BNode(make([]byte, size))
+  middle := BNode(make([]byte, size))
+  nodeSplit2(leftleft, middle, left, size)
+  assert(int(leftleft.nbytes()) <= size)
+  return 3, [3]BNode{leftleft, middle, right}   // 3 nodes
 }
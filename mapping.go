@@ -0,0 +1,206 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "reflect"
+  "sync"
+)
+
+// rows as Go structs. a field maps to a column by the `db` tag:
+//
+//   type User struct {
+//     ID   int64  `db:"id"`
+//     Name string `db:"name"`
+//   }
+//
+// int64 columns take any signed integer field, bytes columns take
+// string or []byte fields. untagged fields are ignored.
+
+// the mapping of a struct type to a table, checked on first use
+type structPlan struct {
+  fields []int // struct field indexes
+  cols   []int // the column of each field
+}
+
+type structPlanKey struct {
+  typ    reflect.Type
+  table  string
+  prefix uint32 // a table recreated under the same name is different
+}
+
+var structPlans sync.Map // structPlanKey -> *structPlan
+
+func getStructPlan(tdef *TableDef, typ reflect.Type) (*structPlan, error) {
+  key := structPlanKey{typ: typ, table: tdef.Name, prefix: tdef.Prefix}
+  if plan, ok := structPlans.Load(key); ok {
+    return plan.(*structPlan), nil
+  }
+  plan, err := newStructPlan(tdef, typ)
+  if err != nil {
+    return nil, err
+  }
+  structPlans.Store(key, plan)
+  return plan, nil
+}
+
+func newStructPlan(tdef *TableDef, typ reflect.Type) (*structPlan, error) {
+  if typ.Kind() != reflect.Struct {
+    return nil, fmt.Errorf("not a struct: %v", typ)
+  }
+  plan := &structPlan{}
+  for i := 0; i < typ.NumField(); i++ {
+    f := typ.Field(i)
+    col := f.Tag.Get("db")
+    if col == "" || col == "-" {
+      continue
+    }
+    if !f.IsExported() {
+      return nil, fmt.Errorf("%v.%s: unexported field", typ, f.Name)
+    }
+    idx := colIndex(tdef, col)
+    if idx < 0 {
+      return nil, fmt.Errorf("%v.%s: no column %s in table %s", typ, f.Name, col, tdef.Name)
+    }
+    for _, c := range plan.cols {
+      if c == idx {
+        return nil, fmt.Errorf("%v.%s: column %s is mapped twice", typ, f.Name, col)
+      }
+    }
+    if !fieldCompatible(f.Type, tdef.Types[idx]) {
+      return nil, fmt.Errorf("%v.%s: %v can't hold column %s", typ, f.Name, f.Type, col)
+    }
+    plan.fields = append(plan.fields, i)
+    plan.cols = append(plan.cols, idx)
+  }
+  return plan, nil
+}
+
+func fieldCompatible(typ reflect.Type, ctype uint32) bool {
+  switch ctype {
+  case TYPE_INT64:
+    switch typ.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+      return true
+    }
+  case TYPE_BYTES:
+    return typ.Kind() == reflect.String ||
+      (typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8)
+  }
+  return false
+}
+
+// the struct as a record
+func (plan *structPlan) record(tdef *TableDef, v reflect.Value) Record {
+  rec := Record{}
+  for i, field := range plan.fields {
+    col, fv := plan.cols[i], v.Field(field)
+    if tdef.Types[col] == TYPE_INT64 {
+      rec.AddInt64(tdef.Cols[col], fv.Int())
+    } else if fv.Kind() == reflect.String {
+      rec.AddStr(tdef.Cols[col], []byte(fv.String()))
+    } else {
+      rec.AddStr(tdef.Cols[col], fv.Bytes())
+    }
+  }
+  return rec
+}
+
+// fill the struct from a full row
+func (plan *structPlan) fill(tdef *TableDef, rec Record, v reflect.Value) error {
+  for i, field := range plan.fields {
+    name, fv := tdef.Cols[plan.cols[i]], v.Field(field)
+    val := rec.Get(name)
+    assert(val != nil)
+    switch {
+    case val.Type == TYPE_INT64:
+      if fv.OverflowInt(val.I64) {
+        return fmt.Errorf("%v.%s: %d overflows %v", v.Type(), v.Type().Field(field).Name, val.I64, fv.Type())
+      }
+      fv.SetInt(val.I64)
+    case fv.Kind() == reflect.String:
+      fv.SetString(string(val.Str))
+    default:
+      // the value may point into the read-only mmap
+      fv.SetBytes(append([]byte(nil), val.Str...))
+    }
+  }
+  return nil
+}
+
+// add a row from a struct or a pointer to a struct, which must map every
+// column but the AutoInc one. returns false if the primary key exists.
+func (tx *DBTX) InsertStruct(table string, row interface{}) (bool, error) {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return false, errNoTable(table)
+  }
+  v := reflect.Indirect(reflect.ValueOf(row))
+  if !v.IsValid() {
+    return false, errors.New("nil row")
+  }
+  plan, err := getStructPlan(tdef, v.Type())
+  if err != nil {
+    return false, err
+  }
+  mapped := len(plan.cols)
+  if tdef.AutoInc != "" && !containsInt(plan.cols, colIndex(tdef, tdef.AutoInc)) {
+    mapped++
+  }
+  // the soft delete column can be left out
+  if mapped != len(tdef.Cols) && mapped != len(visibleCols(tdef)) {
+    return false, fmt.Errorf("%v doesn't map every column of table %s", v.Type(), table)
+  }
+  return dbUpdate(tx, tdef, plan.record(tdef, v), MODE_INSERT_ONLY)
+}
+
+// run the range query and append the rows to `out`, a pointer to
+// a slice of structs or of pointers to structs.
+func (tx *DBTX) ScanStructs(table string, req *Scanner, out interface{}) error {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return errNoTable(table)
+  }
+  slice := reflect.ValueOf(out)
+  if slice.Kind() != reflect.Pointer || slice.Elem().Kind() != reflect.Slice {
+    return fmt.Errorf("not a pointer to a slice: %T", out)
+  }
+  slice = slice.Elem()
+  elem := slice.Type().Elem()
+  byPtr := elem.Kind() == reflect.Pointer
+  if byPtr {
+    elem = elem.Elem()
+  }
+  plan, err := getStructPlan(tdef, elem)
+  if err != nil {
+    return err
+  }
+  if err := dbScan(tx, tdef, req); err != nil {
+    return err
+  }
+  for ; req.Valid(); req.Next() {
+    rec := Record{}
+    if err := req.Deref(&rec); err != nil {
+      return err
+    }
+    v := reflect.New(elem)
+    if err := plan.fill(tdef, rec, v.Elem()); err != nil {
+      return err
+    }
+    if byPtr {
+      slice.Set(reflect.Append(slice, v))
+    } else {
+      slice.Set(reflect.Append(slice, v.Elem()))
+    }
+  }
+  return nil
+}
+
+func containsInt(vals []int, val int) bool {
+  for _, v := range vals {
+    if v == val {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+)
+
+type mapUser struct {
+  ID    int64  `db:"id"`
+  Name  string `db:"name"`
+  Data  []byte `db:"data"`
+  Other int    // not mapped
+}
+
+// the structs inserted and scanned back, and the ones that don't map
+func TestStructMapping(t *testing.T) {
+  db := &DB{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  tx := DBTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  tdef := &TableDef{
+    Name: "users", Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BYTES}, Cols: []string{"id", "name", "data"},
+    PKeys: 1, AutoInc: "id",
+  }
+  if err := tx.TableNew(tdef); err != nil {
+    t.Fatal(err)
+  }
+  type noID struct {
+    Data []byte `db:"data"`
+    Name string `db:"name"`
+  }
+  cases := []struct {
+    row      interface{}
+    inserted bool
+    err      string
+  }{
+    {&mapUser{ID: 5, Name: "a", Data: []byte{1}, Other: 9}, true, ""},
+    {mapUser{ID: 5, Name: "dup"}, false, ""},
+    {noID{Name: "b", Data: []byte{2}}, true, ""}, // the auto-increment id
+    {struct {
+      Name string `db:"name"`
+    }{"c"}, false, "doesn't map every column"},
+    {struct {
+      ID int64 `db:"id"`
+      X  int64 `db:"x"`
+    }{}, false, "no column x"},
+    {struct {
+      A string `db:"name"`
+      B string `db:"name"`
+    }{}, false, "column name is mapped twice"},
+    {struct {
+      ID string `db:"id"`
+    }{}, false, "string can't hold column id"},
+    {struct {
+      name string `db:"name"`
+    }{}, false, "unexported field"},
+    {5, false, "not a struct"},
+    {(*mapUser)(nil), false, "nil row"},
+  }
+  for i, c := range cases {
+    inserted, err := tx.InsertStruct("users", c.row)
+    if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+      t.Fatalf("case %d: %v", i, err)
+    }
+    if inserted != c.inserted {
+      t.Fatalf("case %d: inserted %v", i, inserted)
+    }
+  }
+  all := func() *Scanner {
+    return &Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE, Key1: *(&Record{}).AddInt64("id", 0), Key2: *(&Record{}).AddInt64("id", 1 << 40)}
+  }
+  var users []mapUser
+  if err := tx.ScanStructs("users", all(), &users); err != nil {
+    t.Fatal(err)
+  }
+  if fmt.Sprint(users) != "[{5 a [1] 0} {6 b [2] 0}]" {
+    t.Fatal(users)
+  }
+  // appended, by pointer
+  ptrs := []*mapUser{{ID: 1}}
+  if err := tx.ScanStructs("users", all(), &ptrs); err != nil {
+    t.Fatal(err)
+  }
+  if len(ptrs) != 3 || fmt.Sprint(*ptrs[2]) != "{6 b [2] 0}" {
+    t.Fatal(ptrs)
+  }
+  // a field too small for the value
+  tx.Insert("users", *(&Record{}).AddInt64("id", 300).AddStr("name", nil).AddStr("data", nil))
+  var small []struct {
+    ID int8 `db:"id"`
+  }
+  if err := tx.ScanStructs("users", all(), &small); err == nil || !strings.Contains(err.Error(), "300 overflows int8") {
+    t.Fatal(err)
+  }
+  if err := tx.ScanStructs("users", all(), users); err == nil {
+    t.Fatal("not a pointer")
+  }
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+  "encoding/binary"
+  "sort"
+  "time"
+)
+
+// a commit of a DB transaction, see SubscribeCommits
+type CommitInfo struct {
+  TXID    uint64    // the version of the store after the commit
+  Time    time.Time // when it was committed, increasing, see hlcClock
+  Tables  []string  // the tables with changed rows, sorted
+  Updated int       // rows inserted or updated
+  Deleted int       // rows deleted
+}
+
+// call fn after each commit of a DB transaction that changed something,
+// the returned function stops it. the commit is durable by then.
+// fn is called in commit order by the committing goroutine while the
+// next commits wait, so it should be quick and it can't update the db.
+// the updates with the KV interface are not included.
+func (db *DB) SubscribeCommits(fn func(CommitInfo)) (cancel func()) {
+  db.subsMu.Lock()
+  defer db.subsMu.Unlock()
+  if db.subs == nil {
+    db.subs = map[int]func(CommitInfo){}
+  }
+  id := db.nsubs
+  db.nsubs++
+  db.subs[id] = fn
+  return func() {
+    db.subsMu.Lock()
+    defer db.subsMu.Unlock()
+    delete(db.subs, id)
+  }
+}
+
+// in the order of subscription
+func (db *DB) subscribers() []func(CommitInfo) {
+  db.subsMu.Lock()
+  defer db.subsMu.Unlock()
+  ids := make([]int, 0, len(db.subs))
+  for id := range db.subs {
+    ids = append(ids, id)
+  }
+  sort.Ints(ids)
+  fns := make([]func(CommitInfo), len(ids))
+  for i, id := range ids {
+    fns[i] = db.subs[id]
+  }
+  return fns
+}
+
+// the rows are counted by the primary keys among the pending updates
+func notifyCommit(tx *DBTX, version uint64, fns []func(CommitInfo)) {
+  info := CommitInfo{TXID: version, Time: time.Unix(0, tx.db.kv.clock.tick())}
+  byPrefix := map[uint32]string{}
+  for name, tdef := range tx.tables {
+    if tdef != nil {
+      byPrefix[tdef.Prefix] = name
+    }
+  }
+  touched := map[string]bool{}
+  for iter := tx.kv.pending.Seek(nil, CMP_GE); iter.Valid(); iter.Next() {
+    key := iter.Key()
+    if len(key) < 4 {
+      continue
+    }
+    name, ok := byPrefix[binary.BigEndian.Uint32(key)]
+    if !ok {
+      continue // an index, or the internal tables
+    }
+    touched[name] = true
+    if iter.Val()[0] == FLAG_DELETED {
+      info.Deleted++
+    } else {
+      info.Updated++
+    }
+  }
+  for name := range touched {
+    info.Tables = append(info.Tables, name)
+  }
+  sort.Strings(info.Tables)
+  for _, fn := range fns {
+    fn(info)
+  }
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+  "errors"
+  "sort"
+  "time"
+)
+
+// the occupancy of the nodes by level, sampled over time. deleting keys
+// leaves the nodes partly used, a node is only merged with a sibling
+// below 1/4 of a page. when the average of a level stays low, the sparse
+// subtrees are reported as hints, and KV.Rebuild packs one of them
+// without waiting for a full Compact.
+const (
+  OCCUPANCY_MIN     = 0.5 // the default of Options.OccupancyMin
+  OCCUPANCY_SUSTAIN = 3   // the samples in a row below the min for a hint
+  OCCUPANCY_HISTORY = 64  // the samples kept
+  OCCUPANCY_HINTS   = 8   // the subtrees reported per level
+)
+
+// a walk of the latest version
+type OccupancySample struct {
+  Time   time.Time
+  Levels []LevelOccupancy // by height, the leaves first
+}
+
+type LevelOccupancy struct {
+  Nodes     uint64
+  Occupancy float64 // the average used fraction of a page
+}
+
+// a subtree to rebuild, see KV.Rebuild
+type RebuildHint struct {
+  Key       []byte  // the first key of the subtree
+  Height    int     // of the root of the subtree, its kids are on Level
+  Level     int     // the level found below the min
+  Nodes     int     // the kids of the subtree root
+  Occupancy float64 // their average
+}
+
+type occupancyState struct {
+  samples []OccupancySample // the oldest first
+}
+
+// the samples so far, the oldest first
+func (db *KV) Occupancy() []OccupancySample {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  return append([]OccupancySample(nil), db.occupancy.samples...)
+}
+
+// record a sample, e.g. periodically, and return the hints for the levels
+// below Options.OccupancyMin in the last OCCUPANCY_SUSTAIN samples, the
+// sparsest subtrees first. the whole tree is read.
+func (db *KV) SampleOccupancy() ([]RebuildHint, error) {
+  tree, release := db.snapshot()
+  walk := occupancyWalk{tree: &tree}
+  if tree.root != 0 {
+    walk.node(tree.root, treeHeight(&tree) - 1)
+  }
+  release()
+  sample := OccupancySample{Time: db.clock.wall.Now()}
+  for _, level := range walk.levels {
+    sample.Levels = append(sample.Levels, LevelOccupancy{
+      Nodes: level.nodes, Occupancy: float64(level.bytes) / float64(level.nodes * uint64(tree.pageSize())),
+    })
+  }
+  db.writer.Lock()
+  state := &db.occupancy
+  state.samples = append(state.samples, sample)
+  if len(state.samples) > OCCUPANCY_HISTORY {
+    state.samples = state.samples[len(state.samples) - OCCUPANCY_HISTORY:]
+  }
+  low := occupancyLow(state.samples, occupancyMin(db))
+  db.writer.Unlock()
+  var hints []RebuildHint
+  for _, level := range low {
+    hints = append(hints, walk.hints(level, occupancyMin(db))...)
+  }
+  return hints, nil
+}
+
+func occupancyMin(db *KV) float64 {
+  if db.Options.OccupancyMin > 0 {
+    return db.Options.OccupancyMin
+  }
+  return OCCUPANCY_MIN
+}
+
+// the levels below `limit` in the last samples, a level with a single
+// node is the root and can't be packed
+func occupancyLow(samples []OccupancySample, limit float64) []int {
+  if len(samples) < OCCUPANCY_SUSTAIN {
+    return nil
+  }
+  recent := samples[len(samples) - OCCUPANCY_SUSTAIN:]
+  var low []int
+  for level := range recent[len(recent)-1].Levels {
+    sustained := true
+    for _, s := range recent {
+      if level >= len(s.Levels) || s.Levels[level].Nodes < 2 || s.Levels[level].Occupancy >= limit {
+        sustained = false
+      }
+    }
+    if sustained {
+      low = append(low, level)
+    }
+  }
+  return low
+}
+
+type occupancyWalk struct {
+  tree    *BTree
+  levels  []struct{ nodes, bytes uint64 }
+  parents [][]RebuildHint // the internal nodes by the level of their kids
+}
+
+// returns the size of the node
+func (w *occupancyWalk) node(ptr uint64, level int) uint64 {
+  node := BNode(w.tree.get(ptr))
+  for len(w.levels) <= level {
+    w.levels = append(w.levels, struct{ nodes, bytes uint64 }{})
+    w.parents = append(w.parents, nil)
+  }
+  w.levels[level].nodes++
+  w.levels[level].bytes += uint64(node.nbytes())
+  if node.btype() == BNODE_NODE {
+    kids := uint64(0)
+    for i := uint16(0); i < node.nkeys(); i++ {
+      kids += w.node(node.getPtr(i), level - 1)
+    }
+    w.parents[level-1] = append(w.parents[level-1], RebuildHint{
+      Key: append([]byte(nil), node.getKey(0)...), Height: level, Level: level - 1,
+      Nodes: int(node.nkeys()),
+      Occupancy: float64(kids) / float64(uint64(node.nkeys()) * uint64(w.tree.pageSize())),
+    })
+  }
+  return uint64(node.nbytes())
+}
+
+// the subtrees of a level that would take fewer nodes
+func (w *occupancyWalk) hints(level int, limit float64) []RebuildHint {
+  var hints []RebuildHint
+  for _, hint := range w.parents[level] {
+    if hint.Nodes > 1 && hint.Occupancy < limit {
+      hints = append(hints, hint)
+    }
+  }
+  sort.SliceStable(hints, func(i, j int) bool { return hints[i].Occupancy < hints[j].Occupancy })
+  return hints[:min(len(hints), OCCUPANCY_HINTS)]
+}
+
+// the number of levels, 0 for an empty tree
+func treeHeight(tree *BTree) int {
+  height := 0
+  for ptr := tree.root; ptr != 0; height++ {
+    node := BNode(tree.get(ptr))
+    if node.btype() != BNODE_NODE {
+      return height + 1
+    }
+    ptr = node.getPtr(0)
+  }
+  return height
+}
+
+// pack the nodes of the subtree of a hint, level by level from the
+// leaves, in a commit. the keys and values don't change. the subtree is
+// the one with the key at the height, the tree may have changed since
+// the hint. returns the number of nodes saved.
+func (db *KV) Rebuild(hint RebuildHint) (int, error) {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  height := treeHeight(&db.tree)
+  if hint.Height < 1 || hint.Height > height - 1 {
+    return 0, errors.New("rebuild: no such subtree")
+  }
+  meta := saveMeta(db)
+  saved := 0
+  db.tree.walk = db.tree.walk[:0]
+  db.tree.enter(db.tree.root)
+  node := treeRebuild(&db.tree, db.tree.get(db.tree.root), hint.Key, height - 1, hint.Height, &saved)
+  db.tree.leave()
+  db.tree.del(db.tree.root)
+  // the root may be left with a single kid
+  for node.btype() == BNODE_NODE && node.nkeys() == 1 {
+    ptr := node.getPtr(0)
+    node = BNode(db.tree.get(ptr))
+    db.tree.del(ptr)
+    saved++
+  }
+  db.tree.setRoot(node)
+  if err := updateOrRevert(db, meta); err != nil {
+    return 0, err
+  }
+  return saved, nil
+}
+
+// down to the subtree at `target` with the key, then up with the new links
+func treeRebuild(tree *BTree, node BNode, key []byte, height int, target int, saved *int) BNode {
+  if height == target {
+    return rebuildNode(tree, node, height, saved)
+  }
+  idx := nodeLookupLE(node, key)
+  kptr := node.getPtr(idx)
+  tree.enter(kptr)
+  knode := treeRebuild(tree, tree.get(kptr), key, height - 1, target, saved)
+  tree.leave()
+  nsplit, split := nodeSplit3(knode, tree.pageSize())
+  tree.del(kptr)
+  new := BNode(make([]byte, 2 * tree.pageSize()))
+  nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+  return new
+}
+
+// the internal node with its kids packed, the kids first. it can exceed
+// 1 page, like after an insertion, the link keys may be longer.
+func rebuildNode(tree *BTree, node BNode, height int, saved *int) BNode {
+  var kids []BNode
+  for i := uint16(0); i < node.nkeys(); i++ {
+    kptr := node.getPtr(i)
+    kid := BNode(tree.get(kptr))
+    if height > 1 {
+      tree.enter(kptr)
+      kid = rebuildNode(tree, kid, height - 1, saved)
+      tree.leave()
+    }
+    tree.del(kptr)
+    nsplit, split := nodeSplit3(kid, tree.pageSize())
+    kids = append(kids, split[:nsplit]...)
+  }
+  packed := nodePack(kids, tree.pageSize())
+  *saved += len(kids) - len(packed)
+  keys := kidKeys(node.getKey(0), packed)
+  kvbytes := uint16(0)
+  for _, key := range keys {
+    kvbytes += kvBytes(key, nil)
+  }
+  new := BNode(make([]byte, 2 * tree.pageSize()))
+  b := newNodeBuilder(new, BNODE_NODE, uint16(len(packed)), kvbytes)
+  for i, kid := range packed {
+    b.add(tree.new(kid), keys[i], nil)
+  }
+  return new
+}
+
+// the KVs of adjacent nodes of a level in as few nodes as they fit
+func nodePack(nodes []BNode, size int) []BNode {
+  type run struct {
+    kid    int
+    idx, n uint16
+  }
+  var out []BNode
+  var runs []run // the ranges of the next node
+  nkeys, kvbytes := uint16(0), uint16(0)
+  flush := func() {
+    packed := BNode(make([]byte, size))
+    b := newNodeBuilder(packed, nodes[0].btype(), nkeys, kvbytes)
+    for _, r := range runs {
+      b.addRange(nodes[r.kid], r.idx, r.n)
+    }
+    out = append(out, packed)
+    runs, nkeys, kvbytes = runs[:0], 0, 0
+  }
+  for k, node := range nodes {
+    for i := uint16(0); i < node.nkeys(); i++ {
+      kv := node.rangeBytes(i, 1)
+      if nkeys > 0 && int(nodeSize(nkeys + 1, kvbytes + kv)) > size {
+        flush()
+      }
+      if last := len(runs) - 1; last >= 0 && runs[last].kid == k {
+        runs[last].n++
+      } else {
+        runs = append(runs, run{kid: k, idx: i, n: 1})
+      }
+      nkeys, kvbytes = nkeys + 1, kvbytes + kv
+    }
+  }
+  if nkeys > 0 {
+    flush()
+  }
+  return out
+}
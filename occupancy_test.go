@@ -0,0 +1,87 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "testing"
+)
+
+// the hints for the levels that stay below the min, and the rebuilds of
+// their subtrees
+func TestOccupancyHints(t *testing.T) {
+  cases := []struct {
+    keep   int // 1 of `keep` keys
+    min    float64
+    levels []int // of the hints
+  }{
+    {1, 0.4, nil},
+    {1, 0.6, []int{0, 1}}, // the leaves of in order inserts are half full
+    {2, 0.4, []int{1}},
+    {4, 0.8, nil},         // merged leaves, and the root alone above them
+    {4, 0.9, []int{0}},
+  }
+  for i, c := range cases {
+    db := &KV{Options: Options{InMemory: true, OccupancyMin: c.min}}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    val := func(k int) []byte {
+      return bytes.Repeat([]byte{byte(k)}, 100)
+    }
+    const n = 4000
+    for k := 0; k < n; k++ {
+      db.Set([]byte(fmt.Sprintf("k%05d", k)), val(k))
+    }
+    for k := 0; k < n; k++ {
+      if k % c.keep != 0 {
+        db.Del([]byte(fmt.Sprintf("k%05d", k)))
+      }
+    }
+    var hints []RebuildHint
+    for s := 0; s < OCCUPANCY_SUSTAIN; s++ {
+      var err error
+      if hints, err = db.SampleOccupancy(); err != nil {
+        t.Fatal(err)
+      }
+      if s < OCCUPANCY_SUSTAIN - 1 && len(hints) != 0 {
+        t.Fatalf("case %d: hints after %d samples", i, s + 1)
+      }
+    }
+    levels := []int{}
+    for j, hint := range hints {
+      if j == 0 || hint.Level != hints[j-1].Level {
+        levels = append(levels, hint.Level)
+      }
+      if hint.Occupancy >= c.min || hint.Height != hint.Level + 1 {
+        t.Fatalf("case %d: %+v", i, hint)
+      }
+    }
+    if fmt.Sprint(levels) != fmt.Sprint(c.levels) {
+      t.Fatalf("case %d: levels %v, want %v", i, levels, c.levels)
+    }
+    before := db.Occupancy()[OCCUPANCY_SUSTAIN - 1].Levels
+    saved := 0
+    for _, hint := range hints {
+      if s, err := db.Rebuild(hint); err == nil {
+        saved += s
+      }
+    }
+    if err := db.Verify(); err != nil {
+      t.Fatal(err)
+    }
+    for k := 0; k < n; k += c.keep {
+      if got, ok := db.Get([]byte(fmt.Sprintf("k%05d", k))); !ok || !bytes.Equal(got, val(k)) {
+        t.Fatalf("case %d: k%05d", i, k)
+      }
+    }
+    db.SampleOccupancy()
+    after := db.Occupancy()[OCCUPANCY_SUSTAIN].Levels
+    if (saved > 0) != (len(hints) > 0) || before[0].Nodes - after[0].Nodes > uint64(saved) {
+      t.Fatalf("case %d: %d saved, %v then %v", i, saved, before, after)
+    }
+    if len(hints) > 0 && (after[0].Nodes >= before[0].Nodes || after[0].Occupancy < c.min) {
+      t.Fatalf("case %d: %v then %v", i, before, after)
+    }
+    db.Close()
+  }
+}
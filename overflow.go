@@ -0,0 +1,99 @@
+package main
+
+import (
+  "encoding/binary"
+)
+
+// values larger than BTREE_MAX_VAL_SIZE are stored in a chain of overflow
+// pages. the leaf keeps a reference to the chain, which is marked by
+// the high bit of the value size.
+// reference: | total size 4B | first page 8B |
+// page:      | type 2B | size 2B | next page 8B | data |
+const (
+  BNODE_OVERFLOW      = 3
+  VAL_OVERFLOW        = uint16(1 << 15)
+  OVERFLOW_REF_SIZE   = 12
+  OVERFLOW_HEADER     = 12
+  BTREE_MAX_BLOB_SIZE = 16 << 20
+)
+
+// the data bytes in an overflow page
+func overflowCap(tree *BTree) int {
+  return tree.pageSize() - OVERFLOW_HEADER
+}
+
+// the actual value of a leaf KV
+func treeVal(tree *BTree, node BNode, idx uint16) []byte {
+  val := node.getVal(idx)
+  if node.isOverflow(idx) {
+    val = overflowRead(tree, val)
+  }
+  return val
+}
+
+// write the value to new pages, returns the reference.
+// the chain is built backward so that each page knows the next one.
+// the pages are in the B-tree file or in the cold file, see cold.go.
+func overflowWrite(tree *BTree, val []byte) []byte {
+  assert(len(val) <= BTREE_MAX_BLOB_SIZE)
+  alloc := overflowAlloc(tree, len(val))
+  next, cap := uint64(0), overflowCap(tree)
+  for end := len(val); end > 0; {
+    start := (end - 1) / cap * cap
+    page := make([]byte, tree.pageSize())
+    binary.LittleEndian.PutUint16(page[0:], BNODE_OVERFLOW)
+    binary.LittleEndian.PutUint16(page[2:], uint16(end - start))
+    binary.LittleEndian.PutUint64(page[4:], next)
+    copy(page[OVERFLOW_HEADER:], val[start:end])
+    next = alloc(page)
+    end = start
+  }
+  ref := make([]byte, OVERFLOW_REF_SIZE)
+  binary.LittleEndian.PutUint32(ref[0:], uint32(len(val)))
+  binary.LittleEndian.PutUint64(ref[4:], next)
+  return ref
+}
+
+// the first n bytes of the value, or all of it if it's shorter, from the
+// pages that have them
+func overflowPrefix(tree *BTree, ref []byte, n int) []byte {
+  assert(len(ref) == OVERFLOW_REF_SIZE)
+  out := []byte{}
+  for ptr := binary.LittleEndian.Uint64(ref[4:]); ptr != 0 && len(out) < n; {
+    page := overflowPage(tree, ptr)
+    size := int(binary.LittleEndian.Uint16(page[2:]))
+    out = append(out, page[OVERFLOW_HEADER:][:size]...)
+    ptr = binary.LittleEndian.Uint64(page[4:])
+  }
+  return out[:min(n, len(out))]
+}
+
+func overflowRead(tree *BTree, ref []byte) []byte {
+  assert(len(ref) == OVERFLOW_REF_SIZE)
+  total := int(binary.LittleEndian.Uint32(ref[0:]))
+  out := make([]byte, 0, total)
+  for ptr := binary.LittleEndian.Uint64(ref[4:]); ptr != 0; {
+    page := overflowPage(tree, ptr)
+    assert(binary.LittleEndian.Uint16(page[0:]) == BNODE_OVERFLOW)
+    size := int(binary.LittleEndian.Uint16(page[2:]))
+    out = append(out, page[OVERFLOW_HEADER:][:size]...)
+    ptr = binary.LittleEndian.Uint64(page[4:])
+  }
+  assert(len(out) == total)
+  return out
+}
+
+// deallocate the pages of a value that is deleted or replaced. the pages
+// of the B-tree file are reused, see freelist.go, those of the cold file not.
+func overflowFree(tree *BTree, ref []byte) {
+  assert(len(ref) == OVERFLOW_REF_SIZE)
+  for ptr := binary.LittleEndian.Uint64(ref[4:]); ptr != 0; {
+    next := binary.LittleEndian.Uint64(overflowPage(tree, ptr)[4:])
+    if ptr >> PAGE_FILE_SHIFT == COLD_FILE {
+      tree.cold.Del(ptr &^ PAGE_FILE_MASK)
+    } else {
+      tree.del(ptr)
+    }
+    ptr = next
+  }
+}
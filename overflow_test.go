@@ -0,0 +1,150 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "math/rand"
+  "path/filepath"
+  "testing"
+)
+
+// a value of `size` bytes that differs for each seed
+func overflowVal(size int, seed int64) []byte {
+  val := make([]byte, size)
+  rand.New(rand.NewSource(seed)).Read(val)
+  return val
+}
+
+// the overflow pages of the values, see Stats
+func overflowPages(tree *BTree, sizes map[string]int) uint64 {
+  pages, cap := uint64(0), overflowCap(tree)
+  for _, size := range sizes {
+    if size > BTREE_MAX_VAL_SIZE {
+      pages += uint64((size + cap - 1) / cap)
+    }
+  }
+  return pages
+}
+
+func overflowCheck(t *testing.T, db *KV, sizes map[string]int, seeds map[string]int64) {
+  t.Helper()
+  if err := db.Verify(); err != nil {
+    t.Fatal(err)
+  }
+  for key, size := range sizes {
+    val, ok := db.Get([]byte(key))
+    if !ok || len(val) != size || string(val) != string(overflowVal(size, seeds[key])) {
+      t.Fatalf("%s: %d bytes, want %d", key, len(val), size)
+    }
+  }
+  st, err := db.Stats()
+  if err != nil {
+    t.Fatal(err)
+  }
+  pages, cold := overflowPages(&db.tree, sizes), uint64(0)
+  if db.Options.ColdTier {
+    pages, cold = 0, pages
+  }
+  if st.Keys != uint64(len(sizes)) || st.OverflowPages != pages || st.ColdPages != cold {
+    t.Fatalf("%d keys, %d + %d overflow pages, want %d + %d", st.Keys, st.OverflowPages, st.ColdPages, pages, cold)
+  }
+}
+
+func TestOverflow(t *testing.T) {
+  for _, coldTier := range []bool{false, true} {
+    path := filepath.Join(t.TempDir(), "db")
+    db := &KV{Path: path, Options: Options{ColdTier: coldTier}}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    cap := overflowCap(&db.tree)
+    all := []int{
+      BTREE_MAX_VAL_SIZE - 1, BTREE_MAX_VAL_SIZE, BTREE_MAX_VAL_SIZE + 1,
+      cap, cap + 1, 3 * cap - 1, 3 * cap, 3 * cap + 1, BTREE_MAX_BLOB_SIZE,
+    }
+    sizes, seeds := map[string]int{}, map[string]int64{}
+    set := func(key string, size int, seed int64) {
+      t.Helper()
+      if err := db.Set([]byte(key), overflowVal(size, seed)); err != nil {
+        t.Fatal(err)
+      }
+      sizes[key], seeds[key] = size, seed
+    }
+    for i, size := range all {
+      set(fmt.Sprintf("k%d", i), size, int64(i))
+    }
+    overflowCheck(t, db, sizes, seeds)
+    if err := db.Set([]byte("big"), make([]byte, BTREE_MAX_BLOB_SIZE + 1)); !errors.Is(err, ErrTooLarge) {
+      t.Fatal(err)
+    }
+
+    // replaced by a value of another size, in and out of the overflow pages
+    for i := range all {
+      set(fmt.Sprintf("k%d", i), all[(i + 3) % len(all)], int64(100 + i))
+    }
+    overflowCheck(t, db, sizes, seeds)
+    // and by one of the same size
+    for i, size := range all {
+      if size > BTREE_MAX_VAL_SIZE {
+        set(fmt.Sprintf("k%d", i), sizes[fmt.Sprintf("k%d", i)], int64(200 + i))
+      }
+    }
+    overflowCheck(t, db, sizes, seeds)
+    for i := 0; i < len(all); i += 2 {
+      key := fmt.Sprintf("k%d", i)
+      if ok, err := db.Del([]byte(key)); !ok || err != nil {
+        t.Fatal(ok, err)
+      }
+      delete(sizes, key)
+    }
+    overflowCheck(t, db, sizes, seeds)
+    db.Close()
+
+    db = &KV{Path: path, Options: Options{ColdTier: coldTier}}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    overflowCheck(t, db, sizes, seeds)
+    db.Close()
+  }
+}
+
+// the pages of the deleted and replaced values are reused
+func TestOverflowReuse(t *testing.T) {
+  db := &KV{Path: filepath.Join(t.TempDir(), "db")}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  size := 10 * overflowCap(&db.tree)
+  sizes, seeds := map[string]int{}, map[string]int64{}
+  for i := 0; i < 10; i++ {
+    key := fmt.Sprintf("k%d", i)
+    if err := db.Set([]byte(key), overflowVal(size, int64(i))); err != nil {
+      t.Fatal(err)
+    }
+    sizes[key], seeds[key] = size, int64(i)
+  }
+  before := freeStats(t, db)
+  if ok, err := db.Del([]byte("k0")); !ok || err != nil {
+    t.Fatal(ok, err)
+  }
+  delete(sizes, "k0")
+  if st := freeStats(t, db); st.FreePages < before.FreePages + 10 {
+    t.Fatalf("%d free pages, %d before", st.FreePages, before.FreePages)
+  }
+  for round := 0; round < 5; round++ {
+    for i := 1; i < 10; i++ {
+      key := fmt.Sprintf("k%d", i)
+      seed := int64(100 * round + i)
+      if err := db.Set([]byte(key), overflowVal(size, seed)); err != nil {
+        t.Fatal(err)
+      }
+      seeds[key] = seed
+    }
+  }
+  overflowCheck(t, db, sizes, seeds)
+  if st := freeStats(t, db); st.Pages > before.Pages + 20 {
+    t.Fatalf("%d pages, %d before", st.Pages, before.Pages)
+  }
+}
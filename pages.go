@@ -0,0 +1,61 @@
+package main
+
+// page access of a B-tree
+type Pages interface {
+  Get(ptr uint64) []byte     // read a page
+  New(node []byte) uint64    // allocate a page with the data
+  Del(ptr uint64)            // deallocate a page
+}
+
+func (tree *BTree) usePages(pages Pages) {
+  tree.get = pages.Get
+  tree.new = pages.New
+  tree.del = pages.Del
+}
+
+// pages in a map, nothing is persisted. deallocated pages are dropped
+// right away, so there are no snapshots on it.
+type MemPages struct {
+  pages map[uint64][]byte
+  next  uint64
+}
+
+func NewMemPages() *MemPages {
+  return &MemPages{pages: map[uint64][]byte{}}
+}
+
+func (mp *MemPages) Get(ptr uint64) []byte {
+  node, ok := mp.pages[ptr]
+  assert(ok)
+  return node
+}
+
+func (mp *MemPages) New(node []byte) uint64 {
+  assert(len(node) <= BTREE_PAGE_MAX)
+  mp.next++ // 0 is not a valid pointer
+  mp.pages[mp.next] = node
+  return mp.next
+}
+
+func (mp *MemPages) Del(ptr uint64) {
+  _, ok := mp.pages[ptr]
+  assert(ok)
+  delete(mp.pages, ptr)
+}
+
+// the pages of a KV store, in the file or not written yet
+type kvPages struct {
+  db *KV
+}
+
+func (kp kvPages) Get(ptr uint64) []byte {
+  return kp.db.pageGet(ptr)
+}
+
+func (kp kvPages) New(node []byte) uint64 {
+  return kp.db.pageNew(node)
+}
+
+func (kp kvPages) Del(ptr uint64) {
+  kp.db.pageDel(ptr)
+}
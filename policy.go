@@ -0,0 +1,122 @@
+package main
+
+import (
+  "bytes"
+  "compress/flate"
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "errors"
+  "fmt"
+  "io"
+)
+
+// the row values of a table can be stored compressed and/or encrypted,
+// as set by TableDef.Compression and TableDef.Encryption. the policy is
+// part of the table definition in the catalog.
+// only the values are transformed; the keys, so the primary key and the
+// indexed columns, stay as is to keep their order.
+// a transformed value: | flags 1B | data |
+// the data is compressed first, then encrypted with AES-GCM:
+// | nonce 12B | ciphertext | tag 16B |, with the row key as the AD, so a
+// value can't be moved to another row.
+const (
+  ROW_COMPRESSED = byte(1)
+  ROW_ENCRYPTED  = byte(2)
+)
+
+// the compression of TableDef.Compression
+const COMPRESS_FLATE = "flate"
+
+func rowPolicyCheck(db *DB, tdef *TableDef) error {
+  switch tdef.Compression {
+  case "", COMPRESS_FLATE:
+  default:
+    return fmt.Errorf("table %s: unknown compression %q", tdef.Name, tdef.Compression)
+  }
+  if tdef.Encryption != "" {
+    if _, err := rowCipher(db, tdef); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// the AEAD with the key named by the table
+func rowCipher(db *DB, tdef *TableDef) (cipher.AEAD, error) {
+  var key []byte
+  if db != nil {
+    key = db.Keys[tdef.Encryption]
+  }
+  if key == nil {
+    return nil, fmt.Errorf("table %s: no encryption key %q", tdef.Name, tdef.Encryption)
+  }
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return nil, fmt.Errorf("table %s: %w", tdef.Name, err)
+  }
+  return cipher.NewGCM(block)
+}
+
+// the stored value of a row
+func rowEncode(tx *DBTX, tdef *TableDef, key []byte, val []byte) ([]byte, error) {
+  if tdef.Compression == "" && tdef.Encryption == "" {
+    return val, nil
+  }
+  flags := byte(0)
+  if tdef.Compression == COMPRESS_FLATE {
+    var buf bytes.Buffer
+    w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+    w.Write(val)
+    w.Close()
+    // not for the values that don't compress
+    if buf.Len() < len(val) {
+      val, flags = buf.Bytes(), flags | ROW_COMPRESSED
+    }
+  }
+  if tdef.Encryption != "" {
+    aead, err := rowCipher(tx.db, tdef)
+    if err != nil {
+      return nil, err
+    }
+    nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(val) + aead.Overhead())
+    if _, err := rand.Read(nonce); err != nil {
+      return nil, err
+    }
+    val, flags = aead.Seal(nonce, nonce, val, key), flags | ROW_ENCRYPTED
+  }
+  return append([]byte{flags}, val...), nil
+}
+
+// the reverse of rowEncode
+func rowDecode(tx *DBTX, tdef *TableDef, key []byte, val []byte) ([]byte, error) {
+  if tdef.Compression == "" && tdef.Encryption == "" {
+    return val, nil
+  }
+  if len(val) == 0 {
+    return nil, errors.New("bad row: no flags")
+  }
+  flags, val := val[0], val[1:]
+  if flags & ROW_ENCRYPTED != 0 {
+    aead, err := rowCipher(tx.db, tdef)
+    if err != nil {
+      return nil, err
+    }
+    n := aead.NonceSize()
+    if len(val) < n {
+      return nil, errors.New("bad row: short ciphertext")
+    }
+    val, err = aead.Open(nil, val[:n], val[n:], key)
+    if err != nil {
+      return nil, fmt.Errorf("table %s: decrypt: %w", tdef.Name, err)
+    }
+  }
+  if flags & ROW_COMPRESSED != 0 {
+    out, err := io.ReadAll(flate.NewReader(bytes.NewReader(val)))
+    if err != nil {
+      return nil, fmt.Errorf("table %s: decompress: %w", tdef.Name, err)
+    }
+    val = out
+  }
+  return val, nil
+}
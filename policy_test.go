@@ -0,0 +1,100 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "strings"
+  "testing"
+)
+
+// the stored row values by the policy of the table, and read back
+func TestRowPolicy(t *testing.T) {
+  db := &DB{Options: Options{InMemory: true}}
+  db.Keys = map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32), "short": {1, 2, 3}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  plain := bytes.Repeat([]byte("compressible "), 100)
+  cases := []struct {
+    compression, encryption string
+    val                     []byte
+    flags                   int // -1: no flags byte
+    err                     string
+  }{
+    {"", "", plain, -1, ""},
+    {COMPRESS_FLATE, "", plain, int(ROW_COMPRESSED), ""},
+    {COMPRESS_FLATE, "", []byte("x"), 0, ""}, // doesn't compress
+    {"", "k1", plain, int(ROW_ENCRYPTED), ""},
+    {COMPRESS_FLATE, "k1", plain, int(ROW_COMPRESSED | ROW_ENCRYPTED), ""},
+    {"zstd", "", nil, 0, "unknown compression"},
+    {"", "missing", nil, 0, `no encryption key "missing"`},
+    {"", "short", nil, 0, "invalid key size"},
+  }
+  for i, c := range cases {
+    tx := DBTX{}
+    db.Begin(&tx)
+    tdef := &TableDef{
+      Name: fmt.Sprintf("t%d", i), Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "v"},
+      PKeys: 1, Compression: c.compression, Encryption: c.encryption,
+    }
+    err := tx.TableNew(tdef)
+    if c.err != "" {
+      if err == nil || !strings.Contains(err.Error(), c.err) {
+        t.Fatalf("case %d: %v", i, err)
+      }
+      db.Abort(&tx)
+      continue
+    }
+    if err != nil {
+      t.Fatalf("case %d: %v", i, err)
+    }
+    for id := int64(1); id <= 2; id++ {
+      if _, err := tx.Insert(tdef.Name, *(&Record{}).AddInt64("id", id).AddStr("v", c.val)); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if err := db.Commit(&tx); err != nil {
+      t.Fatal(err)
+    }
+    rowKey := func(id int64) []byte {
+      return encodeKey(nil, tdef.Prefix, []Value{{Type: TYPE_INT64, I64: id}})
+    }
+    stored, _ := db.kv.Get(rowKey(1))
+    if c.flags < 0 && stored[0] == 0 || c.flags >= 0 && int(stored[0]) != c.flags {
+      t.Fatalf("case %d: flags %d", i, stored[0])
+    }
+    if bytes.Contains(stored, c.val) == (c.flags > 0) {
+      t.Fatalf("case %d: %q", i, stored)
+    }
+    get := func() ([]byte, error) {
+      db.Begin(&tx)
+      defer db.Abort(&tx)
+      rec := (&Record{}).AddInt64("id", 1)
+      if _, err := tx.Get(tdef.Name, rec); err != nil {
+        return nil, err
+      }
+      return rec.Get("v").Str, nil
+    }
+    if got, err := get(); err != nil || !bytes.Equal(got, c.val) {
+      t.Fatalf("case %d: %.20q %v", i, got, err)
+    }
+    // a ciphertext is bound to its row
+    if c.encryption != "" {
+      other, _ := db.kv.Get(rowKey(2))
+      db.kv.Set(rowKey(1), other)
+      if _, err := get(); err == nil || !strings.Contains(err.Error(), "decrypt") {
+        t.Fatalf("case %d: %v", i, err)
+      }
+    }
+  }
+  // the key is needed to read the row
+  delete(db.Keys, "k1")
+  tx := DBTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  rec := (&Record{}).AddInt64("id", 2)
+  if _, err := tx.Get("t3", rec); err == nil || !strings.Contains(err.Error(), `no encryption key "k1"`) {
+    t.Fatal(err)
+  }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+  "encoding/binary"
+  "sync"
+  "sync/atomic"
+  "syscall"
+  "time"
+)
+
+// a batch transaction, e.g. an export, yields to the interactive ones,
+// which are all the others. there's no buffer pool, the pages are cached
+// by the OS, so a batch transaction:
+//  - reads at most Options.BatchReadRate pages per second while an
+//    interactive transaction is in progress, and at full speed otherwise.
+//  - marks the leaves and the overflow pages it has read as the first to
+//    evict, so a scan doesn't push the working set out of the cache.
+const (
+  PRIORITY_COLD_BATCH = 64 // pages marked at once
+  MADV_COLD           = 20 // linux 5.4, not in package syscall
+)
+
+type ioSched struct {
+  interactive atomic.Int64 // the interactive transactions in progress
+  mu          sync.Mutex
+  next        time.Time // the time of the next throttled read
+}
+
+// like Begin, with the batch priority
+func (db *KV) BeginBatch(tx *KVTX) {
+  db.Begin(tx)
+  db.sched.interactive.Add(-1)
+  tx.batch = true
+  tx.snapshot.get = batchGet(db, tx.snapshot.get)
+}
+
+// called by each Begin
+func schedBegin(tx *KVTX) {
+  tx.batch = false
+  tx.db.sched.interactive.Add(1)
+}
+
+func schedEnd(tx *KVTX) {
+  if !tx.batch {
+    tx.db.sched.interactive.Add(-1)
+  }
+}
+
+// the page reads of a batch transaction
+func batchGet(db *KV, get func(uint64) []byte) func(uint64) []byte {
+  var read [][]byte
+  return func(ptr uint64) []byte {
+    schedThrottle(db)
+    page := get(ptr)
+    if btype := binary.LittleEndian.Uint16(page); btype == BNODE_LEAF || btype == BNODE_OVERFLOW {
+      // the internal nodes are shared by all the reads, they stay
+      read = append(read, page)
+    }
+    if len(read) == PRIORITY_COLD_BATCH {
+      for _, page := range read {
+        // only a hint, it fails for the pages not in the mmap
+        _ = syscall.Madvise(page, MADV_COLD)
+      }
+      read = read[:0]
+    }
+    return page
+  }
+}
+
+// wait for the next read slot if the interactive work goes on
+func schedThrottle(db *KV) {
+  rate := db.Options.BatchReadRate
+  if rate <= 0 || db.sched.interactive.Load() == 0 {
+    return
+  }
+  db.sched.mu.Lock()
+  now := db.clock.wall.Now()
+  if db.sched.next.Before(now) {
+    db.sched.next = now
+  }
+  wait := db.sched.next.Sub(now)
+  db.sched.next = db.sched.next.Add(time.Second / time.Duration(rate))
+  db.sched.mu.Unlock()
+  if wait > 0 {
+    db.clock.sleep(wait)
+  }
+}
+
+// see KV.BeginBatch
+func (db *DB) BeginBatch(tx *DBTX) {
+  tx.db = db
+  tx.tables = map[string]*TableDef{}
+  schemaBegin(tx)
+  db.kv.BeginBatch(&tx.kv)
+}
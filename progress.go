@@ -0,0 +1,200 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+// the progress of a long-running operation such as Dump, Restore or
+// LoadSorted. the operation updates it, another goroutine can poll it
+// with Info at any time. a nil *Progress is not updated.
+type Progress struct {
+  mu       sync.Mutex
+  unit     string // what's counted, e.g. "bytes"
+  done     int64
+  total    int64 // 0 if unknown
+  start    time.Time
+  finished bool
+}
+
+// a snapshot of a Progress
+type ProgressInfo struct {
+  Unit     string
+  Done     int64
+  Total    int64 // 0 if unknown
+  Elapsed  time.Duration
+  Finished bool
+}
+
+func (p *Progress) Info() ProgressInfo {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  info := ProgressInfo{Unit: p.unit, Done: p.done, Total: p.total, Finished: p.finished}
+  if !p.start.IsZero() {
+    info.Elapsed = time.Since(p.start)
+  }
+  return info
+}
+
+// the estimated time left, assuming a constant rate.
+// false if the total is unknown or nothing is done yet.
+func (info ProgressInfo) ETA() (time.Duration, bool) {
+  if info.Total <= 0 || info.Done <= 0 {
+    return 0, false
+  }
+  left := max(info.Total - info.Done, 0)
+  return time.Duration(float64(info.Elapsed) * float64(left) / float64(info.Done)), true
+}
+
+func (p *Progress) begin(unit string, total int64) {
+  if p == nil {
+    return
+  }
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  p.unit, p.done, p.total, p.start, p.finished = unit, 0, total, time.Now(), false
+}
+
+func (p *Progress) add(n int64) {
+  if p == nil {
+    return
+  }
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  p.done += n
+}
+
+func (p *Progress) finish() {
+  if p == nil {
+    return
+  }
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  p.finished = true
+}
+
+// count the bytes read
+type progressReader struct {
+  in io.Reader
+  p  *Progress
+}
+
+func (r progressReader) Read(buf []byte) (int, error) {
+  n, err := r.in.Read(buf)
+  r.p.add(int64(n))
+  return n, err
+}
+
+// count the keys of an iterator
+type progressIter struct {
+  KVIter
+  p *Progress
+}
+
+func (it progressIter) Next() {
+  it.p.add(1)
+  it.KVIter.Next()
+}
+
+// keep the optional Err() of the wrapped iterator, see BulkLoad
+func (it progressIter) Err() error {
+  if e, ok := it.KVIter.(interface{ Err() error }); ok {
+    return e.Err()
+  }
+  return nil
+}
+
+// and the optional Expires()
+func (it progressIter) Expires() int64 {
+  if e, ok := it.KVIter.(interface{ Expires() int64 }); ok {
+    return e.Expires()
+  }
+  return 0
+}
+
+// the number of leaves, from the internal nodes only
+func leafCount(tree *BTree) int64 {
+  if tree.root == 0 {
+    return 0
+  }
+  // the leaves are all at the same depth
+  height := 1
+  path := []uint64{tree.root}
+  for node := BNode(tree.get(tree.root)); node.btype() == BNODE_NODE; height++ {
+    path = append(path, node.getPtr(0))
+    checkDepth(path, tree.maxDepth)
+    node = BNode(tree.get(node.getPtr(0)))
+  }
+  return leafCountAt(tree, tree.root, height)
+}
+
+func leafCountAt(tree *BTree, ptr uint64, height int) int64 {
+  if height == 1 {
+    return 1
+  }
+  node := BNode(tree.get(ptr))
+  if height == 2 {
+    return int64(node.nkeys())
+  }
+  count := int64(0)
+  for i := uint16(0); i < node.nkeys(); i++ {
+    count += leafCountAt(tree, node.getPtr(i), height - 1)
+  }
+  return count
+}
+
+// draw a progress bar on a terminal until stop is called
+func progressBar(w io.Writer, p *Progress) (stop func()) {
+  done := make(chan struct{})
+  var wg sync.WaitGroup
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    ticker := time.NewTicker(200 * time.Millisecond)
+    defer ticker.Stop()
+    for {
+      select {
+      case <-done:
+        fmt.Fprintf(w, "\r%s\033[K\n", progressLine(p.Info()))
+        return
+      case <-ticker.C:
+        fmt.Fprintf(w, "\r%s\033[K", progressLine(p.Info()))
+      }
+    }
+  }()
+  return func() {
+    close(done)
+    wg.Wait()
+  }
+}
+
+func progressLine(info ProgressInfo) string {
+  if info.Total <= 0 {
+    return fmt.Sprintf("%d %s", info.Done, info.Unit)
+  }
+  const width = 30
+  frac := min(float64(info.Done) / float64(info.Total), 1)
+  filled := int(frac * width)
+  line := fmt.Sprintf("[%s%s] %3.0f%% %d/%d %s",
+    strings.Repeat("#", filled), strings.Repeat(" ", width - filled),
+    frac * 100, info.Done, info.Total, info.Unit)
+  if eta, ok := info.ETA(); ok && !info.Finished {
+    line += fmt.Sprintf(" ETA %v", eta.Round(time.Second))
+  }
+  return line
+}
+
+// run an operation with a progress bar on stderr if it's a terminal
+func withProgress(fn func(p *Progress) error) error {
+  p := &Progress{}
+  if !isTerminal(os.Stderr) {
+    return fn(p)
+  }
+  stop := progressBar(os.Stderr, p)
+  defer stop()
+  return fn(p)
+}
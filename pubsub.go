@@ -0,0 +1,196 @@
+package main
+
+import (
+  "sort"
+  "strings"
+  "sync/atomic"
+)
+
+// the keyspace notifications over RESP, on the channels of Redis:
+// __keyspace@0__:<key> with the event as the message and
+// __keyevent@0__:<event> with the key as the message, see SubscribeKeys.
+// a subscribed connection gets the events of the commits of all the
+// clients as they come. a client that falls RESP_PUBSUB_BUFFER events
+// behind is disconnected, like a Redis client past its pub/sub output
+// buffer limit; it has missed some and must start over.
+const (
+  RESP_KEYSPACE      = "__keyspace@0__:"
+  RESP_KEYEVENT      = "__keyevent@0__:"
+  RESP_PUBSUB_BUFFER = 4096
+)
+
+var respPubSub = map[string]bool{
+  "SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+}
+
+// the subscriptions of a connection, under respConn.outMu
+type respSub struct {
+  channels map[string]bool
+  patterns []string // in the order of subscription
+  cancel   func()   // the subscription to the store
+  done     chan struct{}
+}
+
+func (s *respSub) active() bool {
+  return len(s.channels) + len(s.patterns) > 0
+}
+
+// (P)SUBSCRIBE name... | (P)UNSUBSCRIBE [name...], without names for all
+func (c *respConn) pubsub(name string, args [][]byte) {
+  if (name == "SUBSCRIBE" || name == "PSUBSCRIBE") && len(args) == 0 {
+    respError(c.out, respArgs(name))
+    return
+  }
+  s := &c.sub
+  if s.channels == nil {
+    s.channels = map[string]bool{}
+  }
+  kind := strings.ToLower(name)
+  switch name {
+  case "SUBSCRIBE":
+    for _, ch := range args {
+      s.channels[string(ch)] = true
+      c.pubsubReply(kind, string(ch))
+    }
+  case "PSUBSCRIBE":
+    for _, p := range args {
+      if !contains(s.patterns, string(p)) {
+        s.patterns = append(s.patterns, string(p))
+      }
+      c.pubsubReply(kind, string(p))
+    }
+  case "UNSUBSCRIBE":
+    names := respNames(args)
+    if len(args) == 0 {
+      for ch := range s.channels {
+        names = append(names, ch)
+      }
+      sort.Strings(names)
+    }
+    for _, ch := range names {
+      delete(s.channels, ch)
+      c.pubsubReply(kind, ch)
+    }
+    if len(names) == 0 {
+      c.pubsubReply(kind, "")
+    }
+  case "PUNSUBSCRIBE":
+    names := respNames(args)
+    if len(args) == 0 {
+      names = s.patterns
+    }
+    for _, p := range names {
+      for i := range s.patterns {
+        if s.patterns[i] == p {
+          s.patterns = append(s.patterns[:i:i], s.patterns[i+1:]...)
+          break
+        }
+      }
+      c.pubsubReply(kind, p)
+    }
+    if len(names) == 0 {
+      c.pubsubReply(kind, "")
+    }
+  }
+  if s.active() && s.cancel == nil {
+    c.subscribe()
+  } else if !s.active() && s.cancel != nil {
+    c.unsubscribeAll()
+  }
+}
+
+// | kind | name | the number of subscriptions |, no name is a null
+func (c *respConn) pubsubReply(kind string, name string) {
+  respArray(c.out, 3)
+  respBulk(c.out, []byte(kind))
+  if name == "" {
+    respBulk(c.out, nil)
+  } else {
+    respBulk(c.out, []byte(name))
+  }
+  respInt(c.out, len(c.sub.channels) + len(c.sub.patterns))
+}
+
+func respNames(args [][]byte) []string {
+  names := []string{}
+  for _, arg := range args {
+    names = append(names, string(arg))
+  }
+  return names
+}
+
+// the events are sent by a goroutine, the commits don't wait for the client
+func (c *respConn) subscribe() {
+  events := make(chan KeyEvent, RESP_PUBSUB_BUFFER)
+  done := make(chan struct{})
+  var behind atomic.Bool
+  c.sub.cancel = c.db.SubscribeKeys(nil, func(ev KeyEvent) {
+    select {
+    case events <- ev:
+    default:
+      if !behind.Swap(true) {
+        c.conn.Close() // the reads fail, respServe returns
+      }
+    }
+  })
+  c.sub.done = done
+  go c.deliver(events, done)
+}
+
+// stop the events, with respConn.outMu held or at the end of respServe
+func (c *respConn) unsubscribeAll() {
+  if c.sub.cancel != nil {
+    c.sub.cancel()
+    close(c.sub.done)
+    c.sub.cancel, c.sub.done = nil, nil
+  }
+}
+
+func (c *respConn) deliver(events chan KeyEvent, done chan struct{}) {
+  for {
+    select {
+    case <-done:
+      return
+    case ev := <-events:
+      c.outMu.Lock()
+      c.notify(ev)
+      // the ones queued meanwhile are sent together
+      for more := true; more; {
+        select {
+        case ev := <-events:
+          c.notify(ev)
+        default:
+          more = false
+        }
+      }
+      c.out.Flush()
+      c.outMu.Unlock()
+    }
+  }
+}
+
+// the messages of an event for the channels subscribed to
+func (c *respConn) notify(ev KeyEvent) {
+  msgs := [2][2]string{
+    {RESP_KEYSPACE + string(ev.Key), ev.Event},
+    {RESP_KEYEVENT + ev.Event, string(ev.Key)},
+  }
+  for _, msg := range msgs {
+    ch, payload := msg[0], msg[1]
+    if c.sub.channels[ch] {
+      respArray(c.out, 3)
+      respBulk(c.out, []byte("message"))
+      respBulk(c.out, []byte(ch))
+      respBulk(c.out, []byte(payload))
+    }
+    for _, p := range c.sub.patterns {
+      if respGlob([]byte(p), []byte(ch)) {
+        respArray(c.out, 4)
+        respBulk(c.out, []byte("pmessage"))
+        respBulk(c.out, []byte(p))
+        respBulk(c.out, []byte(ch))
+        respBulk(c.out, []byte(payload))
+      }
+    }
+  }
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+// the events of the commits of another client, on the subscribed channels
+func TestPubSub(t *testing.T) {
+  _, addr := respStart(t)
+  sub, c := respDial(t, addr), respDial(t, addr)
+  if got := sub.do(t, "PSUBSCRIBE", "__keyspace@0__:user:*"); got != `["psubscribe" "__keyspace@0__:user:*" :1]` {
+    t.Fatal(got)
+  }
+  if got := sub.do(t, "SUBSCRIBE", "__keyevent@0__:del"); got != `["subscribe" "__keyevent@0__:del" :2]` {
+    t.Fatal(got)
+  }
+  if got := sub.do(t, "GET", "a"); got != "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context" {
+    t.Fatal(got)
+  }
+  // the keys that don't match have no messages
+  for _, cmd := range [][]string{{"SET", "other", "1"}, {"SET", "user:1", "x"}, {"DEL", "other", "user:1"}} {
+    c.do(t, cmd...)
+  }
+  sub.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+  want := []string{
+    `["pmessage" "__keyspace@0__:user:*" "__keyspace@0__:user:1" "set"]`,
+    `["message" "__keyevent@0__:del" "other"]`,
+    `["pmessage" "__keyspace@0__:user:*" "__keyspace@0__:user:1" "del"]`,
+    `["message" "__keyevent@0__:del" "user:1"]`,
+  }
+  for _, msg := range want {
+    if got := sub.reply(t); got != msg {
+      t.Fatalf("%s, want %s", got, msg)
+    }
+  }
+  // no more events after the unsubscribe
+  if got := sub.do(t, "PUNSUBSCRIBE"); got != `["punsubscribe" "__keyspace@0__:user:*" :1]` {
+    t.Fatal(got)
+  }
+  if got := sub.do(t, "UNSUBSCRIBE"); got != `["unsubscribe" "__keyevent@0__:del" :0]` {
+    t.Fatal(got)
+  }
+  c.do(t, "SET", "user:2", "x")
+  if got := sub.do(t, "GET", "user:2"); got != `"x"` {
+    t.Fatal(got)
+  }
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+// a small query language on top of the tables:
+//   CREATE TABLE t (a int64, b bytes, PRIMARY KEY (a), INDEX (b));
+//   CREATE TABLE u (id int64 AUTO_INCREMENT, c bytes, PRIMARY KEY (id), UNIQUE (c));
+//   ALTER TABLE t ADD INDEX (a, b) | ADD UNIQUE (b) | DROP INDEX (b) | RENAME TO u;
+//   DROP TABLE t;
+//   INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y');
+//   SELECT a, b FROM t WHERE b >= 'x' AND a != 2;
+//   UPDATE t SET a = a + 1 WHERE b = 'x';
+//   DELETE FROM t WHERE a < 0 OR b = '';
+//   BEGIN [READ COMMITTED | SERIALIZABLE | BATCH]; COMMIT; ABORT;
+//   EXPLAIN SELECT|INSERT|UPDATE|DELETE ...;
+//   VACUUM; ANALYZE; CHECKPOINT; INTEGRITY_CHECK; BACKUP TO 'name';
+
+// syntax tree nodes
+const (
+  QL_UNINIT = 0
+  // literals
+  QL_STR = TYPE_BYTES
+  QL_I64 = TYPE_INT64
+  // a column name
+  QL_SYM = 100
+  // unary ops
+  QL_NEG = 101
+  QL_NOT = 102
+  // binary ops
+  QL_ADD = 110
+  QL_SUB = 111
+  QL_MUL = 112
+  QL_EQ  = 120
+  QL_NE  = 121
+  QL_LT  = 122
+  QL_LE  = 123
+  QL_GT  = 124
+  QL_GE  = 125
+  QL_AND = 130
+  QL_OR  = 131
+)
+
+// an expression. literals are stored in Value, names in Value.Str.
+type QLNode struct {
+  Value
+  Kids []QLNode
+}
+
+// statements
+type QLCreateTable struct {
+  Def TableDef
+}
+
+type QLDropTable struct {
+  Table string
+}
+
+// one of the changes
+type QLAlterTable struct {
+  Table     string
+  AddIndex  []string
+  Unique    bool
+  DropIndex []string
+  Rename    string
+}
+
+type QLSelect struct {
+  Table string
+  Names []string // nil for *
+  Where *QLNode
+}
+
+type QLInsert struct {
+  Table  string
+  Names  []string
+  Values [][]QLNode
+}
+
+type QLUpdate struct {
+  Table  string
+  Names  []string
+  Values []QLNode
+  Where  *QLNode
+}
+
+type QLDelete struct {
+  Table string
+  Where *QLNode
+}
+
+// the plan of a statement instead of its result
+type QLExplain struct {
+  Stmt interface{}
+}
+
+type QLBegin struct {
+  ReadCommitted bool
+  Serializable  bool
+  Batch         bool
+}
+type QLCommit struct{}
+type QLAbort struct{}
+
+// tokens
+const (
+  TOK_EOF   = 0
+  TOK_IDENT = 1
+  TOK_INT   = 2
+  TOK_STR   = 3
+  TOK_SYM   = 4 // punctuations and operators
+)
+
+type qlToken struct {
+  kind int
+  text string // the identifier, symbol or the unquoted string
+  pos  int
+}
+
+type qlParser struct {
+  toks []qlToken
+  idx  int
+}
+
+// parse a single statement, the trailing semicolon is optional.
+func qlParse(text string) (interface{}, error) {
+  toks, err := qlLex(text)
+  if err != nil {
+    return nil, err
+  }
+  p := &qlParser{toks: toks}
+  stmt, err := p.parseStmt()
+  if err != nil {
+    return nil, err
+  }
+  p.trySym(";")
+  if p.peek().kind != TOK_EOF {
+    return nil, p.errorf("unexpected %q", p.peek().text)
+  }
+  return stmt, nil
+}
+
+func qlLex(text string) ([]qlToken, error) {
+  var toks []qlToken
+  i := 0
+  for i < len(text) {
+    c := text[i]
+    start := i
+    switch {
+    case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+      i++
+    case c == '-' && strings.HasPrefix(text[i:], "--"):
+      // comment
+      for i < len(text) && text[i] != '\n' {
+        i++
+      }
+    case isIdentStart(c):
+      for i < len(text) && (isIdentStart(text[i]) || isDigit(text[i])) {
+        i++
+      }
+      toks = append(toks, qlToken{TOK_IDENT, text[start:i], start})
+    case isDigit(c):
+      for i < len(text) && isDigit(text[i]) {
+        i++
+      }
+      toks = append(toks, qlToken{TOK_INT, text[start:i], start})
+    case c == '\'':
+      // 'it''s'
+      var sb strings.Builder
+      for i++; ; i++ {
+        if i >= len(text) {
+          return nil, fmt.Errorf("syntax error at %d: unterminated string", start)
+        }
+        if text[i] == '\'' {
+          if i + 1 < len(text) && text[i+1] == '\'' {
+            i++
+          } else {
+            break
+          }
+        }
+        sb.WriteByte(text[i])
+      }
+      i++
+      toks = append(toks, qlToken{TOK_STR, sb.String(), start})
+    default:
+      n := 1
+      for _, sym := range []string{"<=", ">=", "!=", "<>"} {
+        if strings.HasPrefix(text[i:], sym) {
+          n = 2
+        }
+      }
+      if n == 1 && !strings.ContainsRune("(),;*=+-<>", rune(c)) {
+        return nil, fmt.Errorf("syntax error at %d: unexpected %q", start, c)
+      }
+      i += n
+      toks = append(toks, qlToken{TOK_SYM, text[start:i], start})
+    }
+  }
+  toks = append(toks, qlToken{TOK_EOF, "end of input", len(text)})
+  return toks, nil
+}
+
+func isIdentStart(c byte) bool {
+  return c == '_' || c == '@' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+  return '0' <= c && c <= '9'
+}
+
+func (p *qlParser) peek() qlToken {
+  return p.toks[p.idx]
+}
+
+func (p *qlParser) errorf(format string, args ...interface{}) error {
+  return fmt.Errorf("syntax error at %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+// consume a keyword if it's next, case-insensitive
+func (p *qlParser) tryKeyword(kw string) bool {
+  tok := p.peek()
+  if tok.kind == TOK_IDENT && strings.EqualFold(tok.text, kw) {
+    p.idx++
+    return true
+  }
+  return false
+}
+
+func (p *qlParser) tryKeywords(kws ...string) bool {
+  save := p.idx
+  for _, kw := range kws {
+    if !p.tryKeyword(kw) {
+      p.idx = save
+      return false
+    }
+  }
+  return true
+}
+
+func (p *qlParser) expectKeywords(kws ...string) error {
+  if !p.tryKeywords(kws...) {
+    return p.errorf("expect %s", strings.Join(kws, " "))
+  }
+  return nil
+}
+
+func (p *qlParser) trySym(sym string) bool {
+  tok := p.peek()
+  if tok.kind == TOK_SYM && tok.text == sym {
+    p.idx++
+    return true
+  }
+  return false
+}
+
+func (p *qlParser) expectSym(sym string) error {
+  if !p.trySym(sym) {
+    return p.errorf("expect %q", sym)
+  }
+  return nil
+}
+
+func (p *qlParser) parseName() (string, error) {
+  tok := p.peek()
+  if tok.kind != TOK_IDENT {
+    return "", p.errorf("expect a name")
+  }
+  p.idx++
+  return tok.text, nil
+}
+
+// a, b, c
+func (p *qlParser) parseNameList() ([]string, error) {
+  var names []string
+  for {
+    name, err := p.parseName()
+    if err != nil {
+      return nil, err
+    }
+    names = append(names, name)
+    if !p.trySym(",") {
+      return names, nil
+    }
+  }
+}
+
+// (a, b, c)
+func (p *qlParser) parseNameTuple() ([]string, error) {
+  if err := p.expectSym("("); err != nil {
+    return nil, err
+  }
+  names, err := p.parseNameList()
+  if err != nil {
+    return nil, err
+  }
+  return names, p.expectSym(")")
+}
+
+func (p *qlParser) parseStmt() (interface{}, error) {
+  switch {
+  case p.tryKeyword("EXPLAIN"):
+    stmt, err := p.parseStmt()
+    if err != nil {
+      return nil, err
+    }
+    switch stmt.(type) {
+    case *QLSelect, *QLInsert, *QLUpdate, *QLDelete:
+      return &QLExplain{Stmt: stmt}, nil
+    }
+    return nil, errors.New("EXPLAIN: expect SELECT, INSERT, UPDATE or DELETE")
+  case p.tryKeywords("CREATE", "TABLE"):
+    return p.parseCreateTable()
+  case p.tryKeywords("DROP", "TABLE"):
+    name, err := p.parseName()
+    return &QLDropTable{Table: name}, err
+  case p.tryKeywords("ALTER", "TABLE"):
+    return p.parseAlterTable()
+  case p.tryKeywords("INSERT", "INTO"):
+    return p.parseInsert()
+  case p.tryKeyword("SELECT"):
+    return p.parseSelect()
+  case p.tryKeyword("UPDATE"):
+    return p.parseUpdate()
+  case p.tryKeywords("DELETE", "FROM"):
+    return p.parseDelete()
+  case p.tryKeyword("BEGIN"):
+    begin := &QLBegin{ReadCommitted: p.tryKeywords("READ", "COMMITTED")}
+    begin.Serializable = !begin.ReadCommitted && p.tryKeyword("SERIALIZABLE")
+    begin.Batch = !begin.ReadCommitted && !begin.Serializable && p.tryKeyword("BATCH")
+    return begin, nil
+  case p.tryKeyword("COMMIT"):
+    return &QLCommit{}, nil
+  case p.tryKeyword("ABORT") || p.tryKeyword("ROLLBACK"):
+    return &QLAbort{}, nil
+  }
+  if stmt, ok, err := p.parseAdmin(); ok {
+    return stmt, err
+  }
+  return nil, p.errorf("unknown statement")
+}
+
+func (p *qlParser) parseAlterTable() (interface{}, error) {
+  stmt := &QLAlterTable{}
+  var err error
+  if stmt.Table, err = p.parseName(); err != nil {
+    return nil, err
+  }
+  switch {
+  case p.tryKeywords("ADD", "INDEX"):
+    stmt.AddIndex, err = p.parseNameTuple()
+  case p.tryKeywords("ADD", "UNIQUE"):
+    stmt.AddIndex, err = p.parseNameTuple()
+    stmt.Unique = true
+  case p.tryKeywords("DROP", "INDEX"):
+    stmt.DropIndex, err = p.parseNameTuple()
+  case p.tryKeywords("RENAME", "TO"):
+    stmt.Rename, err = p.parseName()
+  default:
+    return nil, p.errorf("expect ADD, DROP or RENAME")
+  }
+  return stmt, err
+}
+
+func (p *qlParser) parseCreateTable() (interface{}, error) {
+  stmt := &QLCreateTable{}
+  name, err := p.parseName()
+  if err != nil {
+    return nil, err
+  }
+  if err := p.expectSym("("); err != nil {
+    return nil, err
+  }
+  var cols []string
+  var types []uint32
+  var pkeys []string
+  var indexes [][]string
+  var unique []bool
+  hasUnique := false
+  var autoInc string
+  for {
+    switch {
+    case p.tryKeywords("PRIMARY", "KEY"):
+      if pkeys != nil {
+        return nil, p.errorf("duplicate primary key")
+      }
+      if pkeys, err = p.parseNameTuple(); err != nil {
+        return nil, err
+      }
+    case p.tryKeyword("INDEX"):
+      index, err := p.parseNameTuple()
+      if err != nil {
+        return nil, err
+      }
+      indexes = append(indexes, index)
+      unique = append(unique, false)
+    case p.tryKeyword("UNIQUE"):
+      index, err := p.parseNameTuple()
+      if err != nil {
+        return nil, err
+      }
+      indexes = append(indexes, index)
+      unique = append(unique, true)
+      hasUnique = true
+    default:
+      col, err := p.parseName()
+      if err != nil {
+        return nil, err
+      }
+      var typ uint32
+      switch {
+      case p.tryKeyword("INT64"):
+        typ = TYPE_INT64
+      case p.tryKeyword("BYTES"):
+        typ = TYPE_BYTES
+      default:
+        return nil, p.errorf("expect a column type")
+      }
+      if p.tryKeyword("AUTO_INCREMENT") {
+        if autoInc != "" {
+          return nil, p.errorf("duplicate AUTO_INCREMENT")
+        }
+        autoInc = col
+      }
+      cols = append(cols, col)
+      types = append(types, typ)
+    }
+    if !p.trySym(",") {
+      break
+    }
+  }
+  if err := p.expectSym(")"); err != nil {
+    return nil, err
+  }
+  if pkeys == nil {
+    return nil, p.errorf("missing primary key")
+  }
+  // the primary key columns go first
+  stmt.Def = TableDef{Name: name, PKeys: len(pkeys), Indexes: indexes, AutoInc: autoInc}
+  if hasUnique {
+    stmt.Def.Unique = unique
+  }
+  for _, col := range pkeys {
+    i := indexOf(cols, col)
+    if i < 0 || contains(stmt.Def.Cols, col) {
+      return nil, fmt.Errorf("bad primary key column: %s", col)
+    }
+    stmt.Def.Cols = append(stmt.Def.Cols, col)
+    stmt.Def.Types = append(stmt.Def.Types, types[i])
+  }
+  for i, col := range cols {
+    if !contains(pkeys, col) {
+      stmt.Def.Cols = append(stmt.Def.Cols, col)
+      stmt.Def.Types = append(stmt.Def.Types, types[i])
+    }
+  }
+  return stmt, nil
+}
+
+func indexOf(cols []string, col string) int {
+  for i, c := range cols {
+    if c == col {
+      return i
+    }
+  }
+  return -1
+}
+
+func (p *qlParser) parseInsert() (interface{}, error) {
+  stmt := &QLInsert{}
+  var err error
+  if stmt.Table, err = p.parseName(); err != nil {
+    return nil, err
+  }
+  if stmt.Names, err = p.parseNameTuple(); err != nil {
+    return nil, err
+  }
+  if err := p.expectKeywords("VALUES"); err != nil {
+    return nil, err
+  }
+  for {
+    if err := p.expectSym("("); err != nil {
+      return nil, err
+    }
+    var row []QLNode
+    for {
+      expr, err := p.parseExpr()
+      if err != nil {
+        return nil, err
+      }
+      row = append(row, expr)
+      if !p.trySym(",") {
+        break
+      }
+    }
+    if err := p.expectSym(")"); err != nil {
+      return nil, err
+    }
+    if len(row) != len(stmt.Names) {
+      return nil, p.errorf("expect %d values", len(stmt.Names))
+    }
+    stmt.Values = append(stmt.Values, row)
+    if !p.trySym(",") {
+      return stmt, nil
+    }
+  }
+}
+
+func (p *qlParser) parseSelect() (interface{}, error) {
+  stmt := &QLSelect{}
+  var err error
+  if !p.trySym("*") {
+    if stmt.Names, err = p.parseNameList(); err != nil {
+      return nil, err
+    }
+  }
+  if err := p.expectKeywords("FROM"); err != nil {
+    return nil, err
+  }
+  if stmt.Table, err = p.parseName(); err != nil {
+    return nil, err
+  }
+  stmt.Where, err = p.parseWhere()
+  return stmt, err
+}
+
+func (p *qlParser) parseUpdate() (interface{}, error) {
+  stmt := &QLUpdate{}
+  var err error
+  if stmt.Table, err = p.parseName(); err != nil {
+    return nil, err
+  }
+  if err := p.expectKeywords("SET"); err != nil {
+    return nil, err
+  }
+  for {
+    name, err := p.parseName()
+    if err != nil {
+      return nil, err
+    }
+    if err := p.expectSym("="); err != nil {
+      return nil, err
+    }
+    expr, err := p.parseExpr()
+    if err != nil {
+      return nil, err
+    }
+    stmt.Names = append(stmt.Names, name)
+    stmt.Values = append(stmt.Values, expr)
+    if !p.trySym(",") {
+      break
+    }
+  }
+  stmt.Where, err = p.parseWhere()
+  return stmt, err
+}
+
+func (p *qlParser) parseDelete() (interface{}, error) {
+  stmt := &QLDelete{}
+  var err error
+  if stmt.Table, err = p.parseName(); err != nil {
+    return nil, err
+  }
+  stmt.Where, err = p.parseWhere()
+  return stmt, err
+}
+
+// the optional WHERE clause
+func (p *qlParser) parseWhere() (*QLNode, error) {
+  if !p.tryKeyword("WHERE") {
+    return nil, nil
+  }
+  expr, err := p.parseExpr()
+  if err != nil {
+    return nil, err
+  }
+  return &expr, nil
+}
+
+// precedence from low to high: OR, AND, NOT, comparisons, + -, *, unary -
+func (p *qlParser) parseExpr() (QLNode, error) {
+  return p.parseOr()
+}
+
+func (p *qlParser) parseOr() (QLNode, error) {
+  left, err := p.parseAnd()
+  for err == nil && p.tryKeyword("OR") {
+    var right QLNode
+    right, err = p.parseAnd()
+    left = qlBinary(QL_OR, left, right)
+  }
+  return left, err
+}
+
+func (p *qlParser) parseAnd() (QLNode, error) {
+  left, err := p.parseNot()
+  for err == nil && p.tryKeyword("AND") {
+    var right QLNode
+    right, err = p.parseNot()
+    left = qlBinary(QL_AND, left, right)
+  }
+  return left, err
+}
+
+func (p *qlParser) parseNot() (QLNode, error) {
+  if p.tryKeyword("NOT") {
+    kid, err := p.parseNot()
+    return QLNode{Value: Value{Type: QL_NOT}, Kids: []QLNode{kid}}, err
+  }
+  return p.parseCmp()
+}
+
+var qlCmpOps = map[string]uint32{
+  "=": QL_EQ, "!=": QL_NE, "<>": QL_NE,
+  "<": QL_LT, "<=": QL_LE, ">": QL_GT, ">=": QL_GE,
+}
+
+func (p *qlParser) parseCmp() (QLNode, error) {
+  left, err := p.parseAdd()
+  if err != nil {
+    return left, err
+  }
+  tok := p.peek()
+  if op, ok := qlCmpOps[tok.text]; ok && tok.kind == TOK_SYM {
+    p.idx++
+    right, err := p.parseAdd()
+    return qlBinary(op, left, right), err
+  }
+  return left, nil
+}
+
+func (p *qlParser) parseAdd() (QLNode, error) {
+  left, err := p.parseMul()
+  for err == nil {
+    var op uint32
+    switch {
+    case p.trySym("+"):
+      op = QL_ADD
+    case p.trySym("-"):
+      op = QL_SUB
+    default:
+      return left, nil
+    }
+    var right QLNode
+    right, err = p.parseMul()
+    left = qlBinary(op, left, right)
+  }
+  return left, err
+}
+
+func (p *qlParser) parseMul() (QLNode, error) {
+  left, err := p.parseUnary()
+  for err == nil && p.trySym("*") {
+    var right QLNode
+    right, err = p.parseUnary()
+    left = qlBinary(QL_MUL, left, right)
+  }
+  return left, err
+}
+
+func (p *qlParser) parseUnary() (QLNode, error) {
+  if p.trySym("-") {
+    // fold negative numbers so that the minimum int64 can be written
+    if tok := p.peek(); tok.kind == TOK_INT {
+      p.idx++
+      i, err := strconv.ParseInt("-" + tok.text, 10, 64)
+      if err != nil {
+        return QLNode{}, errors.New("integer out of range: -" + tok.text)
+      }
+      return QLNode{Value: Value{Type: QL_I64, I64: i}}, nil
+    }
+    kid, err := p.parseUnary()
+    return QLNode{Value: Value{Type: QL_NEG}, Kids: []QLNode{kid}}, err
+  }
+  return p.parsePrimary()
+}
+
+func (p *qlParser) parsePrimary() (QLNode, error) {
+  tok := p.peek()
+  switch tok.kind {
+  case TOK_INT:
+    p.idx++
+    i, err := strconv.ParseInt(tok.text, 10, 64)
+    if err != nil {
+      return QLNode{}, errors.New("integer out of range: " + tok.text)
+    }
+    return QLNode{Value: Value{Type: QL_I64, I64: i}}, nil
+  case TOK_STR:
+    p.idx++
+    return QLNode{Value: Value{Type: QL_STR, Str: []byte(tok.text)}}, nil
+  case TOK_IDENT:
+    p.idx++
+    return QLNode{Value: Value{Type: QL_SYM, Str: []byte(tok.text)}}, nil
+  }
+  if p.trySym("(") {
+    expr, err := p.parseExpr()
+    if err != nil {
+      return expr, err
+    }
+    return expr, p.expectSym(")")
+  }
+  return QLNode{}, p.errorf("expect an expression")
+}
+
+func qlBinary(op uint32, left QLNode, right QLNode) QLNode {
+  return QLNode{Value: Value{Type: op}, Kids: []QLNode{left, right}}
+}
@@ -0,0 +1,755 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// the result of a statement
+type QLResult struct {
+  Cols     []string
+  Rows     [][]Value // SELECT
+  Affected int       // INSERT, UPDATE, DELETE: the rows written
+  // INSERT: the id assigned to the AutoInc column of the last row, 0
+  // without an AutoInc column. see DBTX.LastInsertID
+  LastInsertID int64
+}
+
+// executes statements one at a time. statements outside of
+// BEGIN ... COMMIT are committed individually.
+type QLSession struct {
+  DB *DB
+  tx *DBTX // the explicit transaction
+  // the parsed statements by text, see schema.go
+  plans  map[string]*qlPlan
+  schema uint64 // the catalog version of the resolved plans
+}
+
+// in an explicit transaction?
+func (s *QLSession) InTx() bool {
+  return s.tx != nil
+}
+
+func (s *QLSession) Exec(text string) (*QLResult, error) {
+  plan, err := s.prepare(text)
+  if err != nil {
+    return nil, err
+  }
+  switch stmt := plan.stmt.(type) {
+  case *QLBegin:
+    if s.tx != nil {
+      return nil, errors.New("already in a transaction")
+    }
+    s.tx = &DBTX{}
+    if stmt.ReadCommitted {
+      s.DB.BeginReadCommitted(s.tx)
+    } else if stmt.Serializable {
+      s.DB.BeginSerializable(s.tx)
+    } else if stmt.Batch {
+      s.DB.BeginBatch(s.tx)
+    } else {
+      s.DB.Begin(s.tx)
+    }
+    return &QLResult{}, nil
+  case *QLCommit, *QLAbort:
+    if s.tx == nil {
+      return nil, errors.New("not in a transaction")
+    }
+    tx := s.tx
+    s.tx = nil
+    if _, ok := stmt.(*QLAbort); ok {
+      s.DB.Abort(tx)
+      return &QLResult{}, nil
+    }
+    return &QLResult{}, s.DB.Commit(tx)
+  case *QLAdmin:
+    if s.tx != nil {
+      return nil, fmt.Errorf("%s: can't run in a transaction", stmt.Cmd)
+    }
+    return qlAdmin(s.DB, stmt)
+  }
+  if s.tx != nil {
+    // a statement reads a single version in read committed mode
+    release := s.tx.HoldSnapshot()
+    res, err := s.exec(s.tx, plan)
+    release()
+    if err != nil {
+      // the statement may be partially applied
+      s.DB.Abort(s.tx)
+      s.tx = nil
+      return nil, fmt.Errorf("%w (transaction aborted)", err)
+    }
+    return res, nil
+  }
+  tx := DBTX{}
+  s.DB.Begin(&tx)
+  res, err := s.exec(&tx, plan)
+  if err != nil {
+    s.DB.Abort(&tx)
+    return nil, err
+  }
+  if err := s.DB.Commit(&tx); err != nil {
+    return nil, err
+  }
+  return res, nil
+}
+
+func (s *QLSession) exec(tx *DBTX, plan *qlPlan) (*QLResult, error) {
+  if plan.table != "" {
+    return s.run(tx, plan)
+  }
+  return qlExec(tx, plan.stmt)
+}
+
+func qlExec(tx *DBTX, stmt interface{}) (*QLResult, error) {
+  switch stmt := stmt.(type) {
+  case *QLCreateTable:
+    return &QLResult{}, tx.TableNew(&stmt.Def)
+  case *QLDropTable:
+    return &QLResult{}, tx.TableDrop(stmt.Table)
+  case *QLAlterTable:
+    return &QLResult{}, qlAlter(tx, stmt)
+  }
+  table := qlTable(stmt)
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return nil, errNoTable(table)
+  }
+  return qlRun(tx, tdef, stmt)
+}
+
+func qlAlter(tx *DBTX, stmt *QLAlterTable) error {
+  switch {
+  case stmt.AddIndex != nil:
+    return tx.IndexAdd(stmt.Table, stmt.AddIndex, stmt.Unique)
+  case stmt.DropIndex != nil:
+    return tx.IndexDrop(stmt.Table, stmt.DropIndex)
+  default:
+    return tx.TableRename(stmt.Table, stmt.Rename)
+  }
+}
+
+// the table of a DML statement, "" for others
+func qlTable(stmt interface{}) string {
+  if explain, ok := stmt.(*QLExplain); ok {
+    stmt = explain.Stmt
+  }
+  switch stmt := stmt.(type) {
+  case *QLInsert:
+    return stmt.Table
+  case *QLSelect:
+    return stmt.Table
+  case *QLUpdate:
+    return stmt.Table
+  case *QLDelete:
+    return stmt.Table
+  }
+  return ""
+}
+
+func qlRun(tx *DBTX, tdef *TableDef, stmt interface{}) (*QLResult, error) {
+  explain, isExplain := stmt.(*QLExplain)
+  if isExplain {
+    stmt = explain.Stmt
+  }
+  if isExplain {
+    return qlExplain(tdef, stmt), nil
+  }
+  switch stmt := stmt.(type) {
+  case *QLInsert:
+    return qlInsert(tx, tdef, stmt)
+  case *QLSelect:
+    return qlSelect(tx, tdef, stmt)
+  case *QLUpdate:
+    return qlUpdate(tx, tdef, stmt)
+  case *QLDelete:
+    return qlDelete(tx, tdef, stmt)
+  }
+  panic("unreachable")
+}
+
+func qlInsert(tx *DBTX, tdef *TableDef, stmt *QLInsert) (*QLResult, error) {
+  for _, row := range stmt.Values {
+    rec := Record{}
+    for i, expr := range row {
+      v, err := qlEval(Record{}, expr)
+      if err != nil {
+        return nil, err
+      }
+      rec.Cols = append(rec.Cols, stmt.Names[i])
+      rec.Vals = append(rec.Vals, v)
+    }
+    added, err := dbUpdate(tx, tdef, rec, MODE_INSERT_ONLY)
+    if err != nil {
+      return nil, err
+    }
+    if !added {
+      return nil, &ErrDuplicateKey{Table: tdef.Name, Cols: tdef.Cols[:tdef.PKeys]}
+    }
+  }
+  res := &QLResult{Affected: len(stmt.Values)}
+  if tdef.AutoInc != "" {
+    res.LastInsertID = tx.LastInsertID()
+  }
+  return res, nil
+}
+
+func qlSelect(tx *DBTX, tdef *TableDef, stmt *QLSelect) (*QLResult, error) {
+  names := stmt.Names
+  if names == nil {
+    names = visibleCols(tdef)
+  }
+  for _, name := range names {
+    if colIndex(tdef, name) < 0 {
+      return nil, fmt.Errorf("unknown column: %s", name)
+    }
+  }
+  records, err := qlScan(tx, tdef, stmt.Where)
+  if err != nil {
+    return nil, err
+  }
+  res := &QLResult{Cols: names}
+  for _, rec := range records {
+    row := make([]Value, len(names))
+    for i, name := range names {
+      row[i] = *rec.Get(name)
+    }
+    res.Rows = append(res.Rows, row)
+  }
+  return res, nil
+}
+
+func qlUpdate(tx *DBTX, tdef *TableDef, stmt *QLUpdate) (*QLResult, error) {
+  for _, name := range stmt.Names {
+    idx := colIndex(tdef, name)
+    if idx < 0 {
+      return nil, fmt.Errorf("unknown column: %s", name)
+    }
+    if idx < tdef.PKeys {
+      return nil, fmt.Errorf("cannot update the primary key: %s", name)
+    }
+  }
+  records, err := qlScan(tx, tdef, stmt.Where)
+  if err != nil {
+    return nil, err
+  }
+  res := &QLResult{}
+  for _, rec := range records {
+    // the new values are computed from the old row
+    vals := make([]Value, len(stmt.Values))
+    for i, expr := range stmt.Values {
+      if vals[i], err = qlEval(rec, expr); err != nil {
+        return nil, err
+      }
+    }
+    updated := Record{Cols: rec.Cols, Vals: append([]Value(nil), rec.Vals...)}
+    for i, name := range stmt.Names {
+      *updated.Get(name) = vals[i]
+    }
+    ok, err := dbUpdate(tx, tdef, updated, MODE_UPDATE_ONLY)
+    if err != nil {
+      return nil, err
+    }
+    if ok {
+      res.Affected++
+    }
+  }
+  return res, nil
+}
+
+func qlDelete(tx *DBTX, tdef *TableDef, stmt *QLDelete) (*QLResult, error) {
+  records, err := qlScan(tx, tdef, stmt.Where)
+  if err != nil {
+    return nil, err
+  }
+  res := &QLResult{}
+  for _, rec := range records {
+    pkey := Record{Cols: rec.Cols[:tdef.PKeys], Vals: rec.Vals[:tdef.PKeys]}
+    ok, err := dbDelete(tx, tdef, pkey)
+    if err != nil {
+      return nil, err
+    }
+    if ok {
+      res.Affected++
+    }
+  }
+  return res, nil
+}
+
+// the rows matching the WHERE clause. they are collected before
+// returning because updates invalidate the iterator.
+func qlScan(tx *DBTX, tdef *TableDef, where *QLNode) ([]Record, error) {
+  if ranges := qlUnionRanges(tdef, where); ranges != nil {
+    return qlScanUnion(tx, tdef, where, ranges)
+  }
+  sc := qlScanRange(tdef, where)
+  if err := dbScan(tx, tdef, &sc); err != nil {
+    return nil, err
+  }
+  var out []Record
+  for ; sc.Valid(); sc.Next() {
+    rec := Record{}
+    if err := sc.Deref(&rec); err != nil {
+      return nil, err
+    }
+    if where != nil {
+      v, err := qlEval(rec, *where)
+      if err != nil {
+        return nil, err
+      }
+      if v.Type != TYPE_INT64 {
+        return nil, errors.New("WHERE: expect a boolean")
+      }
+      if v.I64 == 0 {
+        continue
+      }
+    }
+    out = append(out, rec)
+  }
+  return out, nil
+}
+
+// use an index for the WHERE clause if possible. the comparisons between the
+// leading column of the primary key or an index and a constant that are ANDed
+// together restrict the range. the rows are still filtered by the whole clause.
+// the access path: a range on the primary key or on an index, or the
+// whole table. each usable column is tried, the narrowest range wins.
+func qlScanRange(tdef *TableDef, where *QLNode) Scanner {
+  best := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE} // the whole table
+  if where == nil {
+    return best
+  }
+  conds := qlConjuncts(nil, *where)
+  tried := map[string]bool{}
+  for _, cond := range conds {
+    col, op, _, ok := qlColCmp(tdef, cond)
+    if !ok || op == QL_NE || tried[col] {
+      continue
+    }
+    tried[col] = true
+    if sc := qlColRange(tdef, conds, col); qlRangeRank(tdef, sc) > qlRangeRank(tdef, best) {
+      best = sc
+    }
+  }
+  return best
+}
+
+// rank the ranges: a point, then bounded on both sides, then one side.
+// on a tie the primary key is better since there is no row to fetch.
+func qlRangeRank(tdef *TableDef, sc Scanner) int {
+  rank := 0
+  if len(sc.Key1.Cols) > 0 {
+    rank += 2
+  }
+  if len(sc.Key2.Cols) > 0 {
+    rank += 2
+  }
+  if rank == 4 && sc.Cmp1 == CMP_GE && sc.Cmp2 == CMP_LE && qlValueEq(sc.Key1.Vals[0], sc.Key2.Vals[0]) {
+    rank += 2
+  }
+  if rank > 0 && qlRangeCol(sc) == tdef.Cols[0] {
+    rank++
+  }
+  return rank
+}
+
+// the column of the range, "" for the whole table
+func qlRangeCol(sc Scanner) string {
+  if len(sc.Key1.Cols) > 0 {
+    return sc.Key1.Cols[0]
+  }
+  if len(sc.Key2.Cols) > 0 {
+    return sc.Key2.Cols[0]
+  }
+  return ""
+}
+
+func qlValueEq(a Value, b Value) bool {
+  return a.Type == b.Type && a.I64 == b.I64 && bytes.Equal(a.Str, b.Str)
+}
+
+// the bounds on a single column
+func qlColRange(tdef *TableDef, conds []QLNode, col string) Scanner {
+  sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+  for _, cond := range conds {
+    name, op, v, ok := qlColCmp(tdef, cond)
+    if !ok || name != col {
+      continue
+    }
+    lower := len(sc.Key1.Cols) == 0
+    upper := len(sc.Key2.Cols) == 0
+    switch {
+    case op == QL_EQ && lower && upper:
+      sc.Key1.Cols, sc.Key1.Vals, sc.Cmp1 = []string{col}, []Value{v}, CMP_GE
+      sc.Key2.Cols, sc.Key2.Vals, sc.Cmp2 = []string{col}, []Value{v}, CMP_LE
+    case (op == QL_GT || op == QL_GE) && lower:
+      sc.Key1.Cols, sc.Key1.Vals, sc.Cmp1 = []string{col}, []Value{v}, CMP_GE
+      if op == QL_GT {
+        sc.Cmp1 = CMP_GT
+      }
+    case (op == QL_LT || op == QL_LE) && upper:
+      sc.Key2.Cols, sc.Key2.Vals, sc.Cmp2 = []string{col}, []Value{v}, CMP_LE
+      if op == QL_LT {
+        sc.Cmp2 = CMP_LT
+      }
+    }
+  }
+  return sc
+}
+
+// flatten the ANDs
+func qlConjuncts(out []QLNode, node QLNode) []QLNode {
+  return qlFlatten(out, node, QL_AND)
+}
+
+func qlFlatten(out []QLNode, node QLNode, op uint32) []QLNode {
+  if node.Type == op {
+    out = qlFlatten(out, node.Kids[0], op)
+    return qlFlatten(out, node.Kids[1], op)
+  }
+  return append(out, node)
+}
+
+// a WHERE clause of ORs can use a range for each of the alternatives,
+// but only if all of them have one. nil if it's not worth it.
+func qlUnionRanges(tdef *TableDef, where *QLNode) []Scanner {
+  if where == nil || where.Type != QL_OR {
+    return nil
+  }
+  var ranges []Scanner
+  for _, alt := range qlFlatten(nil, *where, QL_OR) {
+    sc := qlScanRange(tdef, &alt)
+    if len(sc.Key1.Cols) == 0 && len(sc.Key2.Cols) == 0 {
+      return nil // a full scan anyway
+    }
+    ranges = append(ranges, sc)
+  }
+  return ranges
+}
+
+// the union of the ranges. the primary keys are deduplicated before
+// the rows are fetched, and the rows are returned in primary key order.
+func qlScanUnion(tx *DBTX, tdef *TableDef, where *QLNode, ranges []Scanner) ([]Record, error) {
+  pkeys := map[string]Record{}
+  for i := range ranges {
+    sc := &ranges[i]
+    if err := dbScan(tx, tdef, sc); err != nil {
+      return nil, err
+    }
+    for ; sc.Valid(); sc.Next() {
+      pkey, err := sc.primaryKey()
+      if err != nil {
+        return nil, err
+      }
+      pkeys[string(encodeKey(nil, tdef.Prefix, pkey.Vals))] = pkey
+    }
+  }
+  // the encoding is order-preserving
+  keys := make([]string, 0, len(pkeys))
+  for key := range pkeys {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  var out []Record
+  for _, key := range keys {
+    rec := pkeys[key]
+    ok, err := dbGet(tx, tdef, &rec)
+    if err != nil {
+      return nil, err
+    }
+    assert(ok)
+    v, err := qlEval(rec, *where)
+    if err != nil {
+      return nil, err
+    }
+    if v.Type != TYPE_INT64 {
+      return nil, errors.New("WHERE: expect a boolean")
+    }
+    if v.I64 != 0 {
+      out = append(out, rec)
+    }
+  }
+  return out, nil
+}
+
+// match `col op constant` where col leads the primary key or an index
+func qlColCmp(tdef *TableDef, node QLNode) (string, uint32, Value, bool) {
+  if node.Type < QL_EQ || node.Type > QL_GE {
+    return "", 0, Value{}, false
+  }
+  op, a, b := node.Type, node.Kids[0], node.Kids[1]
+  if a.Type != QL_SYM {
+    // constant op col
+    a, b = b, a
+    op = map[uint32]uint32{
+      QL_EQ: QL_EQ, QL_NE: QL_NE, QL_LT: QL_GT, QL_LE: QL_GE, QL_GT: QL_LT, QL_GE: QL_LE,
+    }[op]
+  }
+  if a.Type != QL_SYM || (b.Type != QL_I64 && b.Type != QL_STR) {
+    return "", 0, Value{}, false
+  }
+  col := string(a.Str)
+  idx := colIndex(tdef, col)
+  if idx < 0 || tdef.Types[idx] != b.Type {
+    return "", 0, Value{}, false
+  }
+  leading := idx == 0
+  for _, index := range tdef.Indexes {
+    leading = leading || index[0] == col
+  }
+  return col, op, b.Value, leading
+}
+
+func qlEval(rec Record, node QLNode) (Value, error) {
+  switch node.Type {
+  case QL_I64, QL_STR:
+    return node.Value, nil
+  case QL_SYM:
+    v := rec.Get(string(node.Str))
+    if v == nil {
+      return Value{}, fmt.Errorf("unknown column: %s", node.Str)
+    }
+    return *v, nil
+  case QL_NEG, QL_NOT:
+    v, err := qlEval(rec, node.Kids[0])
+    if err != nil {
+      return v, err
+    }
+    if v.Type != TYPE_INT64 {
+      return Value{}, errors.New("expect an integer")
+    }
+    if node.Type == QL_NEG {
+      return Value{Type: TYPE_INT64, I64: -v.I64}, nil
+    }
+    return qlBool(v.I64 == 0), nil
+  }
+  left, err := qlEval(rec, node.Kids[0])
+  if err != nil {
+    return left, err
+  }
+  // short circuit
+  if node.Type == QL_AND || node.Type == QL_OR {
+    if left.Type != TYPE_INT64 {
+      return Value{}, errors.New("expect a boolean")
+    }
+    if (node.Type == QL_AND) == (left.I64 == 0) {
+      return qlBool(left.I64 != 0), nil
+    }
+  }
+  right, err := qlEval(rec, node.Kids[1])
+  if err != nil {
+    return right, err
+  }
+  if left.Type != right.Type {
+    return Value{}, errors.New("type mismatch")
+  }
+  switch node.Type {
+  case QL_AND, QL_OR:
+    if right.Type != TYPE_INT64 {
+      return Value{}, errors.New("expect a boolean")
+    }
+    return qlBool(right.I64 != 0), nil
+  case QL_ADD, QL_SUB, QL_MUL:
+    if left.Type != TYPE_INT64 {
+      return Value{}, errors.New("expect an integer")
+    }
+    out := Value{Type: TYPE_INT64}
+    switch node.Type {
+    case QL_ADD:
+      out.I64 = left.I64 + right.I64
+    case QL_SUB:
+      out.I64 = left.I64 - right.I64
+    case QL_MUL:
+      out.I64 = left.I64 * right.I64
+    }
+    return out, nil
+  }
+  r := qlCompare(left, right)
+  switch node.Type {
+  case QL_EQ:
+    return qlBool(r == 0), nil
+  case QL_NE:
+    return qlBool(r != 0), nil
+  case QL_LT:
+    return qlBool(r < 0), nil
+  case QL_LE:
+    return qlBool(r <= 0), nil
+  case QL_GT:
+    return qlBool(r > 0), nil
+  case QL_GE:
+    return qlBool(r >= 0), nil
+  }
+  panic("unreachable")
+}
+
+func qlCompare(a Value, b Value) int {
+  if a.Type == TYPE_BYTES {
+    return bytes.Compare(a.Str, b.Str)
+  }
+  switch {
+  case a.I64 < b.I64:
+    return -1
+  case a.I64 > b.I64:
+    return +1
+  }
+  return 0
+}
+
+// booleans are integers
+func qlBool(b bool) Value {
+  if b {
+    return Value{Type: TYPE_INT64, I64: 1}
+  }
+  return Value{Type: TYPE_INT64}
+}
+
+// what a statement reads, writes and checks
+// the plan of a SELECT, INSERT, UPDATE or DELETE statement, one step
+// per line, like the output of EXPLAIN.
+func (tx *DBTX) Explain(query string) ([]string, error) {
+  stmt, err := qlParse(query)
+  if err != nil {
+    return nil, err
+  }
+  if explain, ok := stmt.(*QLExplain); ok {
+    stmt = explain.Stmt
+  }
+  switch stmt.(type) {
+  case *QLSelect, *QLInsert, *QLUpdate, *QLDelete:
+  default:
+    return nil, errors.New("EXPLAIN: expect SELECT, INSERT, UPDATE or DELETE")
+  }
+  res, err := qlExec(tx, &QLExplain{Stmt: stmt})
+  if err != nil {
+    return nil, err
+  }
+  var plan []string
+  for _, row := range res.Rows {
+    plan = append(plan, string(row[0].Str))
+  }
+  return plan, nil
+}
+
+func qlExplain(tdef *TableDef, stmt interface{}) *QLResult {
+  var plan []string
+  switch stmt := stmt.(type) {
+  case *QLInsert:
+    plan = append(plan, fmt.Sprintf("check: primary key %s is unique", qlColList(tdef.Cols[:tdef.PKeys])))
+    plan = qlExplainUnique(plan, tdef, tdef.Cols)
+    plan = append(plan, fmt.Sprintf("write: %d row(s)", len(stmt.Values)))
+    plan = qlExplainIndexes(plan, tdef, tdef.Cols)
+  case *QLSelect:
+    plan = qlExplainScan(plan, tdef, stmt.Where)
+  case *QLUpdate:
+    plan = qlExplainScan(plan, tdef, stmt.Where)
+    plan = qlExplainUnique(plan, tdef, stmt.Names)
+    plan = append(plan, "write: each matching row")
+    plan = qlExplainIndexes(plan, tdef, stmt.Names)
+  case *QLDelete:
+    plan = qlExplainScan(plan, tdef, stmt.Where)
+    plan = append(plan, "delete: each matching row")
+    plan = qlExplainIndexes(plan, tdef, tdef.Cols)
+  }
+  res := &QLResult{Cols: []string{"plan"}}
+  for _, line := range plan {
+    res.Rows = append(res.Rows, []Value{{Type: TYPE_BYTES, Str: []byte(line)}})
+  }
+  return res
+}
+
+// how the rows are located
+func qlExplainScan(plan []string, tdef *TableDef, where *QLNode) []string {
+  if ranges := qlUnionRanges(tdef, where); ranges != nil {
+    plan = append(plan, fmt.Sprintf("scan: union of %d ranges, deduplicated by primary key", len(ranges)))
+    for _, sc := range ranges {
+      plan = append(plan, "  "+qlExplainRange(tdef, sc))
+    }
+  } else {
+    plan = append(plan, "scan: "+qlExplainRange(tdef, qlScanRange(tdef, where)))
+  }
+  if where != nil {
+    plan = append(plan, "filter: the WHERE clause on each row")
+  }
+  return plan
+}
+
+func qlExplainRange(tdef *TableDef, sc Scanner) string {
+  cols := sc.Key1.Cols
+  if len(sc.Key2.Cols) > len(cols) {
+    cols = sc.Key2.Cols
+  }
+  if len(cols) == 0 {
+    return "full scan on primary key " + qlColList(tdef.Cols[:tdef.PKeys])
+  }
+  index, icols := findIndex(tdef, cols)
+  name := "primary key " + qlColList(icols)
+  if index >= 0 {
+    name = "index " + qlColList(icols)
+  }
+  var bounds []string
+  ops := map[int]string{CMP_GE: ">=", CMP_GT: ">", CMP_LT: "<", CMP_LE: "<="}
+  if len(sc.Key1.Cols) > 0 {
+    bounds = append(bounds, fmt.Sprintf("%s %s %s", cols[0], ops[sc.Cmp1], qlLiteral(sc.Key1.Vals[0])))
+  }
+  if len(sc.Key2.Cols) > 0 {
+    bounds = append(bounds, fmt.Sprintf("%s %s %s", cols[0], ops[sc.Cmp2], qlLiteral(sc.Key2.Vals[0])))
+  }
+  if qlRangeRank(tdef, sc) >= 6 {
+    bounds = []string{fmt.Sprintf("%s = %s", cols[0], qlLiteral(sc.Key1.Vals[0]))}
+  }
+  out := name + ", range " + strings.Join(bounds, " AND ")
+  if index >= 0 {
+    out += ", then fetch the rows by the primary key"
+  }
+  return out
+}
+
+// the lookups of checkUnique for the rows written with the columns. a
+// unique index is checked when its values or the primary key may change.
+func qlExplainUnique(plan []string, tdef *TableDef, cols []string) []string {
+  pkey := false
+  for _, col := range cols {
+    pkey = pkey || contains(tdef.Cols[:tdef.PKeys], col)
+  }
+  for i := range tdef.Indexes {
+    unique := uniqueCols(tdef, i)
+    if unique == nil {
+      continue
+    }
+    for _, col := range cols {
+      if pkey || contains(unique, col) {
+        plan = append(plan, fmt.Sprintf("check: unique index %s, a lookup per row", qlColList(unique)))
+        break
+      }
+    }
+  }
+  return plan
+}
+
+// the indexes to maintain when the columns are written
+func qlExplainIndexes(plan []string, tdef *TableDef, cols []string) []string {
+  for _, index := range tdef.Indexes {
+    for _, col := range cols {
+      if contains(index, col) {
+        plan = append(plan, "maintain: index "+qlColList(index))
+        break
+      }
+    }
+  }
+  return plan
+}
+
+func qlColList(cols []string) string {
+  return "(" + strings.Join(cols, ", ") + ")"
+}
+
+func qlLiteral(v Value) string {
+  if v.Type == TYPE_INT64 {
+    return strconv.FormatInt(v.I64, 10)
+  }
+  return "'" + strings.ReplaceAll(string(v.Str), "'", "''") + "'"
+}
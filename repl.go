@@ -0,0 +1,263 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+)
+
+// read statements from `in` and print the results to `out`.
+// a line starting with get, set, del or scan is a raw KV command,
+// anything else is a statement of the query language ended by `;`.
+// `trace on` prints the steps of the tree updates, see BTree.SetTrace.
+func repl(s *QLSession, in io.Reader, out io.Writer, interactive bool) {
+  scanner := bufio.NewScanner(in)
+  scanner.Buffer(nil, 1 << 20)
+  pending := "" // an unfinished statement
+  for {
+    if interactive {
+      switch {
+      case pending != "":
+        fmt.Fprint(out, "..> ")
+      case s.InTx():
+        fmt.Fprint(out, "tx> ")
+      default:
+        fmt.Fprint(out, "db> ")
+      }
+    }
+    if !scanner.Scan() {
+      break
+    }
+    line := scanner.Text()
+    if pending == "" {
+      if args := strings.Fields(line); len(args) > 0 && isRawCmd(args[0]) {
+        res, err := rawExec(s, splitRaw(line))
+        replPrint(out, res, err)
+        continue
+      }
+      if args := strings.Fields(line); len(args) == 1 && (args[0] == "exit" || args[0] == "quit") {
+        break
+      }
+      if args := strings.Fields(line); len(args) == 2 && args[0] == "trace" && (args[1] == "on" || args[1] == "off") {
+        replTrace(s, out, args[1] == "on")
+        continue
+      }
+    }
+    pending += line + "\n"
+    stmts, rest := splitStmts(pending)
+    pending = rest
+    for _, stmt := range stmts {
+      res, err := s.Exec(stmt)
+      replPrint(out, res, err)
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    fmt.Fprintln(out, "error:", err)
+  }
+  if strings.TrimSpace(pending) != "" {
+    fmt.Fprintln(out, "error: incomplete statement")
+  }
+  if s.InTx() {
+    s.Exec("ABORT")
+    fmt.Fprintln(out, "the open transaction is aborted")
+  }
+}
+
+func replTrace(s *QLSession, out io.Writer, on bool) {
+  if !on {
+    s.DB.kv.SetTrace(nil)
+    return
+  }
+  s.DB.kv.SetTrace(func(ev TraceEvent) {
+    fmt.Fprintln(out, "  " + ev.String())
+  })
+}
+
+// complete statements ended by `;`, and the remaining text.
+func splitStmts(text string) ([]string, string) {
+  var stmts []string
+  quoted := false
+  start := 0
+  for i := 0; i < len(text); i++ {
+    switch {
+    case text[i] == '\'':
+      quoted = !quoted // a '' escape toggles twice
+    case text[i] == ';' && !quoted:
+      if stmt := strings.TrimSpace(text[start:i]); stmt != "" {
+        stmts = append(stmts, stmt)
+      }
+      start = i + 1
+    }
+  }
+  rest := text[start:]
+  if strings.TrimSpace(rest) == "" {
+    rest = ""
+  }
+  return stmts, rest
+}
+
+func isRawCmd(cmd string) bool {
+  return cmd == "get" || cmd == "set" || cmd == "del" || cmd == "scan"
+}
+
+// the value of set is the rest of the line, spaces included.
+func splitRaw(line string) []string {
+  args := strings.Fields(line)
+  if len(args) > 3 && args[0] == "set" {
+    rest := strings.TrimSpace(line)
+    for _, arg := range args[:2] {
+      rest = strings.TrimSpace(strings.TrimPrefix(rest, arg))
+    }
+    args = []string{args[0], args[1], rest}
+  }
+  return args
+}
+
+// get <key> | set <key> <val> | del <key> | scan [lo [hi]]
+// within the open transaction if there is one.
+func rawExec(s *QLSession, args []string) (*QLResult, error) {
+  n := map[string]int{"get": 2, "set": 3, "del": 2, "scan": 3}[args[0]]
+  if len(args) > n || (args[0] != "scan" && len(args) < n) {
+    return nil, errors.New("usage: get <key> | set <key> <val> | del <key> | scan [lo [hi]]")
+  }
+  tx := &KVTX{}
+  if s.InTx() {
+    tx = &s.tx.kv
+  } else {
+    s.DB.kv.Begin(tx)
+  }
+  res, err := rawExecTx(tx, args)
+  if s.InTx() {
+    return res, err
+  }
+  if err != nil {
+    s.DB.kv.Abort(tx)
+    return nil, err
+  }
+  return res, s.DB.kv.Commit(tx)
+}
+
+func rawExecTx(tx *KVTX, args []string) (*QLResult, error) {
+  switch args[0] {
+  case "get":
+    val, ok := tx.Get([]byte(args[1]))
+    if !ok {
+      return nil, ErrNotFound
+    }
+    return rawResult([][]byte{[]byte(args[1]), val}), nil
+  case "set":
+    return &QLResult{Affected: 1}, tx.Set([]byte(args[1]), []byte(args[2]))
+  case "del":
+    deleted, err := tx.Del([]byte(args[1]))
+    if err == nil && !deleted {
+      err = ErrNotFound
+    }
+    return &QLResult{Affected: 1}, err
+  }
+  // scan
+  var lo, hi []byte
+  if len(args) > 1 {
+    lo = []byte(args[1])
+  }
+  if len(args) > 2 {
+    hi = []byte(args[2])
+  }
+  var kvs [][]byte
+  for iter := tx.Seek(lo, CMP_GE); iter.Valid(); iter.Next() {
+    if hi != nil && bytes.Compare(iter.Key(), hi) >= 0 {
+      break
+    }
+    kvs = append(kvs, iter.Key(), iter.Val())
+  }
+  return rawResult(kvs), nil
+}
+
+func rawResult(kvs [][]byte) *QLResult {
+  res := &QLResult{Cols: []string{"key", "val"}}
+  for i := 0; i < len(kvs); i += 2 {
+    row := []Value{{Type: TYPE_BYTES, Str: kvs[i]}, {Type: TYPE_BYTES, Str: kvs[i+1]}}
+    res.Rows = append(res.Rows, row)
+  }
+  return res
+}
+
+func replPrint(out io.Writer, res *QLResult, err error) {
+  switch {
+  case err != nil:
+    fmt.Fprintln(out, "error:", err)
+  case res.Cols != nil:
+    printTable(out, res)
+  case res.Affected > 0 && res.LastInsertID != 0:
+    fmt.Fprintf(out, "%d row(s) affected, last insert id %d\n", res.Affected, res.LastInsertID)
+  case res.Affected > 0:
+    fmt.Fprintf(out, "%d row(s) affected\n", res.Affected)
+  default:
+    fmt.Fprintln(out, "ok")
+  }
+}
+
+// print the rows as an aligned table
+func printTable(out io.Writer, res *QLResult) {
+  cells := [][]string{res.Cols}
+  for _, row := range res.Rows {
+    line := make([]string, len(row))
+    for i, v := range row {
+      line[i] = formatValue(v)
+    }
+    cells = append(cells, line)
+  }
+  widths := make([]int, len(res.Cols))
+  for _, line := range cells {
+    for i, cell := range line {
+      widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+    }
+  }
+  for n, line := range cells {
+    for i, cell := range line {
+      if i > 0 {
+        fmt.Fprint(out, " | ")
+      }
+      cell += strings.Repeat(" ", widths[i] - utf8.RuneCountInString(cell))
+      if i == len(line) - 1 {
+        cell = strings.TrimRight(cell, " ")
+      }
+      fmt.Fprint(out, cell)
+    }
+    fmt.Fprintln(out)
+    if n == 0 {
+      for i, w := range widths {
+        if i > 0 {
+          fmt.Fprint(out, "-+-")
+        }
+        fmt.Fprint(out, strings.Repeat("-", w))
+      }
+      fmt.Fprintln(out)
+    }
+  }
+  fmt.Fprintf(out, "(%d row(s))\n", len(res.Rows))
+}
+
+// bytes are printed as is if they are printable, quoted otherwise.
+func formatValue(v Value) string {
+  if v.Type == TYPE_INT64 {
+    return strconv.FormatInt(v.I64, 10)
+  }
+  s := string(v.Str)
+  if !utf8.ValidString(s) || strings.IndexFunc(s, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+    return strconv.Quote(s)
+  }
+  return s
+}
+
+// is stdin a terminal?
+func isTerminal(f *os.File) bool {
+  fi, err := f.Stat()
+  return err == nil && fi.Mode() & os.ModeCharDevice != 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestREPL(t *testing.T) {
+  cases := []struct {
+    in   string
+    want string
+  }{
+    {"set a 1\nget a\n", "1 row(s) affected\nkey | val\n----+----\na   | 1\n(1 row(s))\n"},
+    {"set k hello,  world \nget k\n", "1 row(s) affected\nkey | val\n----+--------------\nk   | hello,  world\n(1 row(s))\n"},
+    {"get x\ndel x\nget\n", "error: not found\nerror: not found\n" +
+      "error: usage: get <key> | set <key> <val> | del <key> | scan [lo [hi]]\n"},
+    {"set b \x01\nset a 1\nset c 3\nscan a c\n", "1 row(s) affected\n1 row(s) affected\n1 row(s) affected\n" +
+      "key | val\n----+-------\na   | 1\nb   | \"\\x01\"\n(2 row(s))\n"},
+    // a statement over lines, and 2 on a line
+    {"CREATE TABLE t (id int64, v bytes,\n PRIMARY KEY (id));\nINSERT INTO t (id, v) VALUES (1, 'a;b'), (22, 'c'); SELECT id, v FROM t WHERE id > 0;\n",
+      "ok\n2 row(s) affected\nid | v\n---+----\n1  | a;b\n22 | c\n(2 row(s))\n"},
+    {"SELECT x FROM nope WHERE x = 1;\n", "error: table not found: nope\n"},
+    {"BEGIN;\nset a 2\nSELECT\n", "ok\n1 row(s) affected\nerror: incomplete statement\nthe open transaction is aborted\n"},
+    {"set a 1\nBEGIN;\ndel a\nABORT;\nget a\nexit\nget a\n", "1 row(s) affected\nok\n1 row(s) affected\nok\nkey | val\n----+----\na   | 1\n(1 row(s))\n"},
+  }
+  for i, c := range cases {
+    db := &DB{Options: Options{InMemory: true}}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    var out strings.Builder
+    repl(&QLSession{DB: db}, strings.NewReader(c.in), &out, false)
+    db.Close()
+    if out.String() != c.want {
+      t.Fatalf("case %d:\n%s\nwant:\n%s", i, out.String(), c.want)
+    }
+  }
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "math/rand"
+  "time"
+)
+
+// how UpdateWithRetry retries, the zero value is the defaults
+type RetryPolicy struct {
+  MaxAttempts int              // including the first one, 0 for RETRY_ATTEMPTS
+  BaseDelay   time.Duration    // the backoff before the 2nd attempt, 0 for RETRY_BASE_DELAY
+  MaxDelay    time.Duration    // the backoff doubles up to this, 0 for RETRY_MAX_DELAY
+  Retryable   func(error) bool // nil for IsRetryable
+}
+
+const (
+  RETRY_ATTEMPTS   = 10
+  RETRY_BASE_DELAY = 5 * time.Millisecond
+  RETRY_MAX_DELAY  = time.Second
+)
+
+// the transaction failed because of other transactions and may succeed
+// if it's run again
+func IsRetryable(err error) bool {
+  return errors.Is(err, ErrDeadlock) || errors.Is(err, ErrLockTimeout) || errors.Is(err, ErrConflict)
+}
+
+// run fn in a transaction and commit it. the transaction is aborted if
+// fn fails, and it's run again, after a backoff with jitter, if the error
+// is retryable. fn may run several times, so it must not have side effects
+// outside of the transaction.
+func (db *DB) UpdateWithRetry(ctx context.Context, fn func(tx *DBTX) error, policy RetryPolicy) error {
+  attempts, retryable := policy.MaxAttempts, policy.Retryable
+  if attempts <= 0 {
+    attempts = RETRY_ATTEMPTS
+  }
+  if retryable == nil {
+    retryable = IsRetryable
+  }
+  for attempt := 1; ; attempt++ {
+    tx := DBTX{}
+    db.Begin(&tx)
+    err := fn(&tx)
+    if err == nil {
+      err = db.CommitCtx(ctx, &tx)
+    } else {
+      db.Abort(&tx)
+    }
+    if err == nil || !retryable(err) {
+      return err
+    }
+    if attempt >= attempts {
+      return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+    }
+    select {
+    case <-ctx.Done():
+      return fmt.Errorf("gave up after %d attempts: %w", attempt, errors.Join(err, ctx.Err()))
+    case <-db.kv.clock.wall.After(retryDelay(policy, attempt)):
+    }
+  }
+}
+
+// exponential backoff with full jitter: random up to the exponential
+// delay, so that the conflicting transactions don't retry in lockstep.
+func retryDelay(policy RetryPolicy, attempt int) time.Duration {
+  base, limit := policy.BaseDelay, policy.MaxDelay
+  if base <= 0 {
+    base = RETRY_BASE_DELAY
+  }
+  if limit <= 0 {
+    limit = RETRY_MAX_DELAY
+  }
+  delay := limit
+  if attempt - 1 < 32 && base << (attempt - 1) < limit {
+    delay = base << (attempt - 1)
+  }
+  return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "iter"
+)
+
+// a filter on raw values, checked against the page bytes before anything
+// is copied or decoded. the size of an overflow value is in its reference,
+// its prefix in the first pages of the chain, which is read in full only
+// for the values that pass.
+type Filter struct {
+  MinValLen   int
+  MaxValLen   int // 0 means no limit
+  ValuePrefix []byte
+}
+
+func (f *Filter) match(val []byte) bool {
+  if len(val) < f.MinValLen {
+    return false
+  }
+  if f.MaxValLen > 0 && len(val) > f.MaxValLen {
+    return false
+  }
+  return bytes.HasPrefix(val, f.ValuePrefix)
+}
+
+// the filter on the value at the iterator
+func (f *Filter) matchAt(iter *BIter) bool {
+  leaf, pos := iter.path[len(iter.path)-1], iter.pos[len(iter.pos)-1]
+  val := leaf.getVal(pos)
+  if !leaf.isOverflow(pos) {
+    return f.match(val)
+  }
+  size := int(binary.LittleEndian.Uint32(val[0:]))
+  if size < f.MinValLen || (f.MaxValLen > 0 && size > f.MaxValLen) {
+    return false
+  }
+  n := len(f.ValuePrefix)
+  return n == 0 || bytes.Equal(overflowPrefix(iter.tree, val, n), f.ValuePrefix)
+}
+
+// call fn for the KV pairs in lo <= key < hi that pass the filter, in key
+// order. a nil hi means no upper bound. the key and value point into the
+// page and are only valid inside the callback. return false to stop.
+func (db *KV) Scan(lo []byte, hi []byte, filter Filter, fn func(key []byte, val []byte) bool) {
+  tree, release := db.snapshot()
+  defer release()
+  for iter := tree.Seek(lo, CMP_GE); iter.Valid(); iter.Next() {
+    key := iter.Key()
+    if hi != nil && bytes.Compare(key, hi) >= 0 {
+      break
+    }
+    if filter.matchAt(iter) && !fn(key, iter.Val()) {
+      break
+    }
+  }
+}
+
+// visit the KV pairs in lo <= key < hi in key order.
+func (tree *BTree) scan(lo []byte, hi []byte, fn func(key []byte, val []byte) bool) {
+  for iter := tree.Seek(lo, CMP_GE); iter.Valid(); iter.Next() {
+    key := iter.Key()
+    if hi != nil && bytes.Compare(key, hi) >= 0 {
+      break
+    }
+    if !fn(key, iter.Val()) {
+      break
+    }
+  }
+}
+
+// the KV pairs in start <= key < end, in key order or in reverse.
+// a nil end means no upper bound. for use with range-over-func:
+//
+//   for key, val := range db.Range(start, end, true) { ... }
+//
+// like Scan, the key and value are only valid inside the loop body.
+func (db *KV) Range(start []byte, end []byte, reverse bool) iter.Seq2[[]byte, []byte] {
+  return func(yield func([]byte, []byte) bool) {
+    tree, release := db.snapshot()
+    defer release()
+    if !reverse {
+      tree.scan(start, end, yield)
+      return
+    }
+    it := tree.SeekLast()
+    if end != nil {
+      it = tree.Seek(end, CMP_LT)
+    }
+    for ; it.Valid() && bytes.Compare(it.Key(), start) >= 0; it.Prev() {
+      if !yield(it.Key(), it.Val()) {
+        return
+      }
+    }
+  }
+}
+
+// the keys starting with the prefix
+func (db *KV) PrefixScan(prefix []byte) iter.Seq2[[]byte, []byte] {
+  var end []byte // no upper bound if the prefix is all 0xff
+  if bytes.Count(prefix, []byte{0xff}) < len(prefix) {
+    end = prefixEnd(prefix)
+  }
+  return db.Range(prefix, end, false)
+}
+
+// a KV pair in a batch of ScanBatch
+type KVPair struct {
+  Key []byte
+  Val []byte
+}
+
+// like Scan, but the KV pairs are delivered in batches, one per leaf.
+// the batch is reused after the callback returns.
+func (db *KV) ScanBatch(lo []byte, hi []byte, filter Filter, fn func(batch []KVPair) bool) {
+  tree, release := db.snapshot()
+  defer release()
+  var batch []KVPair
+  for iter := tree.Seek(lo, CMP_GE); iter.Valid(); iter.Next() {
+    key := iter.Key()
+    if hi != nil && bytes.Compare(key, hi) >= 0 {
+      break
+    }
+    if filter.matchAt(iter) {
+      batch = append(batch, KVPair{Key: key, Val: iter.Val()})
+    }
+    if iter.leafEnd() && len(batch) > 0 {
+      if !fn(batch) {
+        return
+      }
+      batch = batch[:0]
+    }
+  }
+  if len(batch) > 0 {
+    fn(batch)
+  }
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "path/filepath"
+  "slices"
+  "testing"
+)
+
+// small values of 1 to 40 bytes, and overflow values of 11 pages
+func scanCreate(t *testing.T) (*KV, map[string][]byte) {
+  t.Helper()
+  db := checksumOpen(t, filepath.Join(t.TempDir(), "db"), Options{})
+  vals := map[string][]byte{}
+  for i := 1; i <= 40; i++ {
+    vals[fmt.Sprintf("s%02d", i)] = bytes.Repeat([]byte{byte('a' + i % 2)}, i)
+  }
+  big := 10 * overflowCap(&db.tree)
+  for i := 0; i < 4; i++ {
+    vals[fmt.Sprintf("o%d", i)] = append([]byte{byte('a' + i % 2)}, overflowVal(big + i, int64(i))...)
+  }
+  for key, val := range vals {
+    if err := db.Set([]byte(key), val); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return db, vals
+}
+
+func TestScanFilter(t *testing.T) {
+  db, vals := scanCreate(t)
+  defer db.Close()
+  big := 10 * overflowCap(&db.tree)
+  cases := []struct {
+    lo, hi   string
+    filter   Filter
+    keys     []string
+    overflow int // the most overflow pages read
+  }{
+    {"", "", Filter{}, []string{"o0", "o1", "o2", "o3", "s01", "s02", "s03"}, 44},
+    {"s", "s06", Filter{}, []string{"s01", "s02", "s03", "s04", "s05"}, 0},
+    {"s", "", Filter{MinValLen: 38}, []string{"s38", "s39", "s40"}, 0},
+    {"s", "s10", Filter{MaxValLen: 2}, []string{"s01", "s02"}, 0},
+    {"s", "s10", Filter{ValuePrefix: []byte("aa")}, []string{"s02", "s04", "s06", "s08"}, 0},
+    // the sizes in the references
+    {"", "", Filter{MaxValLen: 40}, []string{"s01", "s02", "s03"}, 0},
+    {"", "", Filter{MinValLen: big + 3}, []string{"o2", "o3"}, 22},
+    {"o", "p", Filter{MinValLen: big + 2, MaxValLen: big + 2}, []string{"o1"}, 11},
+    // the prefixes in the first pages
+    {"o", "p", Filter{ValuePrefix: []byte("b")}, []string{"o1", "o3"}, 24},
+    {"o", "p", Filter{ValuePrefix: vals["o2"][:overflowCap(&db.tree) + 1]}, []string{"o2"}, 17},
+    {"o", "p", Filter{ValuePrefix: []byte("c")}, nil, 4},
+  }
+  for i, c := range cases {
+    var hi []byte
+    if c.hi != "" {
+      hi = []byte(c.hi)
+    }
+    check := func(got []string, reads uint64) {
+      t.Helper()
+      if len(got) > len(c.keys) {
+        got = got[:len(c.keys)] // stopped by the callback
+      }
+      if fmt.Sprint(got) != fmt.Sprint(c.keys) {
+        t.Fatalf("case %d: %v, want %v", i, got, c.keys)
+      }
+      if reads > uint64(c.overflow) + 4 {
+        t.Fatalf("case %d: %d pages read", i, reads)
+      }
+    }
+    var got []string
+    reads := db.stats.reads.Load()
+    db.Scan([]byte(c.lo), hi, c.filter, func(key []byte, val []byte) bool {
+      if !bytes.Equal(val, vals[string(key)]) {
+        t.Fatalf("case %d: %s: bad value", i, key)
+      }
+      got = append(got, string(key))
+      return len(got) < len(c.keys)
+    })
+    check(got, db.stats.reads.Load() - reads)
+    got = nil
+    reads = db.stats.reads.Load()
+    db.ScanBatch([]byte(c.lo), hi, c.filter, func(batch []KVPair) bool {
+      for _, kv := range batch {
+        if !bytes.Equal(kv.Val, vals[string(kv.Key)]) {
+          t.Fatalf("case %d: %s: bad value", i, kv.Key)
+        }
+        got = append(got, string(kv.Key))
+      }
+      return len(got) < len(c.keys)
+    })
+    check(got, db.stats.reads.Load() - reads)
+  }
+}
+
+func TestScanRange(t *testing.T) {
+  db, vals := scanCreate(t)
+  defer db.Close()
+  cases := []struct {
+    start, end string
+    reverse    bool
+    keys       []string
+  }{
+    {"o1", "o3", false, []string{"o1", "o2"}},
+    {"o1", "o3", true, []string{"o2", "o1"}},
+    {"s38", "", false, []string{"s38", "s39", "s40"}},
+    {"s38", "", true, []string{"s40", "s39", "s38"}},
+    {"", "o1", true, []string{"o0"}},
+    {"p", "q", false, nil},
+  }
+  for i, c := range cases {
+    var end []byte
+    if c.end != "" {
+      end = []byte(c.end)
+    }
+    var got []string
+    for key, val := range db.Range([]byte(c.start), end, c.reverse) {
+      if !bytes.Equal(val, vals[string(key)]) {
+        t.Fatalf("case %d: %s: bad value", i, key)
+      }
+      got = append(got, string(key))
+    }
+    if fmt.Sprint(got) != fmt.Sprint(c.keys) {
+      t.Fatalf("case %d: %v, want %v", i, got, c.keys)
+    }
+  }
+  for prefix, want := range map[string]int{"o": 4, "s0": 9, "s4": 1, "x": 0, "\xff": 0} {
+    var got []string
+    for key, val := range db.PrefixScan([]byte(prefix)) {
+      if !bytes.HasPrefix(key, []byte(prefix)) || !bytes.Equal(val, vals[string(key)]) {
+        t.Fatalf("%q: %s", prefix, key)
+      }
+      got = append(got, string(key))
+    }
+    if len(got) != want || !slices.IsSorted(got) {
+      t.Fatalf("%q: %v", prefix, got)
+    }
+  }
+  // stopped by the loop
+  for range db.PrefixScan([]byte("o")) {
+    break
+  }
+}
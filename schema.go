@@ -0,0 +1,155 @@
+package main
+
+import (
+  "encoding/binary"
+  "fmt"
+)
+
+// the catalog has a version, the @meta key "schema_version", incremented
+// by each change of the table definitions in the transaction of the
+// change. the version read in a transaction is the version of the
+// definitions it reads, so a cached definition is valid as long as the
+// version is the same.
+//
+// the catalog is in the tree like the rows, so CREATE, ALTER and DROP are
+// in the transaction: they are rolled back with it and the others see them
+// after the commit. the writes of a transaction are only valid for the
+// definitions they used, so a transaction that writes can't commit if the
+// catalog changed after it first read it (ErrConflict). two DDLs at the
+// same time conflict, and so do the rows written for a table dropped or
+// altered in the meantime. a DDL reads the rows of its snapshot, e.g. to
+// fill an index, so it can't commit after any other commit either.
+
+// the cached plans of a session, see QLSession
+const QL_PLAN_CACHE = 256
+
+func schemaKey() *Record {
+  return (&Record{}).AddStr("key", []byte("schema_version"))
+}
+
+// the catalog version in the transaction's view
+func schemaVersion(tx *DBTX) uint64 {
+  meta := schemaKey()
+  ok, err := dbGet(tx, TDEF_META, meta)
+  assert(err == nil)
+  if !ok {
+    return 0
+  }
+  return binary.LittleEndian.Uint64(meta.Get("val").Str)
+}
+
+// the catalog version the writes of the transaction are based on
+func schemaUse(tx *DBTX) {
+  if !tx.based {
+    tx.base, tx.based = schemaVersion(tx), true
+  }
+}
+
+// the transaction has not used a catalog version yet
+func schemaBegin(tx *DBTX) {
+  tx.base, tx.based, tx.ddl = 0, false, false
+}
+
+// KVTX.precommit, the catalog is not changed by the commits after the
+// transaction first read it. the caller holds the writer lock.
+func schemaConflict(tx *DBTX) error {
+  key := encodeKey(nil, TDEF_META.Prefix, schemaKey().Vals)
+  version := uint64(0)
+  if val, ok := tx.db.kv.tree.Get(key); ok {
+    vals := []Value{{Type: TYPE_BYTES}}
+    err := decodeValues(val, vals)
+    assert(err == nil)
+    version = binary.LittleEndian.Uint64(vals[0].Str)
+  }
+  if version != tx.base {
+    return fmt.Errorf("%w: the catalog changed", ErrConflict)
+  }
+  if tx.ddl && tx.db.kv.version != tx.kv.version {
+    return fmt.Errorf("%w: the rows changed", ErrConflict)
+  }
+  return nil
+}
+
+// called by each change of the catalog
+func schemaBump(tx *DBTX) error {
+  val := make([]byte, 8)
+  binary.LittleEndian.PutUint64(val, schemaVersion(tx) + 1)
+  _, err := dbUpdate(tx, TDEF_META, *schemaKey().AddStr("val", val), MODE_UPSERT)
+  tx.ddl = true
+  return err
+}
+
+// a read committed transaction sees the changes committed by others, the
+// definitions it has read are read again when the catalog has changed.
+// a snapshot sees a single version, except for its own changes, which
+// update the cached definitions themselves.
+func schemaCheck(tx *DBTX) {
+  if !tx.kv.readCommitted {
+    return
+  }
+  if v := schemaVersion(tx); v != tx.schema {
+    for name := range tx.tables {
+      tx.tables[name] = getTableDefDB(tx, name)
+    }
+    tx.schema = v
+  }
+}
+
+// the latest catalog version. a long-lived handle that caches anything
+// derived from the table definitions compares it to detect the changes.
+func (db *DB) SchemaVersion() uint64 {
+  tx := DBTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  return schemaVersion(&tx)
+}
+
+// a parsed statement and its table
+type qlPlan struct {
+  stmt  interface{}
+  table string
+  tdef  *TableDef // nil until resolved
+}
+
+// the statement, from the cache of the session if it's a DML
+func (s *QLSession) prepare(text string) (*qlPlan, error) {
+  if plan := s.plans[text]; plan != nil {
+    return plan, nil
+  }
+  stmt, err := qlParse(text)
+  if err != nil {
+    return nil, err
+  }
+  plan := &qlPlan{stmt: stmt}
+  if plan.table = qlTable(stmt); plan.table != "" {
+    if s.plans == nil || len(s.plans) >= QL_PLAN_CACHE {
+      s.plans = map[string]*qlPlan{}
+    }
+    s.plans[text] = plan
+  }
+  return plan, nil
+}
+
+// run a cached plan. the cache is dropped at the start of the statement
+// if the catalog version of the transaction is not the one of the cache.
+// the definitions read in a transaction that changes the catalog are
+// not cached, its version is not final until it commits.
+func (s *QLSession) run(tx *DBTX, plan *qlPlan) (*QLResult, error) {
+  schemaUse(tx) // a cached definition is still used
+  if v := schemaVersion(tx); v != s.schema {
+    for _, cached := range s.plans {
+      cached.tdef = nil
+    }
+    s.schema = v
+  }
+  tdef := plan.tdef
+  if tdef == nil {
+    if tdef = getTableDef(tx, plan.table); tdef == nil {
+      return nil, errNoTable(plan.table)
+    }
+    if !tx.ddl {
+      plan.tdef = tdef
+    }
+  }
+  return qlRun(tx, tdef, plan.stmt)
+}
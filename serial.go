@@ -0,0 +1,160 @@
+package main
+
+import (
+  "bytes"
+  "sync/atomic"
+)
+
+// serializable transactions, checked at the commit instead of locking.
+// a serializable transaction records what it reads: the keys of Get and
+// the key ranges covered by its iterators. the store keeps the keys
+// written by the commits since the oldest serializable transaction
+// started. a transaction that writes can only commit if none of the
+// commits after its snapshot wrote into what it read, including keys
+// that didn't exist, so an insert into a scanned range (a phantom) is a
+// conflict. a read-only transaction reads a snapshot and always commits.
+
+type serialState struct {
+  count   atomic.Int32      // the active serializable transactions
+  active  map[uint64]int    // their versions, under KV.mu
+  pending [][]byte          // the keys written by the commit in progress
+  all     bool              // the commit in progress replaces everything
+  history []serialCommit    // the commits after the oldest active version
+}
+
+type serialCommit struct {
+  version uint64
+  keys    [][]byte
+  all     bool
+}
+
+// a key range read by a transaction, the bounds are inclusive
+type readRange struct {
+  lo, hi         []byte
+  loOpen, hiOpen bool // unbounded
+}
+
+func (r *readRange) covers(key []byte) bool {
+  return (r.loOpen || bytes.Compare(key, r.lo) >= 0) && (r.hiOpen || bytes.Compare(key, r.hi) <= 0)
+}
+
+func (r *readRange) extend(key []byte) {
+  if bytes.Compare(key, r.lo) < 0 {
+    r.lo = append([]byte(nil), key...)
+  }
+  if bytes.Compare(key, r.hi) > 0 {
+    r.hi = append([]byte(nil), key...)
+  }
+}
+
+// begin a serializable transaction, see ErrConflict
+func (db *KV) BeginSerializable(tx *KVTX) {
+  // no commit is in progress, so all the commits after the snapshot
+  // are recorded.
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  db.serial.count.Add(1)
+  db.Begin(tx)
+  tx.serializable = true
+  db.mu.Lock()
+  if db.serial.active == nil {
+    db.serial.active = map[uint64]int{}
+  }
+  db.serial.active[tx.version]++
+  db.mu.Unlock()
+}
+
+// the caller holds db.mu
+func serialEnd(db *KV, tx *KVTX) {
+  if db.serial.active[tx.version]--; db.serial.active[tx.version] == 0 {
+    delete(db.serial.active, tx.version)
+  }
+  db.serial.count.Add(-1)
+  // drop the commits visible to all of them
+  oldest, ok := uint64(0), false
+  for version := range db.serial.active {
+    if !ok || version < oldest {
+      oldest, ok = version, true
+    }
+  }
+  i := 0
+  for i < len(db.serial.history) && (!ok || db.serial.history[i].version <= oldest) {
+    i++
+  }
+  db.serial.history = append([]serialCommit(nil), db.serial.history[i:]...)
+}
+
+// BTree.onWrite, with the writer lock held
+func serialWrote(db *KV, key []byte) {
+  if db.serial.count.Load() > 0 {
+    db.serial.pending = append(db.serial.pending, append([]byte(nil), key...))
+  }
+}
+
+// the commit in progress is visible as `version`, the caller holds db.mu
+func serialPublish(db *KV, version uint64) {
+  if db.serial.count.Load() > 0 && (len(db.serial.pending) > 0 || db.serial.all) {
+    db.serial.history = append(db.serial.history, serialCommit{
+      version: version, keys: db.serial.pending, all: db.serial.all,
+    })
+  }
+  db.serial.pending, db.serial.all = nil, false
+}
+
+func serialRevert(db *KV) {
+  db.serial.pending, db.serial.all = nil, false
+}
+
+// any of the later commits wrote into the reads of the transaction?
+// the caller holds the writer lock.
+func serialCheck(db *KV, tx *KVTX) error {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  for _, commit := range db.serial.history {
+    if commit.version <= tx.version {
+      continue
+    }
+    if commit.all && len(tx.reads) > 0 {
+      return ErrConflict
+    }
+    for _, key := range commit.keys {
+      for _, r := range tx.reads {
+        if r.covers(key) {
+          return ErrConflict
+        }
+      }
+    }
+  }
+  return nil
+}
+
+// a point read
+func (tx *KVTX) readKey(key []byte) {
+  if tx.serializable {
+    key = append([]byte(nil), key...)
+    tx.reads = append(tx.reads, &readRange{lo: key, hi: key})
+  }
+}
+
+// the range from the starting key to where the iterator has been
+func (iter *TxIter) observe() {
+  r := iter.reads
+  if r == nil {
+    return
+  }
+  if iter.Valid() {
+    r.extend(iter.Key())
+  } else if iter.dir > 0 {
+    r.hiOpen = true
+  } else {
+    r.loOpen = true
+  }
+}
+
+// see KV.BeginSerializable
+func (db *DB) BeginSerializable(tx *DBTX) {
+  tx.db = db
+  tx.tables = map[string]*TableDef{}
+  schemaBegin(tx)
+  db.kv.BeginSerializable(&tx.kv)
+}
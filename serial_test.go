@@ -0,0 +1,119 @@
+package main
+
+import (
+  "errors"
+  "testing"
+)
+
+func newSerialKV(t *testing.T, keys ...string) *KV {
+  db := &KV{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  for _, k := range keys {
+    if err := db.Set([]byte(k), []byte("v")); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return db
+}
+
+// count the keys in [lo, hi) and write the count elsewhere
+func countRange(tx *KVTX, lo string, hi string) {
+  n := 0
+  for iter := tx.Seek([]byte(lo), CMP_GE); iter.Valid() && string(iter.Key()) < hi; iter.Next() {
+    n++
+  }
+  tx.Set([]byte("count"), []byte{byte(n)})
+}
+
+// an insert into a scanned range fails the scanner
+func TestSerialPhantom(t *testing.T) {
+  db := newSerialKV(t, "a1", "a3", "b1")
+  tx := KVTX{}
+  db.BeginSerializable(&tx)
+  countRange(&tx, "a", "b")
+  if err := db.Set([]byte("a2"), []byte("v")); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Commit(&tx); !errors.Is(err, ErrConflict) {
+    t.Fatalf("phantom: %v", err)
+  }
+  if _, ok := db.Get([]byte("count")); ok {
+    t.Fatal("the conflicting commit was applied")
+  }
+  // past the end of the scan: the iterator stopped at b1
+  db.BeginSerializable(&tx)
+  countRange(&tx, "a", "b")
+  db.Set([]byte("b2"), []byte("v"))
+  db.Set([]byte("0"), []byte("v"))
+  if err := db.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// an insert past the last key conflicts with a scan to the end
+func TestSerialPhantomAtEnd(t *testing.T) {
+  db := newSerialKV(t, "a", "b")
+  tx := KVTX{}
+  db.BeginSerializable(&tx)
+  countRange(&tx, "a", "\xff")
+  db.Set([]byte("z"), []byte("v"))
+  if err := db.Commit(&tx); !errors.Is(err, ErrConflict) {
+    t.Fatalf("phantom: %v", err)
+  }
+  // and a backward scan to the start
+  db.BeginSerializable(&tx)
+  for iter := tx.Seek([]byte("b"), CMP_LE); iter.Valid(); iter.Prev() {
+  }
+  tx.Set([]byte("x"), nil)
+  db.Set([]byte("0"), []byte("v"))
+  if err := db.Commit(&tx); !errors.Is(err, ErrConflict) {
+    t.Fatalf("backward phantom: %v", err)
+  }
+}
+
+// the write skew of 2 transactions: each reads both keys and writes one
+func TestSerialWriteSkew(t *testing.T) {
+  db := newSerialKV(t, "x", "y")
+  tx1, tx2 := KVTX{}, KVTX{}
+  db.BeginSerializable(&tx1)
+  db.BeginSerializable(&tx2)
+  for _, tx := range []*KVTX{&tx1, &tx2} {
+    tx.Get([]byte("x"))
+    tx.Get([]byte("y"))
+  }
+  tx1.Del([]byte("x"))
+  tx2.Del([]byte("y"))
+  if err := db.Commit(&tx1); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Commit(&tx2); !errors.Is(err, ErrConflict) || !IsRetryable(err) {
+    t.Fatalf("write skew: %v", err)
+  }
+  if _, ok := db.Get([]byte("y")); !ok {
+    t.Fatal("the conflicting commit was applied")
+  }
+}
+
+// a read-only transaction reads a snapshot, a missing key is still read
+func TestSerialReadOnly(t *testing.T) {
+  db := newSerialKV(t, "a")
+  tx := KVTX{}
+  db.BeginSerializable(&tx)
+  tx.Get([]byte("b"))
+  db.Set([]byte("b"), []byte("v"))
+  if err := db.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+  db.BeginSerializable(&tx)
+  tx.Get([]byte("c"))
+  tx.Set([]byte("d"), nil)
+  db.Set([]byte("c"), []byte("v"))
+  if err := db.Commit(&tx); !errors.Is(err, ErrConflict) {
+    t.Fatalf("read of a missing key: %v", err)
+  }
+  if len(db.serial.history) != 0 || db.serial.count.Load() != 0 {
+    t.Fatalf("%d commits kept", len(db.serial.history))
+  }
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// a subset of the Redis protocol (RESP) over the KV store:
+// PING, ECHO, GET, SET [EX s | PX ms] [NX | XX], MSET, DEL, EXISTS,
+// SCAN cursor [MATCH pattern] [COUNT n], MULTI, EXEC, DISCARD, QUIT,
+// and the keyspace notifications with SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE
+// and PUNSUBSCRIBE, see pubsub.go.
+// each command is a transaction, MULTI ... EXEC runs the queued commands
+// in one transaction.
+const (
+  RESP_MAX_ARGS   = 1 << 20
+  RESP_MAX_CURSOR = 1024 // open SCAN cursors per connection
+)
+
+// serve the clients of the listener until it's closed
+func (db *KV) Serve(ln net.Listener) error {
+  for {
+    conn, err := ln.Accept()
+    if errors.Is(err, net.ErrClosed) {
+      return nil
+    }
+    if err != nil {
+      return fmt.Errorf("accept: %w", err)
+    }
+    go respServe(db, conn)
+  }
+}
+
+type respConn struct {
+  db    *KV
+  conn  net.Conn
+  in    *bufio.Reader
+  outMu sync.Mutex // the notifications are written by another goroutine
+  out   *bufio.Writer
+  multi [][][]byte // the queued commands, nil if not in MULTI
+  // SCAN cursors, a cursor is where the next batch begins
+  cursors    map[uint64][]byte
+  lastCursor uint64
+  sub        respSub // see pubsub.go
+}
+
+func respServe(db *KV, conn net.Conn) {
+  defer conn.Close()
+  c := &respConn{db: db, conn: conn, in: bufio.NewReader(conn), out: bufio.NewWriter(conn), cursors: map[uint64][]byte{}}
+  defer c.unsubscribeAll()
+  for {
+    args, err := respRead(c.in)
+    c.outMu.Lock()
+    if err != nil {
+      if !errors.Is(err, io.EOF) {
+        respError(c.out, err)
+        c.out.Flush()
+      }
+      c.outMu.Unlock()
+      return
+    }
+    quit := len(args) > 0 && strings.EqualFold(string(args[0]), "QUIT")
+    if quit {
+      respSimple(c.out, "OK")
+    } else if len(args) > 0 {
+      c.command(args)
+    }
+    // replies to pipelined commands are sent together
+    if c.in.Buffered() == 0 || quit {
+      if err := c.out.Flush(); err != nil || quit {
+        c.outMu.Unlock()
+        return
+      }
+    }
+    c.outMu.Unlock()
+  }
+}
+
+func (c *respConn) command(args [][]byte) {
+  name := strings.ToUpper(string(args[0]))
+  switch {
+  case respPubSub[name]:
+    if c.multi != nil {
+      respError(c.out, fmt.Errorf("%s inside MULTI is not allowed", name))
+      return
+    }
+    c.pubsub(name, args[1:])
+  case c.sub.active() && name != "PING":
+    respError(c.out, fmt.Errorf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name)))
+  case name == "MULTI":
+    if c.multi != nil {
+      respError(c.out, errors.New("MULTI calls can not be nested"))
+      return
+    }
+    c.multi = [][][]byte{}
+    respSimple(c.out, "OK")
+  case name == "DISCARD":
+    if c.multi == nil {
+      respError(c.out, errors.New("DISCARD without MULTI"))
+      return
+    }
+    c.multi = nil
+    respSimple(c.out, "OK")
+  case name == "EXEC":
+    if c.multi == nil {
+      respError(c.out, errors.New("EXEC without MULTI"))
+      return
+    }
+    cmds := c.multi
+    c.multi = nil
+    c.exec(cmds, true)
+  case c.multi != nil:
+    c.multi = append(c.multi, args)
+    respSimple(c.out, "QUEUED")
+  default:
+    c.exec([][][]byte{args}, false)
+  }
+}
+
+// run the commands in a transaction. the replies are sent once it commits,
+// in an array for EXEC.
+func (c *respConn) exec(cmds [][][]byte, multi bool) {
+  tx := KVTX{}
+  c.db.Begin(&tx)
+  var replies bytes.Buffer
+  w := bufio.NewWriter(&replies)
+  if multi {
+    respArray(w, len(cmds))
+  }
+  for _, args := range cmds {
+    if err := c.run(&tx, w, args); err != nil {
+      respError(w, err)
+    }
+  }
+  w.Flush()
+  if err := c.db.Commit(&tx); err != nil {
+    respError(c.out, err)
+    return
+  }
+  c.out.Write(replies.Bytes())
+}
+
+// a command in a transaction, an error is its reply
+func (c *respConn) run(tx *KVTX, w *bufio.Writer, args [][]byte) error {
+  name := strings.ToUpper(string(args[0]))
+  args = args[1:]
+  switch name {
+  case "PING":
+    if len(args) == 0 {
+      respSimple(w, "PONG")
+    } else {
+      respBulk(w, args[0])
+    }
+  case "ECHO":
+    if len(args) != 1 {
+      return respArgs(name)
+    }
+    respBulk(w, args[0])
+  case "GET":
+    if len(args) != 1 {
+      return respArgs(name)
+    }
+    val, ok := tx.Get(args[0])
+    if !ok {
+      val = nil
+    }
+    respBulk(w, val)
+  case "SET":
+    return respSet(tx, w, args)
+  case "MSET":
+    if len(args) == 0 || len(args) % 2 != 0 {
+      return respArgs(name)
+    }
+    for i := 0; i < len(args); i += 2 {
+      if err := tx.Set(args[i], args[i+1]); err != nil {
+        return err
+      }
+    }
+    respSimple(w, "OK")
+  case "DEL", "EXISTS":
+    if len(args) == 0 {
+      return respArgs(name)
+    }
+    n := 0
+    for _, key := range args {
+      var ok bool
+      if name == "DEL" {
+        var err error
+        if ok, err = tx.Del(key); err != nil {
+          return err
+        }
+      } else {
+        _, ok = tx.Get(key)
+      }
+      if ok {
+        n++
+      }
+    }
+    respInt(w, n)
+  case "SCAN":
+    return c.scan(tx, w, args)
+  case "SELECT":
+    if len(args) != 1 || string(args[0]) != "0" {
+      return errors.New("only DB 0 is supported")
+    }
+    respSimple(w, "OK")
+  case "COMMAND":
+    respArray(w, 0) // no command docs
+  default:
+    return fmt.Errorf("unknown command '%s'", name)
+  }
+  return nil
+}
+
+// SET key value [EX seconds | PX milliseconds] [NX | XX]
+func respSet(tx *KVTX, w *bufio.Writer, args [][]byte) error {
+  if len(args) < 2 {
+    return respArgs("SET")
+  }
+  key, val := args[0], args[1]
+  ttl, nx, xx := time.Duration(0), false, false
+  for i := 2; i < len(args); i++ {
+    switch opt := strings.ToUpper(string(args[i])); {
+    case opt == "NX":
+      nx = true
+    case opt == "XX":
+      xx = true
+    case (opt == "EX" || opt == "PX") && i + 1 < len(args) && ttl == 0:
+      n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+      if err != nil || n <= 0 {
+        return errors.New("invalid expire time in 'set' command")
+      }
+      ttl = time.Duration(n) * time.Millisecond
+      if opt == "EX" {
+        ttl = time.Duration(n) * time.Second
+      }
+      i++
+    default:
+      return errors.New("syntax error")
+    }
+  }
+  if nx && xx {
+    return errors.New("syntax error")
+  }
+  if nx || xx {
+    if _, exists := tx.Get(key); exists != xx {
+      respBulk(w, nil) // not set
+      return nil
+    }
+  }
+  var err error
+  if ttl > 0 {
+    err = tx.SetWithTTL(key, val, ttl)
+  } else {
+    err = tx.Set(key, val)
+  }
+  if err != nil {
+    return err
+  }
+  respSimple(w, "OK")
+  return nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT n], the keys in order.
+// the cursor 0 starts a scan and is returned at the end of it.
+func (c *respConn) scan(tx *KVTX, w *bufio.Writer, args [][]byte) error {
+  if len(args) == 0 || len(args) % 2 != 1 {
+    return respArgs("SCAN")
+  }
+  cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+  if err != nil {
+    return errors.New("invalid cursor")
+  }
+  var pattern []byte
+  count := 10
+  for i := 1; i < len(args); i += 2 {
+    switch strings.ToUpper(string(args[i])) {
+    case "MATCH":
+      pattern = args[i+1]
+    case "COUNT":
+      if count, err = strconv.Atoi(string(args[i+1])); err != nil || count <= 0 {
+        return errors.New("value is out of range")
+      }
+    default:
+      return errors.New("syntax error")
+    }
+  }
+  start, cmp := []byte(nil), CMP_GT
+  if cursor != 0 {
+    var ok bool
+    if start, ok = c.cursors[cursor]; !ok {
+      return errors.New("invalid cursor")
+    }
+    delete(c.cursors, cursor)
+    cmp = CMP_GE
+  }
+  // like Redis, COUNT bounds the keys visited, not the keys returned
+  var keys [][]byte
+  iter := tx.Seek(start, cmp)
+  for n := 0; iter.Valid() && n < count; iter.Next() {
+    if pattern == nil || respGlob(pattern, iter.Key()) {
+      keys = append(keys, iter.Key())
+    }
+    n++
+  }
+  next := uint64(0)
+  if iter.Valid() {
+    if len(c.cursors) >= RESP_MAX_CURSOR {
+      clear(c.cursors) // abandoned scans
+    }
+    c.lastCursor++
+    next = c.lastCursor
+    c.cursors[next] = append([]byte(nil), iter.Key()...)
+  }
+  respArray(w, 2)
+  respBulk(w, []byte(strconv.FormatUint(next, 10)))
+  respArray(w, len(keys))
+  for _, key := range keys {
+    respBulk(w, key)
+  }
+  return nil
+}
+
+// Redis glob patterns: * ? [...] and \ for escaping
+func respGlob(pattern []byte, s []byte) bool {
+  for len(pattern) > 0 {
+    switch pattern[0] {
+    case '*':
+      for i := len(s); i >= 0; i-- {
+        if respGlob(pattern[1:], s[i:]) {
+          return true
+        }
+      }
+      return false
+    case '?':
+      if len(s) == 0 {
+        return false
+      }
+    case '[':
+      end := bytes.IndexByte(pattern[1:], ']')
+      if end < 0 || len(s) == 0 || !respClass(pattern[1:1+end], s[0]) {
+        return false
+      }
+      pattern = pattern[end+1:]
+    case '\\':
+      if len(pattern) > 1 {
+        pattern = pattern[1:]
+      }
+      fallthrough
+    default:
+      if len(s) == 0 || s[0] != pattern[0] {
+        return false
+      }
+    }
+    pattern, s = pattern[1:], s[1:]
+  }
+  return len(s) == 0
+}
+
+// a character class such as a-z or ^0-9
+func respClass(class []byte, c byte) bool {
+  negate := len(class) > 0 && class[0] == '^'
+  if negate {
+    class = class[1:]
+  }
+  match := false
+  for i := 0; i < len(class); i++ {
+    if i + 2 < len(class) && class[i+1] == '-' {
+      match = match || (class[i] <= c && c <= class[i+2])
+      i += 2
+    } else {
+      match = match || class[i] == c
+    }
+  }
+  return match != negate
+}
+
+func respArgs(name string) error {
+  return fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+// read a command, either an array of bulk strings or an inline command
+func respRead(in *bufio.Reader) ([][]byte, error) {
+  line, err := respLine(in)
+  if err != nil {
+    return nil, err
+  }
+  if len(line) == 0 || line[0] != '*' {
+    // inline: space-separated words
+    args := [][]byte{}
+    for _, word := range bytes.Fields(line) {
+      args = append(args, append([]byte(nil), word...))
+    }
+    return args, nil
+  }
+  n, err := strconv.Atoi(string(line[1:]))
+  if err != nil || n > RESP_MAX_ARGS {
+    return nil, errors.New("Protocol error: invalid multibulk length")
+  }
+  args := make([][]byte, 0, max(n, 0))
+  for i := 0; i < n; i++ {
+    line, err := respLine(in)
+    if err != nil {
+      return nil, err
+    }
+    if len(line) == 0 || line[0] != '$' {
+      return nil, errors.New("Protocol error: expected '$'")
+    }
+    size, err := strconv.Atoi(string(line[1:]))
+    if err != nil || size < 0 || size > BTREE_MAX_BLOB_SIZE {
+      return nil, errors.New("Protocol error: invalid bulk length")
+    }
+    arg := make([]byte, size + 2)
+    if _, err := io.ReadFull(in, arg); err != nil {
+      return nil, err
+    }
+    if !bytes.HasSuffix(arg, []byte("\r\n")) {
+      return nil, errors.New("Protocol error: expected CRLF")
+    }
+    args = append(args, arg[:size])
+  }
+  return args, nil
+}
+
+// a line without the CRLF, only valid until the next read
+func respLine(in *bufio.Reader) ([]byte, error) {
+  line, err := in.ReadSlice('\n')
+  if errors.Is(err, bufio.ErrBufferFull) {
+    return nil, errors.New("Protocol error: line too long")
+  }
+  if err != nil {
+    if len(line) > 0 && errors.Is(err, io.EOF) {
+      err = io.ErrUnexpectedEOF
+    }
+    return nil, err
+  }
+  return bytes.TrimSuffix(line[:len(line)-1], []byte("\r")), nil
+}
+
+// the replies
+func respSimple(w *bufio.Writer, s string) {
+  w.WriteString("+" + s + "\r\n")
+}
+
+func respError(w *bufio.Writer, err error) {
+  msg := strings.ReplaceAll(err.Error(), "\r\n", " ")
+  if !strings.HasPrefix(msg, "Protocol error") {
+    msg = "ERR " + msg
+  }
+  w.WriteString("-" + msg + "\r\n")
+}
+
+func respInt(w *bufio.Writer, n int) {
+  w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+// nil is the null reply
+func respBulk(w *bufio.Writer, b []byte) {
+  if b == nil {
+    w.WriteString("$-1\r\n")
+    return
+  }
+  w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+  w.Write(b)
+  w.WriteString("\r\n")
+}
+
+func respArray(w *bufio.Writer, n int) {
+  w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
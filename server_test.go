@@ -0,0 +1,154 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "net"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+// a store served on a loopback port
+func respStart(t *testing.T) (*KV, string) {
+  t.Helper()
+  db := &KV{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  ln, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  done := make(chan error)
+  go func() { done <- db.Serve(ln) }()
+  t.Cleanup(func() {
+    ln.Close()
+    if err := <-done; err != nil {
+      t.Error(err)
+    }
+    db.Close()
+  })
+  return db, ln.Addr().String()
+}
+
+type respClient struct {
+  conn net.Conn
+  in   *bufio.Reader
+}
+
+func respDial(t *testing.T, addr string) *respClient {
+  t.Helper()
+  conn, err := net.Dial("tcp", addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() { conn.Close() })
+  return &respClient{conn: conn, in: bufio.NewReader(conn)}
+}
+
+// send a command as an array of bulk strings
+func (c *respClient) send(t *testing.T, args ...string) {
+  t.Helper()
+  var b strings.Builder
+  fmt.Fprintf(&b, "*%d\r\n", len(args))
+  for _, arg := range args {
+    fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+  }
+  if _, err := c.conn.Write([]byte(b.String())); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// a reply as text: OK, -ERR ..., :1, "bulk", nil and [...] for arrays
+func (c *respClient) reply(t *testing.T) string {
+  t.Helper()
+  line, err := c.in.ReadString('\n')
+  if err != nil {
+    t.Fatal(err)
+  }
+  line = strings.TrimSuffix(line, "\r\n")
+  switch line[0] {
+  case '+':
+    return line[1:]
+  case '-', ':':
+    return line
+  case '$':
+    n, _ := strconv.Atoi(line[1:])
+    if n < 0 {
+      return "nil"
+    }
+    buf := make([]byte, n + 2)
+    if _, err := io.ReadFull(c.in, buf); err != nil {
+      t.Fatal(err)
+    }
+    return strconv.Quote(string(buf[:n]))
+  case '*':
+    n, _ := strconv.Atoi(line[1:])
+    items := []string{}
+    for i := 0; i < n; i++ {
+      items = append(items, c.reply(t))
+    }
+    return "[" + strings.Join(items, " ") + "]"
+  }
+  t.Fatalf("bad reply %q", line)
+  return ""
+}
+
+func (c *respClient) do(t *testing.T, args ...string) string {
+  t.Helper()
+  c.send(t, args...)
+  return c.reply(t)
+}
+
+func TestServer(t *testing.T) {
+  _, addr := respStart(t)
+  c := respDial(t, addr)
+  cases := []struct {
+    cmd  string
+    want string
+  }{
+    {"PING", "PONG"},
+    {"GET a", "nil"},
+    {"SET a 1", "OK"},
+    {"GET a", `"1"`},
+    {"SET a 2 NX", "nil"},
+    {"SET b 2 XX", "nil"},
+    {"SET b 2 NX", "OK"},
+    {"MSET c 3 d 4 e 5", "OK"},
+    {"EXISTS a b x", ":2"},
+    {"DEL a x", ":1"},
+    {"GET a", "nil"},
+    {"SCAN 0 COUNT 2", `["1" ["b" "c"]]`},
+    {"SCAN 1 COUNT 2", `["0" ["d" "e"]]`},
+    {"SCAN 1", "-ERR invalid cursor"},
+    {"SCAN 0 MATCH [bd]", `["0" ["b" "d"]]`},
+    {"SET", "-ERR wrong number of arguments for 'set' command"},
+    {"NOPE", "-ERR unknown command 'NOPE'"},
+    // one transaction, the replies come with EXEC
+    {"MULTI", "OK"},
+    {"SET m 1", "QUEUED"},
+    {"GET m", "QUEUED"},
+    {"DEL b", "QUEUED"},
+    {"EXEC", `[OK "1" :1]`},
+    {"GET b", "nil"},
+    {"MULTI", "OK"},
+    {"SET n 1", "QUEUED"},
+    {"DISCARD", "OK"},
+    {"GET n", "nil"},
+    {"EXEC", "-ERR EXEC without MULTI"},
+  }
+  for _, tc := range cases {
+    if got := c.do(t, strings.Fields(tc.cmd)...); got != tc.want {
+      t.Fatalf("%s: %s, want %s", tc.cmd, got, tc.want)
+    }
+  }
+  // another client sees the commits
+  if got := respDial(t, addr).do(t, "GET", "m"); got != `"1"` {
+    t.Fatal(got)
+  }
+  if got := c.do(t, "QUIT"); got != "OK" {
+    t.Fatal(got)
+  }
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "os"
+)
+
+// a debug check for Options.ShadowReads: read the page again with pread
+// and compare it with the mmap. a page is only overwritten once no reader
+// reaches it, see freelist.go, so the 2 must agree.
+func shadowCheck(fd *os.File, ptr uint64, page []byte) {
+  file := make([]byte, len(page))
+  if _, err := fd.ReadAt(file, int64(ptr) * int64(len(page))); err != nil {
+    panic(fmt.Errorf("page %d: shadow read: %w", ptr, err))
+  }
+  if !bytes.Equal(file, page) {
+    panic(fmt.Errorf("page %d: the mmap differs from the file", ptr))
+  }
+}
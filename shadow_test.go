@@ -0,0 +1,82 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// the panic message of fn, "" for none
+func shadowPanic(fn func()) (msg string) {
+  defer func() {
+    if r := recover(); r != nil {
+      msg = fmt.Sprint(r)
+    }
+  }()
+  fn()
+  return ""
+}
+
+func TestShadowCheck(t *testing.T) {
+  const size = 4096
+  fd, err := os.Create(filepath.Join(t.TempDir(), "f"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer fd.Close()
+  data := make([]byte, 3 * size)
+  for i := range data {
+    data[i] = byte(i / 7)
+  }
+  fd.Write(data)
+  page := func(ptr int) []byte {
+    return append([]byte(nil), data[ptr*size:(ptr+1)*size]...)
+  }
+  flipped := page(1)
+  flipped[size-1] ^= 1
+  cases := []struct {
+    ptr  uint64
+    page []byte
+    msg  string
+  }{
+    {0, page(0), ""},
+    {2, page(2), ""},
+    {1, page(2), "page 1: the mmap differs from the file"},
+    {1, flipped, "page 1: the mmap differs from the file"},
+    {3, page(0), "page 3: shadow read"},
+  }
+  for i, c := range cases {
+    msg := shadowPanic(func() { shadowCheck(fd, c.ptr, c.page) })
+    if c.msg == "" && msg != "" || !strings.HasPrefix(msg, c.msg) {
+      t.Fatalf("case %d: %q", i, msg)
+    }
+  }
+}
+
+// the pages reused under the readers agree with the file
+func TestShadowReads(t *testing.T) {
+  for _, wal := range []bool{false, true} {
+    db := checksumOpen(t, filepath.Join(t.TempDir(), "db"), Options{ShadowReads: true, WAL: wal, CheckpointPages: 20})
+    tx := KVTX{}
+    for round := 0; round < 5; round++ {
+      if round == 2 {
+        db.Begin(&tx)
+      }
+      for k := 0; k < 500; k++ {
+        db.Set([]byte(fmt.Sprintf("k%03d", k)), []byte(fmt.Sprint(round)))
+      }
+      if round == 3 {
+        if val, ok := tx.Get([]byte("k000")); !ok || string(val) != "1" {
+          t.Fatalf("%q", val)
+        }
+        db.Abort(&tx)
+      }
+    }
+    if msg := shadowPanic(func() { freeStats(t, db) }); msg != "" {
+      t.Fatal(msg)
+    }
+    db.Close()
+  }
+}
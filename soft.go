@@ -0,0 +1,105 @@
+package main
+
+import (
+  "fmt"
+  "time"
+)
+
+// a table with TableDef.SoftDelete keeps the deleted rows: a delete sets
+// the hidden last column to the time of the deletion, in unix nanoseconds,
+// and the reads skip the rows where it's not 0. the rows are removed by
+// Purge. the index entries of a deleted row are kept until then, so its
+// unique keys stay taken.
+// the column is in the records read from the table, and it can be left
+// out of the records written, it's 0 then. SELECT * leaves it out.
+const SOFT_DELETE_COL = "@deleted_at"
+
+func softDeleted(tdef *TableDef, values []Value) bool {
+  return tdef.SoftDelete && values[len(tdef.Cols)-1].I64 != 0
+}
+
+// the columns without the hidden one
+func visibleCols(tdef *TableDef) []string {
+  if tdef.SoftDelete {
+    return tdef.Cols[:len(tdef.Cols)-1]
+  }
+  return tdef.Cols
+}
+
+// mark the row as deleted, `old` is the live row
+func dbSoftDelete(tx *DBTX, tdef *TableDef, old []Value) error {
+  values := append([]Value(nil), old...)
+  values[len(values)-1] = Value{Type: TYPE_INT64, I64: tx.kv.db.clock.now()}
+  key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+  val, err := rowEncode(tx, tdef, key, encodeValues(nil, values[tdef.PKeys:]))
+  if err != nil {
+    return err
+  }
+  return applyWrites(tx, []kvWrite{{key: key, val: val}})
+}
+
+// the scan includes the soft-deleted rows; call it before the scan starts
+func (sc *Scanner) WithDeleted() *Scanner {
+  sc.withDeleted = true
+  return sc
+}
+
+func (sc *Scanner) skipDeleted() {
+  if !sc.tdef.SoftDelete || sc.withDeleted {
+    return
+  }
+  for sc.Valid() {
+    rec := Record{}
+    // a row that can't be read is left to Deref to report
+    if err := sc.Deref(&rec); err != nil || !softDeleted(sc.tdef, rec.Vals) {
+      return
+    }
+    sc.step()
+  }
+}
+
+// remove the rows deleted at or before `before` for good
+func (tx *DBTX) Purge(table string, before time.Time) (int, error) {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return 0, errNoTable(table)
+  }
+  if !tdef.SoftDelete {
+    return 0, fmt.Errorf("table %s: no soft delete", table)
+  }
+  sc := (&Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}).WithDeleted()
+  if err := dbScan(tx, tdef, sc); err != nil {
+    return 0, err
+  }
+  // collected first, the deletes invalidate the iterator
+  var pkeys []Record
+  for ; sc.Valid(); sc.Next() {
+    rec := Record{}
+    if err := sc.Deref(&rec); err != nil {
+      return 0, err
+    }
+    at := rec.Vals[len(tdef.Cols)-1].I64
+    if at != 0 && at <= before.UnixNano() {
+      pkeys = append(pkeys, Record{Cols: rec.Cols[:tdef.PKeys], Vals: rec.Vals[:tdef.PKeys]})
+    }
+  }
+  for _, pkey := range pkeys {
+    if _, err := dbRemove(tx, tdef, pkey); err != nil {
+      return 0, err
+    }
+  }
+  return len(pkeys), nil
+}
+
+// purge the rows deleted more than `retention` ago in a transaction,
+// e.g. periodically
+func (db *DB) Purge(table string, retention time.Duration) (int, error) {
+  tx := DBTX{}
+  db.Begin(&tx)
+  n, err := tx.Purge(table, time.Unix(0, db.kv.clock.now()).Add(-retention))
+  if err != nil {
+    db.Abort(&tx)
+    return 0, err
+  }
+  return n, db.Commit(&tx)
+}
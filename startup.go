@@ -0,0 +1,132 @@
+package main
+
+import (
+  "fmt"
+)
+
+// how much of the file Open checks, see Options.StartupCheck
+const (
+  CHECK_OFF  = 0 // only what's needed to open it
+  CHECK_FAST = 1 // the root and the first and the last leaves
+  CHECK_FULL = 2 // KV.VerifySkip, reads the whole tree
+)
+
+// the state of the file found by Open
+const (
+  STARTUP_CLEAN      = 0
+  STARTUP_RECOVERED  = 1 // commits replayed from the WAL, or a torn record dropped
+  STARTUP_NEEDS_FSCK = 2 // the check found problems, reads may panic
+)
+
+type StartupReport struct {
+  Status    int
+  Level     int      // the check that was run
+  Replayed  int      // WAL records applied
+  TornBytes int      // the unfinished record at the end of the WAL
+  Problems  []string // what the check found
+}
+
+func (r StartupReport) String() string {
+  switch r.Status {
+  case STARTUP_CLEAN:
+    return "clean"
+  case STARTUP_RECOVERED:
+    return fmt.Sprintf("recovered: %d WAL records replayed, %d torn bytes dropped", r.Replayed, r.TornBytes)
+  }
+  return fmt.Sprintf("needs fsck: %d problem(s), first: %s", len(r.Problems), r.Problems[0])
+}
+
+// the report of the last Open. Open doesn't fail on the problems found,
+// the caller decides what to do with them.
+func (db *KV) Startup() StartupReport {
+  return db.startup
+}
+
+// the check of Options.StartupCheck. the master page was checked when
+// it was read; the free list is checked against the tree by CHECK_FULL,
+// see KV.Verify.
+func startupCheck(db *KV) {
+  r := &db.startup
+  r.Level = db.Options.StartupCheck
+  switch r.Level {
+  case CHECK_FAST:
+    if err := startupEdges(db); err != nil {
+      r.Problems = append(r.Problems, err.Error())
+    }
+  case CHECK_FULL:
+    bad, err := db.VerifySkip()
+    for _, e := range bad {
+      r.Problems = append(r.Problems, e.Error())
+    }
+    if err != nil {
+      r.Problems = append(r.Problems, err.Error())
+    }
+  }
+  switch {
+  case len(r.Problems) > 0:
+    r.Status = STARTUP_NEEDS_FSCK
+  case r.Replayed > 0 || r.TornBytes > 0:
+    r.Status = STARTUP_RECOVERED
+  default:
+    r.Status = STARTUP_CLEAN
+  }
+}
+
+// walk down to the first and the last leaves without panicking
+func startupEdges(db *KV) error {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  if db.tree.root == 0 {
+    return nil // empty
+  }
+  npages := db.page.flushed + uint64(len(db.page.temp))
+  limit := maxDepth(&db.Options, npages)
+  get := func(ptr uint64) (BNode, error) {
+    if ptr == 0 || ptr >= npages {
+      return nil, corruptf(ptr, "pointer out of range")
+    }
+    if page, ok := db.page.updates[ptr]; ok {
+      return BNode(page), nil
+    }
+    if ptr >= db.page.flushed {
+      return BNode(db.page.temp[ptr - db.page.flushed]), nil
+    }
+    page := db.store.ReadPage(ptr, db.tree.pageSize())
+    if err := pageSumCheck(db.sums.crcs, ptr, page); err != nil {
+      return nil, err
+    }
+    if err := nodeCheck(BNode(page)); err != nil {
+      return nil, corruptf(ptr, "%w", err)
+    }
+    return BNode(page), nil
+  }
+  depths := [2]int{}
+  for side := range depths {
+    ptr := db.tree.root
+    for depth := 1; ; depth++ {
+      if depth > limit {
+        return corruptf(ptr, "the tree is deeper than %d", limit)
+      }
+      node, err := get(ptr)
+      if err != nil {
+        return err
+      }
+      if node.btype() == BNODE_LEAF {
+        depths[side] = depth
+        break
+      }
+      if node.btype() != BNODE_NODE || node.nkeys() == 0 {
+        return corruptf(ptr, "bad node")
+      }
+      idx := uint16(0)
+      if side == 1 {
+        idx = node.nkeys() - 1
+      }
+      ptr = node.getPtr(idx)
+    }
+  }
+  if depths[0] != depths[1] {
+    return fmt.Errorf("the first and the last leaves are at depths %d and %d", depths[0], depths[1])
+  }
+  return nil
+}
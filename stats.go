@@ -0,0 +1,93 @@
+package main
+
+import (
+  "encoding/binary"
+)
+
+// the shape of the tree and the I/O counters
+type Stats struct {
+  // the latest version
+  Height        int // 0 for an empty tree
+  InternalPages uint64
+  LeafPages     uint64
+  OverflowPages uint64 // in the B-tree file
+  ColdPages     uint64 // the overflow pages in the cold file, see cold.go
+  Keys          uint64     // KV pairs, not counting the sentinel key
+  Fill          [10]uint64 // tree nodes by the used fraction of the page, in steps of 10%
+  // the file. the pages that aren't reachable from the latest version are
+  // free or kept for the older snapshots, see freelist.go
+  Pages       uint64 // including the master page
+  UnusedPages uint64
+  FreePages   uint64 // reusable or waiting for the readers of older versions
+  FileBytes   int64
+  // since the store was opened
+  PageReads  uint64 // reads from the file, pages of the current update aren't counted
+  PageWrites uint64
+  Splits     uint64 // nodes split in 2 or 3
+  Merges     uint64
+}
+
+func (db *KV) Stats() (Stats, error) {
+  stats := Stats{}
+  db.writer.Lock()
+  stats.Pages = db.page.flushed + uint64(len(db.page.temp))
+  stats.PageWrites = db.stats.writes
+  stats.FreePages = uint64(len(db.free.all()))
+  stats.Splits = db.tree.splits[2] + db.tree.splits[3]
+  stats.Merges = db.tree.merges
+  db.writer.Unlock()
+  if db.store != nil {
+    size, err := db.store.Size()
+    if err != nil {
+      return stats, err
+    }
+    stats.FileBytes = size
+  }
+  // the walk reads pages too, take the counter first
+  stats.PageReads = db.stats.reads.Load()
+  tree, release := db.snapshot()
+  defer release()
+  if tree.root != 0 {
+    statsNode(&tree, tree.root, 1, &stats)
+    stats.Keys-- // the sentinel
+  }
+  used := stats.InternalPages + stats.LeafPages + stats.OverflowPages + 1
+  if stats.Pages > used {
+    stats.UnusedPages = stats.Pages - used
+  }
+  return stats, nil
+}
+
+func (db *DB) Stats() (Stats, error) {
+  return db.kv.Stats()
+}
+
+func statsNode(tree *BTree, ptr uint64, depth int, stats *Stats) {
+  node := BNode(tree.get(ptr))
+  stats.Height = max(stats.Height, depth)
+  stats.Fill[min(9, int(node.nbytes()) * 10 / tree.pageSize())]++
+  nkeys := node.nkeys()
+  if node.btype() == BNODE_NODE {
+    stats.InternalPages++
+    for i := uint16(0); i < nkeys; i++ {
+      statsNode(tree, node.getPtr(i), depth + 1, stats)
+    }
+    return
+  }
+  stats.LeafPages++
+  stats.Keys += uint64(nkeys)
+  for i := uint16(0); i < nkeys; i++ {
+    if !node.isOverflow(i) {
+      continue
+    }
+    ref := node.getVal(i)
+    for ptr := binary.LittleEndian.Uint64(ref[4:]); ptr != 0; {
+      if ptr >> PAGE_FILE_SHIFT == COLD_FILE {
+        stats.ColdPages++
+      } else {
+        stats.OverflowPages++
+      }
+      ptr = binary.LittleEndian.Uint64(overflowPage(tree, ptr)[4:])
+    }
+  }
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "sync"
+  "sync/atomic"
+  "syscall"
+)
+
+// the storage of the B-tree file below the pages, see Options.Store.
+// the checksums, the log and the cold file are still files next to
+// KV.Path. a Store is used by a single KV at a time.
+type Store interface {
+  // the size in bytes
+  Size() (int64, error)
+  // the page at `ptr`, of `size` bytes, for reads only. it stays valid
+  // until Close and can be read concurrently with the writes. only the
+  // written pages are read, an I/O error is a panic like a fault on a mmap.
+  ReadPage(ptr uint64, size int) []byte
+  // write at the offset, the store grows as needed
+  WriteAt(data []byte, off int64) error
+  // make the writes durable
+  Sync() error
+  Close() error
+}
+
+// the default: the file at KV.Path, read through a mmap
+type mmapStore struct {
+  fd     *os.File
+  chunks atomic.Pointer[[][]byte] // multiple mmaps, can be non-continuous
+  total  int                      // mmap size, can be larger than the file size
+  shadow bool                     // see Options.ShadowReads
+}
+
+// map the whole file, with some room to grow.
+func newMmapStore(fd *os.File, shadow bool) (*mmapStore, error) {
+  fi, err := fd.Stat()
+  if err != nil {
+    return nil, fmt.Errorf("stat: %w", err)
+  }
+  size := 64 << 20
+  for size < int(fi.Size()) {
+    size *= 2
+  }
+  chunk, err := syscall.Mmap(int(fd.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+  if err != nil {
+    return nil, fmt.Errorf("mmap: %w", err)
+  }
+  ms := &mmapStore{fd: fd, total: size, shadow: shadow}
+  ms.chunks.Store(&[][]byte{chunk})
+  return ms, nil
+}
+
+func (ms *mmapStore) Size() (int64, error) {
+  fi, err := ms.fd.Stat()
+  if err != nil {
+    return 0, fmt.Errorf("stat: %w", err)
+  }
+  return fi.Size(), nil
+}
+
+func (ms *mmapStore) ReadPage(ptr uint64, size int) []byte {
+  page := mmapPage(*ms.chunks.Load(), ptr, size)
+  if ms.shadow {
+    shadowCheck(ms.fd, ptr, page)
+  }
+  return page
+}
+
+func mmapPage(chunks [][]byte, ptr uint64, size int) []byte {
+  start := uint64(0)
+  for _, chunk := range chunks {
+    end := start + uint64(len(chunk) / size)
+    if ptr < end {
+      offset := uint64(size) * (ptr - start)
+      return chunk[offset:offset+uint64(size)]
+    }
+    start = end
+  }
+  panic("bad ptr")
+}
+
+func (ms *mmapStore) WriteAt(data []byte, off int64) error {
+  if err := ms.extend(int(off) + len(data)); err != nil {
+    return err
+  }
+  if _, err := ms.fd.WriteAt(data, off); err != nil {
+    return err
+  }
+  return nil
+}
+
+// extend the mmap by adding new mappings. the readers keep the old list.
+func (ms *mmapStore) extend(size int) error {
+  for ms.total < size {
+    // double the address space
+    chunk, err := syscall.Mmap(
+      int(ms.fd.Fd()), int64(ms.total), ms.total,
+      syscall.PROT_READ, syscall.MAP_SHARED,
+    )
+    if err != nil {
+      return fmt.Errorf("mmap: %w", err)
+    }
+    ms.total += ms.total
+    chunks := *ms.chunks.Load()
+    chunks = append(chunks[:len(chunks):len(chunks)], chunk)
+    ms.chunks.Store(&chunks)
+  }
+  return nil
+}
+
+// drop the end of the file, the mmap is kept for the file to grow again
+func (ms *mmapStore) Truncate(size int64) error {
+  return ms.fd.Truncate(size)
+}
+
+func (ms *mmapStore) Sync() error {
+  return ms.fd.Sync()
+}
+
+func (ms *mmapStore) Close() error {
+  for _, chunk := range *ms.chunks.Load() {
+    err := syscall.Munmap(chunk)
+    assert(err == nil)
+  }
+  ms.chunks.Store(&[][]byte{})
+  return ms.fd.Close()
+}
+
+// a file read with pread, for the file systems without a coherent mmap.
+// each read is a copy.
+type FileStore struct {
+  fd *os.File
+}
+
+// open the file for a store, like the default one. see Options.Store
+func OpenFileStore(path string, readOnly bool) (*FileStore, error) {
+  flags := os.O_RDWR|os.O_CREATE
+  if readOnly {
+    flags = os.O_RDONLY
+  }
+  fd, err := os.OpenFile(path, flags, 0644)
+  if err != nil {
+    return nil, fmt.Errorf("OpenFile: %w", err)
+  }
+  return &FileStore{fd: fd}, nil
+}
+
+func (fs *FileStore) Size() (int64, error) {
+  fi, err := fs.fd.Stat()
+  if err != nil {
+    return 0, fmt.Errorf("stat: %w", err)
+  }
+  return fi.Size(), nil
+}
+
+func (fs *FileStore) ReadPage(ptr uint64, size int) []byte {
+  page := make([]byte, size)
+  if _, err := fs.fd.ReadAt(page, int64(ptr) * int64(size)); err != nil {
+    panic(fmt.Errorf("page %d: read: %w", ptr, err))
+  }
+  return page
+}
+
+func (fs *FileStore) WriteAt(data []byte, off int64) error {
+  _, err := fs.fd.WriteAt(data, off)
+  return err
+}
+
+func (fs *FileStore) Truncate(size int64) error {
+  return fs.fd.Truncate(size)
+}
+
+func (fs *FileStore) Sync() error {
+  return fs.fd.Sync()
+}
+
+func (fs *FileStore) Close() error {
+  return fs.fd.Close()
+}
+
+// a store in memory, which survives Close. a KV reopened on it sees the
+// synced writes, the others are lost like in a crash.
+type MemStore struct {
+  mu      sync.Mutex
+  data    []byte // the synced bytes
+  pending []byte // with the writes since the last sync
+}
+
+func NewMemStore() *MemStore {
+  return &MemStore{}
+}
+
+func (ms *MemStore) Size() (int64, error) {
+  ms.mu.Lock()
+  defer ms.mu.Unlock()
+  return int64(len(ms.pending)), nil
+}
+
+func (ms *MemStore) ReadPage(ptr uint64, size int) []byte {
+  ms.mu.Lock()
+  defer ms.mu.Unlock()
+  off := int(ptr) * size
+  if off + size > len(ms.pending) {
+    panic(fmt.Errorf("page %d: read past the end", ptr))
+  }
+  return append([]byte(nil), ms.pending[off:off+size]...)
+}
+
+func (ms *MemStore) WriteAt(data []byte, off int64) error {
+  ms.mu.Lock()
+  defer ms.mu.Unlock()
+  if end := int(off) + len(data); end > len(ms.pending) {
+    ms.pending = append(ms.pending, make([]byte, end - len(ms.pending))...)
+  }
+  copy(ms.pending[off:], data)
+  return nil
+}
+
+func (ms *MemStore) Truncate(size int64) error {
+  ms.mu.Lock()
+  defer ms.mu.Unlock()
+  if int(size) < len(ms.pending) {
+    ms.pending = ms.pending[:size]
+  }
+  return nil
+}
+
+func (ms *MemStore) Sync() error {
+  ms.mu.Lock()
+  defer ms.mu.Unlock()
+  ms.data = append(ms.data[:0], ms.pending...)
+  return nil
+}
+
+// the unsynced writes are dropped
+func (ms *MemStore) Close() error {
+  ms.mu.Lock()
+  defer ms.mu.Unlock()
+  ms.pending = append([]byte(nil), ms.data...)
+  return nil
+}
+
+// the store of Options.Store, or the file at Path
+func storeOpen(db *KV) error {
+  if db.Options.Store != nil {
+    db.store = db.Options.Store
+    return nil
+  }
+  fd, err := openFile(db)
+  if err != nil {
+    return err
+  }
+  store, err := newMmapStore(fd, db.Options.ShadowReads)
+  if err != nil {
+    fd.Close()
+    return err
+  }
+  db.store = store
+  return nil
+}
+
+var errCustomStore = errors.New("not with Options.Store")
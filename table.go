@@ -0,0 +1,664 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "sync"
+
+  "database/codec"
+)
+
+// column types
+const (
+  TYPE_ERROR = 0
+  TYPE_BYTES = 1
+  TYPE_INT64 = 2
+)
+
+// table cell
+type Value struct {
+  Type uint32
+  I64  int64
+  Str  []byte
+}
+
+// table row
+type Record struct {
+  Cols []string
+  Vals []Value
+}
+
+func (rec *Record) AddStr(col string, val []byte) *Record {
+  rec.Cols = append(rec.Cols, col)
+  rec.Vals = append(rec.Vals, Value{Type: TYPE_BYTES, Str: val})
+  return rec
+}
+
+func (rec *Record) AddInt64(col string, val int64) *Record {
+  rec.Cols = append(rec.Cols, col)
+  rec.Vals = append(rec.Vals, Value{Type: TYPE_INT64, I64: val})
+  return rec
+}
+
+func (rec *Record) Get(col string) *Value {
+  for i, c := range rec.Cols {
+    if c == col {
+      return &rec.Vals[i]
+    }
+  }
+  return nil
+}
+
+// table definition
+type TableDef struct {
+  // user defined
+  Name  string
+  Types []uint32 // column types
+  Cols  []string // column names
+  PKeys int      // the first `PKeys` columns are the primary key
+  Indexes [][]string // secondary indexes, the primary key is appended
+  Unique  []bool     // the unique indexes, nil for none
+  AutoInc string     // an INT64 column assigned on insert if omitted
+  // auto-assigned B-tree key prefixes for different tables and indexes
+  Prefix        uint32
+  IndexPrefixes []uint32
+  IndexCols     []int // the number of columns of each index before the primary key
+  // how the row values are stored, see policy.go
+  Compression string // "" or COMPRESS_FLATE
+  Encryption  string // "" or the name of a key in DB.Keys
+  // keep the deleted rows until they are purged, see soft.go
+  SoftDelete bool
+}
+
+// internal table: metadata
+var TDEF_META = &TableDef{
+  Prefix: 1,
+  Name:   "@meta",
+  Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
+  Cols:   []string{"key", "val"},
+  PKeys:  1,
+}
+
+// internal table: table schemas
+var TDEF_TABLE = &TableDef{
+  Prefix: 2,
+  Name:   "@table",
+  Types:  []uint32{TYPE_BYTES, TYPE_BYTES},
+  Cols:   []string{"name", "def"},
+  PKeys:  1,
+}
+
+var INTERNAL_TABLES = map[string]*TableDef{
+  "@meta":  TDEF_META,
+  "@table": TDEF_TABLE,
+}
+
+// the first prefix for user tables
+const TABLE_PREFIX_MIN = 100
+
+// a relational DB on top of the KV store
+type DB struct {
+  Path    string
+  Options Options
+  // internals
+  kv     KV
+  rowsMu sync.Mutex
+  rows   map[string]*newRows // the inserts by table, for the warnings
+  // the encryption keys by name, see TableDef.Encryption. they are
+  // not stored, the tables using a missing key can't be read.
+  Keys   map[string][]byte
+  subsMu sync.Mutex
+  subs   map[int]func(CommitInfo) // see SubscribeCommits
+  nsubs  int
+}
+
+// DB transaction
+type DBTX struct {
+  kv     KVTX
+  db     *DB
+  tables map[string]*TableDef // table definitions read by this transaction
+  schema uint64               // the catalog version of `tables` in read committed mode
+  ddl    bool                 // changed the catalog, see schema.go
+  base   uint64               // the catalog version of the writes
+  based  bool                 // `base` is read
+  lastID int64                // see LastInsertID()
+}
+
+func (db *DB) Open() error {
+  db.kv.Path = db.Path
+  db.kv.Options = db.Options
+  return db.kv.Open()
+}
+
+func (db *DB) Close() {
+  db.kv.Close()
+}
+
+func (db *DB) Begin(tx *DBTX) {
+  tx.db = db
+  tx.tables = map[string]*TableDef{}
+  schemaBegin(tx)
+  db.kv.Begin(&tx.kv)
+}
+
+func (db *DB) Commit(tx *DBTX) error {
+  return db.CommitCtx(context.Background(), tx)
+}
+
+func (db *DB) CommitCtx(ctx context.Context, tx *DBTX) error {
+  if fns := db.subscribers(); len(fns) > 0 {
+    tx.kv.committed = func(version uint64) { notifyCommit(tx, version, fns) }
+  }
+  if tx.based {
+    tx.kv.precommit = func() error { return schemaConflict(tx) }
+  }
+  return db.kv.CommitCtx(ctx, &tx.kv)
+}
+
+func (db *DB) Abort(tx *DBTX) {
+  db.kv.Abort(&tx.kv)
+}
+
+// get a single row by the primary key
+func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return false, errNoTable(table)
+  }
+  return dbGet(tx, tdef, rec)
+}
+
+// modes of the updates
+const (
+  MODE_UPSERT      = 0 // insert or replace
+  MODE_UPDATE_ONLY = 1 // update existing rows
+  MODE_INSERT_ONLY = 2 // only add new rows
+)
+
+// add a row, returns false if the primary key exists.
+// a conflict on a unique index is an *ErrDuplicateKey.
+func (tx *DBTX) Insert(table string, rec Record) (bool, error) {
+  return tx.Set(table, rec, MODE_INSERT_ONLY)
+}
+
+// replace a row, returns false if the primary key doesn't exist.
+func (tx *DBTX) Update(table string, rec Record) (bool, error) {
+  return tx.Set(table, rec, MODE_UPDATE_ONLY)
+}
+
+// add or replace a row
+func (tx *DBTX) Upsert(table string, rec Record) (bool, error) {
+  return tx.Set(table, rec, MODE_UPSERT)
+}
+
+func (tx *DBTX) Set(table string, rec Record, mode int) (bool, error) {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return false, errNoTable(table)
+  }
+  return dbUpdate(tx, tdef, rec, mode)
+}
+
+// delete a row by the primary key
+func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+  tdef := getTableDef(tx, table)
+  if tdef == nil {
+    return false, errNoTable(table)
+  }
+  return dbDelete(tx, tdef, rec)
+}
+
+// create a new table. on success tdef gets the prefixes, and the columns
+// and the indexes as stored. it's not changed on error.
+func (tx *DBTX) TableNew(tdef *TableDef) error {
+  def := tableDefCopy(tdef)
+  if err := tableNew(tx, def); err != nil {
+    return err
+  }
+  *tdef = *def
+  return nil
+}
+
+func tableNew(tx *DBTX, tdef *TableDef) error {
+  if err := tableDefCheck(tdef); err != nil {
+    return err
+  }
+  if err := rowPolicyCheck(tx.db, tdef); err != nil {
+    return err
+  }
+  schemaUse(tx)
+  if tdef.SoftDelete {
+    if colIndex(tdef, SOFT_DELETE_COL) >= 0 {
+      return fmt.Errorf("reserved column name: %s", SOFT_DELETE_COL)
+    }
+    tdef.Cols = append(tdef.Cols, SOFT_DELETE_COL)
+    tdef.Types = append(tdef.Types, TYPE_INT64)
+  }
+  // check the existing table
+  table := (&Record{}).AddStr("name", []byte(tdef.Name))
+  ok, err := dbGet(tx, TDEF_TABLE, table)
+  assert(err == nil)
+  if ok {
+    return fmt.Errorf("table exists: %s", tdef.Name)
+  }
+  for i, index := range tdef.Indexes {
+    tdef.IndexCols = append(tdef.IndexCols, len(index))
+    tdef.Indexes[i] = indexWithPKey(tdef, index)
+  }
+  // allocate new prefixes
+  if tdef.Prefix, err = prefixAlloc(tx, 1 + len(tdef.Indexes)); err != nil {
+    return err
+  }
+  for i := range tdef.Indexes {
+    tdef.IndexPrefixes = append(tdef.IndexPrefixes, tdef.Prefix + 1 + uint32(i))
+  }
+  if err := tableDefSave(tx, tdef); err != nil {
+    return err
+  }
+  return schemaBump(tx)
+}
+
+// the primary key is appended to the indexes, so index keys are unique
+func indexWithPKey(tdef *TableDef, index []string) []string {
+  for _, col := range tdef.Cols[:tdef.PKeys] {
+    if !contains(index, col) {
+      index = append(index, col)
+    }
+  }
+  return index
+}
+
+// allocate `n` consecutive prefixes, they are never reused
+func prefixAlloc(tx *DBTX, n int) (uint32, error) {
+  prefix := uint32(TABLE_PREFIX_MIN)
+  meta := (&Record{}).AddStr("key", []byte("next_prefix"))
+  ok, err := dbGet(tx, TDEF_META, meta)
+  assert(err == nil)
+  if ok {
+    prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
+    assert(prefix > TABLE_PREFIX_MIN)
+  } else {
+    meta.AddStr("val", nil)
+  }
+  // update the next prefix. the old value may point into the read-only mmap.
+  next := make([]byte, 4)
+  binary.LittleEndian.PutUint32(next, prefix + uint32(n))
+  meta.Get("val").Str = next
+  _, err = dbUpdate(tx, TDEF_META, *meta, MODE_UPSERT)
+  return prefix, err
+}
+
+// store the definition
+func tableDefSave(tx *DBTX, tdef *TableDef) error {
+  val, err := json.Marshal(tdef)
+  assert(err == nil)
+  table := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
+  _, err = dbUpdate(tx, TDEF_TABLE, *table, MODE_UPSERT)
+  return err
+}
+
+func tableDefCheck(tdef *TableDef) error {
+  bad := tdef.Name == "" || len(tdef.Cols) == 0 || len(tdef.Cols) != len(tdef.Types)
+  bad = bad || !(1 <= tdef.PKeys && tdef.PKeys <= len(tdef.Cols))
+  bad = bad || tdef.Prefix != 0 || len(tdef.IndexPrefixes) != 0 || len(tdef.IndexCols) != 0
+  bad = bad || (tdef.Unique != nil && len(tdef.Unique) != len(tdef.Indexes))
+  if bad {
+    return fmt.Errorf("bad table definition: %s", tdef.Name)
+  }
+  if tdef.Name[0] == '@' {
+    return fmt.Errorf("reserved table name: %s", tdef.Name)
+  }
+  seen := map[string]bool{}
+  for i, col := range tdef.Cols {
+    if col == "" || seen[col] {
+      return fmt.Errorf("bad column name: %q", col)
+    }
+    seen[col] = true
+    if tdef.Types[i] != TYPE_BYTES && tdef.Types[i] != TYPE_INT64 {
+      return fmt.Errorf("bad column type: %s", col)
+    }
+  }
+  for _, index := range tdef.Indexes {
+    if err := indexCheck(tdef, index); err != nil {
+      return err
+    }
+  }
+  if tdef.AutoInc != "" {
+    idx := colIndex(tdef, tdef.AutoInc)
+    if idx < 0 || tdef.Types[idx] != TYPE_INT64 {
+      return fmt.Errorf("bad auto-increment column: %s", tdef.AutoInc)
+    }
+  }
+  return nil
+}
+
+// the columns exist and are not repeated
+func indexCheck(tdef *TableDef, index []string) error {
+  if len(index) == 0 {
+    return fmt.Errorf("bad index: %v", index)
+  }
+  for i, col := range index {
+    if colIndex(tdef, col) < 0 || contains(index[:i], col) {
+      return fmt.Errorf("bad index: %v", index)
+    }
+  }
+  return nil
+}
+
+func contains(cols []string, col string) bool {
+  for _, c := range cols {
+    if c == col {
+      return true
+    }
+  }
+  return false
+}
+
+// get the table definition by name
+func getTableDef(tx *DBTX, name string) *TableDef {
+  if tdef, ok := INTERNAL_TABLES[name]; ok {
+    return tdef // expose internal tables
+  }
+  schemaUse(tx)
+  schemaCheck(tx)
+  tdef := tx.tables[name]
+  if tdef == nil {
+    if tdef = getTableDefDB(tx, name); tdef != nil {
+      tx.tables[name] = tdef
+    }
+  }
+  return tdef
+}
+
+func getTableDefDB(tx *DBTX, name string) *TableDef {
+  rec := (&Record{}).AddStr("name", []byte(name))
+  ok, err := dbGet(tx, TDEF_TABLE, rec)
+  assert(err == nil)
+  if !ok {
+    return nil
+  }
+  tdef := &TableDef{}
+  err = json.Unmarshal(rec.Get("def").Str, tdef)
+  assert(err == nil)
+  return tdef
+}
+
+// reorder a record and check for missing columns.
+// n == tdef.PKeys: record is exactly a primary key
+// n == len(tdef.Cols): record contains all columns
+func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
+  // the soft delete column is optional, see soft.go
+  hidden := tdef.SoftDelete && n == len(tdef.Cols) && len(rec.Cols) == n - 1
+  if len(rec.Cols) != len(rec.Vals) || (len(rec.Cols) != n && !hidden) {
+    return nil, fmt.Errorf("expect %d columns", len(visibleCols(tdef)))
+  }
+  values := make([]Value, len(tdef.Cols))
+  found := make([]bool, len(tdef.Cols))
+  for i, col := range rec.Cols {
+    idx := colIndex(tdef, col)
+    if idx < 0 || idx >= n || found[idx] {
+      return nil, fmt.Errorf("bad column: %s", col)
+    }
+    if rec.Vals[i].Type != tdef.Types[idx] {
+      return nil, fmt.Errorf("bad column type: %s", col)
+    }
+    values[idx] = rec.Vals[i]
+    found[idx] = true
+  }
+  if hidden {
+    if found[n-1] {
+      return nil, fmt.Errorf("expect %d columns", n - 1)
+    }
+    values[n-1] = Value{Type: TYPE_INT64}
+  }
+  return values, nil
+}
+
+func colIndex(tdef *TableDef, col string) int {
+  for i, c := range tdef.Cols {
+    if c == col {
+      return i
+    }
+  }
+  return -1
+}
+
+// get a single row by the primary key
+func dbGet(tx *DBTX, tdef *TableDef, rec *Record) (bool, error) {
+  return dbGetAll(tx, tdef, rec, false)
+}
+
+// like dbGet, `deleted` includes the soft-deleted rows
+func dbGetAll(tx *DBTX, tdef *TableDef, rec *Record, deleted bool) (bool, error) {
+  values, err := checkRecord(tdef, *rec, tdef.PKeys)
+  if err != nil {
+    return false, err
+  }
+  key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+  val, ok := tx.kv.Get(key)
+  if !ok {
+    return false, nil
+  }
+  if val, err = rowDecode(tx, tdef, key, val); err != nil {
+    return false, err
+  }
+  for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+    values[i].Type = tdef.Types[i]
+  }
+  if err := decodeValues(val, values[tdef.PKeys:]); err != nil {
+    return false, err
+  }
+  if !deleted && softDeleted(tdef, values) {
+    return false, nil
+  }
+  rec.Cols = tdef.Cols
+  rec.Vals = values
+  return true, nil
+}
+
+// add a row to the table, along with its index entries
+func dbUpdate(tx *DBTX, tdef *TableDef, rec Record, mode int) (bool, error) {
+  if tdef.AutoInc != "" && mode != MODE_UPDATE_ONLY {
+    var err error
+    if rec, err = autoIncAssign(tx, tdef, rec); err != nil {
+      return false, err
+    }
+  }
+  values, err := checkRecord(tdef, rec, len(tdef.Cols))
+  if err != nil {
+    return false, err
+  }
+  key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+  val, err := rowEncode(tx, tdef, key, encodeValues(nil, values[tdef.PKeys:]))
+  if err != nil {
+    return false, err
+  }
+  old, exists, err := dbGetRow(tx, tdef, values)
+  if err != nil {
+    return false, err
+  }
+  // a soft-deleted row is replaced like a missing one
+  live := exists && !softDeleted(tdef, old)
+  if (mode == MODE_INSERT_ONLY && live) || (mode == MODE_UPDATE_ONLY && !live) {
+    return false, nil
+  }
+  if err := checkUnique(tx, tdef, values, old, exists); err != nil {
+    return false, err
+  }
+  writes := []kvWrite{{key: key, val: val}}
+  for i, index := range tdef.Indexes {
+    ikey := encodeKey(nil, tdef.IndexPrefixes[i], indexValues(tdef, values, index))
+    if exists {
+      // the index entry is only replaced if it changes
+      okey := encodeKey(nil, tdef.IndexPrefixes[i], indexValues(tdef, old, index))
+      if bytes.Equal(okey, ikey) {
+        continue
+      }
+      writes = append(writes, kvWrite{key: okey, del: true})
+    }
+    writes = append(writes, kvWrite{key: ikey})
+  }
+  // nothing is counted for a row over the limits
+  if err := checkWrites(writes); err != nil {
+    return false, err
+  }
+  if tdef.AutoInc != "" && !exists {
+    if err := autoIncUpdate(tx, tdef, values); err != nil {
+      return false, err
+    }
+  }
+  if !exists && tx.db != nil {
+    tx.db.countNewRow(tdef, values)
+  }
+  return true, applyWrites(tx, writes)
+}
+
+// delete a row by the primary key, along with its index entries
+func dbDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
+  if !tdef.SoftDelete {
+    return dbRemove(tx, tdef, rec)
+  }
+  values, err := checkRecord(tdef, rec, tdef.PKeys)
+  if err != nil {
+    return false, err
+  }
+  old, exists, err := dbGetRow(tx, tdef, values)
+  if err != nil || !exists || softDeleted(tdef, old) {
+    return false, err
+  }
+  return true, dbSoftDelete(tx, tdef, old)
+}
+
+// delete a row for good
+func dbRemove(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
+  values, err := checkRecord(tdef, rec, tdef.PKeys)
+  if err != nil {
+    return false, err
+  }
+  old, exists, err := dbGetRow(tx, tdef, values)
+  if err != nil || !exists {
+    return false, err
+  }
+  key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+  writes := []kvWrite{{key: key, del: true}}
+  for i, index := range tdef.Indexes {
+    ikey := encodeKey(nil, tdef.IndexPrefixes[i], indexValues(tdef, old, index))
+    writes = append(writes, kvWrite{key: ikey, del: true})
+  }
+  return true, applyWrites(tx, writes)
+}
+
+// read the full row with the primary key from `values`, soft-deleted or not
+func dbGetRow(tx *DBTX, tdef *TableDef, values []Value) ([]Value, bool, error) {
+  rec := Record{Cols: tdef.Cols[:tdef.PKeys], Vals: values[:tdef.PKeys]}
+  ok, err := dbGetAll(tx, tdef, &rec, true)
+  return rec.Vals, ok, err
+}
+
+// a KV update of a row or an index entry
+type kvWrite struct {
+  key []byte
+  val []byte
+  del bool
+}
+
+// the columns of an index, in the order of the index
+func indexValues(tdef *TableDef, values []Value, index []string) []Value {
+  out := make([]Value, len(index))
+  for i, col := range index {
+    out[i] = values[colIndex(tdef, col)]
+  }
+  return out
+}
+
+// apply the KV updates of a row. all of them are checked first,
+// so a bad row is rejected as a whole instead of being partially written.
+func applyWrites(tx *DBTX, writes []kvWrite) error {
+  if err := checkWrites(writes); err != nil {
+    return err
+  }
+  for _, w := range writes {
+    var err error
+    if w.del {
+      _, err = tx.kv.Del(w.key)
+    } else {
+      err = tx.kv.Set(w.key, w.val)
+    }
+    assert(err == nil) // checked above
+  }
+  return nil
+}
+
+func checkWrites(writes []kvWrite) error {
+  for _, w := range writes {
+    if err := checkLimit(w.key, w.val); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// a row is stored as a KV pair:
+// key: | table prefix | primary key columns |
+// val: | the rest of the columns |
+// the encoding is order-preserving, so keys compare with memcmp
+// in the same order as the tuples of values:
+// INT64 is big-endian with the sign bit flipped,
+// BYTES is escaped and terminated by a null byte, see the codec package.
+func encodeValues(out []byte, vals []Value) []byte {
+  for _, v := range vals {
+    switch v.Type {
+    case TYPE_INT64:
+      out = codec.AppendInt64(out, v.I64)
+    case TYPE_BYTES:
+      out = codec.AppendBytes(out, v.Str)
+    default:
+      panic("what?")
+    }
+  }
+  return out
+}
+
+// the types are taken from `out`
+func decodeValues(in []byte, out []Value) error {
+  var err error
+  for i := range out {
+    switch out[i].Type {
+    case TYPE_INT64:
+      out[i].I64, in, err = codec.Int64(in)
+    case TYPE_BYTES:
+      out[i].Str, in, err = codec.Bytes(in)
+    default:
+      panic("what?")
+    }
+    if err != nil {
+      return errors.New("bad value encoding")
+    }
+  }
+  if len(in) != 0 {
+    return errors.New("bad value encoding")
+  }
+  return nil
+}
+
+// for primary keys and other ordered keys
+func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
+  var buf [4]byte
+  binary.BigEndian.PutUint32(buf[:], prefix)
+  out = append(out, buf[:]...)
+  out = encodeValues(out, vals)
+  return out
+}
+
+// the reverse of encodeKey, the types are taken from `out`
+func decodeKey(in []byte, out []Value) (uint32, error) {
+  if len(in) < 4 {
+    return 0, errors.New("bad key encoding")
+  }
+  prefix := binary.BigEndian.Uint32(in[:4])
+  return prefix, decodeValues(in[4:], out)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "strings"
+  "testing"
+)
+
+// a row over the limits doesn't take an auto-increment id nor is counted
+func TestInsertTooLarge(t *testing.T) {
+  db := &DB{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  tx := DBTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  tdef := &TableDef{
+    Name: "t", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "v"},
+    PKeys: 1, AutoInc: "id", Indexes: [][]string{{"v"}},
+  }
+  if err := tx.TableNew(tdef); err != nil {
+    t.Fatal(err)
+  }
+  // the index key is over the limit
+  big := make([]byte, BTREE_MAX_KEY_SIZE + 1)
+  if _, err := tx.Insert("t", *(&Record{}).AddStr("v", big)); !errors.Is(err, ErrTooLarge) {
+    t.Fatal(err)
+  }
+  if db.rows["t"] != nil {
+    t.Fatal("counted")
+  }
+  if _, err := tx.Insert("t", *(&Record{}).AddStr("v", []byte("x"))); err != nil {
+    t.Fatal(err)
+  }
+  if id := tx.LastInsertID(); id != 1 {
+    t.Fatalf("id %d", id)
+  }
+  if db.rows["t"].total != 1 {
+    t.Fatal(db.rows["t"].total)
+  }
+}
+
+// a failed TableNew leaves the definition as it was, it can be used again
+func TestTableNewFailed(t *testing.T) {
+  db := &DB{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  tx := DBTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  newDef := func() *TableDef {
+    index := make([]string, 1, 4) // room for the primary key
+    index[0] = "v"
+    return &TableDef{
+      Name: "t", Types: []uint32{TYPE_INT64, TYPE_BYTES}, Cols: []string{"id", "v"},
+      PKeys: 1, Indexes: [][]string{index}, SoftDelete: true,
+    }
+  }
+  if err := tx.TableNew(newDef()); err != nil {
+    t.Fatal(err)
+  }
+  tdef := newDef()
+  index := tdef.Indexes[0]
+  if err := tx.TableNew(tdef); err == nil {
+    t.Fatal("table exists")
+  }
+  if len(tdef.Cols) != 2 || len(tdef.Types) != 2 || tdef.Prefix != 0 || tdef.IndexCols != nil {
+    t.Fatalf("changed: %+v", tdef)
+  }
+  if len(tdef.Indexes[0]) != 1 || index[:2][1] != "" {
+    t.Fatalf("index changed: %v", index[:2])
+  }
+  tdef.Name = "u"
+  if err := tx.TableNew(tdef); err != nil {
+    t.Fatal(err)
+  }
+  if tdef.Prefix == 0 || len(tdef.Cols) != 3 || len(tdef.Indexes[0]) != 2 || index[:2][1] != "" {
+    t.Fatalf("%+v", tdef)
+  }
+}
+
+// the plan of a write lists the lookup of each unique index it may change
+func TestExplainUnique(t *testing.T) {
+  db := &DB{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  s := &QLSession{DB: db}
+  if _, err := s.Exec("CREATE TABLE t (id int64, a bytes, b bytes, c bytes, PRIMARY KEY (id), UNIQUE (a), UNIQUE (b, c), INDEX (c));"); err != nil {
+    t.Fatal(err)
+  }
+  cases := []struct {
+    query  string
+    unique []string
+  }{
+    {"INSERT INTO t (id, a, b, c) VALUES (1, 'a', 'b', 'c');", []string{"(a)", "(b, c)"}},
+    {"UPDATE t SET a = 'x' WHERE id = 1;", []string{"(a)"}},
+    {"UPDATE t SET c = 'x' WHERE id = 1;", []string{"(b, c)"}},
+    {"UPDATE t SET id = 2 WHERE id = 1;", []string{"(a)", "(b, c)"}},
+    {"DELETE FROM t WHERE id = 1;", nil},
+  }
+  tx := DBTX{}
+  db.Begin(&tx)
+  defer db.Abort(&tx)
+  for _, c := range cases {
+    plan, err := tx.Explain(c.query)
+    if err != nil {
+      t.Fatal(c.query, err)
+    }
+    var got []string
+    for _, line := range plan {
+      if cols, ok := strings.CutPrefix(line, "check: unique index "); ok {
+        got = append(got, strings.TrimSuffix(cols, ", a lookup per row"))
+      }
+    }
+    if fmt.Sprint(got) != fmt.Sprint(c.unique) {
+      t.Fatalf("%s: %q", c.query, plan)
+    }
+  }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+  "fmt"
+  "sync"
+)
+
+// a step of a tree update. the events of an insert or a delete are:
+// the update, then the page reads, splits, merges, allocations and
+// deallocations in the order they happen.
+type TraceEvent struct {
+  Op      string
+  Ptr     uint64 // the page
+  Key     []byte // of TRACE_INSERT and TRACE_DELETE
+  Nodes   int    // of TRACE_SPLIT
+  Sibling uint64 // of TRACE_MERGE
+}
+
+const (
+  TRACE_INSERT = "insert" // an update of the key begins
+  TRACE_DELETE = "delete"
+  TRACE_READ   = "read"   // a page is read
+  TRACE_NEW    = "new"    // a page is allocated
+  TRACE_FREE   = "free"   // a page is deallocated
+  TRACE_SPLIT  = "split"  // the updated node at the page is split in Nodes
+  TRACE_MERGE  = "merge"  // the updated node at the page is merged with the sibling
+  TRACE_GROW   = "grow"   // a new root at the page, the tree is 1 level taller
+  TRACE_SHRINK = "shrink" // the root is replaced by its only kid at the page
+)
+
+func (ev TraceEvent) String() string {
+  switch ev.Op {
+  case TRACE_INSERT, TRACE_DELETE:
+    return fmt.Sprintf("%s %q", ev.Op, ev.Key)
+  case TRACE_SPLIT:
+    return fmt.Sprintf("split page %d into %d", ev.Ptr, ev.Nodes)
+  case TRACE_MERGE:
+    return fmt.Sprintf("merge page %d with page %d", ev.Ptr, ev.Sibling)
+  default:
+    return fmt.Sprintf("%s page %d", ev.Op, ev.Ptr)
+  }
+}
+
+// the page callbacks without tracing
+type tracedPages struct {
+  get func(uint64) []byte
+  new func([]byte) uint64
+  del func(uint64)
+}
+
+// call fn on each event of the updates, nil to stop. the page callbacks
+// must be set, and are not to be replaced while tracing.
+// a nested update, e.g. an overflow value, is traced too.
+func (tree *BTree) SetTrace(fn func(TraceEvent)) {
+  if tree.untraced != nil {
+    tree.get, tree.new, tree.del = tree.untraced.get, tree.untraced.new, tree.untraced.del
+    tree.untraced = nil
+  }
+  tree.trace = fn
+  if fn == nil {
+    return
+  }
+  get, new, del := tree.get, tree.new, tree.del
+  tree.untraced = &tracedPages{get: get, new: new, del: del}
+  tree.get = func(ptr uint64) []byte {
+    fn(TraceEvent{Op: TRACE_READ, Ptr: ptr})
+    return get(ptr)
+  }
+  tree.new = func(node []byte) uint64 {
+    ptr := new(node)
+    fn(TraceEvent{Op: TRACE_NEW, Ptr: ptr})
+    return ptr
+  }
+  tree.del = func(ptr uint64) {
+    fn(TraceEvent{Op: TRACE_FREE, Ptr: ptr})
+    del(ptr)
+  }
+}
+
+func (tree *BTree) emit(ev TraceEvent) {
+  if tree.trace != nil {
+    tree.trace(ev)
+  }
+}
+
+// trace the updates of the store, see BTree.SetTrace
+func (db *KV) SetTrace(fn func(TraceEvent)) {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  db.tree.SetTrace(fn)
+}
+
+// collects the events, e.g. for a test
+type TraceLog struct {
+  mu     sync.Mutex
+  Events []TraceEvent
+}
+
+func (log *TraceLog) Add(ev TraceEvent) {
+  log.mu.Lock()
+  defer log.mu.Unlock()
+  // the key may be reused by the caller
+  ev.Key = append([]byte(nil), ev.Key...)
+  log.Events = append(log.Events, ev)
+}
+
+// the events of an op
+func (log *TraceLog) Count(op string) int {
+  log.mu.Lock()
+  defer log.mu.Unlock()
+  n := 0
+  for _, ev := range log.Events {
+    if ev.Op == op {
+      n++
+    }
+  }
+  return n
+}
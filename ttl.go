@@ -0,0 +1,186 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "time"
+)
+
+// an expiring value is prefixed by its expiry time in the leaf, marked by
+// the 2nd highest bit of the value size. an expired key stays in the tree
+// until it's swept, but lookups and iterators skip it.
+// value: | expires 8B | value or overflow reference |
+// the expiry time is in unix nanoseconds.
+const (
+  VAL_EXPIRES  = uint16(1 << 14)
+  EXPIRES_SIZE = 8
+)
+
+// the time for the expiry times, see hlcClock
+func (tree *BTree) now() int64 {
+  if tree.clock == nil {
+    return hlc.now()
+  }
+  return tree.clock.now()
+}
+
+// the expiry time of a KV, 0 if it doesn't expire
+func (node BNode) expires(idx uint16) int64 {
+  assert(idx < node.nkeys())
+  pos := node.kvPos(idx)
+  if binary.LittleEndian.Uint16(node[pos+2:]) & VAL_EXPIRES == 0 {
+    return 0
+  }
+  klen := binary.LittleEndian.Uint16(node[pos+0:])
+  return int64(binary.LittleEndian.Uint64(node[pos+4+klen:]))
+}
+
+// expired at `now`
+func (node BNode) expired(idx uint16, now int64) bool {
+  t := node.expires(idx)
+  return t != 0 && t <= now
+}
+
+// expired by the clock of the tree, which is only read for the keys that expire
+func (tree *BTree) expired(node BNode, idx uint16) bool {
+  t := node.expires(idx)
+  return t != 0 && t <= tree.now()
+}
+
+// the value in the leaf format, see BTree.updateExpiring
+func withExpires(val []byte, vflag uint16, expires int64) ([]byte, uint16) {
+  if expires == 0 {
+    return val, vflag
+  }
+  out := make([]byte, EXPIRES_SIZE + len(val))
+  binary.LittleEndian.PutUint64(out[0:], uint64(expires))
+  copy(out[EXPIRES_SIZE:], val)
+  return out, vflag | VAL_EXPIRES
+}
+
+func ttlExpires(clock *hlcClock, ttl time.Duration) (int64, error) {
+  if ttl <= 0 {
+    return 0, errors.New("bad TTL")
+  }
+  return clock.now() + int64(ttl), nil
+}
+
+// the expiry time of the current key, 0 if it doesn't expire
+func (iter *BIter) Expires() int64 {
+  assert(iter.Valid())
+  return iter.path[len(iter.path)-1].expires(iter.pos[len(iter.pos)-1])
+}
+
+// expired keys are hidden, at or past the current key in the direction.
+// the time is fixed when the iterator is created.
+func (iter *BIter) skipExpired(dir int) {
+  for iter.Valid() && iter.path[len(iter.path)-1].expired(iter.pos[len(iter.pos)-1], iter.now) {
+    if dir > 0 {
+      iter.next()
+    } else {
+      iter.prev()
+    }
+  }
+}
+
+// insert or update a key that expires after the TTL
+func (db *KV) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+  expires, err := ttlExpires(db.clock, ttl)
+  if err != nil {
+    return err
+  }
+  if err := checkLimit(key, val); err != nil {
+    return err
+  }
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  meta := saveMeta(db)
+  db.tree.updateExpiring(key, val, expires)
+  walLogExpiring(db, key, val, expires)
+  keyEvent(db, key, KEY_SET)
+  return updateOrRevert(db, meta)
+}
+
+// like KV.SetWithTTL, the TTL starts now and not at the commit
+func (tx *KVTX) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+  assert(!tx.done)
+  expires, err := ttlExpires(tx.db.clock, ttl)
+  if err != nil {
+    return err
+  }
+  if err := checkLimit(key, val); err != nil {
+    return err
+  }
+  pending := make([]byte, 1 + EXPIRES_SIZE + len(val))
+  pending[0] = FLAG_EXPIRING
+  binary.LittleEndian.PutUint64(pending[1:], uint64(expires))
+  copy(pending[1+EXPIRES_SIZE:], val)
+  tx.pending.update(key, pending)
+  return nil
+}
+
+// a pending update as the value, false if it's deleted or expired by the
+// clock of the tree
+func pendingVal(val []byte, tree *BTree) ([]byte, bool) {
+  switch val[0] {
+  case FLAG_UPDATED:
+    return val[1:], true
+  case FLAG_DELETED:
+    return nil, false
+  case FLAG_EXPIRING:
+    live := int64(binary.LittleEndian.Uint64(val[1:])) > tree.now()
+    return val[1+EXPIRES_SIZE:], live
+  default:
+    panic("bad pending update")
+  }
+}
+
+// delete the expired keys, returns the number of keys deleted, 0 if the
+// commit fails. the whole tree is read, the keys are deleted in one commit.
+// their pages are reused by the later updates, see freelist.go.
+func (db *KV) Sweep() (int, error) {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  var keys [][]byte
+  if db.tree.root != 0 {
+    keys = sweepNode(&db.tree, db.tree.root, db.clock.now(), keys)
+  }
+  if len(keys) == 0 {
+    return 0, nil
+  }
+  meta := saveMeta(db)
+  count := 0
+  for _, key := range keys {
+    deleted, err := db.tree.Delete(key)
+    if err != nil {
+      revertMeta(db, meta)
+      return 0, err
+    }
+    if !deleted {
+      continue
+    }
+    count++
+    walLog(db, key, nil, true)
+    // published by the commit, dropped by a revert
+    keyEvent(db, key, KEY_EXPIRED)
+  }
+  if err := updateOrRevert(db, meta); err != nil {
+    return 0, err
+  }
+  return count, nil
+}
+
+// collect the expired keys of a subtree
+func sweepNode(tree *BTree, ptr uint64, now int64, keys [][]byte) [][]byte {
+  node := BNode(tree.get(ptr))
+  for i := uint16(0); i < node.nkeys(); i++ {
+    if node.btype() == BNODE_NODE {
+      keys = sweepNode(tree, node.getPtr(i), now, keys)
+    } else if node.expired(i, now) {
+      // copied, the node is replaced by the deletions
+      keys = append(keys, bytes.Clone(node.getKey(i)))
+    }
+  }
+  return keys
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// the events of Sweep are published by its commit
+func TestSweepEvents(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "db")
+  clock := NewManualClock(time.Unix(1000, 0))
+  db := &KV{Path: path, Options: Options{Clock: clock}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  for _, key := range []string{"a", "b"} {
+    if err := db.SetWithTTL([]byte(key), []byte("v"), time.Minute); err != nil {
+      t.Fatal(err)
+    }
+  }
+  db.Set([]byte("c"), []byte("v"))
+  db.Close()
+  clock.Advance(time.Minute)
+
+  db = &KV{Path: path, Options: Options{Clock: clock, ReadOnly: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  var events []KeyEvent
+  db.SubscribeKeys(nil, func(ev KeyEvent) { events = append(events, ev) })
+  if n, err := db.Sweep(); n != 0 || !errors.Is(err, ErrReadOnly) {
+    t.Fatal(n, err)
+  }
+  if len(events) != 0 {
+    t.Fatalf("%d events of a failed commit", len(events))
+  }
+  db.Close()
+
+  db = &KV{Path: path, Options: Options{Clock: clock}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  db.SubscribeKeys(nil, func(ev KeyEvent) { events = append(events, ev) })
+  if n, err := db.Sweep(); n != 2 || err != nil {
+    t.Fatal(n, err)
+  }
+  if len(events) != 2 || events[0].Event != KEY_EXPIRED || string(events[1].Key) != "b" {
+    t.Fatalf("%+v", events)
+  }
+  if st, _ := db.Stats(); st.Keys != 1 {
+    t.Fatal(st.Keys)
+  }
+}
+
+// the pages of the swept keys, with their overflow pages, are reused
+func TestSweepReuse(t *testing.T) {
+  clock := NewManualClock(time.Unix(1000, 0))
+  db := &KV{Path: filepath.Join(t.TempDir(), "db"), Options: Options{Clock: clock}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  set := func(prefix string, ttl time.Duration) {
+    t.Helper()
+    for i := 0; i < 1000; i++ {
+      key, val := []byte(fmt.Sprintf("%s%04d", prefix, i)), make([]byte, 100)
+      if i % 100 == 0 {
+        val = make([]byte, 3 * BTREE_MAX_VAL_SIZE)
+      }
+      var err error
+      if ttl > 0 {
+        err = db.SetWithTTL(key, val, ttl)
+      } else {
+        err = db.Set(key, val)
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+    }
+  }
+  set("a", time.Minute)
+  clock.Advance(time.Minute)
+  before := freeStats(t, db)
+  if n, err := db.Sweep(); n != 1000 || err != nil {
+    t.Fatal(n, err)
+  }
+  swept := freeStats(t, db)
+  if swept.Keys != 0 || swept.FreePages < before.LeafPages + before.OverflowPages {
+    t.Fatalf("%+v, before %+v", swept, before)
+  }
+  set("b", 0)
+  if st := freeStats(t, db); st.Keys != 1000 || st.Pages > swept.Pages {
+    t.Fatalf("%+v, after the sweep %+v", st, swept)
+  }
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/binary"
+  "fmt"
+)
+
+// KV transaction
+type KVTX struct {
+  db      *KV
+  version uint64 // the version of the snapshot
+  // a read-only view of the tree at the start of the transaction.
+  // pages are copy-on-write, so later commits don't change it.
+  snapshot BTree
+  // captured KV updates, the values are prefixed by a 1-byte flag.
+  pending BTree
+  done    bool
+  // read committed, see BeginReadCommitted
+  readCommitted bool
+  held          int    // HoldSnapshot() nesting
+  pinned        *BTree // the version being held
+  // called after the commit with the writer lock held, see SubscribeCommits
+  committed func(version uint64)
+  // called before the commit with the writer lock held, it can fail it
+  precommit func() error
+  // serializable, see serial.go
+  serializable bool
+  reads        []*readRange
+  // throttled for the others, see priority.go
+  batch bool
+  // the id in the lock manager, the later transactions have larger ones
+  id     uint64
+  locked bool // took a lock, see KVTX.Lock
+}
+
+// flags of the pending updates
+const (
+  FLAG_UPDATED  = byte(1)
+  FLAG_DELETED  = byte(2)
+  FLAG_EXPIRING = byte(3) // followed by the expiry time, see ttl.go
+)
+
+// begin a transaction
+func (db *KV) Begin(tx *KVTX) {
+  tx.db = db
+  db.mu.Lock()
+  tx.version = db.version
+  tx.snapshot = db.viewTree()
+  db.readers[tx.version]++
+  db.mu.Unlock()
+  tx.pending = newMemTree()
+  tx.done = false
+  tx.readCommitted, tx.held, tx.pinned = false, 0, nil
+  tx.committed, tx.precommit = nil, nil
+  tx.serializable, tx.reads = false, nil
+  tx.id, tx.locked = db.txids.Add(1), false
+  schedBegin(tx)
+}
+
+// end a transaction: commit updates
+func (db *KV) Commit(tx *KVTX) error {
+  return db.CommitCtx(context.Background(), tx)
+}
+
+// like Commit, but gives up once the context is done.
+// the deadline is checked between the updates, each of them only
+// splits or merges along a single path so the work in between is bounded.
+// nothing is applied if the commit gives up.
+func (db *KV) CommitCtx(ctx context.Context, tx *KVTX) error {
+  assert(tx.db == db && !tx.done)
+  tx.done = true
+  defer endTx(tx)
+  if tx.pending.root == 0 {
+    return nil // read-only
+  }
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  if tx.serializable {
+    if err := serialCheck(db, tx); err != nil {
+      return err
+    }
+  }
+  if tx.precommit != nil {
+    if err := tx.precommit(); err != nil {
+      return err
+    }
+  }
+  // apply the updates to the latest version of the tree
+  meta := saveMeta(db)
+  for iter := tx.pending.Seek(nil, CMP_GE); iter.Valid(); iter.Next() {
+    if err := ctx.Err(); err != nil {
+      revertMeta(db, meta) // the new pages are not reachable from the old root
+      return fmt.Errorf("commit: %w", err)
+    }
+    key, val := iter.Key(), iter.Val()
+    switch val[0] {
+    case FLAG_UPDATED:
+      db.tree.update(key, val[1:])
+      walLog(db, key, val[1:], false)
+      keyEvent(db, key, KEY_SET)
+    case FLAG_DELETED:
+      deleted, err := db.tree.Delete(key)
+      if err != nil {
+        revertMeta(db, meta)
+        return fmt.Errorf("commit: %w", err)
+      }
+      // not for a key that wasn't there, or was deleted by a later commit
+      if deleted {
+        walLog(db, key, nil, true)
+        keyEvent(db, key, KEY_DEL)
+      }
+    case FLAG_EXPIRING:
+      expires := int64(binary.LittleEndian.Uint64(val[1:]))
+      db.tree.updateExpiring(key, val[1+EXPIRES_SIZE:], expires)
+      walLogExpiring(db, key, val[1+EXPIRES_SIZE:], expires)
+      keyEvent(db, key, KEY_SET)
+    default:
+      panic("bad pending update")
+    }
+  }
+  // the updates become visible together
+  if err := updateOrRevert(db, meta); err != nil {
+    return err
+  }
+  if tx.committed != nil {
+    db.mu.Lock()
+    version := db.version
+    db.mu.Unlock()
+    tx.committed(version)
+  }
+  return nil
+}
+
+// end a transaction: rollback
+func (db *KV) Abort(tx *KVTX) {
+  assert(tx.db == db && !tx.done)
+  tx.done = true
+  tx.pending = BTree{}
+  endTx(tx)
+}
+
+// the snapshot is no longer in use
+func endTx(tx *KVTX) {
+  db := tx.db
+  schedEnd(tx)
+  if tx.locked {
+    db.locks.ReleaseAll(tx.id)
+  }
+  if tx.readCommitted {
+    return // no snapshot kept
+  }
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  if tx.serializable {
+    serialEnd(db, tx)
+  }
+  if db.readers[tx.version]--; db.readers[tx.version] == 0 {
+    delete(db.readers, tx.version)
+  }
+}
+
+// read a key, the pending updates take precedence over the snapshot
+func (tx *KVTX) Get(key []byte) ([]byte, bool) {
+  tx.readKey(key)
+  if val, ok := tx.pending.Get(key); ok {
+    val, live := pendingVal(val, &tx.db.tree)
+    return val, live
+  }
+  val, ok := tx.view().Get(key)
+  // the page can be reused once the transaction ends
+  return bytes.Clone(val), ok
+}
+
+// insert or update a key
+func (tx *KVTX) Set(key []byte, val []byte) error {
+  assert(!tx.done)
+  if err := checkLimit(key, val); err != nil {
+    return err
+  }
+  tx.pending.update(key, append([]byte{FLAG_UPDATED}, val...))
+  return nil
+}
+
+// delete a key and returns whether the key was there
+func (tx *KVTX) Del(key []byte) (bool, error) {
+  assert(!tx.done)
+  if err := checkLimit(key, nil); err != nil {
+    return false, err
+  }
+  _, exists := tx.Get(key)
+  if exists {
+    tx.pending.update(key, []byte{FLAG_DELETED})
+  }
+  return exists, nil
+}
+
+// iterate the view of the transaction, see BTree.Seek
+func (tx *KVTX) Seek(key []byte, cmp int) *TxIter {
+  iter := &TxIter{top: tx.pending.Seek(key, cmp), bot: tx.view().Seek(key, cmp), dir: +1}
+  if cmp < 0 {
+    iter.dir = -1
+  }
+  if tx.serializable {
+    key = append([]byte(nil), key...)
+    iter.reads = &readRange{lo: key, hi: key}
+    tx.reads = append(tx.reads, iter.reads)
+  }
+  iter.skipDeleted()
+  iter.observe()
+  return iter
+}
+
+// the pending updates merged on top of the snapshot.
+// an update in the transaction invalidates the iterator.
+type TxIter struct {
+  top *BIter // the pending updates
+  bot *BIter // the snapshot
+  dir int    // +1 for forward, -1 for backward
+  reads *readRange // the keys seen, for a serializable transaction
+}
+
+// which of the 2 iterators are at the current key?
+func (iter *TxIter) pick() (useTop bool, useBot bool) {
+  tv, bv := iter.top.Valid(), iter.bot.Valid()
+  if !(tv && bv) {
+    return tv, bv
+  }
+  // the closest key in the direction; the top wins on ties
+  r := bytes.Compare(iter.top.Key(), iter.bot.Key()) * iter.dir
+  return r <= 0, r >= 0
+}
+
+func (iter *TxIter) Valid() bool {
+  useTop, useBot := iter.pick()
+  return useTop || useBot
+}
+
+func (iter *TxIter) Key() []byte {
+  if useTop, _ := iter.pick(); useTop {
+    return iter.top.Key()
+  }
+  return iter.bot.Key()
+}
+
+func (iter *TxIter) Val() []byte {
+  if useTop, _ := iter.pick(); useTop {
+    val, _ := pendingVal(iter.top.Val(), iter.bot.tree)
+    return val
+  }
+  return iter.bot.Val()
+}
+
+func (iter *TxIter) Next() {
+  iter.move(+1)
+}
+
+func (iter *TxIter) Prev() {
+  iter.move(-1)
+}
+
+func (iter *TxIter) move(dir int) {
+  switch {
+  case dir == iter.dir:
+    iter.step(iter.pick())
+  case iter.Valid():
+    // turn around: reposition both just past the current key
+    key, cmp := iter.Key(), CMP_GT
+    if dir < 0 {
+      cmp = CMP_LT
+    }
+    iter.top = iter.top.tree.Seek(key, cmp)
+    iter.bot = iter.bot.tree.Seek(key, cmp)
+    iter.dir = dir
+  default:
+    // turn around from either end
+    iter.dir = dir
+    iter.step(true, true)
+  }
+  iter.skipDeleted()
+  iter.observe()
+}
+
+// move the iterators at the current key
+func (iter *TxIter) step(useTop bool, useBot bool) {
+  if useTop {
+    iterMove(iter.top, iter.dir)
+  }
+  if useBot {
+    iterMove(iter.bot, iter.dir)
+  }
+}
+
+func iterMove(iter *BIter, dir int) {
+  if dir > 0 {
+    iter.Next()
+  } else {
+    iter.Prev()
+  }
+}
+
+// deleted keys are hidden, and so are the expired ones
+func (iter *TxIter) skipDeleted() {
+  for {
+    useTop, useBot := iter.pick()
+    if !useTop {
+      return
+    }
+    if _, live := pendingVal(iter.top.Val(), iter.bot.tree); live {
+      return
+    }
+    iter.step(useTop, useBot)
+  }
+}
+
+// an in-memory tree, for buffering updates
+func newMemTree() BTree {
+  tree := BTree{}
+  tree.usePages(NewMemPages())
+  return tree
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+  "path/filepath"
+  "testing"
+)
+
+// a key deleted by 2 transactions is deleted once
+func TestCommitDeleted(t *testing.T) {
+  for _, wal := range []bool{false, true} {
+    db := &KV{Path: filepath.Join(t.TempDir(), "db"), Options: Options{WAL: wal}}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    db.Set([]byte("k"), []byte("v"))
+    var events []KeyEvent
+    db.SubscribeKeys(nil, func(ev KeyEvent) { events = append(events, ev) })
+    var tx1, tx2 KVTX
+    db.Begin(&tx1)
+    db.Begin(&tx2)
+    for _, tx := range []*KVTX{&tx1, &tx2} {
+      if ok, err := tx.Del([]byte("k")); !ok || err != nil {
+        t.Fatal(ok, err)
+      }
+      tx.Set([]byte("other"), []byte("v"))
+    }
+    start := db.wal.size
+    if err := db.Commit(&tx1); err != nil {
+      t.Fatal(err)
+    }
+    size := db.wal.size
+    if err := db.Commit(&tx2); err != nil {
+      t.Fatal(err)
+    }
+    dels := 0
+    for _, ev := range events {
+      if ev.Event == KEY_DEL {
+        dels++
+      }
+    }
+    if dels != 1 || len(events) != 3 {
+      t.Fatalf("WAL %v: %+v", wal, events)
+    }
+    if wal && db.wal.size - size >= size - start {
+      t.Fatalf("the second commit logged %d bytes, the first %d", db.wal.size - size, size - start)
+    }
+    db.Close()
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    if _, ok := db.Get([]byte("k")); ok {
+      t.Fatal("deleted key back")
+    }
+    db.Close()
+  }
+}
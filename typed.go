@@ -0,0 +1,171 @@
+package main
+
+import (
+  "bytes"
+  "encoding/gob"
+  "encoding/json"
+  "fmt"
+  "time"
+
+  "database/codec"
+)
+
+// conversions of Go values to the bytes of keys or values.
+// a key codec must preserve the order for Scan to be in key order.
+type Codec[T any] struct {
+  Encode func(T) []byte
+  Decode func([]byte) (T, error)
+}
+
+// the bytes as is, in order
+func StringCodec() Codec[string] {
+  return Codec[string]{
+    Encode: func(s string) []byte { return []byte(s) },
+    Decode: func(b []byte) (string, error) { return string(b), nil },
+  }
+}
+
+func BytesCodec() Codec[[]byte] {
+  return Codec[[]byte]{
+    Encode: func(b []byte) []byte { return b },
+    Decode: func(b []byte) ([]byte, error) { return append([]byte(nil), b...), nil },
+  }
+}
+
+// the order-preserving encodings of the codec package
+func Uint64Codec() Codec[uint64] {
+  return orderedCodec(codec.AppendUint64, codec.Uint64)
+}
+
+func Int64Codec() Codec[int64] {
+  return orderedCodec(codec.AppendInt64, codec.Int64)
+}
+
+func Float64Codec() Codec[float64] {
+  return orderedCodec(codec.AppendFloat64, codec.Float64)
+}
+
+func TimeCodec() Codec[time.Time] {
+  return orderedCodec(codec.AppendTime, codec.Time)
+}
+
+func orderedCodec[T any](enc func([]byte, T) []byte, dec func([]byte) (T, []byte, error)) Codec[T] {
+  return Codec[T]{
+    Encode: func(v T) []byte { return enc(nil, v) },
+    Decode: func(b []byte) (T, error) {
+      v, rest, err := dec(b)
+      if err == nil && len(rest) != 0 {
+        err = codec.ErrBadEncoding
+      }
+      return v, err
+    },
+  }
+}
+
+// not in order, for values only
+func JSONCodec[T any]() Codec[T] {
+  return Codec[T]{
+    Encode: func(v T) []byte {
+      b, err := json.Marshal(v)
+      if err != nil {
+        panic(fmt.Errorf("JSONCodec: %w", err)) // a type that can't be encoded
+      }
+      return b
+    },
+    Decode: func(b []byte) (T, error) {
+      var v T
+      err := json.Unmarshal(b, &v)
+      return v, err
+    },
+  }
+}
+
+// not in order, for values only
+func GobCodec[T any]() Codec[T] {
+  return Codec[T]{
+    Encode: func(v T) []byte {
+      var buf bytes.Buffer
+      if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+        panic(fmt.Errorf("GobCodec: %w", err))
+      }
+      return buf.Bytes()
+    },
+    Decode: func(b []byte) (T, error) {
+      var v T
+      err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+      return v, err
+    },
+  }
+}
+
+// typed KV pairs in a bucket of the store. the keys of a bucket are
+// prefixed by its name: | name | 0 | key |
+type Typed[K any, V any] struct {
+  db     *KV
+  prefix []byte
+  key    Codec[K]
+  val    Codec[V]
+}
+
+func NewTyped[K any, V any](db *KV, bucket string, key Codec[K], val Codec[V]) (*Typed[K, V], error) {
+  if bucket == "" || bytes.IndexByte([]byte(bucket), 0) >= 0 {
+    return nil, fmt.Errorf("bad bucket name %q", bucket)
+  }
+  prefix := append([]byte(bucket), 0)
+  return &Typed[K, V]{db: db, prefix: prefix, key: key, val: val}, nil
+}
+
+func (t *Typed[K, V]) rawKey(k K) []byte {
+  return append(append([]byte(nil), t.prefix...), t.key.Encode(k)...)
+}
+
+func (t *Typed[K, V]) Get(k K) (V, bool, error) {
+  var v V
+  raw, ok := t.db.Get(t.rawKey(k))
+  if !ok {
+    return v, false, nil
+  }
+  v, err := t.val.Decode(raw)
+  if err != nil {
+    return v, false, fmt.Errorf("bucket %s: %w", t.prefix[:len(t.prefix)-1], err)
+  }
+  return v, true, nil
+}
+
+func (t *Typed[K, V]) Set(k K, v V) error {
+  return t.db.Set(t.rawKey(k), t.val.Encode(v))
+}
+
+func (t *Typed[K, V]) Del(k K) (bool, error) {
+  return t.db.Del(t.rawKey(k))
+}
+
+// call fn on the pairs in key order until it returns false
+func (t *Typed[K, V]) Scan(fn func(K, V) bool) error {
+  return t.scan(t.prefix, fn)
+}
+
+// like Scan, from the first key >= lo
+func (t *Typed[K, V]) ScanFrom(lo K, fn func(K, V) bool) error {
+  return t.scan(t.rawKey(lo), fn)
+}
+
+func (t *Typed[K, V]) scan(start []byte, fn func(K, V) bool) error {
+  for iter := t.db.Seek(start, CMP_GE); iter.Valid(); iter.Next() {
+    if !bytes.HasPrefix(iter.Key(), t.prefix) {
+      break // past the bucket
+    }
+    k, err := t.key.Decode(iter.Key()[len(t.prefix):])
+    if err != nil {
+      return fmt.Errorf("bucket %s: %w", t.prefix[:len(t.prefix)-1], err)
+    }
+    v, err := t.val.Decode(iter.Val())
+    if err != nil {
+      return fmt.Errorf("bucket %s: %w", t.prefix[:len(t.prefix)-1], err)
+    }
+    if !fn(k, v) {
+      break
+    }
+  }
+  return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "testing"
+)
+
+type typedPoint struct {
+  X, Y int
+}
+
+// the typed pairs of a bucket in key order, apart from the other buckets
+func TestTyped(t *testing.T) {
+  db := &KV{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  points, err := NewTyped(db, "p", Int64Codec(), JSONCodec[typedPoint]())
+  if err != nil {
+    t.Fatal(err)
+  }
+  // a bucket whose name extends the other one
+  names, err := NewTyped(db, "p2", StringCodec(), GobCodec[[]string]())
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, k := range []int64{5, -300, 0, 1 << 40, -1} {
+    if err := points.Set(k, typedPoint{int(k), 1}); err != nil {
+      t.Fatal(err)
+    }
+  }
+  names.Set("b", []string{"x"})
+  names.Set("a", nil)
+  points.Del(5)
+  cases := []struct {
+    from int64
+    max  int // stop after max pairs
+    want string
+  }{
+    {-1 << 63, 10, "[-300 -1 0 1099511627776]"},
+    {-1, 10, "[-1 0 1099511627776]"},
+    {1, 10, "[1099511627776]"},
+    {-1 << 63, 2, "[-300 -1]"},
+    {1 << 41, 10, "[]"},
+  }
+  for _, c := range cases {
+    got := []int64{}
+    err := points.ScanFrom(c.from, func(k int64, v typedPoint) bool {
+      if v != (typedPoint{int(k), 1}) {
+        t.Fatalf("%d: %v", k, v)
+      }
+      got = append(got, k)
+      return len(got) < c.max
+    })
+    if err != nil || fmt.Sprint(got) != c.want {
+      t.Fatalf("from %d: %v %v", c.from, got, err)
+    }
+  }
+  var keys []string
+  names.Scan(func(k string, v []string) bool {
+    keys = append(keys, fmt.Sprint(k, v))
+    return true
+  })
+  if fmt.Sprint(keys) != "[a[] b[x]]" {
+    t.Fatal(keys)
+  }
+  if v, ok, err := points.Get(-300); !ok || err != nil || v.X != -300 {
+    t.Fatal(v, ok, err)
+  }
+  if _, ok, err := points.Get(5); ok || err != nil {
+    t.Fatal(ok, err)
+  }
+  // the bytes that don't decode
+  db.Set(points.rawKey(7), []byte("{"))
+  if _, _, err := points.Get(7); err == nil || !strings.HasPrefix(err.Error(), "bucket p:") {
+    t.Fatal(err)
+  }
+  if err := points.Scan(func(int64, typedPoint) bool { return true }); err == nil {
+    t.Fatal("decoded")
+  }
+  for _, bad := range []string{"", "a\x00b"} {
+    if _, err := NewTyped(db, bad, StringCodec(), StringCodec()); err == nil {
+      t.Fatalf("%q: no error", bad)
+    }
+  }
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "math"
+  "strings"
+)
+
+// a row conflicts with an existing one on the primary key or a unique index
+type ErrDuplicateKey struct {
+  Table string
+  Cols  []string // the primary key or the unique index
+}
+
+func (e *ErrDuplicateKey) Error() string {
+  return fmt.Sprintf("duplicate key in table %s: (%s)", e.Table, strings.Join(e.Cols, ", "))
+}
+
+// the id assigned to the AutoInc column by the last insert of the transaction
+func (tx *DBTX) LastInsertID() int64 {
+  return tx.lastID
+}
+
+// the columns of the index that must be unique, nil if it isn't unique
+func uniqueCols(tdef *TableDef, i int) []string {
+  if i >= len(tdef.Unique) || !tdef.Unique[i] {
+    return nil
+  }
+  return tdef.Indexes[i][:tdef.IndexCols[i]]
+}
+
+// check the unique indexes before the row is written.
+// `old` is the existing row with the same primary key, if any.
+func checkUnique(tx *DBTX, tdef *TableDef, values []Value, old []Value, exists bool) error {
+  for i := range tdef.Indexes {
+    cols := uniqueCols(tdef, i)
+    if cols == nil {
+      continue
+    }
+    key := encodeKey(nil, tdef.IndexPrefixes[i], indexValues(tdef, values, cols))
+    if exists && bytes.Equal(key, encodeKey(nil, tdef.IndexPrefixes[i], indexValues(tdef, old, cols))) {
+      continue // the row keeps its own entry
+    }
+    // the encoding is prefix-free, the keys of the same values share the prefix
+    iter := tx.kv.Seek(key, CMP_GE)
+    if iter.Valid() && bytes.HasPrefix(iter.Key(), key) {
+      return &ErrDuplicateKey{Table: tdef.Name, Cols: cols}
+    }
+  }
+  return nil
+}
+
+// the counter of the AutoInc column is kept in the meta table
+func autoIncKey(tdef *TableDef) *Record {
+  return (&Record{}).AddStr("key", []byte(fmt.Sprintf("next_id:%d", tdef.Prefix)))
+}
+
+// fill in the AutoInc column if it's missing from the row
+func autoIncAssign(tx *DBTX, tdef *TableDef, rec Record) (Record, error) {
+  if rec.Get(tdef.AutoInc) != nil {
+    return rec, nil
+  }
+  next, err := autoIncNext(tx, tdef)
+  if err != nil {
+    return rec, err
+  }
+  filled := Record{
+    Cols: append(append([]string(nil), rec.Cols...), tdef.AutoInc),
+    Vals: append(append([]Value(nil), rec.Vals...), Value{Type: TYPE_INT64, I64: next}),
+  }
+  return filled, nil
+}
+
+func autoIncNext(tx *DBTX, tdef *TableDef) (int64, error) {
+  meta := autoIncKey(tdef)
+  ok, err := dbGet(tx, TDEF_META, meta)
+  if err != nil {
+    return 0, err
+  }
+  if !ok {
+    return 1, nil
+  }
+  return int64(binary.LittleEndian.Uint64(meta.Get("val").Str)), nil
+}
+
+// ids are never reused, an explicit id moves the counter past it
+func autoIncUpdate(tx *DBTX, tdef *TableDef, values []Value) error {
+  id := values[colIndex(tdef, tdef.AutoInc)].I64
+  tx.lastID = id
+  next, err := autoIncNext(tx, tdef)
+  if err != nil || id < next || id == math.MaxInt64 {
+    return err
+  }
+  val := make([]byte, 8)
+  binary.LittleEndian.PutUint64(val, uint64(id + 1))
+  _, err = dbUpdate(tx, TDEF_META, *autoIncKey(tdef).AddStr("val", val), MODE_UPSERT)
+  return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "fmt"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// UUIDs as primary keys. random (v4) UUIDs spread the inserts all over
+// the tree, so every leaf is split half full and the writes touch a new
+// path each time. time-ordered (v7) UUIDs keep the inserts at the end.
+type UUID [16]byte
+
+var uuidLast struct {
+  sync.Mutex
+  ms  int64
+  seq uint16
+}
+
+// a time-ordered UUID, RFC 9562 version 7.
+// | unix ms 48b | ver 4b | seq 12b | var 2b | random 62b |
+// the sequence keeps the UUIDs increasing within a millisecond.
+func NewUUIDv7() UUID {
+  var u UUID
+  _, err := rand.Read(u[:])
+  assert(err == nil)
+  uuidLast.Lock()
+  ms := time.Now().UnixMilli()
+  if ms <= uuidLast.ms {
+    ms = uuidLast.ms // the clock may go backward
+    uuidLast.seq++
+    if uuidLast.seq >= 1 << 12 {
+      ms, uuidLast.seq = ms + 1, 0 // borrow from the next millisecond
+    }
+  } else {
+    uuidLast.seq = 0
+  }
+  uuidLast.ms = ms
+  seq := uuidLast.seq
+  uuidLast.Unlock()
+  for i := 0; i < 6; i++ {
+    u[i] = byte(ms >> (40 - 8 * i))
+  }
+  u[6] = 0x70 | byte(seq >> 8)
+  u[7] = byte(seq)
+  u[8] = 0x80 | u[8] & 0x3f
+  return u
+}
+
+// a random UUID, version 4
+func NewUUIDv4() UUID {
+  var u UUID
+  _, err := rand.Read(u[:])
+  assert(err == nil)
+  u[6] = 0x40 | u[6] & 0x0f
+  u[8] = 0x80 | u[8] & 0x3f
+  return u
+}
+
+// the 36-char text form
+func (u UUID) String() string {
+  h := hex.EncodeToString(u[:])
+  return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// a random UUID in the binary or the text form?
+func isUUIDv4(key []byte) bool {
+  switch len(key) {
+  case 16:
+    return key[6] >> 4 == 4 && key[8] >> 6 == 2
+  case 36:
+    for _, i := range []int{8, 13, 18, 23} {
+      if key[i] != '-' {
+        return false
+      }
+    }
+    // in either case
+    return key[14] == '4' && strings.IndexByte("89abAB", key[19]) >= 0
+  }
+  return false
+}
+
+// new rows of a table, see DB.Warnings
+type newRows struct {
+  total  int
+  random int // with a random UUID as the leading primary key column
+}
+
+func (db *DB) countNewRow(tdef *TableDef, values []Value) {
+  db.rowsMu.Lock()
+  defer db.rowsMu.Unlock()
+  if db.rows == nil {
+    db.rows = map[string]*newRows{}
+  }
+  rows := db.rows[tdef.Name]
+  if rows == nil {
+    rows = &newRows{}
+    db.rows[tdef.Name] = rows
+  }
+  rows.total++
+  if values[0].Type == TYPE_BYTES && isUUIDv4(values[0].Str) {
+    rows.random++
+  }
+}
+
+// the warnings of KV.Warnings, and the tables that are keyed by random
+// UUIDs. the counters are since the DB was opened.
+func (db *DB) Warnings() []string {
+  out := db.kv.Warnings()
+  db.rowsMu.Lock()
+  defer db.rowsMu.Unlock()
+  var tables []string
+  for name, rows := range db.rows {
+    if rows.total >= 100 && rows.random * 10 >= rows.total * 9 {
+      tables = append(tables, name)
+    }
+  }
+  sort.Strings(tables)
+  for _, name := range tables {
+    out = append(out, fmt.Sprintf(
+      "table %s: the primary keys are random UUIDs, use NewUUIDv7 for time-ordered keys", name,
+    ))
+  }
+  return out
+}
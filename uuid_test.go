@@ -0,0 +1,101 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "strings"
+  "testing"
+)
+
+func TestUUID(t *testing.T) {
+  v4, v7 := NewUUIDv4(), NewUUIDv7()
+  text := v4.String()
+  cases := []struct {
+    key    []byte
+    random bool
+  }{
+    {v4[:], true},
+    {[]byte(text), true},
+    {[]byte(strings.ToUpper(text)), true},
+    {v7[:], false},
+    {[]byte(v7.String()), false},
+    {v4[:15], false},
+    {[]byte(strings.Replace(text, "-", "_", 1)), false},
+    {bytes.Repeat([]byte{0x40}, 16), false}, // not the variant
+  }
+  for i, c := range cases {
+    if isUUIDv4(c.key) != c.random {
+      t.Fatalf("case %d: %q", i, c.key)
+    }
+  }
+  if len(text) != 36 || text[14] != '4' || v7.String()[14] != '7' {
+    t.Fatal(text, v7)
+  }
+  // increasing, even within a millisecond
+  prev := NewUUIDv7()
+  for i := 0; i < 10000; i++ {
+    u := NewUUIDv7()
+    if bytes.Compare(u[:], prev[:]) <= 0 || u[6] >> 4 != 7 || u[8] >> 6 != 2 {
+      t.Fatalf("%v after %v", u, prev)
+    }
+    prev = u
+  }
+}
+
+// a warning for the tables whose new rows are mostly keyed by random UUIDs
+func TestUUIDWarning(t *testing.T) {
+  db := &DB{Options: Options{InMemory: true}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  cases := []struct {
+    name         string
+    rows, random int
+    text         bool
+    warned       bool
+  }{
+    {"random", 100, 100, false, true},
+    {"text", 200, 190, true, true},
+    {"ordered", 100, 0, false, false},
+    {"few", 99, 99, false, false},
+    {"mixed", 100, 80, false, false},
+  }
+  want := []string{}
+  for _, c := range cases {
+    tx := DBTX{}
+    db.Begin(&tx)
+    tdef := &TableDef{Name: c.name, Types: []uint32{TYPE_BYTES}, Cols: []string{"id"}, PKeys: 1}
+    if err := tx.TableNew(tdef); err != nil {
+      t.Fatal(err)
+    }
+    for i := 0; i < c.rows; i++ {
+      u := NewUUIDv7()
+      if i < c.random {
+        u = NewUUIDv4()
+      }
+      key := u[:]
+      if c.text {
+        key = []byte(u.String())
+      }
+      if _, err := tx.Insert(c.name, *(&Record{}).AddStr("id", key)); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if err := db.Commit(&tx); err != nil {
+      t.Fatal(err)
+    }
+    if c.warned {
+      want = append(want, "table " + c.name + ": the primary keys are random UUIDs")
+    }
+  }
+  var got []string
+  for _, w := range db.Warnings() {
+    if name, _, ok := strings.Cut(w, ", use NewUUIDv7"); ok {
+      got = append(got, name)
+    }
+  }
+  if fmt.Sprint(got) != fmt.Sprint(want) {
+    t.Fatalf("%q, want %q", got, want)
+  }
+}
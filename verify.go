@@ -0,0 +1,239 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+)
+
+// check the whole tree: the node layout, the key order across nodes,
+// the tree shape, and that no page is referenced twice.
+func (tree *BTree) Verify() error {
+  return treeVerify(tree, 0)
+}
+
+// like BTree.Verify, also checks the pointers against the file size
+// and the pages against their checksums.
+func (db *KV) Verify() error {
+  _, err := db.verify(false)
+  return err
+}
+
+// like KV.Verify, but a page with a bad checksum is reported and its
+// subtree is skipped, so all of them are found in one pass.
+// the other errors still stop the check.
+func (db *KV) VerifySkip() ([]*ErrChecksum, error) {
+  return db.verify(true)
+}
+
+func (db *KV) verify(skip bool) ([]*ErrChecksum, error) {
+  db.writer.Lock()
+  defer db.writer.Unlock()
+  v := kvVerifier(db, skip)
+  if err := v.run(); err != nil {
+    return v.bad, err
+  }
+  // a free page must not be reachable
+  for _, ptr := range db.free.all() {
+    if v.seen[ptr] {
+      return v.bad, corruptf(ptr, "free page in use")
+    }
+  }
+  return v.bad, nil
+}
+
+// a verifier of the tree of the update in progress, with the writer lock
+func kvVerifier(db *KV, skip bool) *verifier {
+  // read the pages without the check in pageGet(), which panics
+  tree := db.tree
+  tree.get = func(ptr uint64) []byte {
+    if page, ok := db.page.updates[ptr]; ok {
+      return page
+    }
+    if ptr >= db.page.flushed {
+      return db.page.temp[ptr - db.page.flushed]
+    }
+    return db.store.ReadPage(ptr, db.tree.pageSize())
+  }
+  v := newVerifier(&tree, db.page.flushed + uint64(len(db.page.temp)))
+  v.sums, v.skip = db.sums.crcs, skip
+  v.ncold = db.cold.flushed.Load() + uint64(len(db.cold.temp))
+  return v
+}
+
+type verifier struct {
+  tree   *BTree
+  npages uint64 // pointers must be below this, 0 for no limit
+  ncold  uint64 // the same for the cold file
+  seen   map[uint64]bool
+  depth  int // the depth of the leaves, -1 for unknown
+  sums   []uint32 // page checksums, if any
+  skip   bool     // skip the pages with bad checksums
+  bad    []*ErrChecksum
+}
+
+func newVerifier(tree *BTree, npages uint64) *verifier {
+  return &verifier{tree: tree, npages: npages, seen: map[uint64]bool{}, depth: -1}
+}
+
+func treeVerify(tree *BTree, npages uint64) error {
+  return newVerifier(tree, npages).run()
+}
+
+func (v *verifier) run() error {
+  if v.tree.root == 0 {
+    return nil
+  }
+  // the leftmost key is the sentinel, there is no lower bound
+  err := v.node(v.tree.root, nil, nil, 0, true)
+  if err == errSkipped {
+    err = nil
+  }
+  return err
+}
+
+// returned for a skipped page, ends the check of its parent
+var errSkipped = errors.New("skipped")
+
+// claim a page
+func (v *verifier) page(ptr uint64) ([]byte, error) {
+  if ptr >> PAGE_FILE_SHIFT == COLD_FILE {
+    return v.coldPage(ptr)
+  }
+  if ptr == 0 || (v.npages > 0 && ptr >= v.npages) {
+    return nil, corruptf(ptr, "bad pointer")
+  }
+  if v.seen[ptr] {
+    return nil, corruptf(ptr, "referenced twice")
+  }
+  v.seen[ptr] = true
+  page := v.tree.get(ptr)
+  if err := pageSumCheck(v.sums, ptr, page); err != nil {
+    if !v.skip {
+      return nil, err
+    }
+    v.bad = append(v.bad, err.(*ErrChecksum))
+    return nil, errSkipped
+  }
+  return page, nil
+}
+
+// an overflow page in the cold file, which has no checksums
+func (v *verifier) coldPage(ptr uint64) ([]byte, error) {
+  if v.tree.cold == nil || (v.npages > 0 && ptr &^ PAGE_FILE_MASK >= v.ncold) {
+    return nil, corruptf(ptr, "bad pointer")
+  }
+  if v.seen[ptr] {
+    return nil, corruptf(ptr, "referenced twice")
+  }
+  v.seen[ptr] = true
+  return overflowPage(v.tree, ptr), nil
+}
+
+// the keys of the node must be in [lo, hi), hi == nil means no upper bound.
+func (v *verifier) node(ptr uint64, lo []byte, hi []byte, depth int, leftmost bool) error {
+  data, err := v.page(ptr)
+  if err != nil {
+    return err
+  }
+  if len(data) > v.tree.pageSize() {
+    return corruptf(ptr, "%d bytes", len(data))
+  }
+  node := BNode(data)
+  if err := nodeCheck(node); err != nil {
+    return corruptf(ptr, "%w", err)
+  }
+  if int(node.nbytes()) > v.tree.pageSize() {
+    return corruptf(ptr, "node of %d bytes", node.nbytes())
+  }
+  nkeys := node.nkeys()
+  first, last := node.getKey(0), node.getKey(nkeys - 1)
+  if leftmost && len(first) != 0 {
+    return corruptf(ptr, "missing the sentinel key")
+  }
+  // a leaf can be linked by a shorter key, see kidKeys()
+  if !leftmost && node.btype() == BNODE_NODE && !bytes.Equal(first, lo) {
+    return corruptf(ptr, "first key doesn't match the link")
+  }
+  if !leftmost && bytes.Compare(first, lo) < 0 {
+    return corruptf(ptr, "key out of range")
+  }
+  if hi != nil && bytes.Compare(last, hi) >= 0 {
+    return corruptf(ptr, "key out of range")
+  }
+  if node.btype() == BNODE_LEAF {
+    if v.depth < 0 {
+      v.depth = depth
+    }
+    if v.depth != depth {
+      return corruptf(ptr, "leaves at different depths")
+    }
+    for i := uint16(0); i < nkeys; i++ {
+      if len(node.getKey(i)) > BTREE_MAX_KEY_SIZE {
+        return corruptf(ptr, "key %d too long", i)
+      }
+      if node.isOverflow(i) {
+        err := v.overflow(node.getVal(i))
+        if err != nil && err != errSkipped {
+          return corruptf(ptr, "key %d: %w", i, err)
+        }
+        if _, ok := node.entrySum(i); ok && err == nil {
+          if err := entryCheck(node, i, overflowRead(v.tree, node.getVal(i))); err != nil {
+            return corruptf(ptr, "%w", err)
+          }
+        }
+      } else if len(node.getVal(i)) > BTREE_MAX_VAL_SIZE {
+        return corruptf(ptr, "value %d too long", i)
+      } else if err := entryCheck(node, i, node.getVal(i)); err != nil {
+        return corruptf(ptr, "%w", err)
+      }
+    }
+    return nil
+  }
+  for i := uint16(0); i < nkeys; i++ {
+    if len(node.getVal(i)) != 0 {
+      return corruptf(ptr, "internal node with values")
+    }
+    kid := node.getPtr(i)
+    var khi []byte
+    if i + 1 < nkeys {
+      khi = node.getKey(i + 1)
+    } else {
+      khi = hi
+    }
+    err := v.node(kid, node.getKey(i), khi, depth + 1, leftmost && i == 0)
+    if err != nil && err != errSkipped {
+      return err
+    }
+  }
+  return nil
+}
+
+// the chain of overflow pages of a value
+func (v *verifier) overflow(ref []byte) error {
+  total := int(binary.LittleEndian.Uint32(ref[0:]))
+  if total <= BTREE_MAX_VAL_SIZE || total > BTREE_MAX_BLOB_SIZE {
+    return fmt.Errorf("bad overflow size %d", total)
+  }
+  size := 0
+  for ptr := binary.LittleEndian.Uint64(ref[4:]); ptr != 0; {
+    page, err := v.page(ptr)
+    if err != nil {
+      return err
+    }
+    if len(page) < OVERFLOW_HEADER || binary.LittleEndian.Uint16(page[0:]) != BNODE_OVERFLOW {
+      return corruptf(ptr, "bad overflow page")
+    }
+    n := int(binary.LittleEndian.Uint16(page[2:]))
+    if n == 0 || n > min(overflowCap(v.tree), len(page) - OVERFLOW_HEADER) {
+      return corruptf(ptr, "bad overflow page")
+    }
+    size += n
+    ptr = binary.LittleEndian.Uint64(page[4:])
+  }
+  if size != total {
+    return fmt.Errorf("overflow size mismatch: %d != %d", size, total)
+  }
+  return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "os"
+)
+
+const WAL_CHECKPOINT_PAGES = 1024
+
+// the log is a file next to the database, one record per commit.
+// | size 4B | crc32 4B | updates |
+// replaying the records on top of the tree at the master page gives the
+// latest version. the updates are absolute so replaying them twice is
+// harmless, e.g. after a crash between a checkpoint and clearing the log.
+// an update is:
+// | op 1B | klen 2B | vlen 4B | key | val |
+// the op is 0 for a set, 1 for a delete, 2 for a set of an expiring key
+// whose val is | expires 8B | value |, 3 for the time of hlcClock at the
+// commit, with no key and an 8B val.
+const WAL_HEADER = 8
+
+const (
+  WAL_SET          = byte(0)
+  WAL_DEL          = byte(1)
+  WAL_SET_EXPIRING = byte(2)
+  WAL_CLOCK        = byte(3)
+)
+
+func walPath(db *KV) string {
+  return db.Path + "-wal"
+}
+
+// record an update to the tree for the next commit
+func walLog(db *KV, key []byte, val []byte, del bool) {
+  op := WAL_SET
+  if del {
+    op = WAL_DEL
+  }
+  walLogOp(db, op, key, val)
+}
+
+// record a set of an expiring key
+func walLogExpiring(db *KV, key []byte, val []byte, expires int64) {
+  if !db.Options.WAL {
+    return
+  }
+  val, _ = withExpires(val, 0, expires)
+  walLogOp(db, WAL_SET_EXPIRING, key, val)
+}
+
+func walLogOp(db *KV, op byte, key []byte, val []byte) {
+  if !db.Options.WAL {
+    return
+  }
+  var head [7]byte
+  head[0] = op
+  binary.LittleEndian.PutUint16(head[1:], uint16(len(key)))
+  binary.LittleEndian.PutUint32(head[3:], uint32(len(val)))
+  db.wal.ops = append(db.wal.ops, head[:]...)
+  db.wal.ops = append(db.wal.ops, key...)
+  db.wal.ops = append(db.wal.ops, val...)
+}
+
+// make the logged updates durable, or revert the tree on error.
+func walCommit(db *KV, meta []byte) error {
+  var clock [8]byte
+  binary.LittleEndian.PutUint64(clock[:], uint64(db.clock.latest()))
+  walLogOp(db, WAL_CLOCK, nil, clock[:])
+  if err := walAppend(db); err != nil {
+    revertMeta(db, meta)
+    return err
+  }
+  db.page.committed = len(db.page.temp)
+  limit := db.Options.CheckpointPages
+  if limit == 0 {
+    limit = WAL_CHECKPOINT_PAGES
+  }
+  // the reused pages are written too
+  if db.page.committed + len(db.page.updates) >= limit {
+    // the commit is already durable; a failed checkpoint is retried
+    // later and the log keeps growing meanwhile.
+    db.free.written = walCheckpoint(db) == nil
+  }
+  publish(db)
+  return nil
+}
+
+func walAppend(db *KV) error {
+  // a failed append may have left a partial record
+  if db.failed {
+    if err := db.wal.fd.Truncate(db.wal.size); err != nil {
+      return fmt.Errorf("truncate WAL: %w", err)
+    }
+    db.failed = false
+  }
+  rec := make([]byte, WAL_HEADER + len(db.wal.ops))
+  binary.LittleEndian.PutUint32(rec[0:], uint32(len(db.wal.ops)))
+  binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(db.wal.ops))
+  copy(rec[WAL_HEADER:], db.wal.ops)
+  if _, err := db.wal.fd.WriteAt(rec, db.wal.size); err != nil {
+    db.failed = true
+    return fmt.Errorf("write WAL: %w", err)
+  }
+  if err := db.wal.fd.Sync(); err != nil {
+    db.failed = true
+    return fmt.Errorf("fsync WAL: %w", err)
+  }
+  db.wal.size += int64(len(rec))
+  db.wal.ops = db.wal.ops[:0]
+  return nil
+}
+
+// write the tree and clear the log
+func walCheckpoint(db *KV) error {
+  if err := updateFile(db); err != nil {
+    return err
+  }
+  // the log must be empty on disk before new records are appended,
+  // or old records after them would be replayed.
+  if err := db.wal.fd.Truncate(0); err != nil {
+    return fmt.Errorf("truncate WAL: %w", err)
+  }
+  if err := db.wal.fd.Sync(); err != nil {
+    return fmt.Errorf("fsync WAL: %w", err)
+  }
+  db.wal.size = 0
+  return nil
+}
+
+// replay the log left by the last run, then checkpoint.
+// the log is replayed even if the WAL is not enabled this time.
+func walOpen(db *KV) error {
+  var fd *os.File
+  var err error
+  if db.Options.ReadOnly {
+    if db.Options.WAL {
+      return fmt.Errorf("WAL: %w", ErrReadOnly)
+    }
+    fd, err = os.OpenFile(walPath(db), os.O_RDONLY, 0)
+  } else {
+    fd, err = fileOpen(db, walPath(db), db.Options.WAL)
+  }
+  if errors.Is(err, os.ErrNotExist) {
+    return nil
+  }
+  if err != nil {
+    return fmt.Errorf("open WAL: %w", err)
+  }
+  db.wal.fd = fd
+  data, err := io.ReadAll(fd)
+  if err != nil {
+    return fmt.Errorf("read WAL: %w", err)
+  }
+  logged := len(data) > 0
+  if logged && db.Options.ReadOnly {
+    return fmt.Errorf("the WAL needs to be replayed: %w", ErrReadOnly)
+  }
+  // a torn record at the end is an unfinished commit
+  for len(data) >= WAL_HEADER {
+    size := int(binary.LittleEndian.Uint32(data[0:]))
+    if WAL_HEADER + size > len(data) {
+      break
+    }
+    ops := data[WAL_HEADER:WAL_HEADER+size]
+    if crc32.ChecksumIEEE(ops) != binary.LittleEndian.Uint32(data[4:]) {
+      break
+    }
+    if err := walReplay(db, ops); err != nil {
+      return err
+    }
+    db.startup.Replayed++
+    data = data[WAL_HEADER+size:]
+  }
+  db.startup.TornBytes = len(data)
+  db.page.committed = len(db.page.temp)
+  if logged {
+    if err := walCheckpoint(db); err != nil {
+      return err
+    }
+  }
+  if db.Options.ReadOnly {
+    walClose(db) // the empty log is left as is
+    return nil
+  }
+  if !db.Options.WAL {
+    // back to writing the tree on each commit
+    walClose(db)
+    if err := os.Remove(walPath(db)); err != nil {
+      return fmt.Errorf("remove WAL: %w", err)
+    }
+  }
+  return nil
+}
+
+// apply the updates of a record
+func walReplay(db *KV, ops []byte) error {
+  for len(ops) > 0 {
+    if len(ops) < 7 {
+      return errors.New("bad WAL record")
+    }
+    op := ops[0]
+    klen := int(binary.LittleEndian.Uint16(ops[1:]))
+    vlen := int(binary.LittleEndian.Uint32(ops[3:]))
+    if 7 + klen + vlen > len(ops) {
+      return errors.New("bad WAL record")
+    }
+    key, val := ops[7:7+klen], ops[7+klen:7+klen+vlen]
+    var err error
+    switch op {
+    case WAL_SET:
+      err = db.tree.Insert(key, val)
+    case WAL_DEL:
+      _, err = db.tree.Delete(key)
+    case WAL_SET_EXPIRING:
+      if len(val) < EXPIRES_SIZE {
+        return errors.New("bad WAL record")
+      }
+      expires := int64(binary.LittleEndian.Uint64(val))
+      if err = checkLimit(key, val[EXPIRES_SIZE:]); err == nil {
+        db.tree.updateExpiring(key, val[EXPIRES_SIZE:], expires)
+      }
+    case WAL_CLOCK:
+      if len(val) != 8 {
+        return errors.New("bad WAL record")
+      }
+      if t := int64(binary.LittleEndian.Uint64(val)); !db.clock.observe(t) {
+        clockAhead(db, t)
+      }
+    default:
+      return errors.New("bad WAL record")
+    }
+    if err != nil {
+      return fmt.Errorf("replay WAL: %w", err)
+    }
+    ops = ops[7+klen+vlen:]
+  }
+  return nil
+}
+
+// write the pending commits to the tree, which keeps the log short
+func walClose(db *KV) {
+  if db.wal.fd == nil {
+    return
+  }
+  if db.page.committed > 0 {
+    _ = walCheckpoint(db) // the log is replayed on the next open
+  }
+  _ = db.wal.fd.Close()
+  db.wal.fd = nil
+}
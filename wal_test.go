@@ -0,0 +1,166 @@
+package main
+
+import (
+  "encoding/binary"
+  "fmt"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+// the files of an open store as a crash would leave them, the commits
+// since the last checkpoint are only in the log
+func walCrashCopy(t *testing.T, db *KV, path string) {
+  t.Helper()
+  for _, suffix := range []string{"", "-wal", "-sum"} {
+    data, err := os.ReadFile(db.Path + suffix)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if err := os.WriteFile(path + suffix, data, 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+}
+
+// the offsets of the records of a log
+func walRecords(t *testing.T, path string) []int {
+  t.Helper()
+  data, err := os.ReadFile(path + "-wal")
+  if err != nil {
+    t.Fatal(err)
+  }
+  var offs []int
+  for off := 0; off < len(data); {
+    offs = append(offs, off)
+    off += WAL_HEADER + int(binary.LittleEndian.Uint32(data[off:]))
+  }
+  return offs
+}
+
+// the content after `commits` of walCommits
+func walWant(commits int) map[string]string {
+  want := map[string]string{}
+  for i := 0; i < commits; i++ {
+    want[fmt.Sprintf("k%d", i)] = fmt.Sprint(i)
+    want["same"] = fmt.Sprint(i)
+    if i > 0 {
+      delete(want, fmt.Sprintf("k%d", i - 1))
+    }
+  }
+  return want
+}
+
+// sets, replaced keys, deletes and expiring keys, one commit each
+func walCommits(t *testing.T, db *KV, commits int) {
+  t.Helper()
+  for i := 0; i < commits; i++ {
+    tx := KVTX{}
+    db.Begin(&tx)
+    tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprint(i)))
+    tx.Set([]byte("same"), []byte(fmt.Sprint(i)))
+    tx.SetWithTTL([]byte(fmt.Sprintf("ttl%d", i)), []byte("x"), time.Hour * time.Duration(i + 1))
+    if i > 0 {
+      tx.Del([]byte(fmt.Sprintf("k%d", i - 1)))
+    }
+    if err := db.Commit(&tx); err != nil {
+      t.Fatal(err)
+    }
+  }
+}
+
+func walCheck(t *testing.T, path string, clock Clock, commits int) StartupReport {
+  t.Helper()
+  db := &KV{Path: path, Options: Options{WAL: true, Clock: clock}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  if err := db.Verify(); err != nil {
+    t.Fatal(err)
+  }
+  want := walWant(commits)
+  got := map[string]string{}
+  ttls := 0
+  for it := db.Seek(nil, CMP_GT); it.Valid(); it.Next() {
+    if it.Expires() != 0 {
+      ttls++
+      continue
+    }
+    got[string(it.Key())] = string(it.Val())
+  }
+  if fmt.Sprint(got) != fmt.Sprint(want) || ttls != commits {
+    t.Fatalf("%d commits: %v and %d TTLs, want %v", commits, got, ttls, want)
+  }
+  return db.Startup()
+}
+
+func TestWALRecovery(t *testing.T) {
+  dir := t.TempDir()
+  clock := NewManualClock(time.Unix(1000, 0))
+  db := &KV{Path: filepath.Join(dir, "db"), Options: Options{WAL: true, Clock: clock, CheckpointPages: 1 << 20}}
+  if err := db.Open(); err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+  walCommits(t, db, 10)
+  crash := filepath.Join(dir, "crash")
+  walCrashCopy(t, db, crash)
+  offs := walRecords(t, crash)
+  if len(offs) != 10 {
+    t.Fatalf("%d records", len(offs))
+  }
+  wal, _ := os.ReadFile(crash + "-wal")
+
+  t.Run("replay", func(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "db")
+    walCrashCopy(t, &KV{Path: crash}, path)
+    if r := walCheck(t, path, clock, 10); r.Replayed != 10 || r.TornBytes != 0 || r.Status != STARTUP_RECOVERED {
+      t.Fatal(r)
+    }
+  })
+  t.Run("torn", func(t *testing.T) {
+    // the last record is cut at each byte, including its header
+    for _, cut := range []int{1, WAL_HEADER - 1, WAL_HEADER, len(wal) - offs[9] - 1} {
+      path := filepath.Join(t.TempDir(), "db")
+      walCrashCopy(t, &KV{Path: crash}, path)
+      os.Truncate(path + "-wal", int64(len(wal) - cut))
+      r := walCheck(t, path, clock, 9)
+      if r.Replayed != 9 || r.TornBytes != len(wal) - offs[9] - cut {
+        t.Fatalf("cut %d: %v", cut, r)
+      }
+    }
+  })
+  t.Run("crc", func(t *testing.T) {
+    // the records from the bad one are dropped
+    for _, rec := range []int{9, 5} {
+      path := filepath.Join(t.TempDir(), "db")
+      walCrashCopy(t, &KV{Path: crash}, path)
+      bad := append([]byte(nil), wal...)
+      bad[offs[rec] + WAL_HEADER + 3] ^= 1
+      os.WriteFile(path + "-wal", bad, 0644)
+      r := walCheck(t, path, clock, rec)
+      if r.Replayed != rec || r.TornBytes != len(wal) - offs[rec] {
+        t.Fatalf("record %d: %v", rec, r)
+      }
+    }
+  })
+  t.Run("checkpointed", func(t *testing.T) {
+    // the tree written by the checkpoint, but the log not cleared
+    path := filepath.Join(t.TempDir(), "db")
+    walCrashCopy(t, &KV{Path: crash}, path)
+    walCheck(t, path, clock, 10)
+    if fi, err := os.Stat(path + "-wal"); err != nil || fi.Size() != 0 {
+      t.Fatal("the log is not cleared", err)
+    }
+    os.WriteFile(path + "-wal", wal, 0644)
+    // replayed again on top of its own updates
+    if r := walCheck(t, path, clock, 10); r.Replayed != 10 {
+      t.Fatal(r)
+    }
+    if r := walCheck(t, path, clock, 10); r.Replayed != 0 || r.Status != STARTUP_CLEAN {
+      t.Fatal(r)
+    }
+  })
+}
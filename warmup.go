@@ -0,0 +1,35 @@
+package main
+
+import (
+  "syscall"
+)
+
+// prefetch the top levels of the tree so that the first lookups after
+// opening don't stall on disk reads one page at a time. the tree is walked
+// level by level, each level is requested from the OS with madvise before
+// it's read. at most `budget` pages are visited.
+func warmup(db *KV, budget int) {
+  if db.tree.root == 0 {
+    return
+  }
+  level := []uint64{db.tree.root}
+  for len(level) > 0 && budget > 0 {
+    if len(level) > budget {
+      level = level[:budget]
+    }
+    budget -= len(level)
+    for _, ptr := range level {
+      _ = syscall.Madvise(db.pageGet(ptr), syscall.MADV_WILLNEED) // only a hint
+    }
+    next := []uint64{}
+    for _, ptr := range level {
+      node := BNode(db.pageGet(ptr))
+      if node.btype() == BNODE_NODE {
+        for i := uint16(0); i < node.nkeys(); i++ {
+          next = append(next, node.getPtr(i))
+        }
+      }
+    }
+    level = next
+  }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+  "fmt"
+  "path/filepath"
+  "testing"
+)
+
+// the pages read on open, level by level from the root
+func TestWarmup(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "db")
+  db := checksumOpen(t, path, Options{})
+  tx := KVTX{}
+  db.Begin(&tx)
+  for k := 0; k < 20000; k++ {
+    tx.Set([]byte(fmt.Sprintf("k%05d", k)), make([]byte, 100))
+  }
+  if err := db.Commit(&tx); err != nil {
+    t.Fatal(err)
+  }
+  db.SampleOccupancy()
+  levels := db.Occupancy()[0].Levels
+  db.Close()
+  if len(levels) != 3 {
+    t.Fatalf("%+v", levels)
+  }
+  total := levels[0].Nodes + levels[1].Nodes + 1
+  opened := func(budget int) uint64 {
+    t.Helper()
+    db := &KV{Path: path, Warmup: budget}
+    if err := db.Open(); err != nil {
+      t.Fatal(err)
+    }
+    defer db.Close()
+    st, err := db.Stats()
+    if err != nil {
+      t.Fatal(err)
+    }
+    return st.PageReads
+  }
+  base := opened(0)
+  cases := []struct {
+    budget  int
+    visited uint64
+  }{
+    {1, 1},
+    {1 + int(levels[1].Nodes), 1 + levels[1].Nodes}, // the internal nodes
+    {3 + int(levels[1].Nodes), 3 + levels[1].Nodes},
+    {1 << 20, total},
+  }
+  for _, c := range cases {
+    // each page is read for the hint, then for its kids
+    if reads := opened(c.budget) - base; reads != 2 * c.visited {
+      t.Fatalf("budget %d: %d reads, want %d", c.budget, reads, 2 * c.visited)
+    }
+  }
+}